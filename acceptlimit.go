@@ -0,0 +1,48 @@
+package simpleRPC
+
+import (
+	"sync"
+	"time"
+)
+
+// 限制Accept的速率，令牌桶的容量为1，也就是连接均匀地每隔interval接受一个
+// 没有使用golang.org/x/time/rate，避免引入依赖
+type acceptLimiter struct {
+	mu sync.Mutex
+	interval time.Duration
+	next time.Time // 下一个令牌可用的时间
+}
+
+// 等待一个令牌
+func (l *acceptLimiter) wait() {
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	d := l.next.Sub(now)
+	l.next = l.next.Add(l.interval)
+	l.mu.Unlock()
+	if d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// 限制每秒接受的连接数，rps <= 0 为不限制
+// 可以平滑连接风暴，例如短暂故障恢复之后所有客户端同时重连，避免一下子创建大量协程
+// 超过速率的连接留在监听队列里，Accept之前等待
+func (server *Server) SetAcceptRateLimit(rps float64) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if rps <= 0 {
+		server.acceptLimit = nil
+		return
+	}
+	server.acceptLimit = &acceptLimiter{interval: time.Duration(float64(time.Second) / rps)}
+}
+
+func (server *Server) acceptLimiter() *acceptLimiter {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return server.acceptLimit
+}
@@ -0,0 +1,70 @@
+package simpleRPC
+
+import (
+	"log"
+	"time"
+)
+
+// 自动调整maxPending的参数，测试时可以修改
+var (
+	adaptiveSampleInterval = time.Second // 采样间隔
+	adaptiveLowSamples = 5 // 连续这么多次利用率偏低才缩小，避免抖动
+)
+
+const (
+	adaptiveInitialPending = 64 // 没有设置maxPending时的初始值
+	adaptiveMaxPending = 1 << 16 // maxPending的上限
+)
+
+// 根据未处理完的请求数自动调整maxPending（见SetMaxPending）
+// 每次采样利用率（pending / maxPending）接近1时翻倍，连续一段时间低于targetUtilization的一半时减半
+// 连接断开之后停止调整
+func (client *Client) EnableAdaptivePending(targetUtilization float64) {
+	client.mu.Lock()
+	if client.maxPending <= 0 {
+		client.maxPending = adaptiveInitialPending
+	}
+	client.mu.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(adaptiveSampleInterval)
+		defer ticker.Stop()
+		low := 0
+		for range ticker.C {
+			if !client.IsAvailable() {
+				return
+			}
+			low = client.adjustMaxPending(targetUtilization, low)
+		}
+	}()
+}
+
+// 根据当前的利用率调整一次maxPending，返回连续利用率偏低的次数
+func (client *Client) adjustMaxPending(targetUtilization float64, low int) int {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	old := client.maxPending
+	utilization := float64(len(client.pending)) / float64(old)
+	switch {
+	case utilization >= 0.9:
+		low = 0
+		if old < adaptiveMaxPending {
+			client.maxPending = old * 2
+			if client.maxPending > adaptiveMaxPending {
+				client.maxPending = adaptiveMaxPending
+			}
+		}
+	case utilization < targetUtilization * 0.5:
+		low ++
+		if low >= adaptiveLowSamples && old > 1 {
+			client.maxPending = old / 2
+			low = 0
+		}
+	default:
+		low = 0
+	}
+	if client.maxPending != old {
+		log.Printf("rpc client: adjust max pending %d -> %d, utilization %.2f", old, client.maxPending, utilization)
+	}
+	return low
+}
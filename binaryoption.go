@@ -0,0 +1,104 @@
+package simpleRPC
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"simpleRPC/codec"
+	"time"
+)
+
+// 二进制交换协议的固定头部，客户端设置Option.BinaryOptionExchange时使用，代替JSON格式的option
+// | magic [4]byte | version [1]byte | codecType [1]byte | flags [2]byte | connectTimeout [4]byte | handleTimeout [4]byte |
+// 超时时间的单位是毫秒，多字节的字段都是大端序
+// 只有上面这些字段会发送给服务端，Option的其他字段在服务端都是零值
+const binaryOptionSize = 16
+
+// 二进制头部的魔数，JSON格式的option总是以'{'开头，所以服务端读前4个字节就能区分
+var binaryOptionMagic = [4]byte{'S', 'R', 'P', 'B'}
+
+const binaryOptionVersion = 1
+
+// 二进制头部里的编解码器编号，0表示不支持的编解码器
+var binaryCodecTypes = []codec.Type{"", codec.GobType, codec.JsonType, codec.SelfDescribingType}
+
+// flags的每一位对应Option的一个bool字段，其他位没有使用，发送时为0
+const (
+	binaryFlagCoalesceIdenticalCalls uint16 = 1 << 2
+	binaryFlagEnableNagle uint16 = 1 << 4
+)
+
+var errBinaryOption = errors.New("rpc: invalid binary option header")
+
+func binaryCodecCode(t codec.Type) byte {
+	for i, ct := range binaryCodecTypes {
+		if i > 0 && ct == t {
+			return byte(i)
+		}
+	}
+	return 0
+}
+
+// 把opt编码成二进制头部
+func encodeBinaryOption(opt *Option) ([]byte, error) {
+	code := binaryCodecCode(opt.CodecType)
+	if code == 0 {
+		return nil, fmt.Errorf("rpc: codec type %s not supported by binary option exchange", opt.CodecType)
+	}
+	var flags uint16
+	if opt.EnableNagle {
+		flags |= binaryFlagEnableNagle
+	}
+	if opt.CoalesceIdenticalCalls {
+		flags |= binaryFlagCoalesceIdenticalCalls
+	}
+
+	b := make([]byte, binaryOptionSize)
+	copy(b, binaryOptionMagic[:])
+	b[4] = binaryOptionVersion
+	b[5] = code
+	binary.BigEndian.PutUint16(b[6:], flags)
+	binary.BigEndian.PutUint32(b[8:], uint32(opt.ConnectTimeout / time.Millisecond))
+	binary.BigEndian.PutUint32(b[12:], uint32(opt.HandleTimeout / time.Millisecond))
+	return b, nil
+}
+
+// 解码二进制头部，b的长度必须是binaryOptionSize
+func decodeBinaryOption(b []byte, opt *Option) error {
+	if len(b) != binaryOptionSize || !bytes.Equal(b[:4], binaryOptionMagic[:]) || b[4] != binaryOptionVersion {
+		return errBinaryOption
+	}
+	if int(b[5]) >= len(binaryCodecTypes) {
+		return fmt.Errorf("rpc: unknown binary codec type %d", b[5])
+	}
+	flags := binary.BigEndian.Uint16(b[6:])
+	opt.MagicNumber = MagicNumber
+	opt.CodecType = binaryCodecTypes[b[5]]
+	opt.EnableNagle = flags & binaryFlagEnableNagle != 0
+	opt.CoalesceIdenticalCalls = flags & binaryFlagCoalesceIdenticalCalls != 0
+	opt.ConnectTimeout = time.Duration(binary.BigEndian.Uint32(b[8:])) * time.Millisecond
+	opt.HandleTimeout = time.Duration(binary.BigEndian.Uint32(b[12:])) * time.Millisecond
+	opt.BinaryOptionExchange = true
+	return nil
+}
+
+// 发送二进制头部
+func writeBinaryOption(conn io.Writer, opt *Option) error {
+	b, err := encodeBinaryOption(opt)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(b)
+	return err
+}
+
+// 读取并解码二进制头部
+func readBinaryOption(conn io.Reader, opt *Option) error {
+	b := make([]byte, binaryOptionSize)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return err
+	}
+	return decodeBinaryOption(b, opt)
+}
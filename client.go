@@ -10,9 +10,13 @@ import (
 	"net"
 	"net/http"
 	"simpleRPC/codec"
+	"simpleRPC/transport"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"errors"
+	"expvar"
 	"time"
 )
 
@@ -23,6 +27,21 @@ type Call struct {
 	Reply interface{} // 远程调用完成后返回的数据
 	Error error // 如果错误发生，返回错误类型
 	Done chan *Call // 调用完成时注册一个通知事件
+	RemainingBudget time.Duration // 服务端处理超时还剩下的时间，服务端没有设置HandleTimeout时为0
+	ctx context.Context // 调用的上下文，用于传递链路追踪信息
+	enqueuedAt time.Time // 注册到pending的时间
+	fireAndForget bool // 只发送请求，不等待响应
+	onChunk func(chunk []byte) // 流式调用收到数据块时调用
+	headerHook func(h *codec.Header) // 发送之前修改请求头，代理转发时使用
+	cc codec.Codec // 发送请求的连接，Rebind之后旧连接上的调用仍在旧连接上接收响应
+	keepAlive chan struct{} // 收到服务端的保活帧时通知，为nil时不通知
+}
+
+// 未处理完的请求的概要信息
+type CallSummary struct {
+	Seq uint64
+	ServiceMethod string
+	EnqueuedAt time.Time
 }
 
 func (call *Call) done() {
@@ -39,6 +58,25 @@ type Client struct {
 	pending map[uint64]*Call // 存储未处理完的请求，键是编号，值是 Call 实例
 	closing bool // closing 和 shutdown 任意一个值置为 true，则表示 Client 处于不可用的状态，但有些许的差别，closing 是用户主动关闭的，即调用 Close 方法，而 shutdown 置为 true 一般是有错误发生
 	shutdown bool
+	maxPending int // 最多允许多少个未处理完的请求，超过了直接拒绝，0为不限
+	totalCalls uint64 // 发起的调用数
+	totalErrors uint64 // 失败的调用数
+	connectedAt time.Time
+	lastPong int64 // 最后一次收到心跳回复的时间（UnixNano）
+	pong chan struct{} // 收到心跳回复时关闭并置为nil，Ping等待它
+	sendQueue chan *Call // 等待发送的调用，为nil时直接在调用方的协程里发送
+	sendStop chan struct{} // 连接断开时关闭，通知发送队列的协程退出
+	serverLoad atomic.Value // 服务端最近一次报告的负载，serverLoadSample
+}
+
+// 客户端统计信息快照
+type ClientStats struct {
+	TotalCalls uint64
+	PendingCalls int
+	TotalErrors uint64
+	TotalBytesSent int64
+	TotalBytesReceived int64
+	ConnectedAt time.Time
 }
 
 // 关闭连接
@@ -65,6 +103,47 @@ var _ io.Closer = (*Client)(nil)
 
 var ErrShutdown = errors.New("connection is shut down")
 
+var ErrOverloaded = errors.New("rpc client: too many pending calls")
+
+var ErrSendQueueFull = errors.New("rpc client: send queue is full")
+
+var ErrReadTimeout = errors.New("rpc client: read timeout, server may be stalled")
+
+// 所有客户端未处理完的请求数
+var pendingCalls = expvar.NewInt("simplerpc_client_pending_calls")
+
+// 设置最多允许多少个未处理完的请求，用于客户端限流（服务端很慢的时候，请求在客户端就直接拒绝掉，不会堆积）
+func (client *Client) SetMaxPending(n int) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	client.maxPending = n
+}
+
+// 设置交换完协议后的回调，参数是实际使用的编解码器（服务端可能使用了备用的编解码器）
+// 客户端创建的时候已经交换完协议了，所以设置之后会马上调用一次
+func (client *Client) OnCodecNegotiated(fn func(codec string)) {
+	fn(string(client.opt.CodecType))
+}
+
+// 返回客户端当前的统计信息
+func (client *Client) Stats() ClientStats {
+	return ClientStats{
+		TotalCalls: atomic.LoadUint64(&client.totalCalls),
+		PendingCalls: client.PendingCount(),
+		TotalErrors: atomic.LoadUint64(&client.totalErrors),
+		TotalBytesSent: bytesWritten(client.currentCodec()),
+		TotalBytesReceived: bytesRead(client.currentCodec()),
+		ConnectedAt: client.connectedAt,
+	}
+}
+
+// 返回未处理完的请求数
+func (client *Client) PendingCount() int {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return len(client.pending)
+}
+
 // 注册call元素
 func (client *Client) registerCall(call *Call) (uint64, error) {
 	client.mu.Lock()
@@ -73,44 +152,164 @@ func (client *Client) registerCall(call *Call) (uint64, error) {
 	if client.closing || client.shutdown {
 		return 0, ErrShutdown
 	}
+	if client.maxPending > 0 && len(client.pending) >= client.maxPending {
+		return 0, ErrOverloaded
+	}
 	call.Seq = client.seq
+	call.cc = client.cc
+	call.enqueuedAt = time.Now()
+	if len(client.pending) == 0 {
+		client.updateReadDeadline(1)
+	}
 	client.pending[call.Seq] = call
+	atomic.AddUint64(&client.totalCalls, 1)
+	pendingCalls.Add(1)
 	client.seq ++
 	return call.Seq, nil
 }
 
+// 返回所有未处理完的请求，按Seq排序，用于排查客户端卡住的问题
+func (client *Client) PendingCalls() []CallSummary {
+	client.mu.Lock()
+	calls := make([]CallSummary, 0, len(client.pending))
+	for _, call := range client.pending {
+		calls = append(calls, CallSummary{Seq: call.Seq, ServiceMethod: call.ServiceMethod, EnqueuedAt: call.enqueuedAt})
+	}
+	client.mu.Unlock()
+
+	sort.Slice(calls, func(i, j int) bool {
+		return calls[i].Seq < calls[j].Seq
+	})
+	return calls
+}
+
+// 查找call元素，不删除
+func (client *Client) getCall(seq uint64) *Call {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return client.pending[seq]
+}
+
 // 删除call元素
 func (client *Client) removeCall(seq uint64) *Call {
 	client.mu.Lock()
 	defer client.mu.Unlock()
-	call := client.pending[seq]
-	delete(client.pending, seq)
+	call, ok := client.pending[seq]
+	if ok {
+		delete(client.pending, seq)
+		pendingCalls.Add(-1)
+		client.updateReadDeadline(len(client.pending))
+	}
 
 	return call
 }
 
+// 有未完成的调用时，opt.ReadTimeout之内必须收到服务端的数据，没有的话清除读超时，空闲的连接不会超时
+// 调用时需要持有client.mu
+func (client *Client) updateReadDeadline(pending int) {
+	if client.opt.ReadTimeout <= 0 {
+		return
+	}
+	if pending == 0 {
+		setReadDeadline(client.cc, time.Time{})
+		return
+	}
+	setReadDeadline(client.cc, time.Now().Add(client.opt.ReadTimeout))
+}
+
 // 服务端或客户端发生错误时调用，将 shutdown 设置为 true，且将错误信息通知所有 pending 状态的 call
-func (client *Client) terminateCalls(err error) {
+// cc是Rebind之前的旧连接时，只结束在旧连接上发送的调用，客户端仍然可用
+func (client *Client) terminateCalls(cc codec.Codec, err error) {
 	client.sending.Lock()
 	defer client.sending.Unlock()
 	client.mu.Lock()
 	defer client.mu.Unlock()
+	if cc != client.cc {
+		client.failCallsOnLocked(cc, err)
+		return
+	}
 	client.shutdown = true
+	if client.sendStop != nil {
+		close(client.sendStop)
+	}
 	for _, call := range client.pending {
 		call.Error = err
 		call.done()
 	}
+	atomic.AddUint64(&client.totalErrors, uint64(len(client.pending)))
+	pendingCalls.Add(-int64(len(client.pending)))
+	client.pending = make(map[uint64]*Call)
 }
 
-// 接受请求响应
-func (client *Client) receive() {
+// 结束在cc上发送的调用，需要持有client.mu
+func (client *Client) failCallsOnLocked(cc codec.Codec, err error) {
+	for seq, call := range client.pending {
+		if call.cc != cc {
+			continue
+		}
+		delete(client.pending, seq)
+		call.Error = err
+		call.done()
+		atomic.AddUint64(&client.totalErrors, 1)
+		pendingCalls.Add(-1)
+	}
+}
+
+// 接受cc上的请求响应，cc出错之后退出
+func (client *Client) receive(cc codec.Codec) {
 	var err error
 	for err == nil {
 		var h codec.Header
-		if err = client.cc.ReadHeader(&h); err != nil {
+		if err = cc.ReadHeader(&h); err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				// 服务端长时间没有发送数据，关闭连接
+				log.Println(ErrReadTimeout)
+				err = ErrReadTimeout
+				_ = cc.Close()
+			}
 			break
 		}
+		// 收到了服务端的数据（包括心跳和保活帧），重新计算读超时
+		client.mu.Lock()
+		client.updateReadDeadline(len(client.pending))
+		client.mu.Unlock()
+		client.recordServerLoad(&h)
+		if h.Stream == codec.StreamData && headerError(&h) == nil {
+			// 流式调用的数据块，调用还没有结束
+			var chunk []byte
+			if err = cc.ReadBody(&chunk); err == nil {
+				if call := client.getCall(h.Seq); call != nil && call.onChunk != nil {
+					call.onChunk(chunk)
+				}
+			}
+			continue
+		}
+		if h.ServiceMethod == pingMethod {
+			atomic.StoreInt64(&client.lastPong, time.Now().UnixNano())
+			client.mu.Lock()
+			if client.pong != nil {
+				close(client.pong)
+				client.pong = nil
+			}
+			client.mu.Unlock()
+			err = cc.ReadBody(nil)
+			continue
+		}
+		if h.ServiceMethod == keepAliveMethod {
+			// 服务方法还在执行，不结束调用，通知CallWithIdleTimeout重新计时
+			err = cc.ReadBody(nil)
+			if call := client.getCall(h.Seq); call != nil && call.keepAlive != nil {
+				select {
+				case call.keepAlive <- struct{}{}:
+				default:
+				}
+			}
+			continue
+		}
 		call := client.removeCall(h.Seq)
+		if call != nil {
+			call.RemainingBudget = time.Duration(h.RemainingBudgetMs) * time.Millisecond
+		}
 
 		// switch 中的表达式是可选的，可以省略。
 		// 如果省略表达式，则相当于 switch true，
@@ -119,48 +318,124 @@ func (client *Client) receive() {
 		switch {
 		case call == nil:
 			// call不存在，可能是请求没有发送完整，或者因为其他原因被取消，但是服务端仍旧处理了
-			err = client.cc.ReadBody(nil)
-		case h.Error != "":
-			// call 存在，但服务端处理出错，即 h.Error 不为空
-			call.Error = fmt.Errorf(h.Error)
-			err = client.cc.ReadBody(nil)
+			err = cc.ReadBody(nil)
+		case headerError(&h) != nil:
+			// call 存在，但服务端处理出错，即 h.ErrorCode 或 h.ErrorMessage 不为空
+			call.Error = client.replyError(&h)
+			atomic.AddUint64(&client.totalErrors, 1)
+			err = cc.ReadBody(nil)
+			call.done()
+		case h.Compression != "":
+			// 压缩的响应，解压之后再解码
+			var data []byte
+			err = cc.ReadBody(&data)
+			if err == nil {
+				err = decompressBody(&h, data, call.Reply, client.opt)
+				// 解压失败不影响后面的响应
+				if err != nil {
+					call.Error = decodeReplyError(call, err)
+					atomic.AddUint64(&client.totalErrors, 1)
+					err = nil
+				}
+			} else {
+				call.Error = decodeReplyError(call, err)
+				atomic.AddUint64(&client.totalErrors, 1)
+			}
 			call.done()
 		default:
-			err = client.cc.ReadBody(call.Reply)
+			err = cc.ReadBody(call.Reply)
 			if err != nil {
-				call.Error = errors.New("reading body " + err.Error())
+				call.Error = decodeReplyError(call, err)
+				atomic.AddUint64(&client.totalErrors, 1)
 			}
 			call.done()
 		}
 	}
 
 	// 如果错误发生，就挂起调用
-	client.terminateCalls(err)
+	client.terminateCalls(cc, err)
+}
+
+// 解码响应失败的错误，带上服务方法和reply的类型，方便排查客户端和服务端类型不一致的问题
+func decodeReplyError(call *Call, err error) error {
+	return fmt.Errorf("rpc client: failed to decode reply for %s (type %T): %w", call.ServiceMethod, call.Reply, err)
+}
+
+// 服务端返回的错误，设置了ErrorSerializer并且响应里有序列化的错误时，使用它还原错误
+// 还原出来的错误放在RPCError.Err里，这样调用方仍然能区分服务端返回的错误和网络错误
+func (client *Client) replyError(h *codec.Header) error {
+	err := headerError(h)
+	if err == nil || len(h.ErrorData) == 0 || client.opt.ErrorSerializer == nil {
+		return err
+	}
+	if e := client.opt.ErrorSerializer.Unmarshal(h.ErrorData); e != nil {
+		err.(*RPCError).Err = e
+	}
+	return err
 }
 
 func NewClient(conn net.Conn, opt *Option) (*Client, error) {
-	f := codec.NewCodecFuncMap[opt.CodecType]
-	if f == nil {
+	cc, opt, err := handshake(conn, opt)
+	if err != nil {
+		return nil, err
+	}
+	return newClientCodec(cc, opt), nil
+}
+
+// 只交换协议，不启动接收响应的协程，Rebind建立新连接时使用
+func newBareClient(conn net.Conn, opt *Option) (*Client, error) {
+	cc, opt, err := handshake(conn, opt)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{cc: cc, opt: opt}, nil
+}
+
+// 和服务端交换协议，返回连接的编解码器和服务端确认的option
+func handshake(conn net.Conn, opt *Option) (codec.Codec, *Option, error) {
+	// 请求的编解码器本地没有的话，只能使用服务端返回的备用编解码器
+	if _, ok := codec.Lookup(opt.FallbackCodecType); codecFunc(opt) == nil && !ok {
 		err := fmt.Errorf("invalid codec type %s", opt.CodecType)
 		log.Println("rpc client: codec error:", err)
-		return nil, err
+		return nil, nil, err
 	}
 
 	// 发送options给服务端，约定好编码方式（交换协议）
-	if err := json.NewEncoder(conn).Encode(opt); err != nil {
+	writeOpt, readOpt := writeOption, func(r io.Reader, opt *Option) error {
+		return json.NewDecoder(r).Decode(opt)
+	}
+	if opt.BinaryOptionExchange {
+		writeOpt, readOpt = writeBinaryOption, readBinaryOption
+	}
+	if err := writeOpt(conn, opt); err != nil {
 		log.Println("rpc client: options error:", err)
 		_ = conn.Close()
-		return nil, err
+		return nil, nil, err
 	}
 
 	// 接受服务端交换完协议消息，接下来才进行信息的传递，不然有可能会发生粘包
-	if err := json.NewDecoder(conn).Decode(opt); err != nil {
+	// 服务端不支持请求的编解码器时，返回的CodecType是备用的编解码器，所以解码到一个副本里，不修改调用方的opt
+	echo := *opt
+	if err := readOpt(conn, &echo); err != nil {
 		log.Println("rpc client: options error:", err)
 		_ = conn.Close()
-		return nil, err
+		return nil, nil, err
+	}
+	opt = &echo
+	if opt.Error != "" {
+		_ = conn.Close()
+		return nil, nil, errors.New(opt.Error)
 	}
 
-	return newClientCodec(f(conn), opt), nil
+	f := codecFunc(opt)
+	if f == nil {
+		err := fmt.Errorf("invalid codec type %s", opt.CodecType)
+		log.Println("rpc client: codec error:", err)
+		_ = conn.Close()
+		return nil, nil, err
+	}
+
+	return newCountingCodec(f, conn, opt.ReadBufferSize), opt, nil
 }
 
 func newClientCodec(cc codec.Codec, opt *Option) *Client {
@@ -169,9 +444,18 @@ func newClientCodec(cc codec.Codec, opt *Option) *Client {
 		cc: cc,
 		opt: opt,
 		pending: make(map[uint64]*Call),
+		connectedAt: time.Now(),
 	}
 
-	go client.receive()
+	if opt.SendQueueDepth > 0 {
+		client.sendQueue = make(chan *Call, opt.SendQueueDepth)
+		client.sendStop = make(chan struct{})
+		go client.sendLoop(client.sendQueue, client.sendStop)
+	}
+	go client.receive(cc)
+	if opt.PingInterval > 0 {
+		go client.keepAlive(opt.PingInterval)
+	}
 	return client
 }
 
@@ -207,18 +491,60 @@ func dialTimeout(f newClientFunc, network, address string, opts ...*Option) (cli
 		return nil, err
 	}
 
-	conn, err := net.DialTimeout(network, address, opt.ConnectTimeout)
+	conn, err := dialWithRetry(address, opt, func() (net.Conn, error) {
+		return net.DialTimeout(network, address, opt.ConnectTimeout)
+	})
+	if err != nil {
+		// 建立连接超时，或者重试之后仍然失败
+		return nil, err
+	}
+
+	return newClientTimeout(f, conn, opt)
+}
+
+// 通过Transport建立连接，如果Transport实现了TimeoutDialer，连接超时时间为opt.ConnectTimeout
+func dialTransport(f newClientFunc, t transport.Transport, address string, opts ...*Option) (client *Client, err error) {
+	opt, err := parseOptions(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := dialWithRetry(address, opt, func() (net.Conn, error) {
+		if d, ok := t.(transport.TimeoutDialer); ok {
+			return d.DialTimeout(address, opt.ConnectTimeout)
+		}
+		return t.Dial(address)
+	})
 	if err != nil {
-		// 建立连接超时
 		return nil, err
 	}
 
+	return newClientTimeout(f, conn, opt)
+}
+
+// 建立连接，失败的话按opt.ConnectRetryMax和opt.ConnectRetryBaseDelay指数退避重试
+func dialWithRetry(address string, opt *Option, dial func() (net.Conn, error)) (net.Conn, error) {
+	conn, err := dial()
+	delay := opt.ConnectRetryBaseDelay
+	for i := 1; err != nil && i <= opt.ConnectRetryMax; i ++ {
+		log.Printf("rpc client: dial %s failed, retry %d/%d after %s: %v", address, i, opt.ConnectRetryMax, delay, err)
+		time.Sleep(delay)
+		delay *= 2
+		conn, err = dial()
+	}
+	return conn, err
+}
+
+// 在已经建立的连接上交换协议，超时时间为opt.ConnectTimeout
+func newClientTimeout(f newClientFunc, conn net.Conn, opt *Option) (client *Client, err error) {
 	defer func() {
 		if err != nil {
 			_ = conn.Close()
 		}
 	}()
 
+	setNoDelay(conn, !opt.EnableNagle)
+
 	ch := make(chan clientResult)
 	go func(){
 		client, err := f(conn, opt)
@@ -267,6 +593,49 @@ func Dial(network, address string, opts ...*Option) (client *Client, err error)
 
 // 发送请求
 func (client *Client) send(call *Call) {
+	if client.sendQueue == nil {
+		client.write(call)
+		return
+	}
+
+	// 持有client.mu，保证terminateCalls之后不会再有调用放进队列
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if client.closing || client.shutdown {
+		call.Error = ErrShutdown
+		call.done()
+		return
+	}
+	select {
+	case client.sendQueue <- call:
+	default:
+		call.Error = ErrSendQueueFull
+		call.done()
+	}
+}
+
+// 发送队列的协程，依次发送队列里的调用，连接断开之后队列里剩下的调用直接失败
+func (client *Client) sendLoop(queue chan *Call, stop chan struct{}) {
+	for {
+		select {
+		case call := <-queue:
+			client.write(call)
+		case <-stop:
+			for {
+				select {
+				case call := <-queue:
+					call.Error = ErrShutdown
+					call.done()
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// 注册调用并且发送请求
+func (client *Client) write(call *Call) {
 	// 确保客户端能发送一个完整的请求
 	client.sending.Lock()
 	defer client.sending.Unlock()
@@ -282,7 +651,29 @@ func (client *Client) send(call *Call) {
 	// 准备请求头
 	client.header.ServiceMethod = call.ServiceMethod
 	client.header.Seq = seq
-	client.header.Error = ""
+	client.header.ErrorCode = 0
+	client.header.ErrorMessage = ""
+	client.header.TraceParent = ""
+	client.header.TraceState = ""
+	client.header.Timeout = 0
+	client.header.Metadata = nil
+	client.header.FireAndForget = call.fireAndForget
+	client.header.Priority = PriorityFromContext(call.ctx)
+	injectCorrelationID(call.ctx, &client.header)
+	if call.ctx != nil {
+		InjectTraceContext(call.ctx, &client.header)
+		if deadline, ok := call.ctx.Deadline(); ok {
+			// 发送剩下的时间而不是截止时间，两边的时钟不一致也不影响
+			client.header.Timeout = int64(time.Until(deadline))
+			if client.header.Timeout <= 0 {
+				// 已经过了截止时间，服务端马上返回超时
+				client.header.Timeout = 1
+			}
+		}
+	}
+	if call.headerHook != nil {
+		call.headerHook(&client.header)
+	}
 
 	// 编码和发送请求
 	if err := client.cc.Write(&client.header, call.Args); err != nil {
@@ -292,9 +683,31 @@ func (client *Client) send(call *Call) {
 			call.Error = err
 			call.done()
 		}
+		return
+	}
+
+	// 不会有响应，发送成功就完成了
+	if call.fireAndForget {
+		if call := client.removeCall(seq); call != nil {
+			call.done()
+		}
 	}
 }
 
+// 只发送请求，不等待响应，服务方法执行的结果（包括错误）都不会返回
+// 适合日志、指标上报、缓存失效通知等不关心结果的调用，返回的错误只表示请求有没有发送成功
+func (client *Client) SendOnly(serviceMethod string, args interface{}) error {
+	call := &Call{
+		ServiceMethod: serviceMethod,
+		Args: args,
+		Done: make(chan *Call, 1),
+		fireAndForget: true,
+	}
+	client.send(call)
+	<-call.Done
+	return call.Error
+}
+
 // 异步调用
 func (client *Client) Go(serviceMethod string, args, reply interface{}, done chan *Call) *Call {
 	if done == nil {
@@ -328,11 +741,18 @@ func (client *Client) CallWithTimeout(ctx context.Context, serviceMethod string,
 	err := client.Call(ctx, "Foo.Sum", &Args{1, 2}, &reply)
 	*/
 
-	call := client.Go(serviceMethod, args, reply, make(chan *Call, 1))
+	call := &Call{
+		ServiceMethod: serviceMethod,
+		Args: args,
+		Reply: reply,
+		Done: make(chan *Call, 1),
+		ctx: ctx,
+	}
+	client.send(call)
 	select {
 	case <-ctx.Done():
 		client.removeCall(call.Seq)
-		return errors.New("rpc client: call failed: " + ctx.Err().Error())
+		return fmt.Errorf("rpc client: call failed: %w", ctx.Err())
 	case call := <-call.Done:
 		return call.Error
 	}
@@ -343,19 +763,26 @@ func (client *Client) CallWithTimeout(ctx context.Context, serviceMethod string,
 
 // http请求
 func NewHTTPClient(conn net.Conn, opt *Option) (*Client, error) {
-	_, _ = io.WriteString(conn, fmt.Sprintf("CONNECT %s HTTP/1.0\n\n", defaultRPCPath))
+	return newHTTPClient(NewClient)(conn, opt)
+}
 
-	// 在交换RPC协议之前,http请求一定要成功响应
-	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
-	if err == nil && resp.Status == connected {
-		return NewClient(conn, opt)
-	}
+// 先发送CONNECT请求，成功之后再用f交换RPC协议
+func newHTTPClient(f newClientFunc) newClientFunc {
+	return func(conn net.Conn, opt *Option) (*Client, error) {
+		_, _ = io.WriteString(conn, fmt.Sprintf("CONNECT %s HTTP/1.0\n\n", defaultRPCPath))
 
-	if err == nil {
-		err = errors.New("unexpected HTTP response:" + resp.Status)
-	}
+		// 在交换RPC协议之前,http请求一定要成功响应
+		resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
+		if err == nil && resp.Status == connected {
+			return f(conn, opt)
+		}
+
+		if err == nil {
+			err = errors.New("unexpected HTTP response:" + resp.Status)
+		}
 
-	return nil, err
+		return nil, err
+	}
 }
 
 // DialHTTP 连接到指定网络地址的 HTTP RPC 服务器，侦听默认 HTTP RPC 路径
@@ -364,16 +791,23 @@ func DialHTTP(network, address string, opts ...*Option) (*Client, error) {
 }
 
 func XDial(rpcAddr string, opts ...*Option) (*Client, error) {
+	return xdial(NewClient, rpcAddr, opts...)
+}
+
+func xdial(f newClientFunc, rpcAddr string, opts ...*Option) (*Client, error) {
 	parts := strings.Split(rpcAddr, "@")
 	if len(parts) != 2 {
 		return nil, fmt.Errorf("rpc client err: wrong format '%s', expect protocol@addr", rpcAddr)
 	}
 	protocol, addr := parts[0], parts[1]
-	switch protocol {
-	case "http":
-		return DialHTTP("tcp", addr, opts...)
-	default:
-		// return Dial(protocol, addr, opts...)
-		return DialWithTimeout(protocol, addr, opts...)
+	// http是基于tcp的，需要先发送CONNECT请求
+	if protocol == "http" {
+		return dialTimeout(newHTTPClient(f), "tcp", addr, opts...)
+	}
+
+	t, ok := transport.Lookup(protocol)
+	if !ok {
+		return nil, fmt.Errorf("rpc client err: unsupported protocol '%s'", protocol)
 	}
+	return dialTransport(f, t, addr, opts...)
 }
\ No newline at end of file
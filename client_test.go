@@ -1,11 +1,25 @@
 package simpleRPC
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"net"
 	"os"
 	"runtime"
+	"simpleRPC/codec"
+	"simpleRPC/errs"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -71,9 +85,56 @@ func TestClient_Call(t *testing.T) {
 		err := client.CallWithTimeout(context.Background(), "Bar.Timeout", 1, &reply)
 		// fmt.Println(22222222, err)
 		_assert(err != nil && strings.Contains(err.Error(), "handle timeout"), "expect a timeout error")
+		e, ok := err.(*RPCError)
+		_assert(ok && e.Code == errs.Timeout, "expect a timeout error code")
 	})
 }
 
+func TestClient_SetMaxPending(t *testing.T) {
+	t.Parallel()
+	addrCh := make(chan string)
+	go startServer(addrCh)
+	addr := <-addrCh
+
+	client, _ := DialWithTimeout("tcp", addr)
+	defer func() { _ = client.Close() }()
+	client.SetMaxPending(2)
+
+	var calls []*Call
+	for i := 0; i < 5; i ++ {
+		var reply int
+		calls = append(calls, client.Go("Bar.Timeout", 1, &reply, nil))
+	}
+
+	overloaded := 0
+	for _, call := range calls {
+		if call.Error == ErrOverloaded {
+			overloaded++
+		}
+	}
+	_assert(overloaded == 3, "expect 3 overloaded calls, but got %d", overloaded)
+	_assert(client.PendingCount() == 2, "expect 2 pending calls, but got %d", client.PendingCount())
+}
+
+func TestClient_PendingCalls(t *testing.T) {
+	t.Parallel()
+	addrCh := make(chan string)
+	go startServer(addrCh)
+	addr := <-addrCh
+
+	client, _ := DialWithTimeout("tcp", addr)
+	defer func() { _ = client.Close() }()
+
+	var reply int
+	call := client.Go("Bar.Timeout", 1, &reply, nil)
+	time.Sleep(time.Millisecond * 100)
+
+	calls := client.PendingCalls()
+	_assert(len(calls) == 1, "expect 1 pending call, but got %d", len(calls))
+	_assert(calls[0].Seq == call.Seq && calls[0].ServiceMethod == "Bar.Timeout", "wrong pending call %+v", calls[0])
+	_assert(time.Since(calls[0].EnqueuedAt) >= time.Millisecond * 100, "wrong enqueued time")
+}
+
 func TestXDial(t *testing.T) {
 	if runtime.GOOS == "linux" {
 		ch := make(chan struct{})
@@ -93,3 +154,1457 @@ func TestXDial(t *testing.T) {
 	}
 
 }
+
+func TestServer_AcceptMulti(t *testing.T) {
+	server := NewServer()
+	var foo Foo
+	_ = server.Register(&foo)
+
+	l1, _ := net.Listen("tcp", "127.0.0.1:0")
+	l2, _ := net.Listen("tcp", "127.0.0.1:0")
+	done := make(chan error)
+	go func() {
+		done <- server.AcceptMulti(l1, l2)
+	}()
+
+	for _, l := range []net.Listener{l1, l2} {
+		client, err := DialWithTimeout("tcp", l.Addr().String())
+		_assert(err == nil, "failed to dial %s", l.Addr())
+		var reply int
+		err = client.Call("Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+		_assert(err == nil && reply == 3, "failed to call Foo.Sum on %s", l.Addr())
+		_ = client.Close()
+	}
+
+	_ = server.Shutdown()
+	select {
+	case err := <-done:
+		_assert(err == nil, "expect AcceptMulti returns nil after shutdown")
+	case <-time.After(time.Second):
+		t.Fatal("expect AcceptMulti returns after shutdown")
+	}
+}
+
+type Slow struct {
+	calls int32
+}
+
+func (s *Slow) Get(key string, reply *string) error {
+	atomic.AddInt32(&s.calls, 1)
+	time.Sleep(time.Millisecond * 200)
+	*reply = "value of " + key
+	return nil
+}
+
+func TestServer_CoalesceIdenticalCalls(t *testing.T) {
+	server := NewServer()
+	slow := &Slow{}
+	_ = server.Register(slow)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	go server.Accept(l)
+	defer func() { _ = server.Shutdown() }()
+
+	client, _ := DialWithTimeout("tcp", l.Addr().String(), &Option{CoalesceIdenticalCalls: true})
+	defer func() { _ = client.Close() }()
+
+	// 参数不同的请求不合并，每个调用方拿到自己参数的结果
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i ++ {
+		key := "foo"
+		if i % 2 == 1 {
+			key = "bar"
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var reply string
+			err := client.Call("Slow.Get", key, &reply)
+			_assert(err == nil && reply == "value of " + key, "failed to call Slow.Get %s, got %s", key, reply)
+		}()
+	}
+	wg.Wait()
+	_assert(atomic.LoadInt32(&slow.calls) == 2, "expect handler runs once per key, but got %d", slow.calls)
+}
+
+func TestDeadlineBudget(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	deadline, _ := ctx.Deadline()
+	inner, ok := DeadlineBudget(ctx, 0.5).Deadline()
+	_assert(ok, "expect inner context has a deadline")
+	remaining := time.Until(inner)
+	_assert(inner.Before(deadline) && remaining > time.Millisecond * 400 && remaining <= time.Millisecond * 500, "expect about half of the remaining time, but got %s", remaining)
+
+	_, ok = DeadlineBudget(context.Background(), 0.5).Deadline()
+	_assert(!ok, "expect no deadline without a parent deadline")
+}
+
+// 返回收到请求时ctx剩下的时间（毫秒），没有截止时间时返回-1
+type Budget int
+
+func (b *Budget) Remaining(ctx context.Context, _ int, reply *int64) error {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		*reply = -1
+		return nil
+	}
+	*reply = int64(time.Until(deadline) / time.Millisecond)
+	return nil
+}
+
+// 链式调用的中间服务，把剩下的时间的一半留给下游服务
+type Relay struct {
+	client *Client
+}
+
+func (r *Relay) Forward(ctx context.Context, n int, reply *int64) error {
+	return r.client.CallWithTimeout(DeadlineBudget(ctx, 0.5), "Budget.Remaining", n, reply)
+}
+
+func TestDeadlineBudget_ChainedServers(t *testing.T) {
+	backend := NewServer()
+	_ = backend.Register(new(Budget))
+	bl, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = bl.Close() }()
+	go backend.Accept(bl)
+	backendClient, err := Dial("tcp", bl.Addr().String())
+	if err != nil {
+		t.Fatal("failed to dial backend:", err)
+	}
+	defer func() { _ = backendClient.Close() }()
+
+	relay := NewServer()
+	_ = relay.Register(&Relay{client: backendClient})
+	rl, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = rl.Close() }()
+	go relay.Accept(rl)
+	client, err := Dial("tcp", rl.Addr().String())
+	if err != nil {
+		t.Fatal("failed to dial relay:", err)
+	}
+	defer func() { _ = client.Close() }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	var remaining int64
+	err = client.CallWithTimeout(ctx, "Relay.Forward", 1, &remaining)
+	_assert(err == nil && remaining > 300 && remaining <= 500, "expect about half of the caller's deadline at the backend, but got %dms %v", remaining, err)
+
+	// 调用方没有截止时间的话下游也没有
+	err = client.CallWithTimeout(context.Background(), "Relay.Forward", 1, &remaining)
+	_assert(err == nil && remaining == -1, "expect no deadline at the backend, but got %dms %v", remaining, err)
+}
+
+func TestServer_UseConnTracker(t *testing.T) {
+	server := NewServer()
+	ct := NewConnTracker()
+	server.UseConnTracker(ct)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	go server.Accept(l)
+	defer func() { _ = server.Shutdown() }()
+
+	client, _ := DialWithTimeout("tcp", l.Addr().String())
+	_assert(ct.ActiveCount() == 1, "expect 1 active conn, but got %d", ct.ActiveCount())
+	_assert(len(ct.ActiveConns()) == 1, "expect 1 active conn addr")
+
+	_ = client.Close()
+	time.Sleep(time.Millisecond * 100)
+	_assert(ct.ActiveCount() == 0, "expect 0 active conn after client closed, but got %d", ct.ActiveCount())
+}
+
+func TestServer_MessageSizeStats(t *testing.T) {
+	server := NewServer()
+	var foo Foo
+	_ = server.Register(&foo)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	go server.Accept(l)
+	defer func() { _ = server.Shutdown() }()
+
+	client, _ := DialWithTimeout("tcp", l.Addr().String())
+	defer func() { _ = client.Close() }()
+	for i := 0; i < 2; i ++ {
+		var reply int
+		_ = client.Call("Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	}
+	// 响应发送完之后才会记录响应大小
+	time.Sleep(time.Millisecond * 50)
+
+	m := server.Stats().Methods[0]
+	_assert(m.NumCalls == 2 && m.AvgRequestBytes() > 0 && m.AvgResponseBytes() > 0, "expect message sizes recorded, got %+v", m)
+	_assert(m.MaxRequestBytes <= m.RequestBytes && m.MaxResponseBytes <= m.ResponseBytes, "wrong max message sizes %+v", m)
+}
+
+type Echo int
+
+func (e *Echo) Bytes(args []byte, reply *[]byte) error {
+	*reply = args
+	return nil
+}
+
+// 比较不同的读写缓冲区大小，每次请求和响应都是16KB
+func BenchmarkBufferSize(b *testing.B) {
+	server := NewServer()
+	var echo Echo
+	_ = server.Register(&echo)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	go server.Accept(l)
+	defer func() { _ = server.Shutdown() }()
+
+	payload := make([]byte, 16 << 10)
+	for _, size := range []int{4 << 10, 64 << 10, 1 << 20} {
+		b.Run(fmt.Sprintf("%dKB", size >> 10), func(b *testing.B) {
+			server.SetBufferSize(size, size)
+			client, err := DialWithTimeout("tcp", l.Addr().String(), &Option{
+				WriteBufferSize: size,
+				ReadBufferSize: size,
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer func() { _ = client.Close() }()
+
+			b.SetBytes(int64(len(payload)))
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					var reply []byte
+					if err := client.Call("Echo.Bytes", payload, &reply); err != nil {
+						// Fatal只能在运行Benchmark的协程里调用
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestClient_FallbackCodecType(t *testing.T) {
+	server := NewServer()
+	var foo Foo
+	_ = server.Register(&foo)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	go server.Accept(l)
+	defer func() { _ = server.Shutdown() }()
+
+	_, err := DialWithTimeout("tcp", l.Addr().String(), &Option{CodecType: "application/unknown"})
+	_assert(err != nil, "expect an error without fallback codec")
+
+	client, err := DialWithTimeout("tcp", l.Addr().String(), &Option{
+		CodecType: "application/unknown",
+		FallbackCodecType: codec.GobType,
+	})
+	_assert(err == nil, "failed to dial with fallback codec: %v", err)
+	defer func() { _ = client.Close() }()
+	_assert(client.opt.CodecType == codec.GobType, "expect client switched to %s, but got %s", codec.GobType, client.opt.CodecType)
+
+	var reply int
+	err = client.Call("Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	_assert(err == nil && reply == 3, "failed to call Foo.Sum with fallback codec")
+}
+
+func TestClient_Stats(t *testing.T) {
+	server := NewServer()
+	var foo Foo
+	_ = server.Register(&foo)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	go server.Accept(l)
+	defer func() { _ = server.Shutdown() }()
+
+	client, _ := DialWithTimeout("tcp", l.Addr().String())
+	defer func() { _ = client.Close() }()
+	var reply int
+	_ = client.Call("Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	_ = client.Call("Foo.Unknown", Args{Num1: 1, Num2: 2}, &reply)
+
+	stats := client.Stats()
+	_assert(stats.TotalCalls == 2 && stats.TotalErrors == 1 && stats.PendingCalls == 0, "wrong call stats %+v", stats)
+	_assert(stats.TotalBytesSent > 0 && stats.TotalBytesReceived > 0 && !stats.ConnectedAt.IsZero(), "wrong conn stats %+v", stats)
+}
+
+type Clock int
+
+type ClockArgs struct {
+	Start time.Time `json:"start"`
+	Seconds int `json:"seconds"`
+}
+
+func (c Clock) Add(args ClockArgs, reply *time.Time) error {
+	*reply = args.Start.Add(time.Duration(args.Seconds) * time.Second)
+	return nil
+}
+
+// time.Time使用Unix时间戳序列化
+func unixTimeConfig() *codec.JsonConfig {
+	config := codec.NewJsonConfig()
+	config.RegisterMarshaler(time.Time{}, func(v interface{}) ([]byte, error) {
+		return json.Marshal(v.(time.Time).Unix())
+	}, func(data []byte, ptr interface{}) error {
+		var sec int64
+		if err := json.Unmarshal(data, &sec); err != nil {
+			return err
+		}
+		*ptr.(*time.Time) = time.Unix(sec, 0)
+		return nil
+	})
+	return config
+}
+
+func TestClient_JsonConfig(t *testing.T) {
+	config := unixTimeConfig()
+	start := time.Unix(1600000000, 0)
+	data, _ := config.Marshal(ClockArgs{Start: start, Seconds: 10})
+	_assert(string(data) == `{"seconds":10,"start":1600000000}`, "unexpected json %s", data)
+
+	server := NewServer()
+	var c Clock
+	_ = server.Register(&c)
+	server.UseJsonConfig(config)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	go server.Accept(l)
+	defer func() { _ = server.Shutdown() }()
+
+	client, err := DialWithTimeout("tcp", l.Addr().String(), &Option{CodecType: codec.JsonType, JsonConfig: config})
+	_assert(err == nil, "failed to dial with json codec: %v", err)
+	defer func() { _ = client.Close() }()
+
+	var reply time.Time
+	err = client.Call("Clock.Add", ClockArgs{Start: start, Seconds: 10}, &reply)
+	_assert(err == nil && reply.Unix() == start.Unix() + 10, "failed to call Clock.Add: %v %v", err, reply)
+}
+
+func TestServer_LimitService(t *testing.T) {
+	server := NewServer()
+	_ = server.Register(&Slow{})
+	server.LimitService("Slow", 1)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	go server.Accept(l)
+	defer func() { _ = server.Shutdown() }()
+
+	client, _ := DialWithTimeout("tcp", l.Addr().String())
+	defer func() { _ = client.Close() }()
+
+	start := time.Now()
+	calls := make([]*Call, 3)
+	for i := range calls {
+		var reply string
+		calls[i] = client.Go("Slow.Get", fmt.Sprintf("key%d", i), &reply, nil)
+	}
+	time.Sleep(time.Millisecond * 50)
+	stats := server.Stats()
+	_assert(len(stats.Limits) == 1 && stats.Limits[0].MaxConcurrent == 1 && stats.Limits[0].InUse == 1, "wrong limit stats %+v", stats.Limits)
+
+	for _, call := range calls {
+		<-call.Done
+		_assert(call.Error == nil, "failed to call Slow.Get: %v", call.Error)
+	}
+	_assert(time.Since(start) >= time.Millisecond * 600, "expect calls to Slow run one by one")
+}
+
+func TestServer_StrictServiceCheck(t *testing.T) {
+	server := NewServer()
+	var foo Foo
+	_ = server.Register(&foo)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	go server.Accept(l)
+	defer func() { _ = server.Shutdown() }()
+	server.SetStrictServiceCheck(true)
+
+	// 客户端的option不能关掉检查
+	client, _ := DialWithTimeout("tcp", l.Addr().String(), &Option{})
+	defer func() { _ = client.Close() }()
+
+	var reply int
+	err := client.Call("Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	_assert(err == nil && reply == 3, "failed to call Foo.Sum: %v", err)
+
+	err = client.Call("Foo.Unknown", Args{Num1: 1, Num2: 2}, &reply)
+	_, isRPCError := err.(*RPCError)
+	_assert(err != nil && !isRPCError, "expect connection closed rather than an error reply, but got %v", err)
+	_assert(!client.IsAvailable(), "expect client unavailable after connection closed")
+}
+
+func TestOnCodecNegotiated(t *testing.T) {
+	server := NewServer()
+	var foo Foo
+	_ = server.Register(&foo)
+	negotiated := make(chan string, 1)
+	server.OnCodecNegotiated(func(remoteAddr, codec string) {
+		negotiated <- remoteAddr + " " + codec
+	})
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	go server.Accept(l)
+	defer func() { _ = server.Shutdown() }()
+
+	client, err := DialWithTimeout("tcp", l.Addr().String(), &Option{
+		CodecType: "application/unknown",
+		FallbackCodecType: codec.JsonType,
+	})
+	_assert(err == nil, "failed to dial: %v", err)
+	defer func() { _ = client.Close() }()
+
+	var clientCodec string
+	client.OnCodecNegotiated(func(codec string) { clientCodec = codec })
+	_assert(clientCodec == string(codec.JsonType), "expect client codec %s, but got %s", codec.JsonType, clientCodec)
+
+	select {
+	case s := <-negotiated:
+		_assert(strings.HasPrefix(s, "127.0.0.1:") && strings.HasSuffix(s, " " + string(codec.JsonType)), "unexpected server hook args %q", s)
+	case <-time.After(time.Second):
+		t.Fatal("server hook not called")
+	}
+}
+
+func TestServer_ServeConnRaw(t *testing.T) {
+	server := NewServer()
+	var foo Foo
+	_ = server.Register(&foo)
+
+	serverConn, clientConn := net.Pipe()
+	go server.ServeConnRaw(serverConn, codec.GobType)
+	client := newClientCodec(codec.NewGobCodec(clientConn), &Option{CodecType: codec.GobType})
+	defer func() { _ = client.Close() }()
+
+	var reply int
+	err := client.Call("Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	_assert(err == nil && reply == 3, "failed to call Foo.Sum without option exchange: %v", err)
+}
+
+func TestServer_DisableMagicNumberCheck(t *testing.T) {
+	server := NewServer()
+	var foo Foo
+	_ = server.Register(&foo)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	go server.Accept(l)
+	defer func() { _ = server.Shutdown() }()
+
+	// Dial会把MagicNumber设置成默认值，所以直接用NewClient
+	conn, _ := net.Dial("tcp", l.Addr().String())
+	_, err := NewClient(conn, &Option{MagicNumber: 1, CodecType: codec.GobType})
+	_assert(err != nil, "expect an error with wrong magic number")
+
+	server.SetDisableMagicNumberCheck(true)
+	conn, _ = net.Dial("tcp", l.Addr().String())
+	client, err := NewClient(conn, &Option{MagicNumber: 1, CodecType: codec.GobType})
+	_assert(err == nil, "failed to dial with magic number check disabled: %v", err)
+	defer func() { _ = client.Close() }()
+	var reply int
+	err = client.Call("Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	_assert(err == nil && reply == 3, "failed to call Foo.Sum: %v", err)
+}
+
+func TestServer_SlowCallDetector(t *testing.T) {
+	server := NewServer()
+	_ = server.Register(&Slow{})
+	var foo Foo
+	_ = server.Register(&foo)
+	slow := make(chan SlowCallInfo, 10)
+	server.StartSlowCallDetector(time.Millisecond * 100, func(req SlowCallInfo) {
+		slow <- req
+	})
+	defer server.StopSlowCallDetector()
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	go server.Accept(l)
+	defer func() { _ = server.Shutdown() }()
+
+	client, _ := DialWithTimeout("tcp", l.Addr().String())
+	defer func() { _ = client.Close() }()
+	var sum int
+	_ = client.Call("Foo.Sum", Args{Num1: 1, Num2: 2}, &sum)
+	var reply string
+	_ = client.Call("Slow.Get", "key", &reply)
+
+	_assert(len(slow) == 1, "expect 1 slow call, but got %d", len(slow))
+	info := <-slow
+	_assert(info.ServiceMethod == "Slow.Get" && info.Elapsed >= time.Millisecond * 100 && strings.HasPrefix(info.RemoteAddr, "127.0.0.1:"), "unexpected slow call %+v", info)
+}
+
+func TestServer_RegisterUpgradeHandler(t *testing.T) {
+	const upgradeMagic = 0x1234
+	server := NewServer()
+	var foo Foo
+	_ = server.Register(&foo)
+	// 升级之后的协议：原样返回一行数据
+	server.RegisterUpgradeHandler(upgradeMagic, func(conn net.Conn) {
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		_, _ = conn.Write([]byte(line))
+	})
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	go server.Accept(l)
+	defer func() { _ = server.Shutdown() }()
+
+	conn, _ := net.Dial("tcp", l.Addr().String())
+	defer func() { _ = conn.Close() }()
+	_, _ = conn.Write([]byte(`{"MagicNumber":4660}` + "hello\n"))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	_assert(err == nil && line == "hello\n", "unexpected upgraded reply %q %v", line, err)
+
+	// 同一个端口仍然可以正常调用
+	client, _ := DialWithTimeout("tcp", l.Addr().String())
+	defer func() { _ = client.Close() }()
+	var reply int
+	err = client.Call("Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	_assert(err == nil && reply == 3, "failed to call Foo.Sum: %v", err)
+}
+
+func TestServer_CompressThreshold(t *testing.T) {
+	server := NewServer()
+	var echo Echo
+	_ = server.Register(&echo)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	go server.Accept(l)
+	defer func() { _ = server.Shutdown() }()
+
+	server.SetCompressThreshold(1024)
+
+	// 压缩之前使用连接的编解码器编码，Gob和Json都可以
+	for _, codecType := range []codec.Type{codec.GobType, codec.JsonType} {
+		client, _ := DialWithTimeout("tcp", l.Addr().String(), &Option{CodecType: codecType})
+		for _, size := range []int{16, 64 << 10} {
+			payload := []byte(strings.Repeat("a", size))
+			var reply []byte
+			before := client.Stats().TotalBytesReceived
+			err := client.Call("Echo.Bytes", payload, &reply)
+			_assert(err == nil && string(reply) == string(payload), "failed to call Echo.Bytes with %d bytes over %s: %v", size, codecType, err)
+			received := client.Stats().TotalBytesReceived - before
+			if size > 1024 {
+				_assert(received < int64(size) / 10, "expect compressed response over %s, but received %d bytes", codecType, received)
+			}
+		}
+		_ = client.Close()
+	}
+}
+
+func TestServer_CompressThresholdTimeLocation(t *testing.T) {
+	server := NewServer()
+	var c Clock
+	_ = server.Register(&c)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	go server.Accept(l)
+	defer func() { _ = server.Shutdown() }()
+	server.SetCompressThreshold(1)
+
+	// 压缩过的响应解压之后和没有压缩的一样转换时区
+	loc := time.FixedZone("UTC+9", 9 * 3600)
+	client, err := Dial("tcp", l.Addr().String(), &Option{CodecType: codec.GobType, TimeLocation: loc})
+	if err != nil {
+		t.Fatal("failed to dial:", err)
+	}
+	defer func() { _ = client.Close() }()
+	start := time.Date(2024, 1, 2, 3, 4, 5, 0, time.FixedZone("UTC-7", -7 * 3600))
+	var reply time.Time
+	err = client.Call("Clock.Add", ClockArgs{Start: start, Seconds: 10}, &reply)
+	_assert(err == nil && reply.Equal(start.Add(10 * time.Second)) && reply.Location() == loc, "expect compressed reply in %s, but got %v, %v", loc, reply, err)
+}
+
+func Test_decompressBodyLimit(t *testing.T) {
+	var zbuf bytes.Buffer
+	zw := gzip.NewWriter(&zbuf)
+	_, _ = zw.Write(make([]byte, maxDecompressedSize + 1))
+	_ = zw.Close()
+
+	// 很小的压缩数据解压出超过限制的数据时返回错误
+	h := &codec.Header{Compression: gzipCompression}
+	var reply []byte
+	err := decompressBody(h, zbuf.Bytes(), &reply, &Option{CodecType: codec.GobType})
+	_assert(err != nil && strings.Contains(err.Error(), "larger than"), "expect the decompressed size limit, but got %v", err)
+}
+
+func BenchmarkResponseCompression(b *testing.B) {
+	server := NewServer()
+	var echo Echo
+	_ = server.Register(&echo)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	go server.Accept(l)
+	defer func() { _ = server.Shutdown() }()
+
+	for _, size := range []int{256, 4 << 10, 64 << 10, 1 << 20} {
+		// 半随机的数据，比全是相同字符更接近真实的响应
+		payload := make([]byte, size)
+		for i := range payload {
+			payload[i] = "abcdefgh"[(i * 7 + i / 13) % 8]
+		}
+		for _, threshold := range []int{0, 128} {
+			name := fmt.Sprintf("%dB/plain", size)
+			if threshold > 0 {
+				name = fmt.Sprintf("%dB/gzip", size)
+			}
+			b.Run(name, func(b *testing.B) {
+				server.SetCompressThreshold(threshold)
+				client, err := DialWithTimeout("tcp", l.Addr().String())
+				if err != nil {
+					b.Fatal(err)
+				}
+				defer func() { _ = client.Close() }()
+
+				b.SetBytes(int64(size))
+				b.ResetTimer()
+				for i := 0; i < b.N; i ++ {
+					var reply []byte
+					if err := client.Call("Echo.Bytes", payload, &reply); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestServer_ServeConnContext(t *testing.T) {
+	server := NewServer()
+	var foo Foo
+	_ = server.Register(&foo)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = l.Close() }()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond * 200)
+		defer cancel()
+		server.ServeConnContext(ctx, conn)
+	}()
+
+	client, _ := DialWithTimeout("tcp", l.Addr().String())
+	defer func() { _ = client.Close() }()
+	var reply int
+	err := client.Call("Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	_assert(err == nil && reply == 3, "failed to call Foo.Sum: %v", err)
+
+	// ctx超时之后连接被关闭
+	time.Sleep(time.Millisecond * 300)
+	_assert(!client.IsAvailable(), "expect connection closed after ctx done")
+}
+
+// Wait一直等到ctx取消，把ctx的错误发送到done
+type Waiter struct {
+	done chan error
+}
+
+func (w *Waiter) Wait(ctx context.Context, _ int, reply *int) error {
+	<-ctx.Done()
+	w.done <- ctx.Err()
+	return ctx.Err()
+}
+
+func TestServer_ServeConnContextCancelsHandler(t *testing.T) {
+	server := NewServer()
+	w := &Waiter{done: make(chan error, 1)}
+	_ = server.Register(w)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = l.Close() }()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		server.ServeConnContext(ctx, conn)
+	}()
+
+	client, _ := DialWithTimeout("tcp", l.Addr().String())
+	defer func() { _ = client.Close() }()
+	call := client.Go("Waiter.Wait", 1, new(int), make(chan *Call, 1))
+
+	// 取消连接的ctx之后，正在执行的服务方法能从自己的ctx里看到
+	time.Sleep(time.Millisecond * 100)
+	cancel()
+	select {
+	case err := <-w.done:
+		_assert(err == context.Canceled, "expect the handler ctx canceled, but got %v", err)
+	case <-time.After(time.Second):
+		t.Fatal("expect the handler to see the connection ctx canceled")
+	}
+	<-call.Done
+}
+
+type Recorder struct {
+	ch chan int
+}
+
+func (r *Recorder) Record(n int, reply *int) error {
+	r.ch <- n
+	if n < 0 {
+		return fmt.Errorf("negative number %d", n)
+	}
+	*reply = n
+	return nil
+}
+
+func TestClient_SendOnly(t *testing.T) {
+	server := NewServer()
+	r := &Recorder{ch: make(chan int, 10)}
+	_ = server.Register(r)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	go server.Accept(l)
+	defer func() { _ = server.Shutdown() }()
+
+	client, _ := DialWithTimeout("tcp", l.Addr().String())
+	defer func() { _ = client.Close() }()
+
+	// 成功和失败的调用都不会有响应
+	for _, n := range []int{1, -1} {
+		received := client.Stats().TotalBytesReceived
+		err := client.SendOnly("Recorder.Record", n)
+		_assert(err == nil, "failed to send %d: %v", n, err)
+		select {
+		case got := <-r.ch:
+			_assert(got == n, "expect handler called with %d, but got %d", n, got)
+		case <-time.After(time.Second):
+			t.Fatalf("handler not called with %d", n)
+		}
+		time.Sleep(time.Millisecond * 50)
+		_assert(client.Stats().TotalBytesReceived == received, "expect no response for fire and forget call %d", n)
+		_assert(client.PendingCount() == 0, "expect no pending calls")
+	}
+
+	var reply int
+	err := client.Call("Recorder.Record", 2, &reply)
+	_assert(err == nil && reply == 2 && <-r.ch == 2, "failed to call Recorder.Record after fire and forget calls: %v", err)
+}
+
+func TestDial_ConnectRetry(t *testing.T) {
+	// 先拿到一个空闲端口，过一会儿服务端才开始监听
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := l.Addr().String()
+	_ = l.Close()
+
+	server := NewServer()
+	go func() {
+		time.Sleep(time.Millisecond * 150)
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return
+		}
+		defer func() { _ = l.Close() }()
+		server.Accept(l)
+	}()
+
+	opt := &Option{MagicNumber: MagicNumber, CodecType: codec.GobType, ConnectRetryMax: 5, ConnectRetryBaseDelay: time.Millisecond * 20}
+	client, err := DialWithTimeout("tcp", addr, opt)
+	if err != nil {
+		t.Fatal("expect dial to succeed after retries, but got", err)
+	}
+	_ = client.Close()
+
+	// 不重试的话直接失败
+	l, _ = net.Listen("tcp", "127.0.0.1:0")
+	addr = l.Addr().String()
+	_ = l.Close()
+	_, err = DialWithTimeout("tcp", addr, &Option{MagicNumber: MagicNumber, CodecType: codec.GobType, ConnectRetryMax: 2, ConnectRetryBaseDelay: time.Millisecond})
+	_assert(err != nil, "expect dial error after retries exhausted")
+
+	// 通过Transport建立连接（protocol@addr）也会重试
+	go func() {
+		time.Sleep(time.Millisecond * 150)
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return
+		}
+		defer func() { _ = l.Close() }()
+		server.Accept(l)
+	}()
+	client, err = XDial("tcp@" + addr, opt)
+	if err != nil {
+		t.Fatal("expect XDial to succeed after retries, but got", err)
+	}
+	_ = client.Close()
+}
+
+func TestClient_ServerVersion(t *testing.T) {
+	server := NewServer()
+	_assert(server.RegisterMeta() == nil, "failed to register meta service")
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = l.Close() }()
+	go server.Accept(l)
+
+	client, err := Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal("failed to dial:", err)
+	}
+	defer func() { _ = client.Close() }()
+	v, err := client.ServerVersion(context.Background())
+	_assert(err == nil && v == Version(), "expect server version %s, but got %s, %v", Version(), v, err)
+
+	w := httptest.NewRecorder()
+	serveVersion(w, httptest.NewRequest("GET", defaultDebugPath + "/version", nil))
+	var info versionInfo
+	_assert(w.Code == http.StatusOK && json.Unmarshal(w.Body.Bytes(), &info) == nil, "failed to get version: %s", w.Body.String())
+	_assert(info.Version == Version(), "expect version %s, but got %s", Version(), info.Version)
+}
+
+func TestClient_PingInterval(t *testing.T) {
+	opt := &Option{MagicNumber: MagicNumber, CodecType: codec.GobType, PingInterval: time.Millisecond * 20}
+
+	// 正常的服务端会回复心跳，连接一直可用
+	server := NewServer()
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = l.Close() }()
+	go server.Accept(l)
+	client, err := Dial("tcp", l.Addr().String(), opt)
+	if err != nil {
+		t.Fatal("failed to dial:", err)
+	}
+	defer func() { _ = client.Close() }()
+	time.Sleep(time.Millisecond * 100)
+	_assert(client.IsAvailable(), "expect client available with pongs")
+	_assert(time.Since(time.Unix(0, atomic.LoadInt64(&client.lastPong))) < time.Millisecond * 50, "expect recent pong")
+
+	// 服务端交换完协议之后不再回复，调用会因为心跳超时失败
+	dead, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = dead.Close() }()
+	go func() {
+		conn, err := dead.Accept()
+		if err != nil {
+			return
+		}
+		var o Option
+		_ = json.NewDecoder(conn).Decode(&o)
+		_ = writeOption(conn, &o)
+		_, _ = io.Copy(ioutil.Discard, conn)
+	}()
+	client2, err := Dial("tcp", dead.Addr().String(), opt)
+	if err != nil {
+		t.Fatal("failed to dial:", err)
+	}
+	var reply int
+	call := client2.Go("Foo.Sum", &Args{Num1: 1, Num2: 2}, &reply, make(chan *Call, 1))
+	select {
+	case call := <-call.Done:
+		_assert(call.Error != nil, "expect call to fail after ping timeout")
+	case <-time.After(time.Second):
+		t.Fatal("expect call to fail after ping timeout")
+	}
+}
+
+type Sleeper int
+
+func (s Sleeper) Sleep(ms int, reply *int) error {
+	time.Sleep(time.Duration(ms) * time.Millisecond)
+	*reply = ms
+	return nil
+}
+
+func TestClient_RemainingBudget(t *testing.T) {
+	server := NewServer()
+	var s Sleeper
+	_ = server.Register(&s)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = l.Close() }()
+	go server.Accept(l)
+
+	client, err := Dial("tcp", l.Addr().String(), &Option{CodecType: codec.GobType, HandleTimeout: time.Second})
+	if err != nil {
+		t.Fatal("failed to dial:", err)
+	}
+	defer func() { _ = client.Close() }()
+	var reply int
+	call := <-client.Go("Sleeper.Sleep", 100, &reply, make(chan *Call, 1)).Done
+	_assert(call.Error == nil, "expect no error, but got %v", call.Error)
+	_assert(call.RemainingBudget > time.Millisecond * 800 && call.RemainingBudget <= time.Millisecond * 900,
+		"expect remaining budget about 900ms, but got %s", call.RemainingBudget)
+
+	// 服务端没有设置超时
+	client2, _ := Dial("tcp", l.Addr().String())
+	defer func() { _ = client2.Close() }()
+	call = <-client2.Go("Sleeper.Sleep", 1, &reply, make(chan *Call, 1)).Done
+	_assert(call.Error == nil && call.RemainingBudget == 0, "expect no remaining budget, but got %s", call.RemainingBudget)
+}
+
+func TestClient_Ping(t *testing.T) {
+	// 开启严格检查的服务端也直接回复心跳
+	server := NewServer()
+	server.SetStrictServiceCheck(true)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = l.Close() }()
+	go server.Accept(l)
+	client, err := Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal("failed to dial:", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	for i := 0; i < 3; i ++ {
+		_assert(client.Ping(ctx) == nil, "failed to ping")
+	}
+	_assert(client.IsAvailable(), "expect client available after pings")
+	_ = client.Close()
+	_assert(client.Ping(ctx) == ErrShutdown, "expect ping on a closed client to fail")
+}
+
+func TestClient_KeepAliveAckInterval(t *testing.T) {
+	server := NewServer()
+	var s Sleeper
+	_ = server.Register(&s)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = l.Close() }()
+	go server.Accept(l)
+
+	client, err := Dial("tcp", l.Addr().String(), &Option{CodecType: codec.GobType})
+	if err != nil {
+		t.Fatal("failed to dial:", err)
+	}
+	defer func() { _ = client.Close() }()
+
+	// 服务端没有发送保活帧，超过idle就失败
+	var reply int
+	err = client.CallWithIdleTimeout(context.Background(), "Sleeper.Sleep", 400, &reply, time.Millisecond * 250)
+	_assert(err == ErrIdleTimeout, "expect idle timeout without keepalive, but got %v", err)
+
+	// 执行期间会收到多个保活帧，每次重新计时，调用要等到服务方法返回才结束
+	server.SetKeepAliveInterval(time.Nanosecond)
+	_assert(server.keepAliveAckInterval() == minKeepAliveInterval, "expect the interval clamped to %s", minKeepAliveInterval)
+	start := time.Now()
+	err = client.CallWithIdleTimeout(context.Background(), "Sleeper.Sleep", 400, &reply, time.Millisecond * 250)
+	_assert(err == nil && reply == 400, "expect reply after keepalive frames, but got %d, %v", reply, err)
+	_assert(time.Since(start) >= time.Millisecond * 400, "expect call to wait for the handler")
+}
+
+func TestClient_DecodeErrors(t *testing.T) {
+	server := NewServer()
+	var foo Foo
+	_ = server.Register(&foo)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = l.Close() }()
+	go server.Accept(l)
+
+	// 参数类型和服务端不一致
+	client, _ := Dial("tcp", l.Addr().String())
+	defer func() { _ = client.Close() }()
+	var reply int
+	err := client.Call("Foo.Sum", "1+2", &reply)
+	_assert(err != nil && strings.Contains(err.Error(), "failed to decode arg for Foo.Sum (type simpleRPC.Args)"), "unexpected error: %v", err)
+
+	// reply类型和服务端不一致
+	client2, _ := Dial("tcp", l.Addr().String())
+	defer func() { _ = client2.Close() }()
+	var s string
+	err = client2.Call("Foo.Sum", Args{Num1: 1, Num2: 2}, &s)
+	_assert(err != nil && strings.Contains(err.Error(), "failed to decode reply for Foo.Sum (type *string)"), "unexpected error: %v", err)
+}
+
+func TestClient_SendQueueDepth(t *testing.T) {
+	server := NewServer()
+	var s Sleeper
+	_ = server.Register(&s)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = l.Close() }()
+	go server.Accept(l)
+
+	client, err := Dial("tcp", l.Addr().String(), &Option{CodecType: codec.GobType, SendQueueDepth: 1})
+	if err != nil {
+		t.Fatal("failed to dial:", err)
+	}
+	var reply int
+	_assert(client.Call("Sleeper.Sleep", 1, &reply) == nil && reply == 1, "expect call through send queue to succeed")
+
+	// 发送协程被占住的时候，队列里只能放一个调用
+	client.sending.Lock()
+	calls := make([]*Call, 3)
+	for i := range calls {
+		calls[i] = client.Go("Sleeper.Sleep", 1, new(int), make(chan *Call, 1))
+	}
+	client.sending.Unlock()
+	full := 0
+	for _, call := range calls {
+		if (<-call.Done).Error == ErrSendQueueFull {
+			full ++
+		}
+	}
+	_assert(full >= 1, "expect ErrSendQueueFull when queue is full")
+
+	// 连接关闭之后调用直接失败
+	_ = client.Close()
+	time.Sleep(time.Millisecond * 50)
+	err = client.Call("Sleeper.Sleep", 1, &reply)
+	_assert(err == ErrShutdown, "expect ErrShutdown after close, but got %v", err)
+}
+
+func TestClient_EnableAdaptivePending(t *testing.T) {
+	adaptiveSampleInterval, adaptiveLowSamples = time.Millisecond * 20, 2
+	defer func() { adaptiveSampleInterval, adaptiveLowSamples = time.Second, 5 }()
+
+	server := NewServer()
+	var s Sleeper
+	_ = server.Register(&s)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = l.Close() }()
+	go server.Accept(l)
+
+	client, _ := Dial("tcp", l.Addr().String())
+	defer func() { _ = client.Close() }()
+	client.SetMaxPending(2)
+	client.EnableAdaptivePending(0.8)
+
+	maxPending := func() int {
+		client.mu.Lock()
+		defer client.mu.Unlock()
+		return client.maxPending
+	}
+
+	// 一直发送慢请求，未处理完的请求数保持在上限，maxPending会增长
+	deadline := time.Now().Add(time.Millisecond * 300)
+	for time.Now().Before(deadline) {
+		client.Go("Sleeper.Sleep", 100, new(int), make(chan *Call, 1))
+		time.Sleep(time.Millisecond)
+	}
+	grown := maxPending()
+	_assert(grown > 2, "expect max pending to grow under load, but got %d", grown)
+
+	// 没有请求之后会缩小
+	time.Sleep(time.Millisecond * 300)
+	_assert(maxPending() < grown, "expect max pending to shrink when idle, but got %d", maxPending())
+}
+
+func TestClient_ReadTimeout(t *testing.T) {
+	server := NewServer()
+	var s Sleeper
+	_ = server.Register(&s)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = l.Close() }()
+	go server.Accept(l)
+
+	client, err := Dial("tcp", l.Addr().String(), &Option{CodecType: codec.GobType, ReadTimeout: time.Millisecond * 100})
+	if err != nil {
+		t.Fatal("failed to dial:", err)
+	}
+	defer func() { _ = client.Close() }()
+	var reply int
+	_assert(client.Call("Sleeper.Sleep", 1, &reply) == nil, "expect first call to succeed")
+
+	// 空闲的连接不会超时
+	time.Sleep(time.Millisecond * 200)
+	_assert(client.IsAvailable(), "expect idle client available")
+
+	// 服务方法卡住，一直没有响应
+	start := time.Now()
+	err = client.Call("Sleeper.Sleep", 2000, &reply)
+	_assert(err == ErrReadTimeout, "expect ErrReadTimeout, but got %v", err)
+	_assert(time.Since(start) < time.Second, "expect read timeout before the handler returns")
+	_assert(!client.IsAvailable(), "expect client closed after read timeout")
+}
+
+func TestServer_HeaderDeadline(t *testing.T) {
+	server := NewServer()
+	_ = server.Register(new(Sleeper))
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = l.Close() }()
+	go server.Accept(l)
+	client, _ := Dial("tcp", l.Addr().String())
+	defer func() { _ = client.Close() }()
+
+	// 服务端没有设置HandleTimeout，按请求头里的截止时间返回超时
+	start := time.Now()
+	call := &Call{ServiceMethod: "Sleeper.Sleep", Args: 1000, Reply: new(int), Done: make(chan *Call, 1), ctx: context.Background()}
+	call.headerHook = func(h *codec.Header) {
+		h.Timeout = int64(time.Millisecond * 100)
+	}
+	client.send(call)
+	<-call.Done
+	rpcErr, ok := call.Error.(*RPCError)
+	_assert(ok && rpcErr.Code == errs.Timeout, "expect timeout from the header deadline, but got %v", call.Error)
+	_assert(time.Since(start) < time.Millisecond * 500, "expect the server to stop waiting at the deadline, took %s", time.Since(start))
+}
+
+func TestServer_TimeoutSendsOneResponse(t *testing.T) {
+	server := NewServer()
+	_ = server.Register(new(Sleeper))
+	serverConn, clientConn := net.Pipe()
+	go server.ServeConnRaw(serverConn, codec.GobType)
+	cc := codec.NewGobCodec(clientConn)
+	defer func() { _ = cc.Close() }()
+
+	before := handlerGoroutines()
+	h := &codec.Header{ServiceMethod: "Sleeper.Sleep", Seq: 1, Timeout: int64(time.Millisecond * 50)}
+	if err := cc.Write(h, 200); err != nil {
+		t.Fatal("failed to write request:", err)
+	}
+	var resp codec.Header
+	err := cc.ReadHeader(&resp)
+	_assert(err == nil && resp.Seq == 1 && resp.ErrorCode == errs.Timeout, "expect a timeout response, but got %+v %v", resp, err)
+	_ = cc.ReadBody(nil)
+
+	// 服务方法执行完之后不会再发送一次同一个请求的响应
+	_ = clientConn.SetReadDeadline(time.Now().Add(time.Millisecond * 400))
+	resp = codec.Header{}
+	err = cc.ReadHeader(&resp)
+	_assert(err != nil, "expect no late response after the timeout, but got %+v", resp)
+
+	// 服务方法的协程执行完之后退出，不会阻塞在通知超时处理的channel上
+	leaked := true
+	for i := 0; i < 20 && leaked; i ++ {
+		leaked = handlerGoroutines() > before
+		if leaked {
+			time.Sleep(time.Millisecond * 50)
+		}
+	}
+	_assert(!leaked, "expect the handler goroutine to exit after the timeout")
+}
+
+// 正在执行服务方法的协程数
+func handlerGoroutines() int {
+	buf := make([]byte, 1 << 20)
+	return strings.Count(string(buf[:runtime.Stack(buf, true)]), "handleRequestWithTimeout.func")
+}
+
+func TestNewProxyServer(t *testing.T) {
+	backend := NewServer()
+	var foo Foo
+	_ = backend.Register(&foo)
+	bl, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = bl.Close() }()
+	go backend.Accept(bl)
+
+	var transformed int32
+	proxy := NewProxyServer("tcp@"+bl.Addr().String(), &Option{
+		ProxyHeaderTransform: func(h *codec.Header) {
+			atomic.AddInt32(&transformed, 1)
+		},
+	})
+	pl, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = pl.Close() }()
+	go proxy.Accept(pl)
+
+	client, err := Dial("tcp", pl.Addr().String(), &Option{CodecType: codec.JsonType})
+	if err != nil {
+		t.Fatal("failed to dial:", err)
+	}
+	defer func() { _ = client.Close() }()
+	var reply int
+	err = client.Call("Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	_assert(err == nil && reply == 3, "expect 3 through proxy, but got %d, err %v", reply, err)
+	_assert(atomic.LoadInt32(&transformed) == 1, "expect header transformed once")
+
+	// 后端返回的错误原样返回给客户端
+	err = client.Call("Foo.Unknown", Args{}, &reply)
+	rpcErr, ok := err.(*RPCError)
+	_assert(ok && rpcErr.Code == errs.MethodNotFound, "expect method not found from backend, but got %v", err)
+
+	// 客户端的截止时间传给后端，后端处理太慢的话代理返回超时
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond * 100)
+	defer cancel()
+	_ = backend.Register(new(Sleeper))
+	start := time.Now()
+	err = client.CallWithTimeout(ctx, "Sleeper.Sleep", 1000, &reply)
+	_assert(err != nil && time.Since(start) < time.Millisecond * 500, "expect the proxy to give up at the deadline, but got %v after %s", err, time.Since(start))
+
+	// 代理只支持Json编解码器，交换协议时拒绝
+	_, err = Dial("tcp", pl.Addr().String(), &Option{CodecType: codec.GobType})
+	_assert(err != nil && strings.Contains(err.Error(), "only forwards"), "expect gob rejected by the proxy, but got %v", err)
+}
+
+// 没有在代理上注册的参数类型
+type UnregisteredArgs struct {
+	Num1, Num2 int
+}
+
+func TestProxy_SelfDescribing(t *testing.T) {
+	backend := NewServer()
+	var foo Foo
+	_ = backend.Register(&foo)
+	bl, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = bl.Close() }()
+	go backend.Accept(bl)
+
+	proxy := NewProxyServer("tcp@"+bl.Addr().String(), nil)
+	proxy.RegisterTypes(Args{}, 0)
+	pl, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = pl.Close() }()
+	go proxy.Accept(pl)
+
+	client, err := Dial("tcp", pl.Addr().String(), &Option{CodecType: codec.SelfDescribingType})
+	if err != nil {
+		t.Fatal("failed to dial:", err)
+	}
+	defer func() { _ = client.Close() }()
+	var reply int
+	err = client.Call("Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	_assert(err == nil && reply == 3, "expect 3 through proxy, but got %d, err %v", reply, err)
+
+	// 没有注册的类型返回错误，连接继续可用
+	err = client.Call("Foo.Sum", UnregisteredArgs{Num1: 1, Num2: 2}, &reply)
+	_assert(err != nil && strings.Contains(err.Error(), "unregistered type"), "expect unregistered type error, but got %v", err)
+	err = client.Call("Foo.Sum", Args{Num1: 2, Num2: 3}, &reply)
+	_assert(err == nil && reply == 5, "expect 5 after an unregistered type, but got %d, err %v", reply, err)
+
+	// 类型注册表是每个Server自己的，另一个代理没有注册Args
+	other := NewProxyServer("tcp@"+bl.Addr().String(), nil)
+	ol, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = ol.Close() }()
+	go other.Accept(ol)
+	otherClient, err := Dial("tcp", ol.Addr().String(), &Option{CodecType: codec.SelfDescribingType})
+	if err != nil {
+		t.Fatal("failed to dial:", err)
+	}
+	defer func() { _ = otherClient.Close() }()
+	err = otherClient.Call("Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	_assert(err != nil && strings.Contains(err.Error(), "unregistered type"), "expect Args unregistered on the other proxy, but got %v", err)
+}
+
+func TestProxy_HandleTimeout(t *testing.T) {
+	backend := NewServer()
+	_ = backend.Register(new(Sleeper))
+	bl, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = bl.Close() }()
+	go backend.Accept(bl)
+	proxy := NewProxyServer("tcp@"+bl.Addr().String(), nil)
+	pl, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = pl.Close() }()
+	go proxy.Accept(pl)
+
+	// 没有截止时间的调用，代理按客户端的HandleTimeout放弃等待后端
+	client, err := Dial("tcp", pl.Addr().String(), &Option{CodecType: codec.JsonType, HandleTimeout: time.Millisecond * 100})
+	if err != nil {
+		t.Fatal("failed to dial:", err)
+	}
+	defer func() { _ = client.Close() }()
+	var reply int
+	err = client.Call("Sleeper.Sleep", 1000, &reply)
+	rpcErr, ok := err.(*RPCError)
+	_assert(ok && rpcErr.Code == errs.Timeout, "expect timeout from the proxy, but got %v", err)
+}
+
+func TestClient_BinaryOptionExchange(t *testing.T) {
+	server := NewServer()
+	var foo Foo
+	_ = server.Register(&foo)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = l.Close() }()
+	go server.Accept(l)
+
+	for _, codecType := range []codec.Type{codec.GobType, codec.JsonType} {
+		client, err := Dial("tcp", l.Addr().String(), &Option{CodecType: codecType, HandleTimeout: time.Second, BinaryOptionExchange: true})
+		if err != nil {
+			t.Fatal("failed to dial:", err)
+		}
+		var reply int
+		err = client.Call("Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+		_assert(err == nil && reply == 3, "expect 3 with binary option exchange and %s, but got %d, %v", codecType, reply, err)
+		_ = client.Close()
+	}
+
+	opt := Option{CodecType: codec.JsonType, EnableNagle: true, CoalesceIdenticalCalls: true, ConnectTimeout: time.Second, HandleTimeout: 1500 * time.Millisecond}
+	b, err := encodeBinaryOption(&opt)
+	_assert(err == nil && len(b) == binaryOptionSize, "expect %d bytes header, but got %d, %v", binaryOptionSize, len(b), err)
+	var decoded Option
+	err = decodeBinaryOption(b, &decoded)
+	_assert(err == nil && decoded.CodecType == opt.CodecType && decoded.EnableNagle && decoded.CoalesceIdenticalCalls &&
+		decoded.ConnectTimeout == opt.ConnectTimeout && decoded.HandleTimeout == opt.HandleTimeout, "expect option round trip, but got %+v, %v", decoded, err)
+}
+
+func BenchmarkOptionExchange(b *testing.B) {
+	server := NewServer()
+	for _, binaryExchange := range []bool{false, true} {
+		name := "json"
+		if binaryExchange {
+			name = "binary"
+		}
+		b.Run(name, func(b *testing.B) {
+			opt := &Option{MagicNumber: MagicNumber, CodecType: codec.GobType, BinaryOptionExchange: binaryExchange}
+			for i := 0; i < b.N; i ++ {
+				clientConn, serverConn := net.Pipe()
+				go server.ServeConn(serverConn)
+				client, err := NewClient(clientConn, opt)
+				if err != nil {
+					b.Fatal(err)
+				}
+				_ = client.Close()
+			}
+		})
+	}
+}
+
+func TestClient_TimeLocation(t *testing.T) {
+	server := NewServer()
+	var c Clock
+	_ = server.Register(&c)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = l.Close() }()
+	go server.Accept(l)
+
+	loc := time.FixedZone("UTC+9", 9 * 3600)
+	client, err := Dial("tcp", l.Addr().String(), &Option{CodecType: codec.GobType, TimeLocation: loc})
+	if err != nil {
+		t.Fatal("failed to dial:", err)
+	}
+	defer func() { _ = client.Close() }()
+	start := time.Date(2024, 1, 2, 3, 4, 5, 0, time.FixedZone("UTC-7", -7 * 3600))
+	var reply time.Time
+	err = client.Call("Clock.Add", ClockArgs{Start: start, Seconds: 10}, &reply)
+	_assert(err == nil && reply.Equal(start.Add(10 * time.Second)) && reply.Location() == loc, "expect reply in %s, but got %v, %v", loc, reply, err)
+}
+
+type FieldError struct {
+	Field string `json:"field"`
+	Reason string `json:"reason"`
+}
+
+func (e *FieldError) Error() string {
+	return e.Field + ": " + e.Reason
+}
+
+// 把FieldError序列化成json，其他错误不处理
+type fieldErrorSerializer struct{}
+
+func (fieldErrorSerializer) Marshal(err error) ([]byte, error) {
+	if fe, ok := err.(*FieldError); ok {
+		return json.Marshal(fe)
+	}
+	return nil, nil
+}
+
+func (fieldErrorSerializer) Unmarshal(data []byte) error {
+	var fe FieldError
+	if err := json.Unmarshal(data, &fe); err != nil {
+		return nil
+	}
+	return &fe
+}
+
+type Validator int
+
+func (v Validator) Check(name string, reply *bool) error {
+	if name == "" {
+		return &FieldError{Field: "name", Reason: "required"}
+	}
+	if name == "boom" {
+		return fmt.Errorf("internal failure")
+	}
+	*reply = true
+	return nil
+}
+
+func TestClient_ErrorSerializer(t *testing.T) {
+	server := NewServer()
+	server.SetErrorSerializer(fieldErrorSerializer{})
+	var v Validator
+	_ = server.Register(&v)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = l.Close() }()
+	go server.Accept(l)
+
+	client, err := Dial("tcp", l.Addr().String(), &Option{CodecType: codec.GobType, ErrorSerializer: fieldErrorSerializer{}})
+	if err != nil {
+		t.Fatal("failed to dial:", err)
+	}
+	defer func() { _ = client.Close() }()
+	var ok bool
+	err = client.Call("Validator.Check", "", &ok)
+	var fe *FieldError
+	_assert(errors.As(err, &fe) && fe.Field == "name" && fe.Reason == "required", "expect typed FieldError, but got %T %v", err, err)
+	rpcErr, isRPC := err.(*RPCError)
+	_assert(isRPC && rpcErr.Code == errs.InternalError, "expect the FieldError wrapped in RPCError, but got %T %v", err, err)
+
+	// 没有序列化的错误还是RPCError
+	err = client.Call("Validator.Check", "boom", &ok)
+	_, isRPC = err.(*RPCError)
+	_assert(isRPC && err.Error() == "internal failure", "expect RPCError, but got %T %v", err, err)
+
+	// 没有设置ErrorSerializer的服务端不受影响
+	plain := NewServer()
+	_ = plain.Register(&v)
+	l2, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = l2.Close() }()
+	go plain.Accept(l2)
+	client2, err := Dial("tcp", l2.Addr().String(), &Option{CodecType: codec.GobType, ErrorSerializer: fieldErrorSerializer{}})
+	if err != nil {
+		t.Fatal("failed to dial:", err)
+	}
+	defer func() { _ = client2.Close() }()
+	err = client2.Call("Validator.Check", "", &ok)
+	_, isRPC = err.(*RPCError)
+	_assert(isRPC && err.Error() == "name: required", "expect RPCError from the server without serializer, but got %T %v", err, err)
+}
+
+func TestServer_OutgoingPool(t *testing.T) {
+	// 反向调用的客户端自己也启动一个服务
+	peer := NewServer()
+	var foo Foo
+	_ = peer.Register(&foo)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = l.Close() }()
+	go peer.Accept(l)
+	addr := l.Addr().String()
+
+	pool := NewServer().OutgoingPool()
+	defer func() { _ = pool.Close() }()
+	pool.SetMaxSize(1)
+
+	client, err := pool.Acquire(addr)
+	if err != nil {
+		t.Fatal("failed to acquire:", err)
+	}
+	var reply int
+	err = client.Call("Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	_assert(err == nil && reply == 3, "failed to call Foo.Sum: %v", err)
+	_, err = pool.Acquire(addr)
+	_assert(err == ErrPoolExhausted, "expect pool exhausted, but got %v", err)
+
+	// 归还之后复用同一个连接
+	pool.Release(client)
+	again, err := pool.Acquire(addr)
+	_assert(err == nil && again == client, "expect the idle client to be reused")
+	pool.Release(again)
+
+	// 空闲超时的连接被关闭
+	pool.SetIdleTimeout(10 * time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	fresh, err := pool.Acquire(addr)
+	_assert(err == nil && fresh != client && !client.IsAvailable(), "expect the idle client to be evicted")
+	pool.Release(fresh)
+	idle, inUse := pool.Stats(addr)
+	_assert(idle == 1 && inUse == 0, "unexpected stats idle=%d inUse=%d", idle, inUse)
+}
+
+func TestClient_Rebind(t *testing.T) {
+	listen := func(rcvrs ...interface{}) string {
+		server := NewServer()
+		for _, rcvr := range rcvrs {
+			_ = server.Register(rcvr)
+		}
+		l, _ := net.Listen("tcp", "127.0.0.1:0")
+		t.Cleanup(func() { _ = l.Close() })
+		go server.Accept(l)
+		return l.Addr().String()
+	}
+	var s Sleeper
+	var foo Foo
+	// 只有新的服务端注册了Foo
+	oldAddr, newAddr := listen(&s), listen(&s, &foo)
+
+	client, err := Dial("tcp", oldAddr)
+	if err != nil {
+		t.Fatal("failed to dial:", err)
+	}
+	defer func() { _ = client.Close() }()
+
+	// 切换时正在进行的调用在旧连接上完成
+	var slept int
+	inflight := client.Go("Sleeper.Sleep", 200, &slept, nil)
+	time.Sleep(20 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 2 * time.Second)
+	defer cancel()
+	err = client.Rebind(ctx, newAddr)
+	_assert(err == nil, "failed to rebind: %v", err)
+	call := <-inflight.Done
+	_assert(call.Error == nil && slept == 200, "expect the in-flight call to finish, but got %v", call.Error)
+	var sum int
+	err = client.Call("Foo.Sum", Args{Num1: 1, Num2: 2}, &sum)
+	_assert(err == nil && sum == 3, "expect calls to go to the new server: %v", err)
+
+	// 旧连接上的调用没有在ctx结束之前完成
+	inflight = client.Go("Sleeper.Sleep", 1000, &slept, nil)
+	time.Sleep(20 * time.Millisecond)
+	short, cancelShort := context.WithTimeout(context.Background(), 50 * time.Millisecond)
+	defer cancelShort()
+	err = client.Rebind(short, oldAddr)
+	_assert(err != nil && strings.Contains(err.Error(), context.DeadlineExceeded.Error()), "expect drain timeout, but got %v", err)
+	call = <-inflight.Done
+	_assert(call.Error != nil, "expect the undrained call to fail")
+	err = client.Call("Foo.Sum", Args{Num1: 1, Num2: 2}, &sum)
+	_assert(err != nil, "expect calls to go to the old server again")
+	_assert(client.IsAvailable(), "client should stay available after rebind")
+}
@@ -0,0 +1,55 @@
+package simpleRPC
+
+import (
+	"bytes"
+	"encoding/gob"
+	"reflect"
+	"sync"
+)
+
+// 合并相同的请求（singleflight），防止缓存失效时大量相同请求同时打到服务方法上
+type flightCall struct {
+	wg sync.WaitGroup
+	replyv reflect.Value
+	err error
+}
+
+type flightGroup struct {
+	mu sync.Mutex
+	calls map[string]*flightCall
+}
+
+// 同一个key同时只会执行一次fn，其他调用等待并共享fn的结果
+func (g *flightGroup) do(key string, fn func() (reflect.Value, error)) (reflect.Value, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall)
+	}
+	if c, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		c.wg.Wait()
+		return c.replyv, c.err
+	}
+	c := new(flightCall)
+	c.wg.Add(1)
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	c.replyv, c.err = fn()
+	c.wg.Done()
+
+	g.mu.Lock()
+	delete(g.calls, key)
+	g.mu.Unlock()
+	return c.replyv, c.err
+}
+
+// 请求的key：服务方法 + 编码后的参数，参数无法编码的话不合并
+// 直接用编码后的字节而不是哈希，哈希冲突会把别人的结果返回给调用方
+func coalesceKey(req *request) (string, bool) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(req.argv.Interface()); err != nil {
+		return "", false
+	}
+	return req.h.ServiceMethod + ":" + buf.String(), true
+}
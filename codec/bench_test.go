@@ -0,0 +1,203 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+// 在内存里写入之后再读出来，编解码器的读写都在同一个缓冲区上
+type loopConn struct {
+	bytes.Buffer
+}
+
+func (c *loopConn) Close() error {
+	return nil
+}
+
+type benchStruct struct {
+	ID int64
+	Name string
+	Email string
+	Age int
+	Score float64
+	Active bool
+	Tags []string
+	Attrs map[string]string
+	Payload []byte
+	Version uint32
+}
+
+func newBenchStruct() *benchStruct {
+	return &benchStruct{
+		ID: 10086,
+		Name: "simpleRPC",
+		Email: "simple@rpc.io",
+		Age: 18,
+		Score: 99.5,
+		Active: true,
+		Tags: []string{"rpc", "codec", "bench"},
+		Attrs: map[string]string{"region": "cn", "zone": "a"},
+		Payload: []byte("hello world"),
+		Version: 3,
+	}
+}
+
+func lookup(b *testing.B, t Type) NewCodecFunc {
+	f, ok := Lookup(t)
+	if !ok {
+		b.Fatal("codec not registered:", t)
+	}
+	return f
+}
+
+// 每次op编码并解码body n次
+func benchmarkRoundTrip(b *testing.B, f NewCodecFunc, body interface{}, newBody func() interface{}, n int) {
+	conn := &loopConn{}
+	cc := f(conn)
+	h := &Header{ServiceMethod: "Foo.Sum"}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i ++ {
+		for j := 0; j < n; j ++ {
+			h.Seq = uint64(j)
+			if err := cc.Write(h, body); err != nil {
+				b.Fatal(err)
+			}
+			var rh Header
+			if err := cc.ReadHeader(&rh); err != nil {
+				b.Fatal(err)
+			}
+			if err := cc.ReadBody(newBody()); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkCodecRoundTrip(b *testing.B) {
+	body := newBenchStruct()
+	for _, t := range Types() {
+		b.Run(string(t), func(b *testing.B) {
+			benchmarkRoundTrip(b, lookup(b, t), body, func() interface{} { return &benchStruct{} }, 1000)
+		})
+	}
+}
+
+func BenchmarkCodecLargePayload(b *testing.B) {
+	payload := bytes.Repeat([]byte{'x'}, 1 << 20)
+	for _, t := range Types() {
+		b.Run(string(t), func(b *testing.B) {
+			b.SetBytes(int64(len(payload)))
+			benchmarkRoundTrip(b, lookup(b, t), payload, func() interface{} { return &[]byte{} }, 1)
+		})
+	}
+}
+
+// 模拟短连接：每次op新建一个编解码器，发送少量消息之后关闭
+func BenchmarkCodecShortConn(b *testing.B) {
+	body := newBenchStruct()
+	for _, t := range Types() {
+		b.Run(string(t), func(b *testing.B) {
+			f := lookup(b, t)
+			h := &Header{ServiceMethod: "Foo.Sum"}
+			b.ReportAllocs()
+			for i := 0; i < b.N; i ++ {
+				cc := f(&loopConn{})
+				for j := 0; j < 10; j ++ {
+					if err := cc.Write(h, body); err != nil {
+						b.Fatal(err)
+					}
+					var rh Header
+					if err := cc.ReadHeader(&rh); err != nil {
+						b.Fatal(err)
+					}
+					if err := cc.ReadBody(&benchStruct{}); err != nil {
+						b.Fatal(err)
+					}
+				}
+				_ = cc.Close()
+			}
+		})
+	}
+}
+
+// 对比GobCodec现在的写法（bufio缓冲之后Flush）和net.Buffers的gather写法（writev）
+// 小消息时bufio只有一次系统调用，gather没有优势；body超过缓冲区大小时bufio会分两次写
+
+// gob把每条消息一次性写给w，这里复制一份保存下来，之后一起写
+type gatherWriter struct {
+	bufs net.Buffers
+}
+
+func (w *gatherWriter) Write(p []byte) (int, error) {
+	w.bufs = append(w.bufs, append([]byte(nil), p...))
+	return len(p), nil
+}
+
+// 返回一对tcp连接，另一端的数据直接丢掉
+func tcpPair(b *testing.B) (net.Conn, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		_, _ = io.Copy(ioutil.Discard, conn)
+	}()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	return conn, func() { _ = conn.Close(); _ = l.Close() }
+}
+
+func BenchmarkGobWrite(b *testing.B) {
+	for _, size := range []int{1 << 10, 100 << 10} {
+		body := bytes.Repeat([]byte{'x'}, size)
+		h := &Header{ServiceMethod: "Foo.Sum"}
+
+		b.Run(fmt.Sprintf("bufio-%dKB", size >> 10), func(b *testing.B) {
+			conn, closeFn := tcpPair(b)
+			defer closeFn()
+			cc := NewGobCodec(conn)
+			b.SetBytes(int64(size))
+			b.ResetTimer()
+			for i := 0; i < b.N; i ++ {
+				if err := cc.Write(h, body); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+
+		b.Run(fmt.Sprintf("gather-%dKB", size >> 10), func(b *testing.B) {
+			conn, closeFn := tcpPair(b)
+			defer closeFn()
+			w := &gatherWriter{}
+			enc := gob.NewEncoder(w)
+			b.SetBytes(int64(size))
+			b.ResetTimer()
+			for i := 0; i < b.N; i ++ {
+				w.bufs = w.bufs[:0]
+				if err := enc.Encode(h); err != nil {
+					b.Fatal(err)
+				}
+				if err := enc.Encode(body); err != nil {
+					b.Fatal(err)
+				}
+				bufs := w.bufs
+				if _, err := bufs.WriteTo(conn); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -1,13 +1,46 @@
 package codec
 
-import "io"
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
 
 type Header struct {
 	ServiceMethod string // 格式：Service.Method，就像别的rpc框架一样，远程调用的path
 	Seq uint64
-	Error string
+	ErrorCode int32 // 错误码，定义在simpleRPC/errs
+	ErrorMessage string
+	ErrorDetail string // 错误详情，例如服务端的调用栈
+	ErrorData []byte // ErrorSerializer序列化的错误，服务端没有设置ErrorSerializer时为空
+	TraceParent string // W3C traceparent，格式：00-<trace-id>-<span-id>-<flags>
+	TraceState string // W3C tracestate
+	Timeout int64 // 调用方剩下的时间（纳秒），服务端从收到请求开始计算截止时间，不依赖两边的时钟一致，0表示没有截止时间
+	Metadata map[string]string // 附加信息，例如x-correlation-id
+	Compression string // body的压缩方式，例如gzip，空表示没有压缩
+	FireAndForget bool // 客户端不等待响应，服务端执行完服务方法之后不发送响应
+	Stream StreamFlag // 流式调用的帧类型
+	RemainingBudgetMs int64 // 响应里服务端处理超时（HandleTimeout）还剩下的毫秒数，没有设置超时时为0
+	Priority int // 请求的优先级，PriorityNormal、PriorityHigh或者PriorityCritical，服务端使用工作协程池时优先处理高优先级的请求
 }
 
+// 请求的优先级
+const (
+	PriorityNormal = iota // 普通请求
+	PriorityHigh // 高优先级，例如健康检查
+	PriorityCritical // 最高优先级
+)
+
+// 流式调用的帧类型，同一个流式调用的所有帧使用相同的Seq
+type StreamFlag uint8
+
+const (
+	StreamNone StreamFlag = iota // 普通调用
+	StreamData // 数据块，body是[]byte
+	StreamEnd // 客户端表示数据发送完了，服务端表示服务方法返回了（错误在ErrorCode和ErrorMessage里）
+)
+
 type Codec interface {
 	// 相当于继承io.Closer接口，所以实现Codec的时候，需要实现接口io.Closer里的Close()方法
 	io.Closer
@@ -24,11 +57,51 @@ type Type string
 const (
 	GobType Type = "application/gob"
 	JsonType Type = "application/json"
+	SelfDescribingType Type = "application/x-simplerpc-self-describing"
 )
 
-var NewCodecFuncMap map[Type]NewCodecFunc
+// 已注册的编解码器，第三方包可以在init里调用Register添加自己的编解码器
+var (
+	codecsMu sync.RWMutex
+	codecs = make(map[Type]NewCodecFunc)
+)
+
+// 注册编解码器，类型已经注册过或者fn为nil时返回错误
+func Register(t Type, fn NewCodecFunc) error {
+	if fn == nil {
+		return fmt.Errorf("rpc codec: register nil codec func for %s", t)
+	}
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	if _, dup := codecs[t]; dup {
+		return fmt.Errorf("rpc codec: codec type %s already registered", t)
+	}
+	codecs[t] = fn
+	return nil
+}
+
+// 查找编解码器的创建方法
+func Lookup(t Type) (NewCodecFunc, bool) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	fn, ok := codecs[t]
+	return fn, ok
+}
+
+// 所有已注册的编解码器类型，按名称排序
+func Types() []Type {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	types := make([]Type, 0, len(codecs))
+	for t := range codecs {
+		types = append(types, t)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	return types
+}
 
 func init() {
-	NewCodecFuncMap = make(map[Type]NewCodecFunc)
-	NewCodecFuncMap[GobType] = NewGobCodec
+	_ = Register(GobType, NewGobCodec)
+	_ = Register(JsonType, NewJsonCodec)
+	_ = Register(SelfDescribingType, NewSelfDescribingCodec)
 }
@@ -0,0 +1,149 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/gob"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRegister(t *testing.T) {
+	const customType Type = "application/x-test-custom"
+	if _, ok := Lookup(customType); ok {
+		t.Fatal("expect custom codec not registered")
+	}
+	if err := Register(customType, NewGobCodec); err != nil {
+		t.Fatal("failed to register custom codec:", err)
+	}
+	if f, ok := Lookup(customType); !ok || f == nil {
+		t.Fatal("expect custom codec registered")
+	}
+	if err := Register(customType, NewJsonCodec); err == nil {
+		t.Fatal("expect error when registering duplicate codec")
+	}
+	if err := Register("application/x-test-nil", nil); err == nil {
+		t.Fatal("expect error when registering nil codec func")
+	}
+}
+
+type Event struct {
+	Name string
+	At time.Time
+	History []*time.Time
+	Extra map[string]interface{}
+}
+
+func TestDateTimeNormalizer(t *testing.T) {
+	// interface{}里的time.Time需要注册
+	gob.Register(time.Time{})
+	shanghai := time.FixedZone("CST", 8 * 3600)
+	newYork := time.FixedZone("EST", -5 * 3600)
+	at := time.Date(2024, 1, 2, 3, 4, 5, 0, shanghai)
+	ev := &Event{Name: "deploy", At: at, History: []*time.Time{&at}, Extra: map[string]interface{}{"at": at}}
+
+	c1, c2 := net.Pipe()
+	client := NewDateTimeNormalizer(NewGobCodec(c1), shanghai)
+	server := NewDateTimeNormalizer(NewGobCodec(c2), newYork)
+	defer func() { _ = client.Close(); _ = server.Close() }()
+	go func() {
+		_ = client.Write(&Header{ServiceMethod: "Event.Add"}, ev)
+	}()
+
+	var h Header
+	var got Event
+	if err := server.ReadHeader(&h); err != nil {
+		t.Fatal("failed to read header:", err)
+	}
+	if err := server.ReadBody(&got); err != nil {
+		t.Fatal("failed to read body:", err)
+	}
+	if !got.At.Equal(at) || got.At.Location() != newYork || got.History[0].Location() != newYork || got.Extra["at"].(time.Time).Location() != newYork {
+		t.Fatalf("expect times converted to %s, but got %+v", newYork, got)
+	}
+	if ev.At.Location() != shanghai || ev.History[0].Location() != shanghai {
+		t.Fatal("expect caller's args unchanged")
+	}
+}
+
+// 记录写到连接上的数据
+type recordingConn struct {
+	net.Conn
+	written bytes.Buffer
+}
+
+func (c *recordingConn) Write(p []byte) (int, error) {
+	c.written.Write(p)
+	return c.Conn.Write(p)
+}
+
+func TestPipeline(t *testing.T) {
+	aesStage, err := NewAESGCMStage(bytes.Repeat([]byte{7}, 32))
+	if err != nil {
+		t.Fatal("failed to create aes stage:", err)
+	}
+	newCodec := Pipeline(NewGobCodec, NewGzipStage(), aesStage)
+
+	c1, c2 := net.Pipe()
+	rc := &recordingConn{Conn: c1}
+	client, server := newCodec(rc), newCodec(c2)
+	defer func() { _ = client.Close(); _ = server.Close() }()
+	secret := strings.Repeat("top secret payload ", 100)
+	go func() {
+		_ = client.Write(&Header{ServiceMethod: "Vault.Put", Seq: 1}, secret)
+	}()
+
+	var h Header
+	var body string
+	if err := server.ReadHeader(&h); err != nil {
+		t.Fatal("failed to read header:", err)
+	}
+	if err := server.ReadBody(&body); err != nil {
+		t.Fatal("failed to read body:", err)
+	}
+	if h.ServiceMethod != "Vault.Put" || body != secret {
+		t.Fatalf("unexpected message %+v %q", h, body)
+	}
+	if bytes.Contains(rc.written.Bytes(), []byte("top secret")) || rc.written.Len() >= len(secret) {
+		t.Fatalf("expect compressed and encrypted data on the wire, got %d bytes", rc.written.Len())
+	}
+}
+
+func TestAESGCMStage_Sequence(t *testing.T) {
+	shared, _ := NewAESGCMStage(bytes.Repeat([]byte{7}, 32))
+	a, b := shared.(ConnStage).NewConn(), shared.(ConnStage).NewConn()
+	f1, _ := a.Encode([]byte("first"))
+	f2, _ := a.Encode([]byte("second"))
+
+	// 乱序的帧解密失败，按顺序的帧正常解密
+	if _, err := b.Decode(f2); err == nil {
+		t.Fatal("expect out of order frame rejected")
+	}
+	if p, err := b.Decode(f1); err != nil || string(p) != "first" {
+		t.Fatalf("failed to decode the first frame: %q %v", p, err)
+	}
+	// 重放的帧解密失败
+	if _, err := b.Decode(f1); err == nil {
+		t.Fatal("expect replayed frame rejected")
+	}
+	if p, err := b.Decode(f2); err != nil || string(p) != "second" {
+		t.Fatalf("failed to decode the second frame: %q %v", p, err)
+	}
+	// 反射回发送方的帧解密失败
+	if _, err := a.Decode(f1); err == nil {
+		t.Fatal("expect reflected frame rejected")
+	}
+}
+
+func TestGzipStage_Limit(t *testing.T) {
+	s := gzipStage{max: 10}
+	frame, _ := s.Encode(bytes.Repeat([]byte{1}, 11))
+	if _, err := s.Decode(frame); err == nil {
+		t.Fatal("expect oversized frame rejected instead of truncated")
+	}
+	frame, _ = s.Encode(bytes.Repeat([]byte{1}, 10))
+	if p, err := s.Decode(frame); err != nil || len(p) != 10 {
+		t.Fatalf("failed to decode frame within the limit: %d %v", len(p), err)
+	}
+}
@@ -0,0 +1,22 @@
+package codec
+
+import "errors"
+
+// 服务方法返回的错误的序列化方式，序列化的结果放在响应头的ErrorData里
+// 自定义实现可以把带类型的错误（例如带错误详情的结构体）序列化成json，客户端再还原成同样类型的错误
+type ErrorSerializer interface {
+	Marshal(err error) ([]byte, error)
+	// 从Marshal的结果还原错误，返回的就是还原出来的错误，返回nil表示无法还原
+	Unmarshal(data []byte) error
+}
+
+// 默认的错误序列化方式，只保留err.Error()
+type StringErrorSerializer struct{}
+
+func (StringErrorSerializer) Marshal(err error) ([]byte, error) {
+	return []byte(err.Error()), nil
+}
+
+func (StringErrorSerializer) Unmarshal(data []byte) error {
+	return errors.New(string(data))
+}
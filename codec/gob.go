@@ -55,7 +55,15 @@ var _ Codec = (*GobCodec)(nil)
 
 // 解码方法
 func NewGobCodec(conn io.ReadWriteCloser) Codec {
-	buf := bufio.NewWriter(conn)
+	return NewGobCodecSize(conn, 0)
+}
+
+// Write先写到bufio里再Flush，小消息一次系统调用；试过net.Buffers的writev写法反而更慢（见BenchmarkGobWrite）
+// gob的编解码器保存了每个连接已经发送过的类型信息，不能复用，所以没有像json那样使用池
+// 指定写缓冲区大小，小于等于0时使用默认大小（4KB）
+// 缓冲区越大，系统调用越少，但是每个连接占用的内存也越多
+func NewGobCodecSize(conn io.ReadWriteCloser, writeBufferSize int) Codec {
+	buf := bufio.NewWriterSize(conn, writeBufferSize)
 	return &GobCodec{
 		conn: conn,
 		buf: buf,
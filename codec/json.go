@@ -0,0 +1,375 @@
+package codec
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+type JsonCodec struct {
+	conn io.ReadWriteCloser
+	mu sync.Mutex // 保护buf，Close之后buf会放回池里
+	buf *bufio.Writer // 为nil表示已经关闭
+	dec *json.Decoder
+	enc *json.Encoder
+	config *JsonConfig // 自定义的序列化方法，为nil时使用encoding/json的默认行为
+}
+
+// 写缓冲区池，短连接很多的时候可以减少内存分配
+// json.Encoder和json.Decoder没有Reset方法，不能放到池里
+var jsonWriterPool = sync.Pool{
+	New: func() interface{} { return bufio.NewWriter(nil) },
+}
+
+func (c *JsonCodec) Close() error {
+	c.mu.Lock()
+	if c.buf != nil {
+		c.buf.Reset(nil)
+		jsonWriterPool.Put(c.buf)
+		c.buf = nil
+	}
+	c.mu.Unlock()
+	return c.conn.Close()
+}
+
+func (c *JsonCodec) ReadHeader(h *Header) error {
+	return c.dec.Decode(h)
+}
+
+func (c *JsonCodec) ReadBody(body interface{}) error {
+	if body == nil {
+		// 丢掉body
+		var raw json.RawMessage
+		return c.dec.Decode(&raw)
+	}
+	if c.config == nil {
+		return c.dec.Decode(body)
+	}
+
+	var raw json.RawMessage
+	if err := c.dec.Decode(&raw); err != nil {
+		return err
+	}
+	return c.config.Unmarshal(raw, body)
+}
+
+func (c *JsonCodec) Write(h *Header, body interface{}) (err error) {
+	c.mu.Lock()
+	if c.buf == nil {
+		c.mu.Unlock()
+		return io.ErrClosedPipe
+	}
+	defer func() {
+		_ = c.buf.Flush()
+		c.mu.Unlock()
+		if err != nil {
+			_ = c.Close()
+		}
+	}()
+
+	if err := c.enc.Encode(h); err != nil {
+		log.Println("rpc codec: json error encoding header:", err)
+		return err
+	}
+
+	if c.config != nil {
+		data, err := c.config.Marshal(body)
+		if err != nil {
+			log.Println("rpc codec: json error encoding body:", err)
+			return err
+		}
+		body = json.RawMessage(data)
+	}
+	if err := c.enc.Encode(body); err != nil {
+		log.Println("rpc codec: json error encoding body:", err)
+		return err
+	}
+
+	return nil
+}
+
+var _ Codec = (*JsonCodec)(nil)
+
+func NewJsonCodec(conn io.ReadWriteCloser) Codec {
+	return NewJsonCodecWithConfig(conn, nil)
+}
+
+// 使用自定义的序列化方法，config为nil时和NewJsonCodec一样
+func NewJsonCodecWithConfig(conn io.ReadWriteCloser, config *JsonConfig) Codec {
+	buf := jsonWriterPool.Get().(*bufio.Writer)
+	buf.Reset(conn)
+	return &JsonCodec{
+		conn: conn,
+		buf: buf,
+		dec: json.NewDecoder(conn),
+		enc: json.NewEncoder(buf),
+		config: config,
+	}
+}
+
+// 自定义类型的json序列化方法，例如time.Time使用Unix时间戳而不是RFC3339
+// 和实现json.Marshaler不同，只对使用这个配置的连接生效，不会影响其他包
+type JsonConfig struct {
+	mu sync.RWMutex
+	marshalers map[reflect.Type]jsonMarshaler
+}
+
+type jsonMarshaler struct {
+	marshal func(v interface{}) ([]byte, error)
+	unmarshal func(data []byte, ptr interface{}) error
+}
+
+func NewJsonConfig() *JsonConfig {
+	return &JsonConfig{marshalers: make(map[reflect.Type]jsonMarshaler)}
+}
+
+// 注册v的类型的序列化方法，marshal的参数是该类型的值，unmarshal的参数是指向该类型的指针
+// 类型出现在结构体字段、切片、map里也会使用注册的方法
+func (c *JsonConfig) RegisterMarshaler(v interface{}, marshal func(v interface{}) ([]byte, error), unmarshal func(data []byte, ptr interface{}) error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.marshalers[reflect.TypeOf(v)] = jsonMarshaler{marshal: marshal, unmarshal: unmarshal}
+}
+
+func (c *JsonConfig) lookup(t reflect.Type) (jsonMarshaler, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	m, ok := c.marshalers[t]
+	return m, ok
+}
+
+// t里面是否有注册了序列化方法的类型，没有的话直接使用encoding/json
+func (c *JsonConfig) contains(t reflect.Type, visited map[reflect.Type]bool) bool {
+	if _, ok := c.lookup(t); ok {
+		return true
+	}
+	if visited[t] {
+		return false
+	}
+	visited[t] = true
+
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Array:
+		return c.contains(t.Elem(), visited)
+	case reflect.Map:
+		return t.Key().Kind() == reflect.String && c.contains(t.Elem(), visited)
+	case reflect.Struct:
+		for _, f := range jsonFields(t) {
+			if c.contains(t.FieldByIndex(f.index).Type, visited) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (c *JsonConfig) Marshal(v interface{}) ([]byte, error) {
+	tree, err := c.toTree(reflect.ValueOf(v))
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(tree)
+}
+
+// 把v转换成encoding/json可以直接序列化的值，注册了的类型替换成json.RawMessage
+func (c *JsonConfig) toTree(v reflect.Value) (interface{}, error) {
+	if !v.IsValid() {
+		return nil, nil
+	}
+	if m, ok := c.lookup(v.Type()); ok {
+		data, err := m.marshal(v.Interface())
+		return json.RawMessage(data), err
+	}
+	if !c.contains(v.Type(), make(map[reflect.Type]bool)) {
+		return v.Interface(), nil
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil, nil
+		}
+		return c.toTree(v.Elem())
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return nil, nil
+		}
+		items := make([]interface{}, v.Len())
+		for i := range items {
+			item, err := c.toTree(v.Index(i))
+			if err != nil {
+				return nil, err
+			}
+			items[i] = item
+		}
+		return items, nil
+	case reflect.Map:
+		if v.IsNil() {
+			return nil, nil
+		}
+		m := make(map[string]interface{}, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			item, err := c.toTree(iter.Value())
+			if err != nil {
+				return nil, err
+			}
+			m[iter.Key().String()] = item
+		}
+		return m, nil
+	case reflect.Struct:
+		m := make(map[string]interface{})
+		for _, f := range jsonFields(v.Type()) {
+			fv := v.FieldByIndex(f.index)
+			if f.omitEmpty && fv.IsZero() {
+				continue
+			}
+			item, err := c.toTree(fv)
+			if err != nil {
+				return nil, err
+			}
+			m[f.name] = item
+		}
+		return m, nil
+	}
+	return v.Interface(), nil
+}
+
+// ptr必须是指针
+func (c *JsonConfig) Unmarshal(data []byte, ptr interface{}) error {
+	v := reflect.ValueOf(ptr)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return json.Unmarshal(data, ptr)
+	}
+	return c.fromJSON(data, v.Elem())
+}
+
+// 把data解析到v，v必须是可以修改的
+func (c *JsonConfig) fromJSON(data []byte, v reflect.Value) error {
+	if m, ok := c.lookup(v.Type()); ok {
+		return m.unmarshal(data, v.Addr().Interface())
+	}
+	if !c.contains(v.Type(), make(map[reflect.Type]bool)) {
+		return json.Unmarshal(data, v.Addr().Interface())
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr:
+		if string(data) == "null" {
+			v.Set(reflect.Zero(v.Type()))
+			return nil
+		}
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return c.fromJSON(data, v.Elem())
+	case reflect.Slice, reflect.Array:
+		var items []json.RawMessage
+		if err := json.Unmarshal(data, &items); err != nil {
+			return err
+		}
+		if v.Kind() == reflect.Slice {
+			if items == nil {
+				v.Set(reflect.Zero(v.Type()))
+				return nil
+			}
+			v.Set(reflect.MakeSlice(v.Type(), len(items), len(items)))
+		}
+		for i := 0; i < len(items) && i < v.Len(); i ++ {
+			if err := c.fromJSON(items[i], v.Index(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	case reflect.Map:
+		var items map[string]json.RawMessage
+		if err := json.Unmarshal(data, &items); err != nil {
+			return err
+		}
+		if items == nil {
+			v.Set(reflect.Zero(v.Type()))
+			return nil
+		}
+		v.Set(reflect.MakeMapWithSize(v.Type(), len(items)))
+		for key, item := range items {
+			elem := reflect.New(v.Type().Elem()).Elem()
+			if err := c.fromJSON(item, elem); err != nil {
+				return err
+			}
+			v.SetMapIndex(reflect.ValueOf(key).Convert(v.Type().Key()), elem)
+		}
+		return nil
+	case reflect.Struct:
+		var items map[string]json.RawMessage
+		if err := json.Unmarshal(data, &items); err != nil {
+			return err
+		}
+		for _, f := range jsonFields(v.Type()) {
+			item, ok := items[f.name]
+			if !ok {
+				// 和encoding/json一样，字段名不区分大小写
+				for key, raw := range items {
+					if strings.EqualFold(key, f.name) {
+						item, ok = raw, true
+						break
+					}
+				}
+			}
+			if !ok {
+				continue
+			}
+			if err := c.fromJSON(item, v.FieldByIndex(f.index)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return json.Unmarshal(data, v.Addr().Interface())
+}
+
+type jsonField struct {
+	index []int
+	name string
+	omitEmpty bool
+}
+
+// 结构体中需要序列化的字段，支持json标签的字段名、omitempty和"-"，匿名的结构体字段会展开
+func jsonFields(t reflect.Type) []jsonField {
+	var fields []jsonField
+	for i := 0; i < t.NumField(); i ++ {
+		sf := t.Field(i)
+		tag := sf.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts := tag, ""
+		if idx := strings.Index(tag, ","); idx >= 0 {
+			name, opts = tag[:idx], tag[idx+1:]
+		}
+
+		if sf.Anonymous && name == "" && sf.Type.Kind() == reflect.Struct {
+			for _, f := range jsonFields(sf.Type) {
+				f.index = append([]int{i}, f.index...)
+				fields = append(fields, f)
+			}
+			continue
+		}
+		if sf.PkgPath != "" {
+			// 不可导出的字段
+			continue
+		}
+		if name == "" {
+			name = sf.Name
+		}
+		fields = append(fields, jsonField{
+			index: []int{i},
+			name: name,
+			omitEmpty: strings.Contains(","+opts+",", ",omitempty,"),
+		})
+	}
+	return fields
+}
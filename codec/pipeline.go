@@ -0,0 +1,244 @@
+package codec
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// 编解码之后的数据的变换，例如压缩、加密
+// Encode在发送之前调用，Decode在收到之后调用，每次处理一帧完整的数据
+type Stage interface {
+	Encode(p []byte) ([]byte, error)
+	Decode(p []byte) ([]byte, error)
+}
+
+// 每个连接需要独立状态的变换（例如带序号的加密）实现这个接口，Pipeline为每个连接调用一次NewConn
+type ConnStage interface {
+	Stage
+	NewConn() Stage
+}
+
+// 组合编解码器和若干个变换：发送时先用newCodec编码，再按顺序执行stages；收到时按相反的顺序执行，再解码
+// 例如 Pipeline(NewGobCodec, NewGzipStage(), aesStage) 先Gob编码，再压缩，最后加密
+// 这样压缩、加密等功能可以任意组合，不需要为每种组合写一个编解码器
+// 连接上的数据按帧传输：| 长度 [4]byte | 变换之后的数据 |，两端的stages需要一致
+func Pipeline(newCodec NewCodecFunc, stages ...Stage) NewCodecFunc {
+	return func(conn io.ReadWriteCloser) Codec {
+		connStages := make([]Stage, len(stages))
+		for i, s := range stages {
+			if cs, ok := s.(ConnStage); ok {
+				s = cs.NewConn()
+			}
+			connStages[i] = s
+		}
+		return newCodec(&stagedConn{conn: conn, stages: connStages})
+	}
+}
+
+// 一帧数据的最大长度，防止收到错误的长度之后分配太大的内存
+const maxStageFrameSize = 64 << 20
+
+// 按帧执行变换的连接，编解码器通过它读写数据
+type stagedConn struct {
+	conn io.ReadWriteCloser
+	stages []Stage
+	writeMu sync.Mutex
+	pending []byte // 已经解出来但还没有被读走的数据
+}
+
+func (c *stagedConn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	data := p
+	for _, s := range c.stages {
+		var err error
+		if data, err = s.Encode(data); err != nil {
+			return 0, err
+		}
+	}
+	frame := make([]byte, 4 + len(data))
+	binary.BigEndian.PutUint32(frame, uint32(len(data)))
+	copy(frame[4:], data)
+	if _, err := c.conn.Write(frame); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *stagedConn) Read(p []byte) (int, error) {
+	for len(c.pending) == 0 {
+		var size [4]byte
+		if _, err := io.ReadFull(c.conn, size[:]); err != nil {
+			return 0, err
+		}
+		n := binary.BigEndian.Uint32(size[:])
+		if n > maxStageFrameSize {
+			return 0, fmt.Errorf("rpc codec: stage frame too large: %d", n)
+		}
+		data := make([]byte, n)
+		if _, err := io.ReadFull(c.conn, data); err != nil {
+			return 0, err
+		}
+		for i := len(c.stages) - 1; i >= 0; i -- {
+			var err error
+			if data, err = c.stages[i].Decode(data); err != nil {
+				return 0, err
+			}
+		}
+		c.pending = data
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *stagedConn) Close() error {
+	return c.conn.Close()
+}
+
+// gzip压缩
+type gzipStage struct {
+	max int64 // 解压之后的最大长度
+}
+
+func NewGzipStage() Stage {
+	return gzipStage{max: maxStageFrameSize}
+}
+
+func (gzipStage) Encode(p []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(p); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (s gzipStage) Decode(p []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(p))
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = r.Close() }()
+	// 多读一个字节，超过长度限制的话返回错误，不能截断之后当成完整的数据
+	data, err := ioutil.ReadAll(io.LimitReader(r, s.max + 1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > s.max {
+		return nil, fmt.Errorf("rpc codec: gzip frame larger than %d bytes", s.max)
+	}
+	return data, nil
+}
+
+// AES-GCM加密，每帧的格式：| 发送方标识 [8]byte | nonce | 密文 |
+// 发送方标识是每个连接随机生成的，和这个方向的帧序号一起作为附加数据（AAD）参与认证，
+// 重放、重排或者丢弃的帧，以及被反射回发送方的帧都会解密失败
+type aesGCMStage struct {
+	aead cipher.AEAD
+	mu sync.Mutex
+	id [8]byte // 本端的标识
+	peer []byte // 对端的标识，收到第一帧时记录
+	writeSeq uint64 // 下一个发送的帧序号
+	readSeq uint64 // 下一个接收的帧序号
+}
+
+// key的长度为16、24或者32字节，分别对应AES-128、AES-192、AES-256
+func NewAESGCMStage(key []byte) (Stage, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return newAESGCMStage(aead)
+}
+
+func newAESGCMStage(aead cipher.AEAD) (*aesGCMStage, error) {
+	s := &aesGCMStage{aead: aead}
+	if _, err := rand.Read(s.id[:]); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// 每个连接使用新的标识和序号
+func (s *aesGCMStage) NewConn() Stage {
+	c, err := newAESGCMStage(s.aead)
+	if err != nil {
+		// 随机数生成失败的话，Encode和Decode都返回错误
+		return errStage{err}
+	}
+	return c
+}
+
+// 附加数据：发送方标识和帧序号
+func aesGCMAdditionalData(id []byte, seq uint64) []byte {
+	ad := make([]byte, len(id) + 8)
+	copy(ad, id)
+	binary.BigEndian.PutUint64(ad[len(id):], seq)
+	return ad
+}
+
+func (s *aesGCMStage) Encode(p []byte) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := s.aead.NonceSize()
+	out := make([]byte, len(s.id) + n, len(s.id) + n + len(p) + s.aead.Overhead())
+	copy(out, s.id[:])
+	nonce := out[len(s.id):]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out = s.aead.Seal(out, nonce, p, aesGCMAdditionalData(s.id[:], s.writeSeq))
+	s.writeSeq ++
+	return out, nil
+}
+
+func (s *aesGCMStage) Decode(p []byte) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := s.aead.NonceSize()
+	if len(p) < len(s.id) + n {
+		return nil, errors.New("rpc codec: aes-gcm frame too short")
+	}
+	sender := p[:len(s.id)]
+	if bytes.Equal(sender, s.id[:]) {
+		return nil, errors.New("rpc codec: aes-gcm frame reflected back to its sender")
+	}
+	if s.peer != nil && !bytes.Equal(sender, s.peer) {
+		return nil, errors.New("rpc codec: aes-gcm frame from an unexpected sender")
+	}
+	data, err := s.aead.Open(nil, p[len(s.id):len(s.id) + n], p[len(s.id) + n:], aesGCMAdditionalData(sender, s.readSeq))
+	if err != nil {
+		return nil, err
+	}
+	if s.peer == nil {
+		s.peer = append([]byte(nil), sender...)
+	}
+	s.readSeq ++
+	return data, nil
+}
+
+// 创建失败的变换，Encode和Decode都返回err
+type errStage struct {
+	err error
+}
+
+func (s errStage) Encode(p []byte) ([]byte, error) { return nil, s.err }
+
+func (s errStage) Decode(p []byte) ([]byte, error) { return nil, s.err }
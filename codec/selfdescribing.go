@@ -0,0 +1,140 @@
+package codec
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"reflect"
+	"sync"
+)
+
+// 类型注册表，类型名 -> reflect.Type，接收方根据类型名就能创建对应的实例
+type TypeRegistry struct {
+	mu sync.RWMutex
+	types map[string]reflect.Type
+}
+
+func NewTypeRegistry() *TypeRegistry {
+	return &TypeRegistry{types: make(map[string]reflect.Type)}
+}
+
+var DefaultTypeRegistry = NewTypeRegistry()
+
+// 类型名，指针类型使用它指向的类型名，如 *simpleRPC.Args 和 simpleRPC.Args 都是 simpleRPC.Args
+func typeName(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	t := reflect.TypeOf(v)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.String()
+}
+
+// 注册v的类型
+func (r *TypeRegistry) Register(v interface{}) {
+	t := reflect.TypeOf(v)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.types[t.String()] = t
+}
+
+func (r *TypeRegistry) Lookup(name string) (reflect.Type, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	t, ok := r.types[name]
+	return t, ok
+}
+
+// 类型名没有注册，body已经被丢掉，连接上后面的消息还能正常读取
+var ErrUnregisteredType = errors.New("rpc codec: unregistered type")
+
+// 自描述的编解码器，在body前面多编码一个类型名，接收方不需要知道方法签名也能解码body
+// 例如代理服务（NewProxyServer），只需要注册类型，不需要知道每个方法的签名就能转发请求
+type SelfDescribingCodec struct {
+	*GobCodec
+	registry *TypeRegistry
+}
+
+var _ Codec = (*SelfDescribingCodec)(nil)
+
+func (c *SelfDescribingCodec) Write(h *Header, body interface{}) (err error) {
+	defer func() {
+		_ = c.buf.Flush()
+		if err != nil {
+			_ = c.Close()
+		}
+	}()
+
+	if err := c.enc.Encode(h); err != nil {
+		log.Println("rpc codec: self-describing error encoding header:", err)
+		return err
+	}
+
+	if err := c.enc.Encode(typeName(body)); err != nil {
+		log.Println("rpc codec: self-describing error encoding type name:", err)
+		return err
+	}
+
+	if err := c.enc.Encode(body); err != nil {
+		log.Println("rpc codec: self-describing error encoding body:", err)
+		return err
+	}
+
+	return nil
+}
+
+// body是*interface{}时，和ReadAnyBody一样根据类型名创建实例
+func (c *SelfDescribingCodec) ReadBody(body interface{}) error {
+	if any, ok := body.(*interface{}); ok {
+		v, err := c.ReadAnyBody()
+		if err == nil {
+			*any = v
+		}
+		return err
+	}
+	var name string
+	if err := c.dec.Decode(&name); err != nil {
+		return err
+	}
+	return c.dec.Decode(body)
+}
+
+// 读取body，根据类型名创建实例，返回的是指向实例的指针
+func (c *SelfDescribingCodec) ReadAnyBody() (interface{}, error) {
+	var name string
+	if err := c.dec.Decode(&name); err != nil {
+		return nil, err
+	}
+	t, ok := c.registry.Lookup(name)
+	if !ok {
+		// 丢掉body，保证后面的请求还能正常读取
+		if err := c.dec.DecodeValue(reflect.Value{}); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w %s", ErrUnregisteredType, name)
+	}
+	body := reflect.New(t).Interface()
+	if err := c.dec.Decode(body); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+// 替换类型注册表，需要在读取第一个body之前设置
+func (c *SelfDescribingCodec) SetTypeRegistry(registry *TypeRegistry) {
+	c.registry = registry
+}
+
+// 使用默认的类型注册表
+func NewSelfDescribingCodec(conn io.ReadWriteCloser) Codec {
+	return &SelfDescribingCodec{
+		GobCodec: NewGobCodec(conn).(*GobCodec),
+		registry: DefaultTypeRegistry,
+	}
+}
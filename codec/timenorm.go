@@ -0,0 +1,197 @@
+package codec
+
+import (
+	"reflect"
+	"sync"
+	"time"
+)
+
+// 包装一个编解码器，发送之前把body里的time.Time转成UTC，收到之后转成loc时区
+// Gob编码time.Time时会带上时区偏移，客户端和服务端在不同时区的时候，收到的时间的时区和本地不一致
+// 发送时不修改调用方的参数，包含time.Time的部分会复制一份；不包含time.Time的类型直接跳过
+// 只转换导出的字段，和Gob一样；服务端压缩过的响应（Server.SetCompressThreshold）解压之后使用TimesIn转换
+type DateTimeNormalizer struct {
+	Codec
+	loc *time.Location
+}
+
+var _ Codec = (*DateTimeNormalizer)(nil)
+
+// loc为nil时使用本地时区
+func NewDateTimeNormalizer(c Codec, loc *time.Location) Codec {
+	if loc == nil {
+		loc = time.Local
+	}
+	return &DateTimeNormalizer{Codec: c, loc: loc}
+}
+
+func (n *DateTimeNormalizer) ReadBody(body interface{}) error {
+	if err := n.Codec.ReadBody(body); err != nil {
+		return err
+	}
+	TimesIn(body, n.loc)
+	return nil
+}
+
+// 把body里的time.Time都转成loc时区，和DateTimeNormalizer收到body之后的处理一样，body需要是指针，为nil时不处理
+func TimesIn(body interface{}, loc *time.Location) {
+	if body != nil {
+		timesIn(reflect.ValueOf(body), loc)
+	}
+}
+
+func (n *DateTimeNormalizer) Write(h *Header, body interface{}) error {
+	if body != nil {
+		body = timesToUTC(reflect.ValueOf(body)).Interface()
+	}
+	return n.Codec.Write(h, body)
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// 类型是否包含time.Time，key为reflect.Type
+var containsTimeCache sync.Map
+
+// 类型是否可能包含time.Time，interface的实际类型运行时才知道，当作包含
+func containsTime(t reflect.Type) bool {
+	if v, ok := containsTimeCache.Load(t); ok {
+		return v.(bool)
+	}
+	result := containsTimeType(t, make(map[reflect.Type]bool))
+	containsTimeCache.Store(t, result)
+	return result
+}
+
+// visiting记录正在检查的类型，避免递归类型死循环
+func containsTimeType(t reflect.Type, visiting map[reflect.Type]bool) bool {
+	if t == timeType {
+		return true
+	}
+	if visiting[t] {
+		return false
+	}
+	visiting[t] = true
+	switch t.Kind() {
+	case reflect.Interface:
+		return true
+	case reflect.Ptr, reflect.Slice, reflect.Array, reflect.Map:
+		return containsTimeType(t.Elem(), visiting)
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i ++ {
+			f := t.Field(i)
+			if f.PkgPath == "" && containsTimeType(f.Type, visiting) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// 返回v的一个副本，里面的time.Time都转成UTC，不包含time.Time的部分和v共用
+func timesToUTC(v reflect.Value) reflect.Value {
+	t := v.Type()
+	if !containsTime(t) {
+		return v
+	}
+	if t == timeType {
+		return reflect.ValueOf(v.Interface().(time.Time).UTC())
+	}
+	switch t.Kind() {
+	case reflect.Interface:
+		if v.IsNil() {
+			return v
+		}
+		n := reflect.New(t).Elem()
+		n.Set(timesToUTC(v.Elem()))
+		return n
+	case reflect.Ptr:
+		if v.IsNil() {
+			return v
+		}
+		n := reflect.New(t.Elem())
+		n.Elem().Set(timesToUTC(v.Elem()))
+		return n
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		n := reflect.MakeSlice(t, v.Len(), v.Len())
+		for i := 0; i < v.Len(); i ++ {
+			n.Index(i).Set(timesToUTC(v.Index(i)))
+		}
+		return n
+	case reflect.Array:
+		n := reflect.New(t).Elem()
+		for i := 0; i < v.Len(); i ++ {
+			n.Index(i).Set(timesToUTC(v.Index(i)))
+		}
+		return n
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		n := reflect.MakeMapWithSize(t, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			n.SetMapIndex(iter.Key(), timesToUTC(iter.Value()))
+		}
+		return n
+	case reflect.Struct:
+		n := reflect.New(t).Elem()
+		n.Set(v)
+		for i := 0; i < t.NumField(); i ++ {
+			if t.Field(i).PkgPath == "" {
+				n.Field(i).Set(timesToUTC(v.Field(i)))
+			}
+		}
+		return n
+	}
+	return v
+}
+
+// 把v里的time.Time都转成loc时区，直接修改，v需要是指针或者可以修改的值
+func timesIn(v reflect.Value, loc *time.Location) {
+	t := v.Type()
+	if !containsTime(t) {
+		return
+	}
+	if t == timeType {
+		if v.CanSet() {
+			v.Set(reflect.ValueOf(v.Interface().(time.Time).In(loc)))
+		}
+		return
+	}
+	switch t.Kind() {
+	case reflect.Interface:
+		if v.IsNil() || !v.CanSet() {
+			return
+		}
+		// interface里的值不能直接修改，复制出来修改之后再放回去
+		e := reflect.New(v.Elem().Type()).Elem()
+		e.Set(v.Elem())
+		timesIn(e, loc)
+		v.Set(e)
+	case reflect.Ptr:
+		if !v.IsNil() {
+			timesIn(v.Elem(), loc)
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i ++ {
+			timesIn(v.Index(i), loc)
+		}
+	case reflect.Map:
+		iter := v.MapRange()
+		for iter.Next() {
+			e := reflect.New(t.Elem()).Elem()
+			e.Set(iter.Value())
+			timesIn(e, loc)
+			v.SetMapIndex(iter.Key(), e)
+		}
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i ++ {
+			if t.Field(i).PkgPath == "" {
+				timesIn(v.Field(i), loc)
+			}
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package simpleRPC
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"simpleRPC/codec"
+)
+
+const gzipCompression = "gzip"
+
+// 解压之后的最大长度，和codec里gzip阶段的限制一样，防止很小的压缩数据解压出很大的数据
+const maxDecompressedSize = 64 << 20
+
+// 响应编码之后超过n字节时使用gzip压缩，<= 0 为不压缩（默认）
+// 压缩由服务端决定，客户端看响应头里的压缩方式解压
+func (server *Server) SetCompressThreshold(n int) {
+	if n < 0 {
+		n = 0
+	}
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.compressThreshold = n
+}
+
+func (server *Server) compressAbove() int {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return server.compressThreshold
+}
+
+// 使用连接的编解码器序列化body，只支持Gob和Json，其他编解码器返回false
+func marshalBody(opt *Option, body interface{}) ([]byte, bool) {
+	switch opt.CodecType {
+	case codec.GobType:
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(body); err != nil {
+			return nil, false
+		}
+		return buf.Bytes(), true
+	case codec.JsonType:
+		var data []byte
+		var err error
+		if opt.JsonConfig != nil {
+			data, err = opt.JsonConfig.Marshal(body)
+		} else {
+			data, err = json.Marshal(body)
+		}
+		return data, err == nil
+	default:
+		return nil, false
+	}
+}
+
+// 和marshalBody对应，使用连接的编解码器反序列化
+func unmarshalBody(opt *Option, data []byte, reply interface{}) error {
+	switch opt.CodecType {
+	case codec.GobType:
+		return gob.NewDecoder(bytes.NewReader(data)).Decode(reply)
+	case codec.JsonType:
+		if opt.JsonConfig != nil {
+			return opt.JsonConfig.Unmarshal(data, reply)
+		}
+		return json.Unmarshal(data, reply)
+	default:
+		return errors.New("rpc: compressed body not supported by codec " + string(opt.CodecType))
+	}
+}
+
+// 响应使用连接的编解码器编码之后超过threshold字节的话，使用gzip压缩，返回压缩后的数据，并在h里设置压缩方式
+// 小的响应压缩不划算，直接返回body
+func compressBody(h *codec.Header, body interface{}, threshold int, opt *Option) interface{} {
+	if threshold <= 0 {
+		return body
+	}
+
+	data, ok := marshalBody(opt, body)
+	if !ok || len(data) <= threshold {
+		return body
+	}
+
+	var zbuf bytes.Buffer
+	zw := gzip.NewWriter(&zbuf)
+	if _, err := zw.Write(data); err != nil {
+		return body
+	}
+	if err := zw.Close(); err != nil {
+		return body
+	}
+	h.Compression = gzipCompression
+	return zbuf.Bytes()
+}
+
+// 解压body，使用连接的编解码器解码到reply，设置了TimeLocation的话和没有压缩的响应一样转换时区
+func decompressBody(h *codec.Header, data []byte, reply interface{}, opt *Option) error {
+	if h.Compression != gzipCompression {
+		return errors.New("unsupported compression " + h.Compression)
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	// 多读一个字节，超过长度限制的话返回错误，不能截断之后当成完整的数据
+	raw, err := ioutil.ReadAll(io.LimitReader(zr, maxDecompressedSize + 1))
+	if err != nil {
+		return err
+	}
+	if len(raw) > maxDecompressedSize {
+		return fmt.Errorf("rpc: decompressed body larger than %d bytes", maxDecompressedSize)
+	}
+	if reply == nil {
+		return nil
+	}
+	if err := unmarshalBody(opt, raw, reply); err != nil {
+		return err
+	}
+	if opt.TimeLocation != nil {
+		codec.TimesIn(reply, opt.TimeLocation)
+	}
+	return nil
+}
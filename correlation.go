@@ -0,0 +1,57 @@
+package simpleRPC
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"simpleRPC/codec"
+)
+
+// 请求头Metadata里correlation id的key
+const CorrelationIDKey = "x-correlation-id"
+
+type correlationIDKey struct{}
+
+// 把correlation id放到ctx里，客户端调用时会带到请求头，用于串联一次请求经过的所有服务
+func WithCorrelationID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, correlationIDKey{}, id)
+}
+
+// 从ctx里获取correlation id，没有的话返回空字符串
+func CorrelationIDFromContext(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	id, _ := ctx.Value(correlationIDKey{}).(string)
+	return id
+}
+
+// 生成一个随机的UUID（version 4）
+func newCorrelationID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	b[6] = b[6] & 0x0f | 0x40
+	b[8] = b[8] & 0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// 把ctx里的correlation id写到请求头，ctx里没有的话生成一个新的
+func injectCorrelationID(ctx context.Context, header *codec.Header) {
+	id := CorrelationIDFromContext(ctx)
+	if id == "" {
+		id = newCorrelationID()
+	}
+	if header.Metadata == nil {
+		header.Metadata = make(map[string]string)
+	}
+	header.Metadata[CorrelationIDKey] = id
+}
+
+// 从请求头里取出correlation id放到ctx里
+func extractCorrelationID(ctx context.Context, header *codec.Header) context.Context {
+	id := header.Metadata[CorrelationIDKey]
+	if id == "" {
+		return ctx
+	}
+	return WithCorrelationID(ctx, id)
+}
@@ -0,0 +1,102 @@
+package simpleRPC
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"simpleRPC/codec"
+	"sync/atomic"
+	"time"
+)
+
+// 统计读写字节数的连接
+// 实现了io.ByteReader，gob就不会再套一层bufio预读数据，读到的字节数和消息是一一对应的
+type countingConn struct {
+	io.ReadWriteCloser
+	r *bufio.Reader
+	read int64
+	written int64
+}
+
+// readBufferSize 读缓冲区大小，小于等于0时使用默认大小（4KB）
+func newCountingConn(conn io.ReadWriteCloser, readBufferSize int) *countingConn {
+	r := bufio.NewReader(conn)
+	if readBufferSize > 0 {
+		r = bufio.NewReaderSize(conn, readBufferSize)
+	}
+	return &countingConn{ReadWriteCloser: conn, r: r}
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	atomic.AddInt64(&c.read, int64(n))
+	return n, err
+}
+
+func (c *countingConn) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		atomic.AddInt64(&c.read, 1)
+	}
+	return b, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Write(p)
+	atomic.AddInt64(&c.written, int64(n))
+	return n, err
+}
+
+func (c *countingConn) bytesRead() int64 {
+	return atomic.LoadInt64(&c.read)
+}
+
+func (c *countingConn) bytesWritten() int64 {
+	return atomic.LoadInt64(&c.written)
+}
+
+// 可以拿到读写字节数的编解码器
+type countingCodec struct {
+	codec.Codec
+	conn *countingConn
+}
+
+func newCountingCodec(f codec.NewCodecFunc, conn io.ReadWriteCloser, readBufferSize int) *countingCodec {
+	cconn := newCountingConn(conn, readBufferSize)
+	return &countingCodec{Codec: f(cconn), conn: cconn}
+}
+
+// 读取的字节数，cc不是countingCodec的话返回0
+func bytesRead(cc codec.Codec) int64 {
+	if c, ok := cc.(*countingCodec); ok {
+		return c.conn.bytesRead()
+	}
+	return 0
+}
+
+// 写入的字节数，cc不是countingCodec的话返回0
+func bytesWritten(cc codec.Codec) int64 {
+	if c, ok := cc.(*countingCodec); ok {
+		return c.conn.bytesWritten()
+	}
+	return 0
+}
+
+// 客户端地址，连接不是net.Conn的话返回空字符串
+func remoteAddr(cc codec.Codec) string {
+	if c, ok := cc.(*countingCodec); ok {
+		if conn, ok := c.conn.ReadWriteCloser.(net.Conn); ok {
+			return conn.RemoteAddr().String()
+		}
+	}
+	return ""
+}
+
+// 设置连接的读超时，连接不是net.Conn的话不设置
+func setReadDeadline(cc codec.Codec, t time.Time) {
+	if c, ok := cc.(*countingCodec); ok {
+		if conn, ok := c.conn.ReadWriteCloser.(net.Conn); ok {
+			_ = conn.SetReadDeadline(t)
+		}
+	}
+}
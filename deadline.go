@@ -0,0 +1,47 @@
+package simpleRPC
+
+import (
+	"context"
+	"simpleRPC/codec"
+	"time"
+)
+
+// 请求的截止时间：客户端在h.Timeout里带的剩余时间和timeout（HandleTimeout）里早的那个，都从start（收到请求的时间）开始算，
+// 都没有的话返回零值
+func requestDeadline(h *codec.Header, start time.Time, timeout time.Duration) time.Time {
+	var deadline time.Time
+	if h.Timeout > 0 {
+		deadline = start.Add(time.Duration(h.Timeout))
+	}
+	if timeout > 0 {
+		if d := start.Add(timeout); deadline.IsZero() || d.Before(deadline) {
+			deadline = d
+		}
+	}
+	return deadline
+}
+
+// 链式调用时（服务方法里再调用别的rpc服务），把剩余时间的fraction作为内部调用的截止时间，
+// 内部调用就不会使用一个全新的超时时间。ctx没有截止时间的话原样返回
+// 服务方法的第一个参数是context.Context时，ctx带着调用方的截止时间，例如：
+// func (t *T) Method(ctx context.Context, args A, reply *R) error {
+//     return xc.Call(simpleRPC.DeadlineBudget(ctx, 0.5), "Other.Method", args, reply)
+// }
+func DeadlineBudget(ctx context.Context, fraction float64) context.Context {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return ctx
+	}
+	if fraction <= 0 || fraction > 1 {
+		fraction = 1
+	}
+
+	remaining := time.Until(deadline)
+	ctx, cancel := context.WithDeadline(ctx, time.Now().Add(time.Duration(float64(remaining) * fraction)))
+	// 到了截止时间或者上层ctx取消的时候释放资源
+	go func() {
+		<-ctx.Done()
+		cancel()
+	}()
+	return ctx
+}
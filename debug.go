@@ -3,13 +3,25 @@ package simpleRPC
 import (
 	"fmt"
 	"html/template"
+	"net"
 	"net/http"
 )
 
 const debugText = `<html>
 	<body>
 	<title>GeeRPC Services</title>
-	{{range .}}
+	{{if .Tracking}}
+	<hr>
+	Connections {{len .Conns}}
+	<hr>
+		<table>
+		<th align=center>Remote Addr</th>
+		{{range .Conns}}
+			<tr><td align=left font=fixed>{{.}}</td></tr>
+		{{end}}
+		</table>
+	{{end}}
+	{{range .Services}}
 	<hr>
 	Service {{.Name}}
 	<hr>
@@ -32,6 +44,12 @@ type debugHTTP struct {
 	*Server
 }
 
+type debugData struct {
+	Services []debugService
+	Tracking bool // 是否安装了连接记录器
+	Conns []net.Addr
+}
+
 type debugService struct {
 	Name string
 	Method map[string]*methodType
@@ -48,7 +66,13 @@ func (server debugHTTP) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		return true
 	})
 
-	err := debug.Execute(w, services)
+	data := debugData{Services: services}
+	if ct := server.tracker(); ct != nil {
+		data.Tracking = true
+		data.Conns = ct.ActiveConns()
+	}
+
+	err := debug.Execute(w, data)
 	if err != nil {
 		_, _ = fmt.Fprintln(w, "rpc: error executing template:", err.Error())
 	}
@@ -0,0 +1,61 @@
+package simpleRPC
+
+import (
+	"log"
+	"simpleRPC/codec"
+	"simpleRPC/errs"
+)
+
+// 服务端返回的错误，调用方可以通过类型断言拿到错误码，例如：
+// if e, ok := err.(*simpleRPC.RPCError); ok && e.Code == errs.Timeout {...}
+// 客户端设置了Option.ErrorSerializer时，还原出来的错误放在Err里，可以用errors.As取出
+type RPCError struct {
+	Code int32
+	Message string
+	Stack string // 服务端的调用栈，只有服务端开启了Server.SetIncludeStack才有
+	Err error // ErrorSerializer还原出来的错误，没有时为nil
+}
+
+func (e *RPCError) Error() string {
+	return e.Message
+}
+
+func (e *RPCError) Unwrap() error {
+	return e.Err
+}
+
+// 把错误写到响应头，如果是RPCError的话，带上对应的错误码，否则认为是服务内部错误
+// 设置了Server.SetErrorSerializer的话，同时把序列化的错误放到ErrorData里
+func (server *Server) setHeaderError(h *codec.Header, err error) {
+	if e, ok := err.(*stackError); ok {
+		h.ErrorDetail = e.stack
+		err = e.err
+	}
+	if s := server.errSerializer(); s != nil {
+		data, e := s.Marshal(err)
+		if e != nil {
+			log.Println("rpc server: marshal error err:", e)
+		}
+		h.ErrorData = data
+	}
+	if e, ok := err.(*RPCError); ok {
+		h.ErrorCode = e.Code
+		h.ErrorMessage = e.Message
+		return
+	}
+	h.ErrorCode = errs.InternalError
+	h.ErrorMessage = err.Error()
+}
+
+// 从响应头中解析错误，没有错误返回nil
+// 兼容只设置了ErrorMessage的旧版本服务端，错误码为0的当作服务内部错误
+func headerError(h *codec.Header) error {
+	if h.ErrorCode == errs.OK && h.ErrorMessage == "" {
+		return nil
+	}
+	code := h.ErrorCode
+	if code == errs.OK {
+		code = errs.InternalError
+	}
+	return &RPCError{Code: code, Message: h.ErrorMessage, Stack: h.ErrorDetail}
+}
@@ -0,0 +1,12 @@
+package errs
+
+// 错误码，通过codec.Header.ErrorCode传递给客户端
+const (
+	OK int32 = iota // 没有错误
+	MethodNotFound // 找不到服务或者方法
+	Timeout // 处理超时
+	RateLimit // 被限流
+	InternalError // 服务内部错误（包括服务方法返回的错误）
+	Validation // 参数校验失败
+	PermissionDenied // 没有权限
+)
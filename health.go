@@ -0,0 +1,141 @@
+package simpleRPC
+
+import (
+	"encoding/json"
+	"simpleRPC/errs"
+	"sync"
+)
+
+// simpleRPC的健康检查服务，消息和状态的取值参考了gRPC健康检查协议（grpc.health.v1），
+// 但是编码和传输都是simpleRPC的，gRPC的探测工具不能直接调用：
+// grpc.health.v1.Health.Check 查询服务状态，grpc.health.v1.Health.Watch 是流式调用，状态变化时推送
+
+// 服务的状态，取值和grpc.health.v1.HealthCheckResponse.ServingStatus一致
+type HealthServingStatus int32
+
+const (
+	HealthUnknown HealthServingStatus = iota
+	HealthServing
+	HealthNotServing
+	HealthServiceUnknown // 只在Watch里使用，服务没有注册过状态
+)
+
+func (s HealthServingStatus) String() string {
+	switch s {
+	case HealthServing:
+		return "SERVING"
+	case HealthNotServing:
+		return "NOT_SERVING"
+	case HealthServiceUnknown:
+		return "SERVICE_UNKNOWN"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+type HealthCheckRequest struct {
+	Service string `json:"service"` // 为空表示整个服务端
+}
+
+type HealthCheckResponse struct {
+	Status HealthServingStatus `json:"status"`
+}
+
+// 健康检查服务注册的服务名，带上命名空间，不会和用户自己的Health服务冲突
+const HealthServiceName = "grpc.health.v1.Health"
+
+// 健康检查服务，注册之后服务名为HealthServiceName
+type Health struct {
+	mu sync.Mutex
+	statuses map[string]HealthServingStatus
+	changed chan struct{} // 状态变化时关闭，然后换一个新的
+}
+
+// 注册健康检查服务，整个服务端（Service为空）的初始状态为SERVING
+// 返回的*Health用来更新各个服务的状态，例如预热完成之前设置为NOT_SERVING
+func (server *Server) RegisterHealthService() (*Health, error) {
+	h := &Health{
+		statuses: map[string]HealthServingStatus{"": HealthServing},
+		changed: make(chan struct{}),
+	}
+	s := newService(h)
+	s.name = HealthServiceName
+	if err := server.register(s); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// 设置服务的状态，正在Watch的客户端会收到新的状态
+func (h *Health) SetServingStatus(service string, status HealthServingStatus) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if old, ok := h.statuses[service]; ok && old == status {
+		return
+	}
+	h.statuses[service] = status
+	close(h.changed)
+	h.changed = make(chan struct{})
+}
+
+// 返回服务的状态和状态变化的通知
+func (h *Health) status(service string) (HealthServingStatus, bool, <-chan struct{}) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	status, ok := h.statuses[service]
+	return status, ok, h.changed
+}
+
+// 查询服务的状态，服务没有注册过状态时返回错误（和gRPC的NOT_FOUND对应）
+func (h *Health) Check(req HealthCheckRequest, resp *HealthCheckResponse) error {
+	status, ok, _ := h.status(req.Service)
+	if !ok {
+		return &RPCError{Code: errs.MethodNotFound, Message: "rpc health: unknown service " + req.Service}
+	}
+	resp.Status = status
+	return nil
+}
+
+// 流式调用：客户端发送的第一个数据块是json格式的HealthCheckRequest，
+// 服务端先返回当前状态，之后每次状态变化返回一个json格式的HealthCheckResponse，直到客户端结束
+func (h *Health) Watch(stream PipeStream) error {
+	chunk, err := stream.ReadChunk()
+	if err != nil {
+		return err
+	}
+	var req HealthCheckRequest
+	if err := json.Unmarshal(chunk, &req); err != nil {
+		return &RPCError{Code: errs.Validation, Message: "rpc health: invalid watch request: " + err.Error()}
+	}
+
+	// 客户端不再发送数据（结束或者断开）时停止推送
+	clientDone := make(chan struct{})
+	go func() {
+		defer close(clientDone)
+		for {
+			if _, err := stream.ReadChunk(); err != nil {
+				return
+			}
+		}
+	}()
+
+	last := HealthServingStatus(-1)
+	for {
+		status, ok, changed := h.status(req.Service)
+		if !ok {
+			status = HealthServiceUnknown
+		}
+		if status != last {
+			data, _ := json.Marshal(HealthCheckResponse{Status: status})
+			if err := stream.WriteChunk(data); err != nil {
+				return err
+			}
+			last = status
+		}
+		select {
+		case <-changed:
+		case <-clientDone:
+			return nil
+		}
+	}
+}
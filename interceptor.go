@@ -0,0 +1,114 @@
+package simpleRPC
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"simpleRPC/errs"
+	"time"
+)
+
+// 服务端拦截器拿到的调用信息
+type CallInfo struct {
+	ServiceMethod string
+	RemoteAddr string // 客户端地址，连接不是net.Conn时为空
+	Args interface{}
+	Tags map[string]string // 方法注释里的标签，没有的话为nil，见MethodTagParser
+}
+
+// 服务端拦截器，在服务方法调用前后做一些处理（日志、鉴权等），invoke调用下一个拦截器，最后调用服务方法
+// 不调用invoke的话服务方法不会执行，返回的错误会发送给客户端
+type ServerInterceptor func(ctx context.Context, info *CallInfo, invoke func() error) error
+
+// 日志接口，*log.Logger实现了这个接口
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// 添加拦截器，按添加的顺序执行，先添加的在外层
+func (server *Server) Use(interceptors ...ServerInterceptor) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.interceptors = append(server.interceptors, interceptors...)
+}
+
+// 依次经过所有拦截器之后调用invoke
+func (server *Server) intercept(req *request, invoke func() error) error {
+	server.mu.Lock()
+	interceptors := server.interceptors
+	server.mu.Unlock()
+	if len(interceptors) == 0 {
+		return invoke()
+	}
+
+	info := &CallInfo{ServiceMethod: req.h.ServiceMethod, RemoteAddr: req.remoteAddr, Args: req.argv.Interface(), Tags: req.mtype.Tags}
+	ctx := req.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	next := invoke
+	for i := len(interceptors) - 1; i >= 0; i -- {
+		interceptor, inner := interceptors[i], next
+		next = func() error {
+			return interceptor(ctx, info, inner)
+		}
+	}
+	return next()
+}
+
+// 按sampleRate的比例（0-1）记录请求日志：服务方法、参数的哈希、客户端地址、耗时和错误
+// 生产环境可以设置一个很小的比例，既能看到请求的情况，又不会产生太多日志
+func NewSamplingLoggingInterceptor(sampleRate float64, logger Logger) ServerInterceptor {
+	return func(ctx context.Context, info *CallInfo, invoke func() error) error {
+		if rand.Float64() >= sampleRate {
+			return invoke()
+		}
+		start := time.Now()
+		err := invoke()
+		logger.Printf("rpc server: call %s args %016x from %s took %s, correlation id %s, err: %v",
+			info.ServiceMethod, argsHash(info.Args), info.RemoteAddr, time.Since(start), CorrelationIDFromContext(ctx), err)
+		return err
+	}
+}
+
+// 按方法标签里的timeout（例如 timeout=5s）限制服务方法的执行时间，超时返回errs.Timeout错误
+// 和Option.HandleTimeout一样，超时之后服务方法还会继续执行完，只是结果不再返回给客户端
+func NewMethodTimeoutInterceptor() ServerInterceptor {
+	return func(ctx context.Context, info *CallInfo, invoke func() error) error {
+		timeout, err := time.ParseDuration(info.Tags["timeout"])
+		if err != nil || timeout <= 0 {
+			return invoke()
+		}
+		done := make(chan error, 1)
+		go func() {
+			done <- invoke()
+		}()
+		select {
+		case err := <-done:
+			return err
+		case <-time.After(timeout):
+			return &RPCError{Code: errs.Timeout, Message: fmt.Sprintf("rpc server: %s timeout expect within %s", info.ServiceMethod, timeout)}
+		}
+	}
+}
+
+// 方法标签里有auth（例如 auth=required、auth=admin）时调用authorize检查权限，不是none的话都需要检查
+// authorize可以根据info.Tags["auth"]判断需要的角色，返回错误时拒绝调用，客户端收到errs.PermissionDenied错误
+func NewRBACInterceptor(authorize func(ctx context.Context, info *CallInfo) error) ServerInterceptor {
+	return func(ctx context.Context, info *CallInfo, invoke func() error) error {
+		if auth := info.Tags["auth"]; auth != "" && auth != "none" {
+			if err := authorize(ctx, info); err != nil {
+				return &RPCError{Code: errs.PermissionDenied, Message: fmt.Sprintf("rpc server: %s permission denied: %v", info.ServiceMethod, err)}
+			}
+		}
+		return invoke()
+	}
+}
+
+// 参数的哈希，日志里不直接打印参数，避免泄露敏感数据
+func argsHash(args interface{}) uint64 {
+	h := fnv.New64a()
+	_, _ = fmt.Fprintf(h, "%#v", args)
+	return h.Sum64()
+}
@@ -0,0 +1,154 @@
+package simpleRPC
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"simpleRPC/codec"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 心跳请求的ServiceMethod，服务端收到之后直接回复，不查找服务
+const pingMethod = "__ping__"
+
+// 服务方法执行时间很长时，服务端定时发送的保活帧的ServiceMethod，客户端收到之后直接丢掉
+const keepAliveMethod = "__keepalive__"
+
+var errPingTimeout = errors.New("rpc client: ping timeout, connection may be dead")
+
+// 定时发送心跳，超过两个间隔没有收到回复就关闭连接，正在等待的调用会马上失败
+// 比TCP keepalive更快发现已经断开的连接
+func (client *Client) keepAlive(interval time.Duration) {
+	atomic.StoreInt64(&client.lastPong, time.Now().UnixNano())
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if !client.IsAvailable() {
+			return
+		}
+		if time.Since(time.Unix(0, atomic.LoadInt64(&client.lastPong))) > interval * 2 {
+			log.Println(errPingTimeout)
+			_ = client.currentCodec().Close()
+			return
+		}
+		if err := client.ping(); err != nil {
+			log.Println("rpc client: ping err:", err)
+			return
+		}
+	}
+}
+
+// 发送心跳，Seq为0，不会和普通调用冲突
+func (client *Client) ping() error {
+	client.sending.Lock()
+	defer client.sending.Unlock()
+	h := codec.Header{ServiceMethod: pingMethod}
+	return client.cc.Write(&h, invalidRequest)
+}
+
+// 发送一个心跳并等待服务端回复，服务端不查找服务，所以不会受SetStrictServiceCheck影响
+// 可以用来检查连接是否可用，ctx结束之前没有收到回复返回ctx.Err()
+func (client *Client) Ping(ctx context.Context) error {
+	client.mu.Lock()
+	if client.closing || client.shutdown {
+		client.mu.Unlock()
+		return ErrShutdown
+	}
+	if client.pong == nil {
+		client.pong = make(chan struct{})
+	}
+	pong := client.pong
+	client.mu.Unlock()
+
+	if err := client.ping(); err != nil {
+		return err
+	}
+	select {
+	case <-pong:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// 保活帧的最小间隔，避免每个慢请求都频繁发送
+const minKeepAliveInterval = 100 * time.Millisecond
+
+// 服务方法执行超过d之后，每隔d给客户端发送一个保活帧，0为不发送，小于minKeepAliveInterval的按minKeepAliveInterval
+// 客户端使用CallWithIdleTimeout时，收到保活帧会重新计时，执行时间很长的服务方法不会被当成超时
+func (server *Server) SetKeepAliveInterval(d time.Duration) {
+	if d > 0 && d < minKeepAliveInterval {
+		d = minKeepAliveInterval
+	}
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.keepAliveInterval = d
+}
+
+func (server *Server) keepAliveAckInterval() time.Duration {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return server.keepAliveInterval
+}
+
+// 服务方法执行超过interval之后，每隔interval给客户端发送一个保活帧，防止连接因为长时间没有数据被中间设备断开
+// 返回停止发送的方法，可以调用多次，interval为0时不发送
+func (server *Server) startKeepAlive(cc codec.Codec, h *codec.Header, interval time.Duration, sending *sync.Mutex) (stop func()) {
+	if interval <= 0 {
+		return func() {}
+	}
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				kh := &codec.Header{ServiceMethod: keepAliveMethod, Seq: h.Seq}
+				server.sendResponse(cc, kh, invalidRequest, sending)
+			}
+		}
+	}()
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
+
+var ErrIdleTimeout = errors.New("rpc client: call idle timeout")
+
+// 和CallWithTimeout一样，另外idle时间内没有收到响应或者服务端的保活帧（见Server.SetKeepAliveInterval）时调用失败
+// 每收到一个保活帧重新计时，服务方法一直在执行的话不会超时，适合执行时间不确定的长任务；ctx仍然是整个调用的截止时间
+func (client *Client) CallWithIdleTimeout(ctx context.Context, serviceMethod string, args, reply interface{}, idle time.Duration) error {
+	call := &Call{
+		ServiceMethod: serviceMethod,
+		Args: args,
+		Reply: reply,
+		Done: make(chan *Call, 1),
+		ctx: ctx,
+		keepAlive: make(chan struct{}, 1),
+	}
+	client.send(call)
+	timer := time.NewTimer(idle)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			client.removeCall(call.Seq)
+			return fmt.Errorf("rpc client: call failed: %w", ctx.Err())
+		case <-timer.C:
+			client.removeCall(call.Seq)
+			return ErrIdleTimeout
+		case <-call.keepAlive:
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(idle)
+		case call := <-call.Done:
+			return call.Error
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package simpleRPC
+
+import (
+	"errors"
+	"net"
+)
+
+// 服务端的启动阶段，Prepare/Start使用
+const (
+	stateNew int32 = iota // 还没有调用Prepare
+	statePrepared // 已经绑定了listener，还没有开始Accept
+	stateRunning // 已经开始Accept
+)
+
+// 两阶段启动的第一步：记录已经绑定好的listener，做Accept之前的初始化，不接受连接
+// 地址绑定之后就可以上报给注册中心，预热（加载数据、填充缓存等）完成之后再调用Start，
+// 这期间客户端的连接在内核的队列里等待，不会被拒绝。可以多次调用，添加多个listener
+func (server *Server) Prepare(lis net.Listener) error {
+	if lis == nil {
+		return errors.New("rpc server: prepare nil listener")
+	}
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if server.state == stateRunning {
+		return errors.New("rpc server: prepare after start")
+	}
+	server.state = statePrepared
+	server.prepared = append(server.prepared, lis)
+	// Start之前Shutdown也要关闭listener
+	server.listeners[lis] = struct{}{}
+	// 负载接口的CPU使用率需要两次采样，提前采样一次
+	server.cpu.sample()
+	return nil
+}
+
+// 两阶段启动的第二步：在Prepare的所有listener上开始Accept，不阻塞，使用Shutdown停止
+func (server *Server) Start() error {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	switch server.state {
+	case stateNew:
+		return errors.New("rpc server: start before prepare")
+	case stateRunning:
+		return errors.New("rpc server: already started")
+	}
+	server.state = stateRunning
+	for _, lis := range server.prepared {
+		go server.Accept(lis)
+	}
+	server.prepared = nil
+	return nil
+}
@@ -0,0 +1,43 @@
+package simpleRPC
+
+import (
+	"sync/atomic"
+)
+
+// 服务级别的并发限制
+type serviceLimit struct {
+	sem chan struct{}
+	inUse int32 // 正在处理的请求数
+}
+
+// 限制服务name同时处理的请求数，不同的服务可以设置不同的并发数，例如计算密集的服务设置得小一些
+// maxConcurrent <= 0 时取消限制，超过限制的请求会排队等待
+func (server *Server) LimitService(name string, maxConcurrent int) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if maxConcurrent <= 0 {
+		delete(server.limits, name)
+		return
+	}
+	if server.limits == nil {
+		server.limits = make(map[string]*serviceLimit)
+	}
+	server.limits[name] = &serviceLimit{sem: make(chan struct{}, maxConcurrent)}
+}
+
+// 获取服务的并发名额，返回释放名额的方法
+func (server *Server) acquireService(name string) (release func()) {
+	server.mu.Lock()
+	l := server.limits[name]
+	server.mu.Unlock()
+	if l == nil {
+		return func() {}
+	}
+
+	l.sem <- struct{}{}
+	atomic.AddInt32(&l.inUse, 1)
+	return func() {
+		atomic.AddInt32(&l.inUse, -1)
+		<-l.sem
+	}
+}
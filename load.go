@@ -0,0 +1,131 @@
+package simpleRPC
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"runtime"
+	"simpleRPC/codec"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 服务端当前的负载，给外部的负载均衡器（HAProxy、Nginx等）动态调整权重
+type ServerLoad struct {
+	InFlight int64 `json:"in_flight"` // 正在处理的请求数
+	PendingQueue int64 `json:"pending_queue"` // 等待服务并发名额的请求数（见LimitService）
+	CPUPercent float64 `json:"cpu_percent"` // 距离上次采样进程使用的CPU比例，0-1，不支持的平台为0
+	MemoryMB uint64 `json:"memory_mb"` // Go运行时从系统申请的内存
+}
+
+// 响应头Metadata里服务端负载的key，值是正在处理和等待处理的请求数
+const ServerLoadKey = "x-server-load"
+
+// 在每个响应头里带上服务端当前的负载（InFlight + PendingQueue），客户端可以据此选择负载低的服务（见xclient.HealthAwareSelect）
+// 只使用计数器，不采样CPU和内存，开销很小
+func (server *Server) ReportLoadInResponses(enable bool) {
+	var v int32
+	if enable {
+		v = 1
+	}
+	atomic.StoreInt32(&server.reportLoad, v)
+}
+
+func (server *Server) setLoadHeader(h *codec.Header) {
+	load := atomic.LoadInt64(&server.inFlight) + atomic.LoadInt64(&server.waiting)
+	// 复制一份，请求头的Metadata可能还在被服务方法读取
+	meta := make(map[string]string, len(h.Metadata) + 1)
+	for k, v := range h.Metadata {
+		meta[k] = v
+	}
+	meta[ServerLoadKey] = strconv.FormatInt(load, 10)
+	h.Metadata = meta
+}
+
+// 记录响应头里服务端报告的负载
+func (client *Client) recordServerLoad(h *codec.Header) {
+	v, ok := h.Metadata[ServerLoadKey]
+	if !ok {
+		return
+	}
+	if load, err := strconv.ParseFloat(v, 64); err == nil {
+		client.serverLoad.Store(serverLoadSample{load: load, at: time.Now()})
+	}
+}
+
+// 服务端报告的负载和收到的时间
+type serverLoadSample struct {
+	load float64
+	at time.Time
+}
+
+// 返回服务端最近一次在响应头里报告的负载，服务端没有开启ReportLoadInResponses时ok为false
+func (client *Client) ServerLoad() (load float64, ok bool) {
+	s, ok := client.serverLoad.Load().(serverLoadSample)
+	return s.load, ok
+}
+
+// 和ServerLoad一样，但是只返回t之后收到的负载，用来判断一次调用的响应有没有带上负载
+func (client *Client) ServerLoadSince(t time.Time) (load float64, ok bool) {
+	s, ok := client.serverLoad.Load().(serverLoadSample)
+	if !ok || s.at.Before(t) {
+		return 0, false
+	}
+	return s.load, true
+}
+
+// 上一次采样的CPU时间，用来计算cpu_percent
+type cpuSampler struct {
+	mu sync.Mutex
+	wall time.Time
+	cpu time.Duration
+}
+
+// 返回距离上一次调用进程使用的CPU比例
+func (s *cpuSampler) sample() float64 {
+	cpu, ok := processCPUTime()
+	if !ok {
+		return 0
+	}
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var percent float64
+	if elapsed := now.Sub(s.wall); !s.wall.IsZero() && elapsed > 0 {
+		percent = float64(cpu - s.cpu) / float64(elapsed) / float64(runtime.NumCPU())
+	}
+	s.wall, s.cpu = now, cpu
+	return percent
+}
+
+// 返回服务端当前的负载
+func (server *Server) Load() ServerLoad {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return ServerLoad{
+		InFlight: atomic.LoadInt64(&server.inFlight),
+		PendingQueue: atomic.LoadInt64(&server.waiting),
+		CPUPercent: server.cpu.sample(),
+		MemoryMB: m.Sys >> 20,
+	}
+}
+
+// 注册一个http接口，GET返回json格式的服务端负载
+func (server *Server) HandleLoadHTTP(path string) {
+	server.cpu.sample()
+	http.Handle(path, http.HandlerFunc(server.serveLoad))
+	log.Println("rpc server load path:", path)
+}
+
+func (server *Server) serveLoad(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(server.Load()); err != nil {
+		log.Println("rpc server: encode load err:", err)
+	}
+}
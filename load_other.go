@@ -0,0 +1,17 @@
+// +build !windows
+
+package simpleRPC
+
+import (
+	"syscall"
+	"time"
+)
+
+// 进程使用的CPU时间（用户态和内核态）
+func processCPUTime() (time.Duration, bool) {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		return 0, false
+	}
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano()), true
+}
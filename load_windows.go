@@ -0,0 +1,8 @@
+package simpleRPC
+
+import "time"
+
+// windows下暂不支持统计CPU时间
+func processCPUTime() (time.Duration, bool) {
+	return 0, false
+}
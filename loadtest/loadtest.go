@@ -0,0 +1,124 @@
+package loadtest
+
+import (
+	"context"
+	"simpleRPC"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 压测工具，不需要额外的工具就可以压测自己实现的服务
+// 每个worker使用一个单独的连接，循环调用Method，直到Duration结束
+type Harness struct {
+	Workers int // 并发数，0为1
+	Duration time.Duration // 压测时间
+	Method string // 调用的服务方法，例如 Foo.Sum
+	ArgFactory func() interface{} // 每次调用的参数，为nil时参数是nil
+	ReplyFactory func() interface{} // 每次调用的返回值，必须返回指针
+	Option *simpleRPC.Option // 连接使用的配置，为nil时使用默认配置
+}
+
+// 压测结果
+type Report struct {
+	TPS float64 // 每秒完成的调用数（包括失败的调用）
+	P50, P95, P99 time.Duration // 调用耗时的分位数
+	Errors int // 失败的调用数，连接失败也算一次
+}
+
+// 对addr发起压测，addr的格式可以是 host:port（tcp）或者 protocol@addr
+func (h *Harness) Run(addr string) Report {
+	workers := h.Workers
+	if workers <= 0 {
+		workers = 1
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), h.Duration)
+	defer cancel()
+
+	var (
+		mu sync.Mutex
+		latencies []time.Duration
+		errors int
+		wg sync.WaitGroup
+	)
+	start := time.Now()
+	for i := 0; i < workers; i ++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			local, failed := h.work(ctx, addr)
+			mu.Lock()
+			latencies = append(latencies, local...)
+			errors += failed
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	report := Report{Errors: errors}
+	if elapsed > 0 {
+		report.TPS = float64(len(latencies)) / elapsed.Seconds()
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	report.P50 = percentile(latencies, 0.50)
+	report.P95 = percentile(latencies, 0.95)
+	report.P99 = percentile(latencies, 0.99)
+	return report
+}
+
+// 一个worker的压测循环，返回每次调用的耗时和失败的次数
+func (h *Harness) work(ctx context.Context, addr string) ([]time.Duration, int) {
+	client, err := h.dial(addr)
+	if err != nil {
+		return nil, 1
+	}
+	defer func() { _ = client.Close() }()
+
+	var latencies []time.Duration
+	failed := 0
+	for ctx.Err() == nil {
+		var args, reply interface{}
+		if h.ArgFactory != nil {
+			args = h.ArgFactory()
+		}
+		if h.ReplyFactory != nil {
+			reply = h.ReplyFactory()
+		}
+		begin := time.Now()
+		err := client.CallWithTimeout(ctx, h.Method, args, reply)
+		if err != nil && ctx.Err() != nil {
+			// 压测结束时正在进行的调用不计入结果
+			break
+		}
+		latencies = append(latencies, time.Since(begin))
+		if err != nil {
+			failed ++
+		}
+	}
+	return latencies, failed
+}
+
+func (h *Harness) dial(addr string) (*simpleRPC.Client, error) {
+	var opts []*simpleRPC.Option
+	if h.Option != nil {
+		opts = append(opts, h.Option)
+	}
+	if strings.Contains(addr, "@") {
+		return simpleRPC.XDial(addr, opts...)
+	}
+	return simpleRPC.Dial("tcp", addr, opts...)
+}
+
+// sorted是排好序的耗时，返回p分位数，没有数据时返回0
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(float64(len(sorted)) * p)
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
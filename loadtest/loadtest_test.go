@@ -0,0 +1,44 @@
+package loadtest
+
+import (
+	"errors"
+	"simpleRPC/testutil"
+	"testing"
+	"time"
+)
+
+type Counter int
+
+func (c *Counter) Incr(n int, reply *int) error {
+	if n < 0 {
+		return errors.New("negative")
+	}
+	*reply = n + 1
+	return nil
+}
+
+func TestHarness_Run(t *testing.T) {
+	var c Counter
+	addr, _ := testutil.StartTestServer(t, &c)
+
+	h := &Harness{
+		Workers: 4,
+		Duration: time.Millisecond * 200,
+		Method: "Counter.Incr",
+		ArgFactory: func() interface{} { return 1 },
+		ReplyFactory: func() interface{} { return new(int) },
+	}
+	report := h.Run(addr)
+	if report.TPS <= 0 || report.Errors != 0 {
+		t.Fatalf("expect successful calls, but got %+v", report)
+	}
+	if report.P50 <= 0 || report.P50 > report.P95 || report.P95 > report.P99 {
+		t.Fatalf("expect ordered percentiles, but got %+v", report)
+	}
+
+	h.ArgFactory = func() interface{} { return -1 }
+	report = h.Run("tcp@" + addr)
+	if report.Errors == 0 {
+		t.Fatalf("expect errors to be counted, but got %+v", report)
+	}
+}
@@ -295,7 +295,7 @@ func main() {
 
 	// 注册中心
 	log.SetFlags(0)
-	registryUrl := "http://localhost:9999/_simplerpc_/registry"
+	registryUrl := "http://localhost:9999/v1/_simplerpc_/registry"
 	// var wg sync.WaitGroup
 	wg := sync.WaitGroup{}
 	wg.Add(1)
@@ -0,0 +1,83 @@
+package simpleRPC
+
+import (
+	"go/doc"
+	"go/parser"
+	"go/token"
+	"regexp"
+	"strings"
+)
+
+// 服务方法注释里的标签，例如：
+// // Sum 求和
+// // simplerpc:"timeout=5s,idempotent=true,auth=required"
+// func (f *Foo) Sum(args Args, reply *int) error
+var methodTagPattern = regexp.MustCompile(`simplerpc:"([^"]*)"`)
+
+// 从源码的注释里解析服务方法的标签，运行时拿不到注释，所以需要读取源码目录
+type MethodTagParser struct {
+	tags map[string]map[string]string // key为 Type.Method
+}
+
+func NewMethodTagParser() *MethodTagParser {
+	return &MethodTagParser{tags: make(map[string]map[string]string)}
+}
+
+// 解析dir目录下所有go文件里的方法注释
+func (p *MethodTagParser) ParseDir(dir string) error {
+	fset := token.NewFileSet()
+	pkgs, err := parser.ParseDir(fset, dir, nil, parser.ParseComments)
+	if err != nil {
+		return err
+	}
+	for _, pkg := range pkgs {
+		d := doc.New(pkg, dir, doc.AllDecls | doc.AllMethods)
+		for _, t := range d.Types {
+			for _, m := range t.Methods {
+				if tags := parseMethodTags(m.Doc); tags != nil {
+					p.tags[t.Name + "." + m.Name] = tags
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// 返回服务方法的标签，没有的话返回nil
+func (p *MethodTagParser) Tags(serviceMethod string) map[string]string {
+	return p.tags[serviceMethod]
+}
+
+// 解析注释里的 simplerpc:"k1=v1,k2" 标签，只写了key的值为true
+func parseMethodTags(comment string) map[string]string {
+	match := methodTagPattern.FindStringSubmatch(comment)
+	if match == nil {
+		return nil
+	}
+	tags := make(map[string]string)
+	for _, item := range strings.Split(match[1], ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) == 1 {
+			tags[kv[0]] = "true"
+			continue
+		}
+		tags[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return tags
+}
+
+// 把解析出来的标签设置到已经注册的服务方法上（methodType.Tags），拦截器可以通过CallInfo.Tags拿到
+// 需要在Register之后、开始处理请求之前调用
+func (server *Server) ApplyMethodTags(p *MethodTagParser) {
+	server.serviceMap.Range(func(_, svci interface{}) bool {
+		svc := svci.(*service)
+		for name, m := range svc.method {
+			m.Tags = p.Tags(svc.name + "." + name)
+		}
+		return true
+	})
+}
@@ -0,0 +1,48 @@
+// +build linux darwin
+
+package simpleRPC
+
+import (
+	"net"
+	"syscall"
+	"testing"
+)
+
+func tcpNoDelay(t *testing.T, conn net.Conn) bool {
+	raw, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v int
+	_ = raw.Control(func(fd uintptr) {
+		v, err = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_NODELAY)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v != 0
+}
+
+func TestOption_EnableNagle(t *testing.T) {
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = l.Close() }()
+	go NewServer().Accept(l)
+
+	// 自定义Option没有设置EnableNagle时，和DefaultOption一样禁用Nagle算法
+	for _, tc := range []struct {
+		opt *Option
+		noDelay bool
+	}{
+		{&Option{}, true},
+		{&Option{EnableNagle: true}, false},
+	} {
+		opt, _ := parseOptions(tc.opt)
+		conn, _ := net.Dial("tcp", l.Addr().String())
+		client, err := newClientTimeout(NewClient, conn, opt)
+		if err != nil {
+			t.Fatal("failed to create client:", err)
+		}
+		_assert(tcpNoDelay(t, conn) == tc.noDelay, "expect TCP_NODELAY %v for %+v", tc.noDelay, *tc.opt)
+		_ = client.Close()
+	}
+}
@@ -0,0 +1,197 @@
+package simpleRPC
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrPoolExhausted = errors.New("rpc server: outgoing pool exhausted")
+
+var ErrPoolClosed = errors.New("rpc server: outgoing pool is closed")
+
+// 服务端反向调用客户端时使用的连接池，key为客户端的服务地址
+// 地址的格式可以是 host:port（tcp）或者 protocol@addr
+// Acquire借出一个连接，用完之后需要Release归还；空闲超过IdleTimeout的连接在下次Acquire/Release时关闭
+type OutgoingClientPool struct {
+	mu sync.Mutex
+	maxSize int // 每个地址最多的连接数（包括借出的），0为不限制
+	idleTimeout time.Duration // 空闲连接的最长保留时间，0为一直保留
+	opt *Option // 建立连接使用的配置，为nil时使用默认配置
+	idle map[string][]idleClient // 空闲的连接，最近归还的在最后
+	inUse map[*Client]string // 借出的连接和对应的地址
+	counts map[string]int // 每个地址的连接数
+	closed bool
+}
+
+type idleClient struct {
+	client *Client
+	since time.Time // 归还的时间
+}
+
+func newOutgoingClientPool() *OutgoingClientPool {
+	return &OutgoingClientPool{
+		idle: make(map[string][]idleClient),
+		inUse: make(map[*Client]string),
+		counts: make(map[string]int),
+	}
+}
+
+// 返回服务端的反向调用连接池，第一次调用时创建
+func (server *Server) OutgoingPool() *OutgoingClientPool {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if server.outgoing == nil {
+		server.outgoing = newOutgoingClientPool()
+	}
+	return server.outgoing
+}
+
+// 设置每个地址最多的连接数，<= 0 为不限制
+func (p *OutgoingClientPool) SetMaxSize(n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.maxSize = n
+}
+
+// 设置空闲连接的最长保留时间，<= 0 为一直保留
+func (p *OutgoingClientPool) SetIdleTimeout(d time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.idleTimeout = d
+}
+
+// 设置建立连接使用的配置，只影响之后新建的连接
+func (p *OutgoingClientPool) SetOption(opt *Option) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.opt = opt
+}
+
+// 借出一个到addr的连接，优先使用空闲的连接，没有时新建
+// 连接数达到上限时返回ErrPoolExhausted
+func (p *OutgoingClientPool) Acquire(addr string) (*Client, error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, ErrPoolClosed
+	}
+	p.evictIdleLocked()
+	clients := p.idle[addr]
+	for len(clients) > 0 {
+		ic := clients[len(clients) - 1]
+		clients = clients[:len(clients) - 1]
+		p.idle[addr] = clients
+		if ic.client.IsAvailable() {
+			p.inUse[ic.client] = addr
+			p.mu.Unlock()
+			return ic.client, nil
+		}
+		p.counts[addr] --
+		_ = ic.client.Close()
+	}
+	if p.maxSize > 0 && p.counts[addr] >= p.maxSize {
+		p.mu.Unlock()
+		return nil, ErrPoolExhausted
+	}
+	// 先占一个名额，建立连接时不持有锁
+	p.counts[addr] ++
+	opt := p.opt
+	p.mu.Unlock()
+
+	client, err := dialOutgoing(addr, opt)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err != nil {
+		p.counts[addr] --
+		return nil, err
+	}
+	if p.closed {
+		p.counts[addr] --
+		_ = client.Close()
+		return nil, ErrPoolClosed
+	}
+	p.inUse[client] = addr
+	return client, nil
+}
+
+// 归还借出的连接，不可用的连接直接关闭
+func (p *OutgoingClientPool) Release(client *Client) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	addr, ok := p.inUse[client]
+	if !ok {
+		return
+	}
+	delete(p.inUse, client)
+	if p.closed || !client.IsAvailable() {
+		p.counts[addr] --
+		_ = client.Close()
+		return
+	}
+	p.idle[addr] = append(p.idle[addr], idleClient{client: client, since: time.Now()})
+	p.evictIdleLocked()
+}
+
+// 关闭所有空闲的连接，借出的连接在归还时关闭，之后Acquire返回ErrPoolClosed
+func (p *OutgoingClientPool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	var err error
+	for addr, clients := range p.idle {
+		for _, ic := range clients {
+			if e := ic.client.Close(); e != nil && err == nil {
+				err = e
+			}
+		}
+		p.counts[addr] -= len(clients)
+		delete(p.idle, addr)
+	}
+	return err
+}
+
+// 返回addr的空闲连接数和借出的连接数
+func (p *OutgoingClientPool) Stats(addr string) (idle, inUse int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	idle = len(p.idle[addr])
+	return idle, p.counts[addr] - idle
+}
+
+// 关闭空闲超时的连接，需要持有p.mu
+func (p *OutgoingClientPool) evictIdleLocked() {
+	if p.idleTimeout <= 0 {
+		return
+	}
+	deadline := time.Now().Add(-p.idleTimeout)
+	for addr, clients := range p.idle {
+		// 越早归还的越靠前，找到第一个没有超时的
+		i := 0
+		for i < len(clients) && clients[i].since.Before(deadline) {
+			_ = clients[i].client.Close()
+			i ++
+		}
+		if i == 0 {
+			continue
+		}
+		p.counts[addr] -= i
+		if i == len(clients) {
+			delete(p.idle, addr)
+		} else {
+			p.idle[addr] = clients[i:]
+		}
+	}
+}
+
+func dialOutgoing(addr string, opt *Option) (*Client, error) {
+	var opts []*Option
+	if opt != nil {
+		opts = append(opts, opt)
+	}
+	if strings.Contains(addr, "@") {
+		return XDial(addr, opts...)
+	}
+	return Dial("tcp", addr, opts...)
+}
@@ -0,0 +1,131 @@
+// +build simplerpc_pprof
+
+package simpleRPC
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultPprofPath = "/debug/pprof/"
+
+// profile和trace最长的采样时间，防止一个请求一直占着CPU profile
+const maxPprofSeconds = 120
+
+// 挂载 /debug/pprof/，没有使用net/http/pprof，因为它在init的时候就会注册到http.DefaultServeMux
+func handlePprof() {
+	http.HandleFunc(defaultPprofPath, servePprof)
+	log.Println("rpc server pprof path:", defaultPprofPath)
+}
+
+// 请求里的采样秒数，没有的话使用def，最长maxPprofSeconds
+func pprofSeconds(req *http.Request, def int) int {
+	seconds, _ := strconv.Atoi(req.FormValue("seconds"))
+	if seconds <= 0 {
+		seconds = def
+	}
+	if seconds > maxPprofSeconds {
+		seconds = maxPprofSeconds
+	}
+	return seconds
+}
+
+// /debug/pprof/ 列出所有的profile
+// /debug/pprof/profile?seconds=30 CPU profile
+// /debug/pprof/trace?seconds=1 执行跟踪
+// /debug/pprof/symbol 把程序计数器转换成函数名，go tool pprof使用
+// /debug/pprof/cmdline 命令行参数，用\x00分隔
+// /debug/pprof/<name>?debug=1 heap、goroutine等profile
+func servePprof(w http.ResponseWriter, req *http.Request) {
+	name := strings.TrimPrefix(req.URL.Path, defaultPprofPath)
+	debug, _ := strconv.Atoi(req.FormValue("debug"))
+
+	switch name {
+	case "":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, p := range pprof.Profiles() {
+			_, _ = fmt.Fprintf(w, "%d\t%s\n", p.Count(), p.Name())
+		}
+		_, _ = fmt.Fprintln(w, "profile")
+		_, _ = fmt.Fprintln(w, "trace")
+		_, _ = fmt.Fprintln(w, "symbol")
+		_, _ = fmt.Fprintln(w, "cmdline")
+	case "profile":
+		seconds := pprofSeconds(req, 30)
+		w.Header().Set("Content-Type", "application/octet-stream")
+		if err := pprof.StartCPUProfile(w); err != nil {
+			http.Error(w, "could not enable CPU profiling: " + err.Error(), http.StatusInternalServerError)
+			return
+		}
+		time.Sleep(time.Duration(seconds) * time.Second)
+		pprof.StopCPUProfile()
+	case "trace":
+		seconds := pprofSeconds(req, 1)
+		w.Header().Set("Content-Type", "application/octet-stream")
+		if err := trace.Start(w); err != nil {
+			http.Error(w, "could not enable tracing: " + err.Error(), http.StatusInternalServerError)
+			return
+		}
+		time.Sleep(time.Duration(seconds) * time.Second)
+		trace.Stop()
+	case "symbol":
+		serveSymbol(w, req)
+	case "cmdline":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, _ = fmt.Fprint(w, strings.Join(os.Args, "\x00"))
+	default:
+		p := pprof.Lookup(name)
+		if p == nil {
+			http.Error(w, "unknown profile " + name, http.StatusNotFound)
+			return
+		}
+		if debug > 0 {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		} else {
+			w.Header().Set("Content-Type", "application/octet-stream")
+		}
+		_ = p.WriteTo(w, debug)
+	}
+}
+
+// 和net/http/pprof的Symbol一样：GET返回num_symbols，POST的body（或者GET的query）是用+分隔的十六进制地址，每行返回一个地址和函数名
+func serveSymbol(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	var buf bytes.Buffer
+	// 只要有符号就返回非0，具体的数量go tool pprof不关心
+	_, _ = fmt.Fprintf(&buf, "num_symbols: 1\n")
+
+	var r *bufio.Reader
+	if req.Method == "POST" {
+		r = bufio.NewReader(io.LimitReader(req.Body, 1 << 20))
+	} else {
+		r = bufio.NewReader(strings.NewReader(req.URL.RawQuery))
+	}
+	for {
+		word, err := r.ReadSlice('+')
+		if err == nil {
+			word = word[:len(word) - 1]
+		}
+		pc, _ := strconv.ParseUint(string(word), 0, 64)
+		if pc != 0 {
+			if f := runtime.FuncForPC(uintptr(pc)); f != nil {
+				_, _ = fmt.Fprintf(&buf, "%#x %s\n", pc, f.Name())
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	_, _ = w.Write(buf.Bytes())
+}
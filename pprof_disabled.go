@@ -0,0 +1,10 @@
+// +build !simplerpc_pprof
+
+package simpleRPC
+
+import "log"
+
+// 没有使用 -tags simplerpc_pprof 编译的时候不包含pprof
+func handlePprof() {
+	log.Println("rpc server: pprof is not built in, rebuild with -tags simplerpc_pprof")
+}
@@ -0,0 +1,35 @@
+// +build simplerpc_pprof
+
+package simpleRPC
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestServePprof(t *testing.T) {
+	// 采样时间有上限
+	req := httptest.NewRequest("GET", defaultPprofPath + "profile?seconds=100000", nil)
+	_assert(pprofSeconds(req, 30) == maxPprofSeconds, "expect seconds capped at %d", maxPprofSeconds)
+	req = httptest.NewRequest("GET", defaultPprofPath + "profile", nil)
+	_assert(pprofSeconds(req, 30) == 30, "expect default seconds")
+
+	w := httptest.NewRecorder()
+	servePprof(w, httptest.NewRequest("GET", defaultPprofPath, nil))
+	for _, name := range []string{"profile", "trace", "symbol", "cmdline", "goroutine"} {
+		_assert(strings.Contains(w.Body.String(), name), "expect %s in the index: %s", name, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	servePprof(w, httptest.NewRequest("GET", defaultPprofPath + "cmdline", nil))
+	_assert(w.Body.String() == strings.Join(os.Args, "\x00"), "unexpected cmdline %q", w.Body.String())
+
+	pc := reflect.ValueOf(TestServePprof).Pointer()
+	w = httptest.NewRecorder()
+	servePprof(w, httptest.NewRequest("POST", defaultPprofPath + "symbol", strings.NewReader(fmt.Sprintf("%#x", pc))))
+	_assert(strings.Contains(w.Body.String(), "TestServePprof"), "expect symbol resolved: %s", w.Body.String())
+}
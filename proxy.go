@@ -0,0 +1,176 @@
+package simpleRPC
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"simpleRPC/codec"
+	"simpleRPC/errs"
+	"sync"
+	"time"
+)
+
+// 代理：把请求原样转发到后端服务，再把后端的响应返回给客户端
+// 代理不知道参数和返回值的类型，所以只支持Json编解码器和自描述编解码器，连接后端使用和客户端一样的编解码器
+// 自描述编解码器需要用代理Server的RegisterTypes注册转发的参数和返回值类型
+type proxy struct {
+	backend string // 后端地址，格式 protocol@addr
+	opt     Option
+	types   *codec.TypeRegistry // 代理Server的类型注册表，连接后端的自描述编解码器也使用它
+	mu      sync.Mutex
+	clients map[codec.Type]*Client // 连接后端的客户端，key为编解码器，断开之后下一次转发时重新连接
+}
+
+// 创建一个代理服务端，所有请求都转发到backend（格式 protocol@addr，例如 tcp@127.0.0.1:9999），可以用作API网关
+// opt是连接后端使用的配置，编解码器和客户端连接代理使用的一样，opt.ProxyHeaderTransform可以在转发前修改请求头
+func NewProxyServer(backend string, opt *Option) *Server {
+	server := NewServer()
+	p := &proxy{backend: backend, types: server.types, clients: make(map[codec.Type]*Client)}
+	if opt != nil {
+		p.opt = *opt
+	} else {
+		p.opt = *DefaultOption
+	}
+	server.proxy = p
+	return server
+}
+
+func (p *proxy) getClient(codecType codec.Type) (*Client, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if client := p.clients[codecType]; client != nil && client.IsAvailable() {
+		return client, nil
+	}
+	opt := p.opt
+	opt.CodecType = codecType
+	client, err := XDial(p.backend, &opt)
+	if err != nil {
+		return nil, err
+	}
+	// 还没有发送请求，接收协程不会读取body
+	setTypeRegistry(client.cc, p.types)
+	p.clients[codecType] = client
+	return client, nil
+}
+
+// 代理只能转发Json和自描述编码的请求，其他编解码器在交换协议时拒绝
+func (p *proxy) checkCodec(codecType codec.Type) error {
+	if codecType != codec.JsonType && codecType != codec.SelfDescribingType {
+		return fmt.Errorf("rpc proxy: codec %s not supported, the proxy only forwards %s and %s", codecType, codec.JsonType, codec.SelfDescribingType)
+	}
+	return nil
+}
+
+// 不解码的body，Json编解码器是json.RawMessage，自描述编解码器根据类型名创建的实例
+func newProxyBody(codecType codec.Type) interface{} {
+	if codecType == codec.SelfDescribingType {
+		return new(interface{})
+	}
+	return new(json.RawMessage)
+}
+
+func proxyBodyValue(body interface{}) interface{} {
+	if v, ok := body.(*interface{}); ok {
+		return *v
+	}
+	return *body.(*json.RawMessage)
+}
+
+// 读取客户端的请求，每个请求在一个新的协程里转发，opt是和客户端交换的配置
+func (p *proxy) serve(server *Server, cc codec.Codec, sending *sync.Mutex, wg *sync.WaitGroup, opt *Option) {
+	for {
+		var h codec.Header
+		if err := cc.ReadHeader(&h); err != nil {
+			return
+		}
+		body := newProxyBody(opt.CodecType)
+		if err := cc.ReadBody(body); err != nil {
+			if !errors.Is(err, codec.ErrUnregisteredType) {
+				log.Println("rpc proxy: read body err:", err)
+				return
+			}
+			// body已经丢掉了，返回错误，连接继续使用
+			if !h.FireAndForget {
+				server.setHeaderError(&h, err)
+				server.sendResponse(cc, &h, invalidRequest, sending)
+			}
+			continue
+		}
+		if h.ServiceMethod == pingMethod {
+			server.sendResponse(cc, &h, invalidRequest, sending)
+			continue
+		}
+
+		wg.Add(1)
+		go func(h codec.Header, body interface{}) {
+			defer wg.Done()
+			reply, err := p.forward(&h, proxyBodyValue(body), opt.CodecType, opt.HandleTimeout)
+			if h.FireAndForget {
+				if err != nil {
+					log.Printf("rpc proxy: fire and forget call %s err: %v", h.ServiceMethod, err)
+				}
+				return
+			}
+			if err != nil {
+				server.setHeaderError(&h, err)
+				if rpcErr, ok := err.(*RPCError); ok {
+					h.ErrorDetail = rpcErr.Stack
+				}
+				server.sendResponse(cc, &h, invalidRequest, sending)
+				return
+			}
+			server.sendResponse(cc, &h, reply, sending)
+		}(h, body)
+	}
+}
+
+// 转发一个请求到后端，返回后端的响应
+// 客户端的截止时间和timeout里早的那个到了之后不再等待后端，返回超时错误
+func (p *proxy) forward(h *codec.Header, body interface{}, codecType codec.Type, timeout time.Duration) (interface{}, error) {
+	client, err := p.getClient(codecType)
+	if err != nil {
+		return nil, err
+	}
+	ctx := context.Background()
+	deadline := requestDeadline(h, time.Now(), timeout)
+	if !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+	reply := newProxyBody(codecType)
+	call := &Call{
+		ServiceMethod: h.ServiceMethod,
+		Args:          body,
+		Reply:         reply,
+		Done:          make(chan *Call, 1),
+		ctx:           ctx,
+		fireAndForget: h.FireAndForget,
+	}
+	// 转发客户端的链路追踪信息和附加信息，截止时间由ctx带上，已经包括了代理的HandleTimeout
+	call.headerHook = func(out *codec.Header) {
+		out.TraceParent, out.TraceState, out.Priority = h.TraceParent, h.TraceState, h.Priority
+		for k, v := range h.Metadata {
+			if out.Metadata == nil {
+				out.Metadata = make(map[string]string)
+			}
+			out.Metadata[k] = v
+		}
+		if p.opt.ProxyHeaderTransform != nil {
+			p.opt.ProxyHeaderTransform(out)
+		}
+	}
+	client.send(call)
+	select {
+	case <-ctx.Done():
+		client.removeCall(call.Seq)
+		return nil, &RPCError{Code: errs.Timeout, Message: "rpc proxy: forward " + h.ServiceMethod + " failed: " + ctx.Err().Error()}
+	case <-call.Done:
+		if call.Error != nil {
+			return nil, call.Error
+		}
+		return proxyBodyValue(reply), nil
+	}
+}
@@ -0,0 +1,91 @@
+package simpleRPC
+
+import (
+	"context"
+	"fmt"
+	"simpleRPC/codec"
+	"strings"
+	"time"
+)
+
+// 检查旧连接上的调用是否完成的间隔
+const rebindPollInterval = 10 * time.Millisecond
+
+// 服务端换了地址（例如容器重启）时，不需要关闭客户端重新Dial，把连接切换到newAddr
+// 切换之后的调用发送到新的连接；已经发送的调用在旧的连接上等待响应，全部完成之后关闭旧的连接
+// ctx结束时旧连接上还没有完成的调用直接失败，返回错误，这时新的连接已经生效
+// newAddr的格式可以是 host:port（tcp）或者 protocol@addr，使用和原来的连接一样的option
+// 正在进行的流式调用需要在切换之前结束，否则之后的数据块会发送到新的连接
+func (client *Client) Rebind(ctx context.Context, newAddr string) error {
+	opt := *client.opt
+	var (
+		nc *Client
+		err error
+	)
+	if strings.Contains(newAddr, "@") {
+		nc, err = xdial(newBareClient, newAddr, &opt)
+	} else {
+		nc, err = dialTimeout(newBareClient, "tcp", newAddr, &opt)
+	}
+	if err != nil {
+		return err
+	}
+	// 收到的响应按原来的编解码器解码，新的服务端需要支持同样的编解码器
+	if nc.opt.CodecType != client.opt.CodecType {
+		_ = nc.cc.Close()
+		return fmt.Errorf("rpc client: rebind negotiated codec %s, expect %s", nc.opt.CodecType, client.opt.CodecType)
+	}
+
+	// 持有sending，保证切换的时候没有正在发送的请求
+	client.sending.Lock()
+	client.mu.Lock()
+	if client.closing || client.shutdown {
+		client.mu.Unlock()
+		client.sending.Unlock()
+		_ = nc.cc.Close()
+		return ErrShutdown
+	}
+	old := client.cc
+	client.cc = nc.cc
+	client.mu.Unlock()
+	client.sending.Unlock()
+	go client.receive(nc.cc)
+
+	// 等待旧连接上的调用完成，客户端被关闭时不再等待
+	ticker := time.NewTicker(rebindPollInterval)
+	defer ticker.Stop()
+	for client.hasCallsOn(old) && client.IsAvailable() {
+		select {
+		case <-ctx.Done():
+			err := fmt.Errorf("rpc client: rebind drain failed: %w", ctx.Err())
+			client.mu.Lock()
+			client.failCallsOnLocked(old, err)
+			client.mu.Unlock()
+			_ = old.Close()
+			return err
+		case <-ticker.C:
+		}
+	}
+	// 旧连接上的接收协程读到错误之后退出
+	_ = old.Close()
+	return nil
+}
+
+// 当前发送请求的编解码器
+func (client *Client) currentCodec() codec.Codec {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return client.cc
+}
+
+// 是否还有在cc上发送、没有完成的调用
+func (client *Client) hasCallsOn(cc codec.Codec) bool {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	for _, call := range client.pending {
+		if call.cc == cc {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,13 @@
+// +build simplerpc_test_inject
+
+package registry
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// 测试用，模拟响应很慢的注册中心，之后的每个http响应（GET和POST）都会先等待d，0为关闭
+func (r *SimpleRegistry) InjectLatency(d time.Duration) {
+	atomic.StoreInt64(&r.latency, int64(d))
+}
@@ -1,12 +1,17 @@
 package registry
 
 import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
 	"fmt"
 	"log"
+	"math/rand"
 	"net/http"
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -14,37 +19,65 @@ type SimpleRegistry struct {
 	timeout time.Duration
 	mu sync.Mutex
 	servers map[string]*ServerItem
+	webhooks map[string]struct{} // 服务注册、过期时通知的url
+	sweeping bool // 定时清理过期服务的goroutine是否在运行
+	replicas map[string]string // 服务注册时同步到的其他注册中心url，value为它的鉴权token，为空时不带鉴权
+	authToken string // 不为空时请求需要带上 Authorization: Bearer <authToken>
+	latency int64 // 测试用，每个http响应之前等待的时间，只有 -tags simplerpc_test_inject 编译时才能设置
 }
 
 type ServerItem struct {
 	Addr string
+	Origin string // 服务的来源，OriginLocal 或者 OriginReplicated
 	start time.Time
 }
 
+// 服务的来源
+const (
+	OriginLocal = "local" // 服务直接注册到本注册中心
+	OriginReplicated = "replicated" // 从其他注册中心同步过来
+)
+
 const (
-	defaultPath = "/_simplerpc_/registry"
 	defaultTimeout = time.Minute * 5
 )
 
+// HandleHTTP()使用的默认路径，可以修改
+var DefaultPath = "/v1/_simplerpc_/registry"
+
+// 加版本号之前的路径，作为v1的别名继续挂载，已经部署的心跳发送方和服务发现不需要修改地址
+const legacyPath = "/_simplerpc_/registry"
+
 func New(timeout time.Duration) *SimpleRegistry {
 	return &SimpleRegistry{
 		servers:make(map[string]*ServerItem),
 		timeout:timeout,
+		webhooks:make(map[string]struct{}),
+		replicas:make(map[string]string),
 	}
 }
 
 var DefaultSimpleRegister = New(defaultTimeout)
 
 // 添加服务
-func (r *SimpleRegistry) putServer(addr string) {
+func (r *SimpleRegistry) putServer(addr, origin string) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	s := r.servers[addr]
 	if s == nil {
-		r.servers[addr] = &ServerItem{Addr: addr, start:time.Now()}
+		r.servers[addr] = &ServerItem{Addr: addr, Origin: origin, start:time.Now()}
+		// 只有新注册的服务才通知，心跳只是续期
+		r.notify("registered", addr)
 	} else {
 		// 存在，则更新时间（每次心跳检测都会更新时间，防止过期）
 		s.start = time.Now()
+		if origin == OriginLocal {
+			s.Origin = origin
+		}
+	}
+	// 只同步直接注册过来的服务，防止两个注册中心互相同步的时候死循环
+	if origin == OriginLocal {
+		r.replicate(addr)
 	}
 }
 
@@ -53,22 +86,76 @@ func (r *SimpleRegistry) aliveServers() []string {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
+	r.removeExpired()
 	var alive []string
+	for addr := range r.servers {
+		alive = append(alive, addr)
+	}
+
+	sort.Strings(alive)
+	return alive
+}
+
+// 删除过期的服务并通知webhook，调用时需要持有r.mu
+func (r *SimpleRegistry) removeExpired() {
+	if r.timeout == 0 {
+		return
+	}
 	for addr, s := range r.servers {
-		if r.timeout == 0 || s.start.Add(r.timeout).After(time.Now()) {
-			alive = append(alive, addr)
-		} else {
+		if !s.start.Add(r.timeout).After(time.Now()) {
 			delete(r.servers, addr)
+			r.notify("expired", addr)
 		}
 	}
+}
 
-	sort.Strings(alive)
-	return alive
+// 定时清理过期服务，保证没有服务发现请求的时候webhook也能及时收到expired，
+// 所有webhook都被删除之后退出
+func (r *SimpleRegistry) sweep() {
+	ticker := time.NewTicker(r.timeout / 2)
+	defer ticker.Stop()
+	for range ticker.C {
+		r.mu.Lock()
+		if len(r.webhooks) == 0 {
+			r.sweeping = false
+			r.mu.Unlock()
+			return
+		}
+		r.removeExpired()
+		r.mu.Unlock()
+	}
+}
+
+// 设置鉴权的token，之后GET和POST请求都需要带上 Authorization: Bearer <token>，否则返回401，token为空时不鉴权
+func (r *SimpleRegistry) SetAuthToken(token string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.authToken = token
+}
+
+// 检查请求的token，没有设置token时都通过
+func (r *SimpleRegistry) authorized(req *http.Request) bool {
+	r.mu.Lock()
+	token := r.authToken
+	r.mu.Unlock()
+	if token == "" {
+		return true
+	}
+	got := req.Header.Get("Authorization")
+	return subtle.ConstantTimeCompare([]byte(got), []byte("Bearer " + token)) == 1
 }
 
 // 通过get方法 在header头返回所有的可用服务列表
 // 通过post方法 在header头传递添加的服务地址
 func (r *SimpleRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if d := time.Duration(atomic.LoadInt64(&r.latency)); d > 0 {
+		time.Sleep(d)
+	}
+	if !r.authorized(req) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
 	switch req.Method {
 	case "GET":
 		fmt.Println(111111, r.aliveServers())
@@ -80,49 +167,252 @@ func (r *SimpleRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-		r.putServer(addr)
+		origin := OriginLocal
+		if req.Header.Get("X-Simplerpc-Origin") == OriginReplicated {
+			origin = OriginReplicated
+		}
+		r.putServer(addr, origin)
 	default:
 		w.WriteHeader(http.StatusMethodNotAllowed)
 	}
 }
 
+const (
+	webhookTimeout = time.Second * 3
+	webhookRetries = 3
+)
+
+// 通知webhook的消息体
+type webhookEvent struct {
+	Event string `json:"event"` // registered 或者 expired
+	Addr string `json:"addr"`
+	Metadata map[string]string `json:"metadata"`
+}
+
+// 添加webhook，服务新注册或者过期的时候，会POST一个json到url
+func (r *SimpleRegistry) AddWebhook(url string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.webhooks[url] = struct{}{}
+	if r.timeout > 0 && !r.sweeping {
+		r.sweeping = true
+		go r.sweep()
+	}
+}
+
+func (r *SimpleRegistry) RemoveWebhook(url string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.webhooks, url)
+}
+
+// 异步通知所有webhook，调用时需要持有r.mu
+func (r *SimpleRegistry) notify(event, addr string) {
+	if len(r.webhooks) == 0 {
+		return
+	}
+	body, err := json.Marshal(webhookEvent{Event: event, Addr: addr, Metadata: map[string]string{}})
+	if err != nil {
+		log.Println("rpc registry: webhook marshal err:", err)
+		return
+	}
+	for url := range r.webhooks {
+		go deliverWebhook(url, body)
+	}
+}
+
+// 发送webhook，失败了最多重试webhookRetries次
+func deliverWebhook(url string, body []byte) {
+	httpClient := &http.Client{Timeout: webhookTimeout}
+	for i := 0; i <= webhookRetries; i ++ {
+		if i > 0 {
+			time.Sleep(time.Second * time.Duration(i))
+		}
+		resp, err := httpClient.Post(url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			log.Println("rpc registry: webhook err:", err)
+			continue
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			return
+		}
+		log.Println("rpc registry: webhook unexpected status:", resp.Status)
+	}
+}
+
+// 添加一个远程注册中心（例如另一个地域的注册中心），之后每次有服务注册（包括心跳），都会把服务地址POST过去
+// 远程注册中心收到的服务来源为 OriginReplicated，它不会再继续同步
+func (r *SimpleRegistry) ReplicateTo(remoteRegistryURL string) {
+	r.ReplicateToSecure(remoteRegistryURL, "")
+}
+
+// 和ReplicateTo一样，远程注册中心设置了SetAuthToken时使用，同步请求带上 Authorization: Bearer <token>
+func (r *SimpleRegistry) ReplicateToSecure(remoteRegistryURL, token string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.replicas[remoteRegistryURL] = token
+}
+
+// 返回可用服务以及它们的来源
+func (r *SimpleRegistry) AliveServerItems() []ServerItem {
+	alive := r.aliveServers()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	items := make([]ServerItem, 0, len(alive))
+	for _, addr := range alive {
+		if s := r.servers[addr]; s != nil {
+			items = append(items, *s)
+		}
+	}
+	return items
+}
+
+// 异步把服务同步到所有远程注册中心，调用时需要持有r.mu
+func (r *SimpleRegistry) replicate(addr string) {
+	for url, token := range r.replicas {
+		go func(url, token string) {
+			httpClient := &http.Client{Timeout: webhookTimeout}
+			req, _ := http.NewRequest("POST", url, nil)
+			req.Header.Set("X-Simplerpc-Servers", addr)
+			req.Header.Set("X-Simplerpc-Origin", OriginReplicated)
+			if token != "" {
+				req.Header.Set("Authorization", "Bearer " + token)
+			}
+			resp, err := httpClient.Do(req)
+			if err != nil {
+				log.Println("rpc registry: replicate err:", err)
+				return
+			}
+			_ = resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				log.Println("rpc registry: replicate unexpected status:", resp.Status)
+			}
+		}(url, token)
+	}
+}
+
 func (r *SimpleRegistry) HandleHTTP(registryPath string) {
 	http.Handle(registryPath, r)
 	log.Println("rpc registry path:", registryPath)
 }
 
+// 同时挂载 /v1<prefix> 和 /v2<prefix> 两个版本的接口，例如prefix为 /_simplerpc_/registry
+// v1 通过请求头X-Simplerpc-Servers传递服务列表，v2 GET返回json格式的服务列表
+// 不带版本号的<prefix>是v1的别名
+// 以后新增功能放在新版本里，已经部署的心跳发送方不受影响
+func (r *SimpleRegistry) HandleHTTPVersioned(prefix string) {
+	http.Handle(prefix, r)
+	http.Handle("/v1" + prefix, r)
+	http.Handle("/v2" + prefix, http.HandlerFunc(r.serveV2))
+	log.Println("rpc registry path:", prefix, "/v1" + prefix, "/v2" + prefix)
+}
+
+// v2 接口返回的服务列表
+type serversV2 struct {
+	Servers []string `json:"servers"`
+}
+
+// v2 接口：GET返回json格式的服务列表，POST和v1一样
+func (r *SimpleRegistry) serveV2(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		r.ServeHTTP(w, req)
+		return
+	}
+
+	if d := time.Duration(atomic.LoadInt64(&r.latency)); d > 0 {
+		time.Sleep(d)
+	}
+	if !r.authorized(req) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	servers := r.aliveServers()
+	if servers == nil {
+		servers = []string{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(serversV2{Servers: servers}); err != nil {
+		log.Println("rpc registry: encode servers err:", err)
+	}
+}
+
 func HandleHTTP() {
-	DefaultSimpleRegister.HandleHTTP(defaultPath)
+	DefaultSimpleRegister.HandleHTTP(DefaultPath)
+	if DefaultPath != legacyPath {
+		DefaultSimpleRegister.HandleHTTP(legacyPath)
+	}
+}
+
+// 心跳失败之后重试的等待时间，指数增长
+var (
+	heartbeatBaseDelay = time.Second
+	heartbeatMaxDelay = time.Minute
+)
+
+// 连续失败failures次之后的等待时间：min(heartbeatMaxDelay, heartbeatBaseDelay * 2^(failures-1))，再加上一半的随机抖动
+func heartbeatBackoff(failures int) time.Duration {
+	d := heartbeatBaseDelay
+	for i := 1; i < failures && d < heartbeatMaxDelay; i ++ {
+		d *= 2
+	}
+	if d > heartbeatMaxDelay {
+		d = heartbeatMaxDelay
+	}
+	return d / 2 + time.Duration(rand.Int63n(int64(d / 2) + 1))
 }
 
 // 心跳接口
+// 心跳失败时按指数退避一直重试，直到成功之后再恢复正常的心跳间隔
 func Heartbeat(registry, addr string, duration time.Duration) {
+	HeartbeatSecure(registry, addr, "", duration)
+}
+
+// 和Heartbeat一样，注册中心设置了SetAuthToken时使用，心跳请求带上 Authorization: Bearer <token>
+func HeartbeatSecure(registry, addr, token string, duration time.Duration) {
 	// 限制一下心跳发送时间，防止发送心跳检测的时候，服务早就过期了
 	if duration == 0 || duration > defaultTimeout {
 		duration = defaultTimeout - time.Duration(1) * time.Minute
 	}
-	var err error
-	err = sendHeartbeat(registry, addr)
+	err := sendHeartbeat(registry, addr, token)
 	go func() {
-		t := time.NewTicker(duration)
-		for err == nil {
-			<- t.C
-			err = sendHeartbeat(registry, addr)
+		failures := 0
+		for {
+			wait := duration
+			if err != nil {
+				failures ++
+				wait = heartbeatBackoff(failures)
+				log.Printf("rpc registry: heart beat failed %d times, retry after %s: %v", failures, wait, err)
+			} else {
+				// 只有成功才重置失败次数
+				failures = 0
+			}
+			time.Sleep(wait)
+			err = sendHeartbeat(registry, addr, token)
 		}
 	}()
 }
 
 // 发送心跳检测，此步包含服务的注册
-func sendHeartbeat(registry, addr string) error {
+// token不为空时带上 Authorization 请求头
+func sendHeartbeat(registry, addr, token string) error {
 	log.Println(addr, "send heart beat to registry", registry)
 	httpClient := &http.Client{}
 	req, _ := http.NewRequest("POST", registry, nil)
 	req.Header.Set("X-Simplerpc-Servers", addr)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer " + token)
+	}
 	// 发送心跳检测，如果心跳检测失败，服务的start是不会更新的，5分钟之后就会失效
-	if _, err := httpClient.Do(req); err != nil {
+	resp, err := httpClient.Do(req)
+	if err != nil {
 		log.Println("rpc server: heart beat err:", err)
 		return err
 	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("rpc server: heart beat status %s", resp.Status)
+	}
 
 	return nil
 }
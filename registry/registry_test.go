@@ -0,0 +1,233 @@
+package registry
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHeartbeat_retry(t *testing.T) {
+	heartbeatBaseDelay, heartbeatMaxDelay = time.Millisecond * 10, time.Millisecond * 40
+	defer func() { heartbeatBaseDelay, heartbeatMaxDelay = time.Second, time.Minute }()
+
+	// 前3次心跳失败，之后成功
+	var calls int32
+	r := New(defaultTimeout)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&calls, 1) <= 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		r.ServeHTTP(w, req)
+	}))
+	defer ts.Close()
+
+	Heartbeat(ts.URL, "tcp@127.0.0.1:9999", time.Hour)
+	deadline := time.Now().Add(time.Second)
+	for len(r.aliveServers()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if alive := r.aliveServers(); len(alive) != 1 || alive[0] != "tcp@127.0.0.1:9999" {
+		t.Fatalf("expect server registered after retries, but got %v", alive)
+	}
+	if n := atomic.LoadInt32(&calls); n != 4 {
+		t.Fatalf("expect 4 heart beats, but got %d", n)
+	}
+}
+
+func TestHeartbeatBackoff(t *testing.T) {
+	heartbeatBaseDelay, heartbeatMaxDelay = time.Second, time.Minute
+	for failures, max := range map[int]time.Duration{1: time.Second, 3: time.Second * 4, 10: time.Minute} {
+		d := heartbeatBackoff(failures)
+		if d < max / 2 || d > max {
+			t.Fatalf("backoff after %d failures should be in [%s, %s], but got %s", failures, max / 2, max, d)
+		}
+	}
+}
+
+func TestSimpleRegistry_HandleHTTPVersioned(t *testing.T) {
+	r := New(defaultTimeout)
+	r.HandleHTTPVersioned("/_test_/registry")
+	ts := httptest.NewServer(http.DefaultServeMux)
+	defer ts.Close()
+
+	if err := sendHeartbeat(ts.URL + "/v1/_test_/registry", "tcp@a", ""); err != nil {
+		t.Fatal("failed to send heart beat to v1:", err)
+	}
+	if err := sendHeartbeat(ts.URL + "/v2/_test_/registry", "tcp@b", ""); err != nil {
+		t.Fatal("failed to send heart beat to v2:", err)
+	}
+
+	resp, _ := http.Get(ts.URL + "/v1/_test_/registry")
+	if servers := resp.Header.Get("X-Simplerpc-Servers"); servers != "tcp@a,tcp@b" {
+		t.Fatalf("unexpected v1 servers %q", servers)
+	}
+
+	// 不带版本号的路径是v1的别名
+	resp, _ = http.Get(ts.URL + "/_test_/registry")
+	if servers := resp.Header.Get("X-Simplerpc-Servers"); servers != "tcp@a,tcp@b" {
+		t.Fatalf("unexpected legacy servers %q", servers)
+	}
+
+	resp, _ = http.Get(ts.URL + "/v2/_test_/registry")
+	defer func() { _ = resp.Body.Close() }()
+	var body serversV2
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil || len(body.Servers) != 2 || body.Servers[0] != "tcp@a" {
+		t.Fatalf("unexpected v2 servers %v %v", body.Servers, err)
+	}
+}
+
+func TestHandleHTTP_LegacyPath(t *testing.T) {
+	HandleHTTP()
+	ts := httptest.NewServer(http.DefaultServeMux)
+	defer ts.Close()
+
+	// 旧的心跳发送方还在使用不带版本号的路径
+	if err := sendHeartbeat(ts.URL + legacyPath, "tcp@legacy", ""); err != nil {
+		t.Fatal("failed to send heart beat to the legacy path:", err)
+	}
+	resp, _ := http.Get(ts.URL + DefaultPath)
+	if servers := resp.Header.Get("X-Simplerpc-Servers"); servers != "tcp@legacy" {
+		t.Fatalf("unexpected servers %q", servers)
+	}
+}
+
+func TestSimpleRegistry_ReplicateTo(t *testing.T) {
+	secondary := New(defaultTimeout)
+	ts2 := httptest.NewServer(secondary)
+	defer ts2.Close()
+
+	primary := New(defaultTimeout)
+	primary.ReplicateTo(ts2.URL)
+	ts1 := httptest.NewServer(primary)
+	defer ts1.Close()
+
+	if err := sendHeartbeat(ts1.URL, "tcp@127.0.0.1:9999", ""); err != nil {
+		t.Fatal("failed to send heart beat:", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for len(secondary.aliveServers()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if alive := secondary.aliveServers(); len(alive) != 1 || alive[0] != "tcp@127.0.0.1:9999" {
+		t.Fatalf("expect server replicated to secondary, but got %v", alive)
+	}
+	if items := secondary.AliveServerItems(); items[0].Origin != OriginReplicated {
+		t.Fatalf("expect origin %s, but got %s", OriginReplicated, items[0].Origin)
+	}
+	if items := primary.AliveServerItems(); len(items) != 1 || items[0].Origin != OriginLocal {
+		t.Fatalf("expect local server on primary, but got %v", items)
+	}
+}
+
+func TestSimpleRegistry_ReplicateToSecure(t *testing.T) {
+	secondary := New(defaultTimeout)
+	secondary.SetAuthToken("secret")
+	ts2 := httptest.NewServer(secondary)
+	defer ts2.Close()
+
+	primary := New(defaultTimeout)
+	primary.ReplicateTo(ts2.URL)
+	ts1 := httptest.NewServer(primary)
+	defer ts1.Close()
+
+	// 没有带token的同步被拒绝
+	if err := sendHeartbeat(ts1.URL, "tcp@a", ""); err != nil {
+		t.Fatal("failed to send heart beat:", err)
+	}
+	time.Sleep(time.Millisecond * 100)
+	if alive := secondary.aliveServers(); len(alive) != 0 {
+		t.Fatalf("expect replication without token rejected, but got %v", alive)
+	}
+
+	primary.ReplicateToSecure(ts2.URL, "secret")
+	if err := sendHeartbeat(ts1.URL, "tcp@a", ""); err != nil {
+		t.Fatal("failed to send heart beat:", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for len(secondary.aliveServers()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if alive := secondary.aliveServers(); len(alive) != 1 || alive[0] != "tcp@a" {
+		t.Fatalf("expect server replicated with token, but got %v", alive)
+	}
+}
+
+func TestSimpleRegistry_SetAuthToken(t *testing.T) {
+	r := New(defaultTimeout)
+	r.SetAuthToken("secret")
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	err := sendHeartbeat(ts.URL, "tcp@a", "")
+	if err == nil || !strings.Contains(err.Error(), "401") {
+		t.Fatalf("expect 401 without token, but got %v", err)
+	}
+	if err := sendHeartbeat(ts.URL, "tcp@a", "wrong"); err == nil {
+		t.Fatal("expect heartbeat with wrong token rejected")
+	}
+	if err := sendHeartbeat(ts.URL, "tcp@a", "secret"); err != nil {
+		t.Fatal("failed to send heartbeat with token:", err)
+	}
+
+	resp, err := http.Get(ts.URL)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expect 401 for GET without token, but got %v, %v", resp, err)
+	}
+	_ = resp.Body.Close()
+	req, _ := http.NewRequest("GET", ts.URL, nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusOK || resp.Header.Get("X-Simplerpc-Servers") != "tcp@a" {
+		t.Fatalf("expect servers with token, but got %v, %v", resp, err)
+	}
+	_ = resp.Body.Close()
+}
+
+func TestSimpleRegistry_Webhook(t *testing.T) {
+	events := make(chan webhookEvent, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var e webhookEvent
+		if err := json.NewDecoder(req.Body).Decode(&e); err != nil {
+			t.Errorf("failed to decode webhook body: %v", err)
+		}
+		events <- e
+	}))
+	defer receiver.Close()
+
+	r := New(time.Millisecond * 200)
+	r.AddWebhook(receiver.URL)
+	defer r.RemoveWebhook(receiver.URL)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	// 新注册通知一次registered，之后的心跳不再通知
+	for i := 0; i < 3; i ++ {
+		if err := sendHeartbeat(ts.URL, "tcp@a", ""); err != nil {
+			t.Fatal("failed to send heart beat:", err)
+		}
+	}
+	expect := func(event string) {
+		select {
+		case e := <-events:
+			if e.Event != event || e.Addr != "tcp@a" {
+				t.Fatalf("expect %s event for tcp@a, but got %+v", event, e)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expect %s event, but got nothing", event)
+		}
+	}
+	expect("registered")
+
+	// 没有服务发现请求，expired也要由定时清理发出
+	expect("expired")
+	select {
+	case e := <-events:
+		t.Fatalf("expect no more events, but got %+v", e)
+	case <-time.After(time.Millisecond * 300):
+	}
+}
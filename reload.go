@@ -0,0 +1,43 @@
+package simpleRPC
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// 收到SIGHUP信号时，对每个注册的服务调用rcvrFactory获取新的rcvr，然后替换掉原来的服务
+// rcvrFactory返回nil的服务不替换，已经建立的连接不受影响
+// 返回的rcvr的类型名需要和服务名一样，RegisterFunc注册的函数不会重新加载
+func (server *Server) WatchForReload(rcvrFactory func(name string) interface{}) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	go func() {
+		for range ch {
+			server.reload(rcvrFactory)
+		}
+	}()
+}
+
+func (server *Server) reload(rcvrFactory func(name string) interface{}) {
+	for _, info := range server.Services() {
+		if info.Name == funcServiceName {
+			continue
+		}
+		rcvr := rcvrFactory(info.Name)
+		if rcvr == nil {
+			continue
+		}
+		s := newService(rcvr)
+		if s.name != info.Name {
+			log.Printf("rpc server: reload service %s err: factory returned service %s\n", info.Name, s.name)
+			continue
+		}
+		if err := server.swap(s); err != nil {
+			log.Println("rpc server: reload service err:", err)
+			continue
+		}
+		log.Println("rpc server: reload service", info.Name)
+	}
+}
@@ -0,0 +1,115 @@
+package simpleRPC
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"reflect"
+	"simpleRPC/codec"
+	"simpleRPC/errs"
+	"strings"
+)
+
+// JSON-over-HTTP请求体的最大字节数
+const maxRESTBodyBytes = 4 << 20
+
+// 处理 POST /<prefix>/<service>/<method> 请求，请求体是json格式的参数，响应是json格式的返回值
+// 不需要CONNECT升级，curl、浏览器等普通的http客户端就可以调用服务
+// 出错时返回对应的http状态码和 {"code": 错误码, "error": 错误信息}
+func (server *Server) ServeHTTPRest(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		writeRESTError(w, &RPCError{Code: errs.Validation, Message: "rpc server: must POST"}, http.StatusMethodNotAllowed)
+		return
+	}
+
+	// 路径的最后两段是服务名和方法名
+	parts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	if len(parts) < 2 {
+		writeRESTError(w, &RPCError{Code: errs.MethodNotFound, Message: "rpc server: path must end with /<service>/<method>"}, 0)
+		return
+	}
+	serviceMethod := parts[len(parts) - 2] + "." + parts[len(parts) - 1]
+	svc, mtype, err := server.findService(serviceMethod)
+	if err != nil {
+		writeRESTError(w, &RPCError{Code: errs.MethodNotFound, Message: err.Error()}, 0)
+		return
+	}
+	if mtype.stream {
+		writeRESTError(w, &RPCError{Code: errs.Validation, Message: "rpc server: stream method " + serviceMethod + " is not supported over http"}, 0)
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, maxRESTBodyBytes))
+	if err != nil {
+		writeRESTError(w, &RPCError{Code: errs.Validation, Message: "rpc server: read body: " + err.Error()}, 0)
+		return
+	}
+	r := &request{h: &codec.Header{ServiceMethod: serviceMethod}, mtype: mtype, scv: svc, ctx: req.Context(), remoteAddr: req.RemoteAddr}
+	r.argv, r.replyv = mtype.newArgv(), mtype.newReplyv()
+	if len(body) > 0 {
+		argvi := r.argv.Interface()
+		if r.argv.Type().Kind() != reflect.Ptr {
+			argvi = r.argv.Addr().Interface()
+		}
+		if err := json.Unmarshal(body, argvi); err != nil {
+			writeRESTError(w, &RPCError{Code: errs.Validation, Message: "rpc server: decode args for " + serviceMethod + ": " + err.Error()}, 0)
+			return
+		}
+	}
+
+	// 和tcp连接上的请求一样经过并发限制、拦截器和统计
+	if err := server.handle(nil, r, DefaultOption); err != nil {
+		if e, ok := err.(*stackError); ok {
+			err = e.err
+		}
+		rpcErr, ok := err.(*RPCError)
+		if !ok {
+			rpcErr = &RPCError{Code: errs.InternalError, Message: err.Error()}
+		}
+		writeRESTError(w, rpcErr, 0)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(r.replyv.Interface()); err != nil {
+		log.Println("rpc server: encode http reply err:", err)
+	}
+}
+
+// 在prefix下注册JSON-over-HTTP接口，例如 HandleRESTHTTP("/rpc/") 之后可以 POST /rpc/Foo/Sum
+func (server *Server) HandleRESTHTTP(prefix string) {
+	http.HandleFunc(prefix, server.ServeHTTPRest)
+	log.Println("rpc server rest path:", prefix)
+}
+
+// 错误码对应的http状态码
+func restStatus(code int32) int {
+	switch code {
+	case errs.MethodNotFound:
+		return http.StatusNotFound
+	case errs.Timeout:
+		return http.StatusGatewayTimeout
+	case errs.RateLimit:
+		return http.StatusTooManyRequests
+	case errs.Validation:
+		return http.StatusBadRequest
+	case errs.PermissionDenied:
+		return http.StatusForbidden
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// 返回json格式的错误，status为0时根据错误码决定http状态码
+func writeRESTError(w http.ResponseWriter, err *RPCError, status int) {
+	if status == 0 {
+		status = restStatus(err.Code)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(struct {
+		Code int32 `json:"code"`
+		Error string `json:"error"`
+	}{err.Code, err.Message})
+}
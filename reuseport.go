@@ -0,0 +1,26 @@
+// +build linux darwin
+
+package simpleRPC
+
+import (
+	"context"
+	"net"
+	"syscall"
+)
+
+// 创建设置了SO_REUSEPORT的listener，多个服务端进程可以监听同一个端口，由内核把连接分配给它们
+// 每个进程都需要使用ListenReusePort监听，只支持linux和darwin
+func (server *Server) ListenReusePort(network, addr string) (net.Listener, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var err error
+			if e := c.Control(func(fd uintptr) {
+				err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+			}); e != nil {
+				return e
+			}
+			return err
+		},
+	}
+	return lc.Listen(context.Background(), network, addr)
+}
@@ -0,0 +1,5 @@
+package simpleRPC
+
+import "syscall"
+
+const soReusePort = syscall.SO_REUSEPORT
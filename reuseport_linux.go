@@ -0,0 +1,4 @@
+package simpleRPC
+
+// linux下syscall包里没有SO_REUSEPORT，值和golang.org/x/sys/unix里的一样
+const soReusePort = 0xf
@@ -0,0 +1,30 @@
+// +build linux darwin
+
+package simpleRPC
+
+import (
+	"net"
+	"testing"
+)
+
+func TestServer_ListenReusePort(t *testing.T) {
+	server := NewServer()
+	l1, err := server.ListenReusePort("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("failed to listen:", err)
+	}
+	defer func() { _ = l1.Close() }()
+
+	// 第二个listener可以监听同一个端口
+	l2, err := server.ListenReusePort("tcp", l1.Addr().String())
+	if err != nil {
+		t.Fatal("expect listen on the same port with SO_REUSEPORT, but got", err)
+	}
+	defer func() { _ = l2.Close() }()
+
+	// 没有设置SO_REUSEPORT的话监听失败
+	if l, err := net.Listen("tcp", l1.Addr().String()); err == nil {
+		_ = l.Close()
+		t.Fatal("expect listen without SO_REUSEPORT to fail")
+	}
+}
@@ -1,16 +1,23 @@
 package simpleRPC
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
+	"expvar"
 	"fmt"
 	"go/ast"
 	"io"
 	"log"
+	"math"
 	"net"
 	"net/http"
 	"reflect"
+	"runtime"
 	"simpleRPC/codec"
+	"simpleRPC/errs"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -22,9 +29,43 @@ const MagicNumber = 0x3bef5c
 type Option struct {
 	MagicNumber int
 	CodecType codec.Type
+	FallbackCodecType codec.Type // 服务端不支持CodecType时使用的编解码器，为空则不支持时直接断开连接
 
 	ConnectTimeout time.Duration // 连接超时，0为不限
 	HandleTimeout time.Duration // 处理请求超时，0为不限
+
+	// 建立连接失败（例如服务端还没有开始监听）时重试的次数和第一次重试前的等待时间，之后每次翻倍，只在客户端使用
+	ConnectRetryMax int `json:"-"`
+	ConnectRetryBaseDelay time.Duration `json:"-"`
+	PingInterval time.Duration `json:"-"` // 客户端发送心跳的间隔，0为不发送
+	// 有未完成的调用时，客户端超过这个时间没有收到服务端的任何数据就断开连接，0为不限
+	ReadTimeout time.Duration `json:"-"`
+	// 使用16字节的二进制头部交换协议，比JSON快，但是只能带上部分字段，见binaryoption.go
+	BinaryOptionExchange bool `json:"-"`
+	// 不为nil时，发送之前把参数里的time.Time转成UTC，收到的返回值里的time.Time转成这个时区，见codec.DateTimeNormalizer
+	TimeLocation *time.Location `json:"-"`
+	// 客户端还原服务端序列化的错误的方式，需要和服务端Server.SetErrorSerializer设置的一致，为nil时不还原
+	ErrorSerializer codec.ErrorSerializer `json:"-"`
+	// 代理转发请求之前修改请求头，例如加上鉴权信息，只在NewProxyServer里使用
+	ProxyHeaderTransform func(h *codec.Header) `json:"-"`
+	// 客户端发送队列的长度，由一个协程依次发送，队列满了直接返回ErrSendQueueFull，0为不使用队列（调用方的协程加锁发送）
+	SendQueueDepth int `json:"-"`
+
+	CoalesceIdenticalCalls bool // 相同的请求（服务方法和参数都相同）正在处理时，合并成一次调用
+
+	// 是否启用Nagle算法，默认不启用（TCP_NODELAY）。启用可以减少小包的数量，但是会增加延迟
+	EnableNagle bool
+
+	// 客户端连接的读写缓冲区大小，0为默认大小（4KB）。缓冲区越大系统调用越少，但是每个连接占用的内存也越多
+	// 不会发送给服务端，服务端使用Server.SetBufferSize设置
+	WriteBufferSize int `json:"-"`
+	ReadBufferSize int `json:"-"`
+
+	// Json编解码器使用的自定义序列化方法，不会发送给服务端，服务端使用UseJsonConfig设置
+	JsonConfig *codec.JsonConfig `json:"-"`
+
+	// 服务端拒绝连接的原因，只在服务端返回的option里设置，例如代理不支持客户端请求的编解码器
+	Error string `json:",omitempty"`
 }
 
 var DefaultOption = &Option {
@@ -36,17 +77,74 @@ var DefaultOption = &Option {
 
 type Server struct {
 	serviceMap sync.Map
+
+	mu sync.Mutex
+	listeners map[net.Listener]struct{} // 正在Accept的listener，Shutdown的时候关闭
+	flights flightGroup // 正在处理的请求，用于合并相同的请求
+	connTracker *ConnTracker // 记录当前的连接，为nil时不记录
+	jsonConfig *codec.JsonConfig // Json编解码器使用的自定义序列化方法
+	limits map[string]*serviceLimit // 服务级别的并发限制，key为服务名
+	onCodecNegotiated func(remoteAddr, codec string) // 交换完协议后调用，为nil时不调用
+	inflight sync.Map // 正在处理的请求，key为*request
+	inFlight int64 // 正在处理的请求数
+	waiting int64 // 等待服务并发名额的请求数
+	cpu cpuSampler // 负载接口的CPU采样
+	interceptors []ServerInterceptor // 服务方法调用前后执行的拦截器
+	proxy *proxy // 不为nil时把所有请求转发到后端服务，不使用本地注册的服务
+	slowDetectorStop chan struct{} // 关闭后慢调用检测协程退出
+	upgrades map[uint32]func(conn net.Conn) // 协议升级的处理方法，key为魔数
+	acceptLimit *acceptLimiter // 限制Accept的速率，为nil时不限制
+	state int32 // 两阶段启动（Prepare/Start）的阶段
+	prepared []net.Listener // Prepare之后还没有开始Accept的listener
+	workers *workerPool // 处理请求的工作协程池，为nil时每个请求一个协程
+	outgoing *OutgoingClientPool // 反向调用客户端的连接池，第一次使用时创建
+	reportLoad int32 // 不为0时在响应头里带上服务端的负载
+	readBufferSize int // 每个连接的读缓冲区大小，0为默认大小
+	writeBufferSize int // 每个连接的写缓冲区大小，0为默认大小
+	strictServiceCheck bool // 请求的服务或方法不存在时直接断开连接
+	includeStack bool // 服务方法出错时把调用栈返回给客户端
+	disableMagicNumberCheck bool // 不检查客户端option里的MagicNumber
+	optionExchangeTimeout time.Duration // 等待客户端发送option的时间，0为不限
+	errorSerializer codec.ErrorSerializer // 服务方法返回的错误的序列化方式，为nil时只返回err.Error()
+	keepAliveInterval time.Duration // 服务方法执行超过这个时间，定时发送保活帧，0为不发送
+	compressThreshold int // 响应超过这个字节数时使用gzip压缩，0为不压缩
+	enablePprof bool // HandleHTTP时是否挂载 /debug/pprof/
+	statsName string // 服务方法的统计信息在simplerpc.methods里的key
+	methodVars *expvar.Map // 这个Server的服务方法的统计信息，key为 Service.Method
+	types *codec.TypeRegistry // 自描述编解码器使用的类型注册表，见RegisterTypes
 }
 
+// 已经创建的Server的个数，用来生成statsName
+var serverCount int64
+
 func NewServer() *Server {
-	return &Server{}
+	server := &Server{
+		listeners: make(map[net.Listener]struct{}),
+		optionExchangeTimeout: defaultOptionExchangeTimeout,
+		types: codec.NewTypeRegistry(),
+	}
+	server.statsName = fmt.Sprintf("server-%d", atomic.AddInt64(&serverCount, 1))
+	server.methodVars = new(expvar.Map).Init()
+	methodsVar.Set(server.statsName, server.methodVars)
+	return server
+}
+
+// 返回服务方法的统计信息在 /debug/vars 的simplerpc.methods里的key，每个Server不同，例如 server-1
+func (server *Server) StatsName() string {
+	return server.statsName
 }
 
 var DefaultServer = NewServer()
 
 func (server *Server) Accept(lis net.Listener) {
+	server.trackListener(lis, true)
+	defer server.trackListener(lis, false)
+
 	// for 循环等待 socket 连接建立
 	for {
+		if l := server.acceptLimiter(); l != nil {
+			l.wait()
+		}
 		// 等待客户端建立连接
 		conn, err := lis.Accept()
 		if err != nil {
@@ -55,44 +153,452 @@ func (server *Server) Accept(lis net.Listener) {
 		}
 
 		// 开启子协程处理,处理过程交给了ServerConn方法
-		go server.ServeConn(conn)
+		ct := server.tracker()
+		if ct == nil {
+			go server.ServeConn(conn)
+			continue
+		}
+		ct.OnAccept(conn)
+		go func() {
+			server.ServeConn(conn)
+			ct.OnClose(conn)
+		}()
+	}
+}
+
+// 同时在多个listener上Accept（例如同时监听tcp端口和unix socket），共用同一份服务注册信息
+// 所有listener都关闭之后才返回
+func (server *Server) AcceptMulti(listeners ...net.Listener) error {
+	if len(listeners) == 0 {
+		return errors.New("rpc server: no listeners")
+	}
+
+	var wg sync.WaitGroup
+	for _, lis := range listeners {
+		wg.Add(1)
+		go func(lis net.Listener) {
+			defer wg.Done()
+			server.Accept(lis)
+		}(lis)
+	}
+	wg.Wait()
+	return nil
+}
+
+// 关闭所有正在Accept的listener
+func (server *Server) Shutdown() error {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	var err error
+	for lis := range server.listeners {
+		if e := lis.Close(); e != nil && err == nil {
+			err = e
+		}
+		delete(server.listeners, lis)
+	}
+	return err
+}
+
+// 记录连接的建立和关闭，可以知道当前有多少客户端连接
+type ConnTracker struct {
+	mu sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+func NewConnTracker() *ConnTracker {
+	return &ConnTracker{conns: make(map[net.Conn]struct{})}
+}
+
+// 连接建立时调用
+func (ct *ConnTracker) OnAccept(conn net.Conn) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	ct.conns[conn] = struct{}{}
+}
+
+// 连接关闭时调用
+func (ct *ConnTracker) OnClose(conn net.Conn) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	delete(ct.conns, conn)
+}
+
+// 当前的连接数
+func (ct *ConnTracker) ActiveCount() int {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	return len(ct.conns)
+}
+
+// 当前所有连接的客户端地址
+func (ct *ConnTracker) ActiveConns() []net.Addr {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	addrs := make([]net.Addr, 0, len(ct.conns))
+	for conn := range ct.conns {
+		addrs = append(addrs, conn.RemoteAddr())
+	}
+	return addrs
+}
+
+// 安装连接记录器，之后Accept的连接都会被记录
+func (server *Server) UseConnTracker(ct *ConnTracker) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.connTracker = ct
+}
+
+func (server *Server) tracker() *ConnTracker {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return server.connTracker
+}
+
+// 设置Json编解码器的自定义序列化方法，只对之后建立的连接生效
+func (server *Server) UseJsonConfig(config *codec.JsonConfig) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.jsonConfig = config
+}
+
+func (server *Server) jsonCodecConfig() *codec.JsonConfig {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return server.jsonConfig
+}
+
+// 服务端每个连接的读写缓冲区大小的上限
+const maxBufferSize = 1 << 20
+
+// 设置服务端每个连接的读写缓冲区大小，0为默认大小，超过maxBufferSize的按maxBufferSize，只对之后建立的连接生效
+// 缓冲区大小由服务端决定，不使用客户端option里的值，避免客户端让服务端为每个连接分配很大的内存
+func (server *Server) SetBufferSize(read, write int) {
+	clamp := func(n int) int {
+		if n < 0 {
+			return 0
+		}
+		if n > maxBufferSize {
+			return maxBufferSize
+		}
+		return n
+	}
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.readBufferSize, server.writeBufferSize = clamp(read), clamp(write)
+}
+
+func (server *Server) bufferSizes() (read, write int) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return server.readBufferSize, server.writeBufferSize
+}
+
+// 请求的服务或方法不存在时直接断开连接，不返回错误，避免泄露注册了哪些服务
+// 由服务端决定，客户端探测服务的时候不能关掉这个检查
+func (server *Server) SetStrictServiceCheck(enable bool) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.strictServiceCheck = enable
+}
+
+func (server *Server) strictCheck() bool {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return server.strictServiceCheck
+}
+
+// 服务方法panic或者返回WithStack包装的错误时，是否把调用栈返回给客户端（生产环境建议关闭）
+// 由服务端决定，客户端不能打开
+func (server *Server) SetIncludeStack(enable bool) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.includeStack = enable
+}
+
+func (server *Server) includeStackTrace() bool {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return server.includeStack
+}
+
+// 不检查客户端option里的MagicNumber，用于协议复用等已经去掉了魔数的场景
+// 由服务端决定，客户端不能关掉这个检查
+func (server *Server) SetDisableMagicNumberCheck(disable bool) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.disableMagicNumberCheck = disable
+}
+
+func (server *Server) magicNumberCheckDisabled() bool {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return server.disableMagicNumberCheck
+}
+
+// 服务端等待客户端发送option的默认时间
+const defaultOptionExchangeTimeout = 5 * time.Second
+
+// 设置等待客户端发送option的时间，超时关闭连接，0为不限，默认5秒，只对之后建立的连接生效
+func (server *Server) SetOptionExchangeTimeout(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.optionExchangeTimeout = d
+}
+
+func (server *Server) optionTimeout() time.Duration {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return server.optionExchangeTimeout
+}
+
+// 设置服务方法返回的错误的序列化方式，序列化的结果放在响应头的ErrorData里，客户端使用Option.ErrorSerializer还原
+// 为nil时只返回err.Error()
+func (server *Server) SetErrorSerializer(s codec.ErrorSerializer) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.errorSerializer = s
+}
+
+func (server *Server) errSerializer() codec.ErrorSerializer {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return server.errorSerializer
+}
+
+// 设置交换完协议后的回调，参数是客户端地址和实际使用的编解码器，用于排查编解码器不一致的问题
+func (server *Server) OnCodecNegotiated(fn func(remoteAddr, codec string)) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.onCodecNegotiated = fn
+}
+
+func (server *Server) codecNegotiated(conn io.ReadWriteCloser, codecType codec.Type) {
+	server.mu.Lock()
+	fn := server.onCodecNegotiated
+	server.mu.Unlock()
+	if fn == nil {
+		return
+	}
+
+	remoteAddr := ""
+	if c, ok := conn.(net.Conn); ok {
+		remoteAddr = c.RemoteAddr().String()
+	}
+	fn(remoteAddr, string(codecType))
+}
+
+func (server *Server) trackListener(lis net.Listener, add bool) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if add {
+		server.listeners[lis] = struct{}{}
+	} else {
+		delete(server.listeners, lis)
 	}
 }
 
 func(server *Server) ServeConn(conn io.ReadWriteCloser) {
+	server.ServeConnContext(context.Background(), conn)
+}
+
+// 和ServeConn一样，ctx会传递给每个请求，ctx取消的时候会关闭连接，
+// 例如给ctx设置一个截止时间，就可以断开存在时间太长的连接
+// 第一个参数是context.Context的服务方法拿到的ctx从这个ctx派生，流式调用的服务方法通过PipeStream.Context()拿到
+func (server *Server) ServeConnContext(ctx context.Context, conn io.ReadWriteCloser) {
 	defer func() {
 		_ = conn.Close()
 	}()
 
+	// 客户端连接之后一直不发送option的话，不能一直占着连接
+	dc, _ := conn.(interface{ SetDeadline(t time.Time) error })
+	if timeout := server.optionTimeout(); dc != nil && timeout > 0 {
+		_ = dc.SetDeadline(time.Now().Add(timeout))
+	}
 	var opt Option
-	if err := json.NewDecoder(conn).Decode(&opt); err != nil {
+	// 前4个字节是二进制头部的魔数的话，使用二进制交换协议，否则是JSON格式的option
+	prefix := make([]byte, len(binaryOptionMagic))
+	if _, err := io.ReadFull(conn, prefix); err != nil {
 		log.Println("rpc server: options error: ", err)
 		return
 	}
+	var dec *json.Decoder
+	if bytes.Equal(prefix, binaryOptionMagic[:]) {
+		if err := readBinaryOption(io.MultiReader(bytes.NewReader(prefix), conn), &opt); err != nil {
+			log.Println("rpc server: options error: ", err)
+			return
+		}
+	} else {
+		dec = json.NewDecoder(io.MultiReader(bytes.NewReader(prefix), conn))
+		if err := dec.Decode(&opt); err != nil {
+			log.Println("rpc server: options error: ", err)
+			return
+		}
+	}
+	if dc != nil {
+		_ = dc.SetDeadline(time.Time{})
+	}
 
-	if opt.MagicNumber != MagicNumber {
-		log.Printf("rpc server: invalid magic number %x", opt.MagicNumber)
+	if handler := server.upgradeHandler(opt.MagicNumber); handler != nil && dec != nil {
+		c, ok := conn.(net.Conn)
+		if !ok {
+			log.Printf("rpc server: upgrade %x needs a net.Conn", opt.MagicNumber)
+			return
+		}
+		// json.Decoder可能多读了option后面的数据，需要先交给handler
+		handler(&upgradedConn{Conn: c, r: io.MultiReader(dec.Buffered(), c)})
 		return
 	}
 
+	setNoDelay(conn, !opt.EnableNagle)
+	opt.JsonConfig = server.jsonCodecConfig()
+	readBufferSize, writeBufferSize := server.bufferSizes()
+	opt.WriteBufferSize = writeBufferSize
+
+	if opt.MagicNumber != MagicNumber {
+		if !server.magicNumberCheckDisabled() {
+			log.Printf("rpc server: invalid magic number %x", opt.MagicNumber)
+			return
+		}
+		log.Printf("rpc server: warning: magic number check disabled, accept magic number %x", opt.MagicNumber)
+	}
+
 	// 根据CodeType得到对应的消息编解码器
-	f := codec.NewCodecFuncMap[opt.CodecType]
+	f := codecFunc(&opt)
+	if _, ok := codec.Lookup(opt.FallbackCodecType); f == nil && ok {
+		// 不支持请求的编解码器，使用备用的，返回给客户端的opt里会带上实际使用的编解码器
+		log.Printf("rpc server: codec type %s not supported, fallback to %s", opt.CodecType, opt.FallbackCodecType)
+		opt.CodecType = opt.FallbackCodecType
+		f = codecFunc(&opt)
+	}
 	if f == nil {
 		log.Printf("rpc server: invalid codec type %s", opt.CodecType)
 		return
 	}
+	if server.proxy != nil {
+		if err := server.proxy.checkCodec(opt.CodecType); err != nil {
+			// 二进制头部没有地方放错误信息，只能直接关闭连接
+			log.Println(err)
+			if !opt.BinaryOptionExchange {
+				opt.Error = err.Error()
+				_ = writeOption(conn, &opt)
+			}
+			return
+		}
+	}
 
 	// server.serveCodec(f(conn), &opt)
 
-	cc := f(conn)
+	// 统计每个方法的请求和响应大小
+	cc := newCountingCodec(f, conn, readBufferSize)
 	// 接受到option之后，立马返回通知客户端，告诉客户端服务端已经交换完协议了
 	// 这一步也是为了防止粘包，如果直接调用server.serveCodec(f(conn), &opt)，会有Option|Header格式的报文回来
-	if err := json.NewEncoder(conn).Encode(opt); err != nil {
+	writeOpt := writeOption
+	if opt.BinaryOptionExchange {
+		writeOpt = writeBinaryOption
+	}
+	if err := writeOpt(conn, &opt); err != nil {
 		log.Println("rpc server: option error :", err)
 		return
 	}
+	server.codecNegotiated(conn, opt.CodecType)
+
+	server.serveCodec(ctx, cc, &opt)
+}
+
+// 注册协议升级的处理方法，客户端发送的option里MagicNumber等于magic时，连接交给handler处理，
+// 这样同一个端口可以同时提供simpleRPC和自定义的协议，handler返回之后连接会被关闭
+func (server *Server) RegisterUpgradeHandler(magic uint32, handler func(conn net.Conn)) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if server.upgrades == nil {
+		server.upgrades = make(map[uint32]func(conn net.Conn))
+	}
+	server.upgrades[magic] = handler
+}
+
+func (server *Server) upgradeHandler(magic int) func(conn net.Conn) {
+	if magic == MagicNumber || magic < 0 || int64(magic) > math.MaxUint32 {
+		return nil
+	}
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return server.upgrades[uint32(magic)]
+}
+
+// 升级之后的连接，先读json.Decoder里缓存的数据
+type upgradedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *upgradedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// 不交换协议，直接使用codecType处理连接上的请求，用于协议适配等已经确定了编解码器的场景
+func (server *Server) ServeConnRaw(conn io.ReadWriteCloser, codecType codec.Type) {
+	opt := Option{MagicNumber: MagicNumber, CodecType: codecType, JsonConfig: server.jsonCodecConfig()}
+	f := codecFunc(&opt)
+	if f == nil {
+		log.Printf("rpc server: invalid codec type %s", codecType)
+		_ = conn.Close()
+		return
+	}
+	server.serveCodec(context.Background(), newCountingCodec(f, conn, 0), &opt)
+}
 
-	server.serveCodec(cc, &opt)
+// 发送option，不使用json.Encoder是因为它会在后面加一个换行符，
+// 对端的json.Decoder读到'}'就结束了，换行符如果没有一起读走，会被当成后面编解码器的数据
+func writeOption(conn io.Writer, opt *Option) error {
+	b, err := json.Marshal(opt)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(b)
+	return err
+}
+
+// 根据opt获取编解码器的创建方法，Gob编解码器支持设置写缓冲区大小，Json编解码器支持自定义序列化方法
+func codecFunc(opt *Option) codec.NewCodecFunc {
+	if opt.TimeLocation != nil {
+		inner := *opt
+		inner.TimeLocation = nil
+		f, loc := codecFunc(&inner), opt.TimeLocation
+		if f == nil {
+			return nil
+		}
+		return func(conn io.ReadWriteCloser) codec.Codec {
+			return codec.NewDateTimeNormalizer(f(conn), loc)
+		}
+	}
+	f, ok := codec.Lookup(opt.CodecType)
+	if !ok {
+		return nil
+	}
+	if opt.CodecType == codec.GobType && opt.WriteBufferSize > 0 {
+		size := opt.WriteBufferSize
+		return func(conn io.ReadWriteCloser) codec.Codec {
+			return codec.NewGobCodecSize(conn, size)
+		}
+	}
+	if opt.CodecType == codec.JsonType && opt.JsonConfig != nil {
+		config := opt.JsonConfig
+		return func(conn io.ReadWriteCloser) codec.Codec {
+			return codec.NewJsonCodecWithConfig(conn, config)
+		}
+	}
+	return f
+}
+
+// 如果是tcp连接，设置TCP_NODELAY
+func setNoDelay(conn io.ReadWriteCloser, noDelay bool) {
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		_ = tcpConn.SetNoDelay(noDelay)
+	}
 }
 
 // struct{}表示struct类型，是一个无元素的结构体类型，通常在没有信息存储时使用。
@@ -112,26 +618,85 @@ func(server *Server) ServeConn(conn io.ReadWriteCloser) {
 // }{Name:"test", Age:1}
 var invalidRequest = struct {}{}
 
-func (server *Server) serveCodec(cc codec.Codec, opt *Option) {
+// ctx取消的时候关闭连接，正在处理的请求处理完之后返回
+func (server *Server) serveCodec(ctx context.Context, cc codec.Codec, opt *Option) {
+	setTypeRegistry(cc, server.types)
 	sending := new(sync.Mutex)
 	wg := new(sync.WaitGroup)
+	streams := make(map[uint64]*serverStream) // 正在进行的流式调用
+	if ctx.Done() != nil {
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			select {
+			case <-ctx.Done():
+				// 关闭连接，阻塞在读取请求的循环会返回错误退出
+				_ = cc.Close()
+			case <-done:
+			}
+		}()
+	}
+
+	if server.proxy != nil {
+		server.proxy.serve(server, cc, sending, wg, opt)
+		wg.Wait()
+		_ = cc.Close()
+		return
+	}
+
 	for {
 		// 读取请求
-		req, err := server.readRequest(cc)
+		req, err := server.readRequest(ctx, cc)
 		if err != nil {
 			if req == nil {
 				break;
 			}
-			req.h.Error = err.Error()
+			if rpcErr, ok := err.(*RPCError); ok && rpcErr.Code == errs.MethodNotFound && server.strictCheck() {
+				log.Println("rpc server: close connection for unknown service:", req.h.ServiceMethod)
+				break
+			}
+			if req.h.FireAndForget {
+				log.Printf("rpc server: fire and forget call %s err: %v", req.h.ServiceMethod, err)
+				continue
+			}
+			server.setHeaderError(req.h, err)
 			// 出错了的话，回复请求
 			server.sendResponse(cc, req.h, invalidRequest, sending)
 			continue
 		}
+		if req.h.ServiceMethod == pingMethod {
+			server.sendResponse(cc, req.h, invalidRequest, sending)
+			continue
+		}
+		if req.mtype.stream {
+			server.handleStreamFrame(cc, req, streams, sending, wg)
+			continue
+		}
 		wg.Add(1)
 		// 处理请求
 		// go server.handleRequest(cc, req, sending, wg)
-		go server.handleRequestWithTimeout(cc, req, sending, wg, opt.HandleTimeout)
+		if pool := server.pool(); pool != nil {
+			err := pool.submit(req.h.Priority, func() {
+				server.handleRequestWithTimeout(cc, req, sending, wg, opt)
+			})
+			if err == errWorkerQueueFull {
+				wg.Done()
+				if req.h.FireAndForget {
+					log.Printf("rpc server: fire and forget call %s err: %v", req.h.ServiceMethod, err)
+					continue
+				}
+				server.setHeaderError(req.h, err)
+				server.sendResponse(cc, req.h, invalidRequest, sending)
+				continue
+			}
+			// 协程池已经被替换的话，和没有协程池一样每个请求一个协程
+			if err == nil {
+				continue
+			}
+		}
+		go server.handleRequestWithTimeout(cc, req, sending, wg, opt)
 	}
+	endStreams(streams)
 	wg.Wait()
 	_ = cc.Close()
 }
@@ -150,6 +715,12 @@ type request struct {
 
 	mtype *methodType
 	scv *service
+	ctx context.Context // 连接的ctx，带上请求头里的链路追踪信息、correlation id和截止时间，会传给第一个参数是context.Context的服务方法
+	received time.Time // 收到请求的时间，客户端带的剩余时间从这里开始算
+	start time.Time // 开始处理的时间
+	remoteAddr string
+	slowReported int32 // 是否已经报告过慢调用
+	chunk []byte // 流式调用的数据块
 }
 
 func (server *Server) readRequestHeader(cc codec.Codec) (*codec.Header, error) {
@@ -163,13 +734,23 @@ func (server *Server) readRequestHeader(cc codec.Codec) (*codec.Header, error) {
 	return &h, nil
 }
 
-func (server *Server) readRequest(cc codec.Codec) (*request, error) {
+func (server *Server) readRequest(ctx context.Context, cc codec.Codec) (*request, error) {
+	start := bytesRead(cc)
 	h, err := server.readRequestHeader(cc)
 	if err != nil {
 		return nil, err
 	}
+	received := time.Now()
+	if h.ServiceMethod == pingMethod {
+		// 心跳，不需要查找服务
+		return &request{h: h}, cc.ReadBody(nil)
+	}
 
-	req := &request{h: h}
+	if tc, ok := TraceContextFromContext(ExtractTraceContext(h)); ok {
+		ctx = WithTraceContext(ctx, tc)
+	}
+	req := &request{h: h, ctx: extractCorrelationID(ctx, h), received: received}
+	log.Printf("rpc server: request %s correlation id %s", h.ServiceMethod, CorrelationIDFromContext(req.ctx))
 
 	/*
 	req.argv = reflect.New(reflect.TypeOf(""))
@@ -181,7 +762,22 @@ func (server *Server) readRequest(cc codec.Codec) (*request, error) {
 	// todo 处理客户端发送过来的数据
 	req.scv, req.mtype, err = server.findService(h.ServiceMethod)
 	if err != nil {
-		return req, err
+		// 丢掉body，后面的请求才能正常读取
+		_ = cc.ReadBody(nil)
+		return req, &RPCError{Code: errs.MethodNotFound, Message: err.Error()}
+	}
+	if req.mtype.stream {
+		// 普通调用流式方法的话，服务方法永远等不到StreamEnd，直接拒绝
+		if h.Stream == codec.StreamNone {
+			_ = cc.ReadBody(nil)
+			return req, &RPCError{Code: errs.Validation, Message: "rpc server: " + h.ServiceMethod + " is a stream method, call it with Pipe"}
+		}
+		if err = cc.ReadBody(&req.chunk); err != nil {
+			log.Println("rpc server: read body err:", err)
+			return req, &RPCError{Code: errs.Validation, Message: err.Error()}
+		}
+		req.mtype.recordRequestBytes(bytesRead(cc) - start)
+		return req, nil
 	}
 	req.argv = req.mtype.newArgv()
 	req.replyv = req.mtype.newReplyv()
@@ -191,38 +787,103 @@ func (server *Server) readRequest(cc codec.Codec) (*request, error) {
 		argvi = req.argv.Addr().Interface()
 	}
 	if err = cc.ReadBody(argvi); err != nil {
-		log.Println("rpc server: read body err:", err)
-		return req, err
+		err = fmt.Errorf("rpc server: failed to decode arg for %s (type %s): %w", h.ServiceMethod, req.mtype.ArgType, err)
+		log.Println(err)
+		return req, &RPCError{Code: errs.Validation, Message: err.Error()}
 	}
+	req.mtype.recordRequestBytes(bytesRead(cc) - start)
 
 
 
 	return req, nil
 }
 
-func (server *Server) sendResponse(cc codec.Codec, h *codec.Header, body interface{}, sending *sync.Mutex) {
+// 发送响应，返回写入的字节数（cc不统计字节数的话返回0）
+func (server *Server) sendResponse(cc codec.Codec, h *codec.Header, body interface{}, sending *sync.Mutex) int64 {
 	sending.Lock()
 	defer sending.Unlock()
+	if atomic.LoadInt32(&server.reportLoad) != 0 {
+		server.setLoadHeader(h)
+	}
+	start := bytesWritten(cc)
 	if err := cc.Write(h, body); err != nil {
 		log.Println("rpc server: write response error:", err)
 	}
+	return bytesWritten(cc) - start
 }
 
-func (server *Server) handleRequestWithTimeout(cc codec.Codec, req *request, sending *sync.Mutex, wg *sync.WaitGroup, timeout time.Duration) {
+// 处理超时还剩下的毫秒数，客户端可以根据这个值调整HandleTimeout，timeout为0（不限）时返回0
+func remainingBudgetMs(start time.Time, timeout time.Duration) int64 {
+	if timeout <= 0 {
+		return 0
+	}
+	remaining := timeout - time.Since(start)
+	if remaining < 0 {
+		return 0
+	}
+	return int64(remaining / time.Millisecond)
+}
+
+func (server *Server) handleRequestWithTimeout(cc codec.Codec, req *request, sending *sync.Mutex, wg *sync.WaitGroup, opt *Option) {
 	defer wg.Done()
-	called := make(chan struct{})
-	sent := make(chan struct{})
+	start := req.received
+	if start.IsZero() {
+		start = time.Now()
+	}
+	// 客户端在请求头里带了剩余时间的话，使用它和HandleTimeout里早的那个
+	// 服务方法通过ctx拿到截止时间，超时之后ctx也会取消
+	deadline := requestDeadline(req.h, start, opt.HandleTimeout)
+	if req.ctx == nil {
+		req.ctx = context.Background()
+	}
+	if !deadline.IsZero() {
+		var cancel context.CancelFunc
+		req.ctx, cancel = context.WithDeadline(req.ctx, deadline)
+		defer cancel()
+	}
+
+	if req.h.FireAndForget {
+		// 客户端不等待响应，只执行服务方法
+		if err := server.handle(cc, req, opt); err != nil {
+			log.Printf("rpc server: fire and forget call %s err: %v", req.h.ServiceMethod, err)
+		}
+		return
+	}
+
+	var timeout, wait time.Duration
+	if !deadline.IsZero() {
+		timeout = deadline.Sub(start)
+		wait = time.Until(deadline)
+		if wait <= 0 {
+			// 已经过了截止时间，马上返回超时
+			wait = time.Nanosecond
+		}
+	}
+	// 有缓冲，超时返回之后服务方法的协程不会阻塞在这里
+	called := make(chan struct{}, 1)
+	sent := make(chan struct{}, 1)
+	// 先把它从0改成1的一方发送响应，同一个请求只发送一次响应（处理结果或者超时）
+	var replied int32
+	stopKeepAlive := server.startKeepAlive(cc, req.h, server.keepAliveAckInterval(), sending)
+	defer stopKeepAlive()
 	go func(){
-		err := req.scv.call(req.mtype, req.argv, req.replyv)
+		err := server.handle(cc, req, opt)
+		stopKeepAlive()
 		called <- struct{}{}
+		if !atomic.CompareAndSwapInt32(&replied, 0, 1) {
+			// 已经返回超时了，不再发送处理结果
+			return
+		}
+		req.h.RemainingBudgetMs = remainingBudgetMs(start, timeout)
 		if err != nil {
-			req.h.Error = err.Error()
-			server.sendResponse(cc, req.h, invalidRequest, sending)
+			server.setHeaderError(req.h, err)
+			req.mtype.recordResponseBytes(server.sendResponse(cc, req.h, invalidRequest, sending))
 			sent <- struct{}{}
 			return
 		}
 
-		server.sendResponse(cc, req.h, req.replyv.Interface(), sending)
+		body := compressBody(req.h, req.replyv.Interface(), server.compressAbove(), opt)
+		req.mtype.recordResponseBytes(server.sendResponse(cc, req.h, body, sending))
 		sent <- struct{}{}
 	}()
 
@@ -233,14 +894,77 @@ func (server *Server) handleRequestWithTimeout(cc codec.Codec, req *request, sen
 	}
 
 	select {
-	case <-time.After(timeout):
-		req.h.Error = fmt.Sprintf("rpc server: request handle timeout expect within %s", timeout)
-		server.sendResponse(cc, req.h, invalidRequest, sending)
+	case <-time.After(wait):
+		if !atomic.CompareAndSwapInt32(&replied, 0, 1) {
+			// 服务方法刚好执行完，正在发送处理结果
+			<-sent
+			return
+		}
+		req.h.ErrorCode = errs.Timeout
+		req.h.ErrorMessage = fmt.Sprintf("rpc server: request handle timeout expect within %s", timeout)
+		req.h.RemainingBudgetMs = 0
+		req.mtype.recordResponseBytes(server.sendResponse(cc, req.h, invalidRequest, sending))
 	case <-called:
 		<-sent
 	}
 }
 
+// 获取服务的并发名额，记录正在处理的请求，然后调用服务方法
+func (server *Server) handle(cc codec.Codec, req *request, opt *Option) error {
+	atomic.AddInt64(&server.waiting, 1)
+	release := server.acquireService(req.scv.name)
+	atomic.AddInt64(&server.waiting, -1)
+	defer release()
+	atomic.AddInt64(&server.inFlight, 1)
+	defer atomic.AddInt64(&server.inFlight, -1)
+	req.start = time.Now()
+	if req.remoteAddr == "" {
+		req.remoteAddr = remoteAddr(cc)
+	}
+	server.inflight.Store(req, struct{}{})
+	defer server.inflight.Delete(req)
+	req.mtype.vars.inflight.Add(1)
+	err := server.intercept(req, func() error {
+		return server.invoke(req, opt)
+	})
+	req.mtype.vars.inflight.Add(-1)
+	req.mtype.vars.record(time.Since(req.start), err)
+	return err
+}
+
+// 调用服务方法，结果写到req.replyv
+func (server *Server) invoke(req *request, opt *Option) error {
+	includeStack := server.includeStackTrace()
+	call := func(replyv reflect.Value) error {
+		if includeStack {
+			return req.scv.callWithStack(req.mtype, req.ctx, req.argv, replyv)
+		}
+		err := req.scv.call(req.mtype, req.ctx, req.argv, replyv)
+		// 没有开启时不返回WithStack记录的调用栈
+		if e, ok := err.(*stackError); ok {
+			return e.err
+		}
+		return err
+	}
+	if !opt.CoalesceIdenticalCalls {
+		return call(req.replyv)
+	}
+
+	key, ok := coalesceKey(req)
+	if !ok {
+		return call(req.replyv)
+	}
+	// 相同的请求正在处理的话，等待它的结果，不再重复调用
+	replyv, err := server.flights.do(key, func() (reflect.Value, error) {
+		err := call(req.replyv)
+		return req.replyv, err
+	})
+	if replyv != req.replyv {
+		req.replyv.Elem().Set(replyv.Elem())
+	}
+	return err
+}
+
 func (server *Server) handleRequest(cc codec.Codec, req *request, sending *sync.Mutex, wg *sync.WaitGroup) {
 	defer wg.Done()
 	// log.Println(req.h, req.argv.Elem())
@@ -248,9 +972,9 @@ func (server *Server) handleRequest(cc codec.Codec, req *request, sending *sync.
 
 
 	// todo 远程调用
-	err := req.scv.call(req.mtype, req.argv, req.replyv)
+	err := req.scv.call(req.mtype, req.ctx, req.argv, req.replyv)
 	if err != nil {
-		req.h.Error = err.Error()
+		server.setHeaderError(req.h, err)
 		server.sendResponse(cc, req.h, invalidRequest, sending)
 		return
 	}
@@ -260,10 +984,150 @@ func (server *Server) handleRequest(cc codec.Codec, req *request, sending *sync.
 }
 
 func (server *Server) Register(rcvr interface{}) error {
-	s := newService(rcvr)
+	return server.register(newService(rcvr))
+}
+
+func (server *Server) register(s *service) error {
 	if _, dup := server.serviceMap.LoadOrStore(s.name, s); dup {
 		return errors.New("rpc: service already defined:" + s.name)
 	}
+	server.publishMethodVars(s.name, s.method)
+	return nil
+}
+
+// 和Register一样，但是先检查rcvr的所有导出方法的签名，有不符合的方法时返回错误，不注册服务
+// Register会直接忽略签名不符合的方法，调用的时候才发现方法不存在
+func (server *Server) RegisterChecked(rcvr interface{}) error {
+	typ := reflect.TypeOf(rcvr)
+	_, hasHooks := rcvr.(ServiceHooks)
+	var problems []string
+	for i := 0; i < typ.NumMethod(); i ++ {
+		method := typ.Method(i)
+		if hasHooks && isHookMethod(method.Name) {
+			continue
+		}
+		if problem := checkMethodType(method.Type); problem != "" {
+			problems = append(problems, fmt.Sprintf("method %s: %s", method.Name, problem))
+		}
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return server.Register(rcvr)
+}
+
+// 检查服务方法的签名，符合的话返回空字符串，参数个数包括接收者
+func checkMethodType(mType reflect.Type) string {
+	errorType := reflect.TypeOf((*error)(nil)).Elem()
+	if mType.NumIn() == 2 && mType.In(1) == pipeStreamType && mType.NumOut() == 1 && mType.Out(0) == errorType {
+		return ""
+	}
+	// 第一个参数可以是context.Context
+	first := 1
+	if mType.NumIn() == 4 && mType.In(1) == contextType {
+		first = 2
+	}
+	if mType.NumIn() != first + 2 {
+		return fmt.Sprintf("has %d parameters, want 3", mType.NumIn())
+	}
+	if mType.NumOut() != 1 {
+		return fmt.Sprintf("has %d return values, want 1", mType.NumOut())
+	}
+	if mType.Out(0) != errorType {
+		return fmt.Sprintf("return type %s is not error", mType.Out(0))
+	}
+	argType, replyType := mType.In(first), mType.In(first + 1)
+	if !isExportedOrBuiltinType(argType) {
+		return fmt.Sprintf("argument type %s is not exported", argType)
+	}
+	if !isExportedOrBuiltinType(replyType) {
+		return fmt.Sprintf("reply type %s is not exported", replyType)
+	}
+	if err := checkArgReplyTypes(argType, replyType); err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+// 通过RegisterFunc注册的函数所在的服务名
+const funcServiceName = "Func"
+
+// 把普通函数 func(args A, reply *R) error 注册成服务方法，通过 "Func.<name>" 调用
+// 和结构体方法一样，第一个参数也可以是context.Context
+// 不需要为了一两个方法专门定义结构体，适合脚本和快速原型
+func (server *Server) RegisterFunc(name string, fn interface{}) error {
+	if !ast.IsExported(name) {
+		return fmt.Errorf("rpc: func name %q is not exported", name)
+	}
+	fv := reflect.ValueOf(fn)
+	if fv.Kind() != reflect.Func {
+		return fmt.Errorf("rpc: RegisterFunc %s: %T is not a function", name, fn)
+	}
+	fType := fv.Type()
+	withContext := fType.NumIn() == 3 && fType.In(0) == contextType
+	if (fType.NumIn() != 2 && !withContext) || fType.NumOut() != 1 || fType.Out(0) != reflect.TypeOf((*error)(nil)).Elem() {
+		return fmt.Errorf("rpc: RegisterFunc %s: want func(args A, reply *R) error, got %s", name, fType)
+	}
+	argType, replyType := fType.In(0), fType.In(1)
+	if withContext {
+		argType, replyType = fType.In(1), fType.In(2)
+	}
+	if err := checkArgReplyTypes(argType, replyType); err != nil {
+		return fmt.Errorf("rpc: RegisterFunc %s: %v", name, err)
+	}
+	if !isExportedOrBuiltinType(argType) || !isExportedOrBuiltinType(replyType) {
+		return fmt.Errorf("rpc: RegisterFunc %s: argument or reply type is not exported", name)
+	}
+
+	// 服务注册之后会被并发读取，所以复制一份新的服务再替换掉原来的
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	s := &service{name: funcServiceName, method: make(map[string]*methodType)}
+	if v, ok := server.serviceMap.Load(funcServiceName); ok {
+		old := v.(*service)
+		if old.rcvr.IsValid() {
+			return errors.New("rpc: service already defined:" + funcServiceName)
+		}
+		if _, dup := old.method[name]; dup {
+			return errors.New("rpc: func already defined:" + funcServiceName + "." + name)
+		}
+		for k, m := range old.method {
+			s.method[k] = m
+		}
+	}
+	s.method[name] = &methodType{
+		method: reflect.Method{Name: name, Type: fType, Func: fv},
+		ArgType: argType,
+		ReplyType: replyType,
+		withContext: withContext,
+		vars: newMethodVars(),
+	}
+	server.serviceMap.Store(funcServiceName, s)
+	server.publishMethodVars(funcServiceName, map[string]*methodType{name: s.method[name]})
+	log.Printf("rpc server: register %s.%s\n", funcServiceName, name)
+	return nil
+}
+
+// 替换已经注册的同名服务，正在处理的请求不受影响，之后的请求使用新的rcvr
+// 新服务的调用次数等统计信息从0开始
+func (server *Server) Swap(rcvr interface{}) error {
+	return server.swap(newService(rcvr))
+}
+
+// 检查和替换在同一个锁里完成，和RegisterFunc的复制替换互斥
+func (server *Server) swap(s *service) error {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	v, ok := server.serviceMap.Load(s.name)
+	if !ok {
+		return errors.New("rpc: service not defined:" + s.name)
+	}
+	if !v.(*service).rcvr.IsValid() {
+		// RegisterFunc注册的函数没有rcvr，不能用结构体替换
+		return errors.New("rpc: service registered by RegisterFunc can't be swapped:" + s.name)
+	}
+	server.serviceMap.Store(s.name, s)
+	server.publishMethodVars(s.name, s.method)
 	return nil
 }
 
@@ -290,6 +1154,25 @@ func (server *Server) findService(serviceMethod string) (svc *service, mtype *me
 	return
 }
 
+// 注册参数和返回值类型，这个Server的自描述编解码器连接可以根据类型名创建实例，
+// 例如代理服务（NewProxyServer）需要注册转发的所有参数和返回值类型
+// 每个Server有自己的类型注册表，不影响其他Server
+func (server *Server) RegisterTypes(types ...interface{}) {
+	for _, t := range types {
+		server.types.Register(t)
+	}
+}
+
+// cc是自描述编解码器（或者包装了它的countingCodec）时，使用registry创建实例
+func setTypeRegistry(cc codec.Codec, registry *codec.TypeRegistry) {
+	if c, ok := cc.(*countingCodec); ok {
+		cc = c.Codec
+	}
+	if c, ok := cc.(*codec.SelfDescribingCodec); ok {
+		c.SetTypeRegistry(registry)
+	}
+}
+
 func Register(rcvr interface{}) error {
 	return DefaultServer.Register(rcvr)
 }
@@ -298,17 +1181,87 @@ func Register(rcvr interface{}) error {
 
 
 
+// 服务方法可选的第一个参数的类型
+var contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+
 type methodType struct {
 	method reflect.Method // 方法本身
 	ArgType reflect.Type // 第一个参数的类型
 	ReplyType reflect.Type // 第二个参数的类型
 	numCalls uint64 // 后续统计方法调用次数时会用到
+	requestBytes int64 // 请求的总字节数
+	maxRequestBytes int64 // 最大的请求字节数
+	responseBytes int64 // 响应的总字节数
+	maxResponseBytes int64 // 最大的响应字节数
+	stream bool // 是否是流式调用的方法（参数是PipeStream）
+	withContext bool // 第一个参数是否是context.Context
+	vars *methodVars // 发布到expvar的统计信息
+	Tags map[string]string // 方法注释里的标签，见MethodTagParser
+}
+
+// 所有服务方法的统计信息，可以通过 /debug/vars 查看
+// 第一层的key为Server.StatsName()，第二层的key为 Service.Method，多个Server的同名服务互不影响
+var methodsVar = expvar.NewMap("simplerpc.methods")
+
+// 一个服务方法发布到expvar的统计信息
+type methodVars struct {
+	calls, errors, inflight *expvar.Int
+	avgDurationMs *expvar.Float
+	totalDuration int64 // 所有调用的总耗时，用来计算平均耗时
+}
+
+func newMethodVars() *methodVars {
+	return &methodVars{calls: new(expvar.Int), errors: new(expvar.Int), inflight: new(expvar.Int), avgDurationMs: new(expvar.Float)}
+}
+
+// 把服务方法的统计信息发布到这个Server的simplerpc.methods下面，同名的方法重复注册（例如Swap）时替换掉原来的
+// 在服务注册成功（检查完方法签名）之后调用，没有注册的方法不会出现在统计信息里
+func (server *Server) publishMethodVars(serviceName string, methods map[string]*methodType) {
+	for name, mType := range methods {
+		v := mType.vars
+		m := new(expvar.Map).Init()
+		m.Set("calls", v.calls)
+		m.Set("errors", v.errors)
+		m.Set("inflight", v.inflight)
+		m.Set("avg_duration_ms", v.avgDurationMs)
+		server.methodVars.Set(serviceName + "." + name, m)
+	}
+}
+
+// 记录一次调用的结果
+func (v *methodVars) record(d time.Duration, err error) {
+	v.calls.Add(1)
+	if err != nil {
+		v.errors.Add(1)
+	}
+	total := atomic.AddInt64(&v.totalDuration, int64(d))
+	v.avgDurationMs.Set(float64(total) / float64(v.calls.Value()) / float64(time.Millisecond))
 }
 
 func (m *methodType) NumCalls() uint64 {
 	return atomic.LoadUint64(&m.numCalls)
 }
 
+func (m *methodType) recordRequestBytes(n int64) {
+	atomic.AddInt64(&m.requestBytes, n)
+	storeMax(&m.maxRequestBytes, n)
+}
+
+func (m *methodType) recordResponseBytes(n int64) {
+	atomic.AddInt64(&m.responseBytes, n)
+	storeMax(&m.maxResponseBytes, n)
+}
+
+// 如果n比addr的值大，就更新addr
+func storeMax(addr *int64, n int64) {
+	for {
+		old := atomic.LoadInt64(addr)
+		if n <= old || atomic.CompareAndSwapInt64(addr, old, n) {
+			return
+		}
+	}
+}
+
 func (m *methodType) newArgv() reflect.Value {
 	var argv reflect.Value
 	// 获取参数类型，参数有可能是指针类型或者值类型
@@ -345,7 +1298,7 @@ func (m *methodType) newReplyv() reflect.Value {
 type service struct {
 	name string // 结构体名称（如WaitGroup）
 	typ reflect.Type // 结构体的类型(指针的Value类型，因为nerService传的rcvr就是指针)
-	rcvr reflect.Value // 结构体的实例本身(指针的Value类型，因为nerService传的rcvr就是指针)
+	rcvr reflect.Value // 结构体的实例本身(指针的Value类型，因为nerService传的rcvr就是指针)，RegisterFunc注册的函数服务没有实例
 	method map[string]*methodType // 存储映射的结构体的所有符合条件的方法
 }
 
@@ -361,19 +1314,53 @@ func newService(rcvr interface{}) *service {
 	if !ast.IsExported(s.name) {
 		log.Fatalf("rpc server: %s is not a valid service name", s.name)
 	}
+	// 先去掉检查不通过的方法，注册成功之后只发布剩下的方法的统计信息（见publishMethodVars）
 	s.registerMethods()
+	for _, err := range s.validateMethods() {
+		log.Println(err)
+	}
+	names := make([]string, 0, len(s.method))
+	for name := range s.method {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if s.method[name].stream {
+			log.Printf("rpc server: register stream %s.%s\n", s.name, name)
+		} else {
+			log.Printf("rpc server: register %s.%s\n", s.name, name)
+		}
+	}
 	return s
 }
 
 func (s *service) registerMethods() {
 	s.method = make(map[string]*methodType)
+	_, hasHooks := s.rcvr.Interface().(ServiceHooks)
 	for i := 0; i < s.typ.NumMethod(); i ++ {
 		method := s.typ.Method(i)
 		mType := method.Type
+		// BeforeCall 的签名也符合条件，实现了ServiceHooks的话不能注册成服务方法
+		if hasHooks && isHookMethod(method.Name) {
+			continue
+		}
 		// mType.NumIn() 方法的输入参数个数
 		// mType.NumOut() 方法的返回值个数
 		// 反射出来的对象参数，会比原来多一个对象自身参数，类似于python的self，java中的this
-		if mType.NumIn() != 3 || mType.NumOut() != 1 {
+		// 流式调用的方法：func (t *T) Method(stream PipeStream) error
+		if mType.NumIn() == 2 && mType.In(1) == pipeStreamType && mType.NumOut() == 1 && mType.Out(0) == reflect.TypeOf((*error)(nil)).Elem() {
+			s.method[method.Name] = &methodType{
+				method: method,
+				ArgType: pipeStreamType,
+				ReplyType: pipeStreamType,
+				stream: true,
+				vars: newMethodVars(),
+			}
+			continue
+		}
+		// 也可以在参数前面加一个context.Context：func (t *T) Method(ctx context.Context, args A, reply *R) error
+		withContext := mType.NumIn() == 4 && mType.In(1) == contextType
+		if (mType.NumIn() != 3 && !withContext) || mType.NumOut() != 1 {
 			continue
 		}
 		// mType.Out(0):返回一个函数类型的第i个输出参数的类型
@@ -384,6 +1371,9 @@ func (s *service) registerMethods() {
 
 		// 校验第一个输入参数和第二个输入参数
 		argType, replyType := mType.In(1), mType.In(2)
+		if withContext {
+			argType, replyType = mType.In(2), mType.In(3)
+		}
 		if !isExportedOrBuiltinType(argType) || !isExportedOrBuiltinType(replyType) {
 			continue
 		}
@@ -392,11 +1382,56 @@ func (s *service) registerMethods() {
 			method: method,
 			ArgType: argType,
 			ReplyType: replyType,
+			withContext: withContext,
+			vars: newMethodVars(),
 		}
-		log.Printf("rpc server: register %s.%s\n", s.name, method.Name)
 	}
 }
 
+// 检查registerMethods注册的方法的参数和返回值类型，不符合的方法不注册，返回所有的错误
+// 签名正确但类型有问题的方法注册之后调用时才会出错（例如reply不是指针时newReplyv会panic），所以在这里去掉
+func (s *service) validateMethods() []error {
+	names := make([]string, 0, len(s.method))
+	for name := range s.method {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var problems []error
+	for _, name := range names {
+		m := s.method[name]
+		if m.stream {
+			continue
+		}
+		if err := checkArgReplyTypes(m.ArgType, m.ReplyType); err != nil {
+			problems = append(problems, fmt.Errorf("rpc server: method %s.%s not registered: %v", s.name, name, err))
+			delete(s.method, name)
+			continue
+		}
+		if m.ArgType.Kind() == reflect.Slice && m.ArgType.Elem().Kind() == reflect.Interface {
+			// 元素的实际类型需要提前gob.Register，否则解码失败
+			log.Printf("rpc server: warning: argument type %s of %s.%s contains interfaces, concrete types must be registered with the codec\n", m.ArgType, s.name, name)
+		}
+	}
+	return problems
+}
+
+// 检查参数和返回值的类型能不能正常编解码，reply必须是指针，参数不能是chan、func或者interface{}
+func checkArgReplyTypes(argType, replyType reflect.Type) error {
+	if replyType.Kind() != reflect.Ptr {
+		return fmt.Errorf("reply type %s is not a pointer", replyType)
+	}
+	switch argType.Kind() {
+	case reflect.Chan, reflect.Func:
+		return fmt.Errorf("argument type %s cannot be encoded", argType)
+	case reflect.Interface:
+		if argType.NumMethod() == 0 {
+			return fmt.Errorf("argument type %s cannot be encoded", argType)
+		}
+	}
+	return nil
+}
+
 func isExportedOrBuiltinType(t reflect.Type) bool {
 	// 1. ast.IsExported：检测方法是否可导出（也就是是否为public类型）
 	// 2. PkgPath返回类型的包路径，即明确指定包的import路径，如"encoding/base64"
@@ -409,14 +1444,102 @@ func isExportedOrBuiltinType(t reflect.Type) bool {
 	return ast.IsExported(t.Name()) || t.PkgPath() == ""
 }
 
-func (s *service) call(m *methodType, argv, replyv reflect.Value) error {
+// 服务可以实现这个接口，在每个方法调用前后做一些处理
+type ServiceHooks interface {
+	// 方法调用前调用，返回错误的话不再调用方法，直接把错误返回给客户端
+	BeforeCall(method string, args interface{}) error
+	// 方法调用后调用，err是方法返回的错误
+	AfterCall(method string, reply interface{}, err error)
+}
+
+// ServiceHooks的方法，不是服务方法
+func isHookMethod(name string) bool {
+	return name == "BeforeCall" || name == "AfterCall"
+}
+
+// ctx只传给第一个参数是context.Context的方法，为nil时使用context.Background()
+func (s *service) call(m *methodType, ctx context.Context, argv, replyv reflect.Value) error {
 	atomic.AddUint64(&m.numCalls, 1)
+	var hooks ServiceHooks
+	if s.rcvr.IsValid() {
+		hooks, _ = s.rcvr.Interface().(ServiceHooks)
+	}
+	if hooks != nil {
+		if err := hooks.BeforeCall(m.method.Name, argv.Interface()); err != nil {
+			return err
+		}
+	}
+
 	f := m.method.Func
-	returnValues := f.Call([]reflect.Value{s.rcvr, argv, replyv})
+	in := []reflect.Value{argv, replyv}
+	if m.withContext {
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		in = append([]reflect.Value{reflect.ValueOf(&ctx).Elem()}, in...)
+	}
+	if s.rcvr.IsValid() {
+		// 结构体方法的第一个参数是接收者
+		in = append([]reflect.Value{s.rcvr}, in...)
+	}
+	returnValues := f.Call(in)
+	var err error
 	if errInter := returnValues[0].Interface(); errInter != nil {
-		return errInter.(error)
+		err = errInter.(error)
 	}
-	return nil
+
+	if hooks != nil {
+		hooks.AfterCall(m.method.Name, replyv.Interface(), err)
+	}
+	return err
+}
+
+// 带调用栈的错误
+type stackError struct {
+	err error
+	stack string
+}
+
+func (e *stackError) Error() string {
+	return e.err.Error()
+}
+
+func (e *stackError) Unwrap() error {
+	return e.err
+}
+
+// 当前协程的调用栈
+func currentStack() string {
+	buf := make([]byte, 4096)
+	n := runtime.Stack(buf, false)
+	return string(buf[:n])
+}
+
+// 记录调用WithStack的位置的调用栈，服务端开启了SetIncludeStack时会返回给客户端
+// 服务方法返回之后已经不在调用栈里了，所以需要在出错的地方记录，例如 return simpleRPC.WithStack(err)
+func WithStack(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &stackError{err: err, stack: currentStack()}
+}
+
+// 调用方法，方法panic时在recover里记录panic位置的调用栈，返回WithStack包装的错误时使用记录的调用栈
+// 普通的错误没有出错位置的调用栈，不带调用栈返回
+func (s *service) callWithStack(m *methodType, ctx context.Context, argv, replyv reflect.Value) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			// recover的时候panic的函数还在调用栈里
+			err = &stackError{err: fmt.Errorf("rpc server: %s.%s panic: %v", s.name, m.method.Name, p), stack: currentStack()}
+		}
+	}()
+	err = s.call(m, ctx, argv, replyv)
+	var se *stackError
+	if errors.As(err, &se) && err != error(se) {
+		// 包装过的错误，使用外层的错误信息
+		return &stackError{err: err, stack: se.stack}
+	}
+	return err
 }
 
 
@@ -454,10 +1577,27 @@ func (server *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	server.ServeConn(conn)
 }
 
+// HandleHTTP时是否挂载 /debug/pprof/，需要使用 -tags simplerpc_pprof 编译，默认不挂载
+func (server *Server) SetEnablePprof(enable bool) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.enablePprof = enable
+}
+
+func (server *Server) pprofEnabled() bool {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return server.enablePprof
+}
+
 func (server *Server) HandleHTTP() {
 	http.Handle(defaultRPCPath, server)
 	http.Handle(defaultDebugPath, debugHTTP{server})
+	http.HandleFunc(defaultDebugPath + "/version", serveVersion)
 	log.Println("rpc server debug path:", defaultDebugPath)
+	if server.pprofEnabled() {
+		handlePprof()
+	}
 }
 
 func HandleHTTP() {
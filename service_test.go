@@ -1,9 +1,23 @@
 package simpleRPC
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"encoding/json"
+	"expvar"
 	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
+	"simpleRPC/codec"
+	"simpleRPC/errs"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 type Foo int
@@ -46,6 +60,720 @@ func TestMethodType_Call(t *testing.T) {
 	argv := mType.newArgv()
 	replyv := mType.newReplyv()
 	argv.Set(reflect.ValueOf(Args{Num1:1, Num2:3}))
-	err := s.call(mType, argv, replyv)
+	err := s.call(mType, nil, argv, replyv)
 	_assert(err == nil && *replyv.Interface().(*int) == 4 && mType.NumCalls() == 1, "failed to call Foo.Sum")
-}
\ No newline at end of file
+}
+
+type Baz int
+
+func (b *Baz) Fail(args Args, reply *int) error {
+	return errors.New("fail")
+}
+
+func (b *Baz) FailWithStack(args Args, reply *int) error {
+	return fmt.Errorf("wrapped: %w", WithStack(errors.New("fail")))
+}
+
+func (b *Baz) Panic(args Args, reply *int) error {
+	var m map[string]int
+	m["boom"] = 1
+	return nil
+}
+
+func TestService_callWithStack(t *testing.T) {
+	var baz Baz
+	s := newService(&baz)
+	server := NewServer()
+	call := func(method string) *RPCError {
+		mType := s.method[method]
+		err := s.callWithStack(mType, nil, mType.newArgv(), mType.newReplyv())
+		var h codec.Header
+		server.setHeaderError(&h, err)
+		e, _ := headerError(&h).(*RPCError)
+		return e
+	}
+
+	// 调用栈是出错的位置，不是方法返回之后
+	e := call("FailWithStack")
+	_assert(e != nil && e.Message == "wrapped: fail", "expect a RPCError with the wrapped message, but got %v", e)
+	_assert(strings.Contains(e.Stack, "(*Baz).FailWithStack"), "expect stack at the error, but got %s", e.Stack)
+
+	e = call("Panic")
+	_assert(e != nil && strings.Contains(e.Message, "Baz.Panic panic"), "expect a panic error, but got %v", e)
+	_assert(strings.Contains(e.Stack, "(*Baz).Panic"), "expect stack at the panic, but got %s", e.Stack)
+
+	// 普通的错误没有出错位置的调用栈
+	e = call("Fail")
+	_assert(e != nil && e.Message == "fail" && e.Stack == "", "expect no stack for a plain error, but got %v %q", e, e.Stack)
+}
+
+func TestServer_SetIncludeStack(t *testing.T) {
+	server := NewServer()
+	var baz Baz
+	_ = server.Register(&baz)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = l.Close() }()
+	go server.Accept(l)
+	client, _ := Dial("tcp", l.Addr().String())
+	defer func() { _ = client.Close() }()
+
+	var reply int
+	err := client.Call("Baz.FailWithStack", Args{}, &reply)
+	e, ok := err.(*RPCError)
+	_assert(ok && e.Stack == "", "expect no stack before SetIncludeStack, but got %v", err)
+	server.SetIncludeStack(true)
+	err = client.Call("Baz.FailWithStack", Args{}, &reply)
+	e, ok = err.(*RPCError)
+	_assert(ok && strings.Contains(e.Stack, "FailWithStack"), "expect stack after SetIncludeStack, but got %v", err)
+}
+
+func TestServer_Stats(t *testing.T) {
+	server := NewServer()
+	var foo Foo
+	_ = server.Register(&foo)
+
+	stats := server.Stats()
+	_assert(len(stats.Methods) == 1, "expect 1 method, but got %d", len(stats.Methods))
+	m := stats.Methods[0]
+	_assert(m.Service == "Foo" && m.Method == "Sum", "wrong method %s.%s", m.Service, m.Method)
+	_assert(m.ArgTypeName == "simpleRPC.Args" && m.ReplyTypeName == "*int", "wrong type names %s, %s", m.ArgTypeName, m.ReplyTypeName)
+}
+
+type Hooked struct {
+	after []string
+}
+
+func (h *Hooked) Sum(args Args, reply *int) error {
+	*reply = args.Num1 + args.Num2
+	return nil
+}
+
+func (h *Hooked) BeforeCall(method string, args interface{}) error {
+	if args.(Args).Num1 < 0 {
+		return errors.New("negative number")
+	}
+	return nil
+}
+
+func (h *Hooked) AfterCall(method string, reply interface{}, err error) {
+	h.after = append(h.after, fmt.Sprintf("%s %d %v", method, *reply.(*int), err))
+}
+
+func TestService_Hooks(t *testing.T) {
+	h := &Hooked{}
+	s := newService(h)
+	_assert(len(s.method) == 1, "expect hooks are not registered as methods, but got %d methods", len(s.method))
+	mType := s.method["Sum"]
+
+	argv := mType.newArgv()
+	replyv := mType.newReplyv()
+	argv.Set(reflect.ValueOf(Args{Num1: 1, Num2: 3}))
+	err := s.call(mType, nil, argv, replyv)
+	_assert(err == nil && *replyv.Interface().(*int) == 4, "failed to call Hooked.Sum")
+	_assert(len(h.after) == 1 && h.after[0] == "Sum 4 <nil>", "expect AfterCall called, got %v", h.after)
+
+	argv.Set(reflect.ValueOf(Args{Num1: -1, Num2: 3}))
+	err = s.call(mType, nil, argv, mType.newReplyv())
+	_assert(err != nil && err.Error() == "negative number", "expect BeforeCall aborts the call")
+	_assert(len(h.after) == 1, "expect AfterCall not called after BeforeCall fails")
+}
+
+func TestServer_Services(t *testing.T) {
+	server := NewServer()
+	var foo Foo
+	_ = server.Register(&foo)
+	_ = server.Register(&Hooked{})
+
+	services := server.Services()
+	_assert(len(services) == 2, "expect 2 services, but got %d", len(services))
+	_assert(services[0].Name == "Foo" && len(services[0].Methods) == 1, "wrong service %+v", services[0])
+	_assert(services[1].Name == "Hooked" && len(services[1].Methods) == 1, "wrong service %+v", services[1])
+}
+
+func TestCorrelationID(t *testing.T) {
+	var h codec.Header
+	injectCorrelationID(WithCorrelationID(context.Background(), "req-1"), &h)
+	_assert(h.Metadata[CorrelationIDKey] == "req-1", "expect correlation id from ctx, but got %v", h.Metadata)
+	_assert(CorrelationIDFromContext(extractCorrelationID(context.Background(), &h)) == "req-1", "failed to extract correlation id")
+
+	// ctx里没有的话生成新的UUID
+	var h2 codec.Header
+	injectCorrelationID(nil, &h2)
+	id := h2.Metadata[CorrelationIDKey]
+	_assert(len(id) == 36 && id[14] == '4', "expect a uuid v4, but got %s", id)
+}
+
+type ConfigService struct {
+	version string
+}
+
+func (c *ConfigService) Version(args int, reply *string) error {
+	*reply = c.version
+	return nil
+}
+
+func TestServer_reload(t *testing.T) {
+	server := NewServer()
+	_ = server.Register(&ConfigService{version: "v1"})
+	var foo Foo
+	_ = server.Register(&foo)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	go server.Accept(l)
+	defer func() { _ = server.Shutdown() }()
+
+	client, _ := DialWithTimeout("tcp", l.Addr().String())
+	defer func() { _ = client.Close() }()
+	var reply string
+	_ = client.Call("ConfigService.Version", 0, &reply)
+	_assert(reply == "v1", "expect v1, but got %s", reply)
+
+	_ = server.RegisterFunc("Echo", func(args string, reply *string) error {
+		*reply = args
+		return nil
+	})
+	var names []string
+	server.reload(func(name string) interface{} {
+		names = append(names, name)
+		switch name {
+		case "ConfigService":
+			return &ConfigService{version: "v2"}
+		case "Foo":
+			// 类型和服务名不一致，不能替换掉其他服务
+			return &ConfigService{version: "v3"}
+		}
+		return nil
+	})
+	for _, name := range names {
+		_assert(name != funcServiceName, "expect func service not reloaded")
+	}
+	// 已经建立的连接使用新的服务
+	_ = client.Call("ConfigService.Version", 0, &reply)
+	_assert(reply == "v2", "expect v2 after reload, but got %s", reply)
+
+	_assert(server.Swap(new(Baz)) != nil, "expect an error when swapping an unregistered service")
+	var sum int
+	_assert(client.Call("Foo.Sum", Args{Num1: 1, Num2: 2}, &sum) == nil && sum == 3, "expect Foo untouched by reload")
+	var echo string
+	_assert(client.Call("Func.Echo", "hi", &echo) == nil && echo == "hi", "expect func service untouched by reload")
+}
+
+func TestServer_Load(t *testing.T) {
+	server := NewServer()
+	var foo Foo
+	_ = server.Register(&foo)
+	server.LimitService("Foo", 1)
+
+	// 占住Foo的并发名额，后面的请求会排队
+	release := server.acquireService("Foo")
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = l.Close() }()
+	go server.Accept(l)
+	client, _ := Dial("tcp", l.Addr().String())
+	defer func() { _ = client.Close() }()
+	var reply int
+	call := client.Go("Foo.Sum", Args{Num1: 1, Num2: 2}, &reply, make(chan *Call, 1))
+
+	deadline := time.Now().Add(time.Second)
+	for server.Load().PendingQueue != 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	w := httptest.NewRecorder()
+	server.serveLoad(w, httptest.NewRequest("GET", "/load", nil))
+	var load ServerLoad
+	_assert(json.Unmarshal(w.Body.Bytes(), &load) == nil, "failed to decode load: %s", w.Body.String())
+	_assert(load.PendingQueue == 1 && load.InFlight == 0, "expect 1 pending call, but got %+v", load)
+	_assert(load.MemoryMB > 0, "expect memory usage, but got %+v", load)
+
+	release()
+	<-call.Done
+	_assert(call.Error == nil && reply == 3, "expect call to succeed after release")
+	_assert(server.Load().PendingQueue == 0, "expect no pending call")
+}
+
+func TestServer_OptionExchangeTimeout(t *testing.T) {
+	server := NewServer()
+	server.SetOptionExchangeTimeout(time.Millisecond * 100)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = l.Close() }()
+	go server.Accept(l)
+
+	// 连接之后什么都不发送，服务端超时之后关闭连接
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal("failed to dial:", err)
+	}
+	defer func() { _ = conn.Close() }()
+	start := time.Now()
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	_assert(err == io.EOF, "expect connection closed by server, but got %v", err)
+	_assert(time.Since(start) < time.Millisecond * 500, "expect connection closed after option exchange timeout")
+
+	// 正常发送option之后不受超时影响
+	client, err := Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal("failed to dial:", err)
+	}
+	defer func() { _ = client.Close() }()
+	time.Sleep(time.Millisecond * 200)
+	_assert(client.IsAvailable(), "expect client available after option exchange")
+}
+
+type Malformed int
+
+func (m *Malformed) Sum(args Args, reply *int) error {
+	*reply = args.Num1 + args.Num2
+	return nil
+}
+
+func (m *Malformed) Bar(args Args) error {
+	return nil
+}
+
+func (m *Malformed) Baz(args Args, reply *int) uint {
+	return 0
+}
+
+func TestServer_RegisterChecked(t *testing.T) {
+	server := NewServer()
+	err := server.RegisterChecked(new(Malformed))
+	_assert(err != nil && err.Error() == "method Bar: has 2 parameters, want 3; method Baz: return type uint is not error", "unexpected error: %v", err)
+	_, _, err = server.findService("Malformed.Sum")
+	_assert(err != nil, "expect service not registered")
+
+	var foo Foo
+	_assert(server.RegisterChecked(&foo) == nil, "expect Foo registered")
+
+	// BeforeCall、AfterCall是钩子，不当成签名不符合的服务方法
+	h := new(Hooked)
+	_assert(server.RegisterChecked(h) == nil, "expect hooked service registered")
+	_, mType, err := server.findService("Hooked.Sum")
+	_assert(err == nil && mType != nil, "expect Hooked.Sum registered, got %v", err)
+	_, _, err = server.findService("Hooked.AfterCall")
+	_assert(err != nil, "expect AfterCall not registered as a method")
+}
+
+// 原样返回收到的数据
+type Copier int
+
+func (c *Copier) Copy(stream PipeStream) error {
+	for {
+		chunk, err := stream.ReadChunk()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := stream.WriteChunk(chunk); err != nil {
+			return err
+		}
+	}
+}
+
+func TestServer_MethodExpvar(t *testing.T) {
+	server := NewServer()
+	var foo Foo
+	_ = server.Register(&foo)
+	_ = server.Register(new(Copier))
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = l.Close() }()
+	go server.Accept(l)
+	client, _ := Dial("tcp", l.Addr().String())
+	defer func() { _ = client.Close() }()
+	var reply int
+	_ = client.Call("Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	var dst bytes.Buffer
+	_ = client.Pipe(context.Background(), "Copier.Copy", strings.NewReader("abc"), &dst)
+
+	// 另一个Server注册同名的服务，统计信息互不影响
+	other := NewServer()
+	_ = other.Register(&foo)
+	_assert(server.StatsName() != other.StatsName(), "expect each server to have its own stats name")
+
+	methods, ok := expvar.Get("simplerpc.methods").(*expvar.Map)
+	_assert(ok && methods != nil, "expect simplerpc.methods published")
+	serverVars, ok := methods.Get(server.StatsName()).(*expvar.Map)
+	_assert(ok, "expect stats for %s", server.StatsName())
+	m, ok := serverVars.Get("Foo.Sum").(*expvar.Map)
+	_assert(ok, "expect stats for Foo.Sum")
+	_assert(m.Get("calls").(*expvar.Int).Value() == 1, "expect calls recorded: %s", m.String())
+	_assert(m.Get("inflight").(*expvar.Int).Value() == 0, "expect no inflight calls: %s", m.String())
+	_assert(m.Get("errors") != nil && m.Get("avg_duration_ms") != nil, "expect errors and avg_duration_ms: %s", m.String())
+	stream, ok := serverVars.Get("Copier.Copy").(*expvar.Map)
+	_assert(ok && stream.Get("calls").(*expvar.Int).Value() == 1, "expect stats for the stream method")
+
+	otherVars := methods.Get(other.StatsName()).(*expvar.Map)
+	_assert(otherVars.Get("Foo.Sum").(*expvar.Map).Get("calls").(*expvar.Int).Value() == 0, "expect the other server's stats untouched")
+}
+
+type recordingLogger struct {
+	mu sync.Mutex
+	lines []string
+}
+
+func (l *recordingLogger) Printf(format string, v ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines = append(l.lines, fmt.Sprintf(format, v...))
+}
+
+func TestNewSamplingLoggingInterceptor(t *testing.T) {
+	all, none := &recordingLogger{}, &recordingLogger{}
+	server := NewServer()
+	var foo Foo
+	_ = server.Register(&foo)
+	server.Use(NewSamplingLoggingInterceptor(1, all), NewSamplingLoggingInterceptor(0, none))
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = l.Close() }()
+	go server.Accept(l)
+	client, _ := Dial("tcp", l.Addr().String())
+	defer func() { _ = client.Close() }()
+
+	for i := 0; i < 5; i ++ {
+		var reply int
+		err := client.Call("Foo.Sum", Args{Num1: i, Num2: 1}, &reply)
+		_assert(err == nil && reply == i + 1, "expect call through interceptors to succeed")
+	}
+	all.mu.Lock()
+	defer all.mu.Unlock()
+	_assert(len(all.lines) == 5 && strings.Contains(all.lines[0], "Foo.Sum"), "expect every call logged, but got %v", all.lines)
+	_assert(len(none.lines) == 0, "expect no call logged, but got %v", none.lines)
+}
+
+func TestServer_RegisterFunc(t *testing.T) {
+	server := NewServer()
+	err := server.RegisterFunc("Double", func(n int, reply *int) error {
+		*reply = n * 2
+		return nil
+	})
+	_assert(err == nil, "expect RegisterFunc to succeed, but got %v", err)
+	err = server.RegisterFunc("Fail", func(s string, reply *string) error {
+		return errors.New("fail: " + s)
+	})
+	_assert(err == nil, "expect RegisterFunc to succeed, but got %v", err)
+	err = server.RegisterFunc("HasDeadline", func(ctx context.Context, n int, reply *bool) error {
+		_, *reply = ctx.Deadline()
+		return nil
+	})
+	_assert(err == nil, "expect RegisterFunc with a context to succeed, but got %v", err)
+	_assert(server.RegisterFunc("Double", func(n int, reply *int) error { return nil }) != nil, "expect duplicate func rejected")
+	_assert(server.RegisterFunc("Bad", func(n int) error { return nil }) != nil, "expect bad signature rejected")
+	_assert(server.RegisterFunc("NotFunc", 1) != nil, "expect non-function rejected")
+
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = l.Close() }()
+	go server.Accept(l)
+	client, _ := Dial("tcp", l.Addr().String())
+	defer func() { _ = client.Close() }()
+
+	var reply int
+	err = client.Call("Func.Double", 21, &reply)
+	_assert(err == nil && reply == 42, "expect 42, but got %d, err %v", reply, err)
+	var s string
+	err = client.Call("Func.Fail", "x", &s)
+	_assert(err != nil && strings.Contains(err.Error(), "fail: x"), "expect func error, but got %v", err)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	var ok bool
+	err = client.CallWithTimeout(ctx, "Func.HasDeadline", 1, &ok)
+	_assert(err == nil && ok, "expect the caller's deadline in the func's context, but got %v %v", ok, err)
+}
+
+func TestServer_SetAcceptRateLimit(t *testing.T) {
+	server := NewServer()
+	var foo Foo
+	_ = server.Register(&foo)
+	server.SetAcceptRateLimit(500)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = l.Close() }()
+	go server.Accept(l)
+
+	// 100个客户端同时连接，每秒最多接受500个，至少需要约200ms
+	const n = 100
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < n; i ++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client, err := Dial("tcp", l.Addr().String())
+			if err != nil {
+				t.Error("failed to dial:", err)
+				return
+			}
+			_ = client.Close()
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	_assert(elapsed >= time.Millisecond * 190, "expect accept rate limited to 500/s, but %d connections took %s", n, elapsed)
+}
+
+type Tagged int
+
+// Slow 执行时间超过标签里的超时时间
+// simplerpc:"timeout=50ms,idempotent"
+func (t *Tagged) Slow(n int, reply *int) error {
+	time.Sleep(time.Millisecond * 200)
+	*reply = n
+	return nil
+}
+
+// Admin 需要鉴权
+// simplerpc:"auth=admin"
+func (t *Tagged) Admin(n int, reply *int) error {
+	*reply = n
+	return nil
+}
+
+func (t *Tagged) Plain(n int, reply *int) error {
+	*reply = n
+	return nil
+}
+
+func TestMethodTagParser(t *testing.T) {
+	p := NewMethodTagParser()
+	_assert(p.ParseDir(".") == nil, "failed to parse source")
+	tags := p.Tags("Tagged.Slow")
+	_assert(tags["timeout"] == "50ms" && tags["idempotent"] == "true", "expect tags parsed from comment, but got %v", tags)
+	_assert(p.Tags("Tagged.Plain") == nil, "expect no tags for Tagged.Plain")
+
+	server := NewServer()
+	var tagged Tagged
+	_ = server.Register(&tagged)
+	server.ApplyMethodTags(p)
+	var roles []string
+	server.Use(NewRBACInterceptor(func(ctx context.Context, info *CallInfo) error {
+		roles = append(roles, info.Tags["auth"])
+		return errors.New("not an admin")
+	}), NewMethodTimeoutInterceptor())
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = l.Close() }()
+	go server.Accept(l)
+	client, _ := Dial("tcp", l.Addr().String())
+	defer func() { _ = client.Close() }()
+
+	var reply int
+	err := client.Call("Tagged.Slow", 1, &reply)
+	rpcErr, ok := err.(*RPCError)
+	_assert(ok && rpcErr.Code == errs.Timeout, "expect method timeout from tag, but got %v", err)
+	err = client.Call("Tagged.Admin", 1, &reply)
+	rpcErr, ok = err.(*RPCError)
+	_assert(ok && rpcErr.Code == errs.PermissionDenied, "expect permission denied, but got %v", err)
+	_assert(len(roles) == 1 && roles[0] == "admin", "expect authorize called for Tagged.Admin only, but got %v", roles)
+	err = client.Call("Tagged.Plain", 2, &reply)
+	_assert(err == nil && reply == 2, "expect untagged method to succeed, but got %v", err)
+}
+
+func TestServer_ServeHTTPRest(t *testing.T) {
+	server := NewServer()
+	var foo Foo
+	_ = server.Register(&foo)
+	ts := httptest.NewServer(http.HandlerFunc(server.ServeHTTPRest))
+	defer ts.Close()
+
+	resp, err := http.Post(ts.URL + "/rpc/Foo/Sum", "application/json", strings.NewReader(`{"Num1": 1, "Num2": 2}`))
+	_assert(err == nil && resp.StatusCode == http.StatusOK, "expect 200, but got %v, %v", resp, err)
+	var reply int
+	_ = json.NewDecoder(resp.Body).Decode(&reply)
+	_ = resp.Body.Close()
+	_assert(reply == 3, "expect 3, but got %d", reply)
+
+	for _, c := range []struct {
+		path, body string
+		status int
+	}{
+		{"/rpc/Foo/Unknown", `{}`, http.StatusNotFound},
+		{"/rpc/Foo/Sum", `not json`, http.StatusBadRequest},
+	} {
+		resp, err := http.Post(ts.URL + c.path, "application/json", strings.NewReader(c.body))
+		_assert(err == nil && resp.StatusCode == c.status, "expect %d for %s, but got %v, %v", c.status, c.path, resp, err)
+		_ = resp.Body.Close()
+	}
+	resp, err = http.Get(ts.URL + "/rpc/Foo/Sum")
+	_assert(err == nil && resp.StatusCode == http.StatusMethodNotAllowed, "expect 405 for GET, but got %v, %v", resp, err)
+	_ = resp.Body.Close()
+}
+
+func TestServer_PrepareStart(t *testing.T) {
+	server := NewServer()
+	var foo Foo
+	_ = server.Register(&foo)
+	_assert(server.Start() != nil && server.state == stateNew, "expect Start before Prepare to fail")
+
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	_assert(server.Prepare(l) == nil && server.state == statePrepared, "expect server prepared")
+	defer func() { _ = server.Shutdown() }()
+
+	// 地址已经绑定，Start之前的连接等待Accept
+	done := make(chan error, 1)
+	go func() {
+		client, err := Dial("tcp", l.Addr().String())
+		if err != nil {
+			done <- err
+			return
+		}
+		defer func() { _ = client.Close() }()
+		var reply int
+		done <- client.Call("Foo.Sum", Args{Num1: 1, Num2: 2}, &reply)
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("expect call to wait for Start, but got %v", err)
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	_assert(server.Start() == nil && server.state == stateRunning, "expect server running")
+	_assert(<-done == nil, "expect call to succeed after Start")
+	_assert(server.Start() != nil, "expect second Start to fail")
+	_assert(server.Prepare(l) != nil, "expect Prepare after Start to fail")
+}
+
+func TestServer_SetWorkerPool(t *testing.T) {
+	server := NewServer()
+	r := &Recorder{ch: make(chan int, 10)}
+	var s Sleeper
+	_ = server.Register(r)
+	_ = server.Register(&s)
+	server.SetWorkerPool(1)
+	defer server.SetWorkerPool(0)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = l.Close() }()
+	go server.Accept(l)
+	client, _ := Dial("tcp", l.Addr().String())
+	defer func() { _ = client.Close() }()
+
+	// 唯一的工作协程被慢调用占住，之后的请求都在队列里排队
+	var wg sync.WaitGroup
+	call := func(ctx context.Context, method string, n int) {
+		defer wg.Done()
+		var reply int
+		if err := client.CallWithTimeout(ctx, method, n, &reply); err != nil {
+			t.Error("call failed:", err)
+		}
+	}
+	wg.Add(4)
+	go call(context.Background(), "Sleeper.Sleep", 200)
+	time.Sleep(time.Millisecond * 50)
+	go call(context.Background(), "Recorder.Record", 1)
+	go call(context.Background(), "Recorder.Record", 2)
+	time.Sleep(time.Millisecond * 50)
+	go call(WithPriority(context.Background(), codec.PriorityHigh), "Recorder.Record", 9)
+	wg.Wait()
+
+	first := <-r.ch
+	_assert(first == 9, "expect high priority request handled first, but got %d", first)
+}
+
+func TestServer_SetWorkerPoolWithQueue(t *testing.T) {
+	// 关闭之后的协程池不再接受请求
+	p := newWorkerPool(1, 0)
+	p.close()
+	_assert(p.submit(0, func() {}) == errWorkerPoolClosed, "expect submit after close rejected")
+
+	server := NewServer()
+	var s Sleeper
+	_ = server.Register(&s)
+	server.SetWorkerPoolWithQueue(1, 1)
+	defer server.SetWorkerPool(0)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = l.Close() }()
+	go server.Accept(l)
+	client, _ := Dial("tcp", l.Addr().String())
+	defer func() { _ = client.Close() }()
+
+	// 工作协程和队列都被占满之后，新的请求返回RateLimit
+	var reply int
+	busy := client.Go("Sleeper.Sleep", 200, &reply, make(chan *Call, 1))
+	time.Sleep(time.Millisecond * 50)
+	queued := client.Go("Sleeper.Sleep", 1, new(int), make(chan *Call, 1))
+	time.Sleep(time.Millisecond * 50)
+	err := client.Call("Sleeper.Sleep", 1, new(int))
+	rpcErr, ok := err.(*RPCError)
+	_assert(ok && rpcErr.Code == errs.RateLimit, "expect rate limit when the queue is full, but got %v", err)
+	_assert((<-busy.Done).Error == nil && (<-queued.Done).Error == nil, "expect accepted requests handled")
+}
+
+func TestServer_RegisterHealthService(t *testing.T) {
+	server := NewServer()
+	health, err := server.RegisterHealthService()
+	_assert(err == nil, "failed to register health: %v", err)
+	health.SetServingStatus("Foo", HealthNotServing)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = l.Close() }()
+	go server.Accept(l)
+	client, _ := Dial("tcp", l.Addr().String())
+	defer func() { _ = client.Close() }()
+
+	var resp HealthCheckResponse
+	err = client.Call(HealthServiceName + ".Check", HealthCheckRequest{}, &resp)
+	_assert(err == nil && resp.Status == HealthServing, "expect server SERVING, but got %v, %v", resp.Status, err)
+	err = client.Call(HealthServiceName + ".Check", HealthCheckRequest{Service: "Foo"}, &resp)
+	_assert(err == nil && resp.Status == HealthNotServing, "expect Foo NOT_SERVING, but got %v, %v", resp.Status, err)
+	err = client.Call(HealthServiceName + ".Check", HealthCheckRequest{Service: "Bar"}, &resp)
+	_assert(err != nil, "expect error for unknown service")
+	// 注册在带命名空间的服务名下，不占用Health
+	err = client.Call("Health.Check", HealthCheckRequest{}, &resp)
+	_assert(err != nil && strings.Contains(err.Error(), "can't find service"), "expect Health not registered, but got %v", err)
+
+	// Watch先返回当前状态，状态变化时再返回新的状态
+	src, srcW := io.Pipe()
+	dst, dstW := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- client.Pipe(context.Background(), HealthServiceName + ".Watch", src, dstW)
+	}()
+	req, _ := json.Marshal(HealthCheckRequest{Service: "Foo"})
+	_, _ = srcW.Write(req)
+	dec := json.NewDecoder(dst)
+	_assert(dec.Decode(&resp) == nil && resp.Status == HealthNotServing, "expect initial status NOT_SERVING, but got %v", resp.Status)
+	health.SetServingStatus("Foo", HealthServing)
+	_assert(dec.Decode(&resp) == nil && resp.Status == HealthServing, "expect updated status SERVING, but got %v", resp.Status)
+
+	_ = srcW.Close()
+	_assert(<-done == nil, "expect watch to end after client finished")
+}
+
+type Loose int
+
+func (l *Loose) Good(args int, reply *int) error { return nil }
+func (l *Loose) ValueReply(args int, reply int) error { return nil }
+func (l *Loose) ChanArg(args chan int, reply *int) error { return nil }
+func (l *Loose) AnyArg(args interface{}, reply *int) error { return nil }
+func (l *Loose) AnySlice(args []interface{}, reply *int) error { return nil }
+
+func TestService_validateMethods(t *testing.T) {
+	var l Loose
+	s := &service{name: "Loose", typ: reflect.TypeOf(&l), rcvr: reflect.ValueOf(&l)}
+	s.registerMethods()
+	problems := s.validateMethods()
+	_assert(len(problems) == 3, "expect 3 validation errors, but got %v", problems)
+	for i, name := range []string{"AnyArg", "ChanArg", "ValueReply"} {
+		_assert(strings.Contains(problems[i].Error(), "Loose." + name), "expect error for %s, but got %v", name, problems[i])
+		_assert(s.method[name] == nil, "%s should not be registered", name)
+	}
+	// []interface{}只是警告，仍然注册
+	_assert(s.method["Good"] != nil && s.method["AnySlice"] != nil, "valid methods should stay registered")
+
+	err := NewServer().RegisterChecked(&l)
+	_assert(err != nil && strings.Contains(err.Error(), "not a pointer"), "RegisterChecked should report invalid types, got %v", err)
+
+	// 检查不通过的方法不发布统计信息
+	server := NewServer()
+	_ = server.Register(&l)
+	vars := expvar.Get("simplerpc.methods").(*expvar.Map).Get(server.StatsName()).(*expvar.Map)
+	_assert(vars.Get("Loose.Good") != nil, "expect stats for Loose.Good")
+	_assert(vars.Get("Loose.ValueReply") == nil && vars.Get("Loose.ChanArg") == nil, "expect no stats for rejected methods: %s", vars.String())
+}
+
+func TestServer_SetBufferSize(t *testing.T) {
+	server := NewServer()
+	server.SetBufferSize(1 << 30, -1)
+	read, write := server.bufferSizes()
+	_assert(read == maxBufferSize && write == 0, "expect buffer sizes clamped, but got %d %d", read, write)
+
+	// 客户端的缓冲区大小不会发送给服务端
+	b, _ := json.Marshal(&Option{ReadBufferSize: 1 << 30, WriteBufferSize: 1 << 30})
+	_assert(!strings.Contains(string(b), "BufferSize"), "buffer sizes should not be sent, got %s", b)
+}
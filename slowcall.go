@@ -0,0 +1,63 @@
+package simpleRPC
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// 慢调用信息
+type SlowCallInfo struct {
+	ServiceMethod string
+	Elapsed time.Duration // 已经处理了多长时间
+	RemoteAddr string
+}
+
+// 启动慢调用检测，每threshold/10检查一次正在处理的请求，处理时间超过threshold的请求会调用一次handler
+// 可以在请求达到HandleTimeout之前发现卡住的服务方法，重复调用会先停止之前的检测
+func (server *Server) StartSlowCallDetector(threshold time.Duration, handler func(req SlowCallInfo)) {
+	server.StopSlowCallDetector()
+
+	stop := make(chan struct{})
+	server.mu.Lock()
+	server.slowDetectorStop = stop
+	server.mu.Unlock()
+
+	interval := threshold / 10
+	if interval <= 0 {
+		interval = time.Millisecond
+	}
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-t.C:
+				server.detectSlowCalls(threshold, handler)
+			}
+		}
+	}()
+}
+
+// 停止慢调用检测
+func (server *Server) StopSlowCallDetector() {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if server.slowDetectorStop != nil {
+		close(server.slowDetectorStop)
+		server.slowDetectorStop = nil
+	}
+}
+
+func (server *Server) detectSlowCalls(threshold time.Duration, handler func(req SlowCallInfo)) {
+	server.inflight.Range(func(key, _ interface{}) bool {
+		req := key.(*request)
+		elapsed := time.Since(req.start)
+		// 每个请求只报告一次
+		if elapsed > threshold && atomic.CompareAndSwapInt32(&req.slowReported, 0, 1) {
+			handler(SlowCallInfo{ServiceMethod: req.h.ServiceMethod, Elapsed: elapsed, RemoteAddr: req.remoteAddr})
+		}
+		return true
+	})
+}
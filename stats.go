@@ -0,0 +1,119 @@
+package simpleRPC
+
+import (
+	"sort"
+	"sync/atomic"
+)
+
+// 服务端统计信息快照
+type ServerStats struct {
+	Methods []MethodStats
+	Limits []ServiceLimitStats // 设置了并发限制的服务，按服务名排序
+}
+
+// 服务并发限制的统计信息快照
+type ServiceLimitStats struct {
+	Service string
+	MaxConcurrent int
+	InUse int // 正在处理的请求数
+}
+
+// 方法的统计信息快照
+type MethodStats struct {
+	Service string
+	Method string
+	ArgTypeName string // 参数类型名，如 simpleRPC.Args
+	ReplyTypeName string // 返回值类型名，如 *int
+	NumCalls uint64
+	RequestBytes int64 // 请求的总字节数
+	MaxRequestBytes int64
+	ResponseBytes int64 // 响应的总字节数
+	MaxResponseBytes int64
+}
+
+// 平均每个请求的字节数
+func (m MethodStats) AvgRequestBytes() float64 {
+	if m.NumCalls == 0 {
+		return 0
+	}
+	return float64(m.RequestBytes) / float64(m.NumCalls)
+}
+
+// 平均每个响应的字节数
+func (m MethodStats) AvgResponseBytes() float64 {
+	if m.NumCalls == 0 {
+		return 0
+	}
+	return float64(m.ResponseBytes) / float64(m.NumCalls)
+}
+
+// 返回服务端当前的统计信息，按服务名和方法名排序
+func (server *Server) Stats() ServerStats {
+	var stats ServerStats
+	server.serviceMap.Range(func(_, svci interface{}) bool {
+		svc := svci.(*service)
+		for name, mtype := range svc.method {
+			stats.Methods = append(stats.Methods, MethodStats{
+				Service: svc.name,
+				Method: name,
+				ArgTypeName: mtype.ArgType.String(),
+				ReplyTypeName: mtype.ReplyType.String(),
+				NumCalls: mtype.NumCalls(),
+				RequestBytes: atomic.LoadInt64(&mtype.requestBytes),
+				MaxRequestBytes: atomic.LoadInt64(&mtype.maxRequestBytes),
+				ResponseBytes: atomic.LoadInt64(&mtype.responseBytes),
+				MaxResponseBytes: atomic.LoadInt64(&mtype.maxResponseBytes),
+			})
+		}
+		return true
+	})
+
+	sort.Slice(stats.Methods, func(i, j int) bool {
+		if stats.Methods[i].Service != stats.Methods[j].Service {
+			return stats.Methods[i].Service < stats.Methods[j].Service
+		}
+		return stats.Methods[i].Method < stats.Methods[j].Method
+	})
+
+	server.mu.Lock()
+	for name, l := range server.limits {
+		stats.Limits = append(stats.Limits, ServiceLimitStats{
+			Service: name,
+			MaxConcurrent: cap(l.sem),
+			InUse: int(atomic.LoadInt32(&l.inUse)),
+		})
+	}
+	server.mu.Unlock()
+	sort.Slice(stats.Limits, func(i, j int) bool {
+		return stats.Limits[i].Service < stats.Limits[j].Service
+	})
+	return stats
+}
+
+// 注册的服务信息
+type ServiceInfo struct {
+	Name string
+	Methods []string
+	NumCalls uint64 // 所有方法的调用次数
+}
+
+// 返回所有注册的服务，按服务名排序
+func (server *Server) Services() []ServiceInfo {
+	var services []ServiceInfo
+	server.serviceMap.Range(func(_, svci interface{}) bool {
+		svc := svci.(*service)
+		info := ServiceInfo{Name: svc.name}
+		for name, mtype := range svc.method {
+			info.Methods = append(info.Methods, name)
+			info.NumCalls += mtype.NumCalls()
+		}
+		sort.Strings(info.Methods)
+		services = append(services, info)
+		return true
+	})
+
+	sort.Slice(services, func(i, j int) bool {
+		return services[i].Name < services[j].Name
+	})
+	return services
+}
@@ -0,0 +1,231 @@
+package simpleRPC
+
+import (
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"simpleRPC/codec"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 流式调用的服务端接口，服务方法的签名为 func (t *T) Method(stream PipeStream) error
+// 适合传输很大的数据，不需要先把整个数据读到内存里再调用
+type PipeStream interface {
+	ReadChunk() ([]byte, error) // 读取客户端发送的数据块，客户端发送完之后返回io.EOF
+	WriteChunk([]byte) error // 给客户端发送数据块
+	Context() context.Context // 请求的ctx，连接的ctx（见ServeConnContext）取消的时候也会取消
+}
+
+var pipeStreamType = reflect.TypeOf((*PipeStream)(nil)).Elem()
+
+// 客户端每次发送的数据块大小
+const pipeChunkSize = 32 << 10
+
+// 服务端的一个流式调用
+type serverStream struct {
+	cc codec.Codec
+	h codec.Header
+	sending *sync.Mutex
+	in chan []byte // 客户端发送的数据块，客户端发送完之后关闭
+	err error // 客户端发送失败的原因，in关闭之后ReadChunk返回，为nil时返回io.EOF
+	ended bool // 客户端是否已经发送完
+	done chan struct{} // 服务方法返回之后关闭
+	ctx context.Context
+}
+
+func (s *serverStream) ReadChunk() ([]byte, error) {
+	chunk, ok := <-s.in
+	if !ok {
+		if s.err != nil {
+			return nil, s.err
+		}
+		return nil, io.EOF
+	}
+	return chunk, nil
+}
+
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *serverStream) WriteChunk(chunk []byte) error {
+	s.sending.Lock()
+	defer s.sending.Unlock()
+	h := codec.Header{ServiceMethod: s.h.ServiceMethod, Seq: s.h.Seq, Stream: codec.StreamData}
+	return s.cc.Write(&h, chunk)
+}
+
+// 客户端不再发送数据
+func (s *serverStream) end(err error) {
+	if s.ended {
+		return
+	}
+	s.ended = true
+	s.err = err
+	close(s.in)
+}
+
+// 处理流式调用的一帧数据，第一帧的时候开始调用服务方法，streams只在读取请求的协程里使用
+// 服务方法读取数据块太慢的话，会阻塞这个连接上后面的请求
+func (server *Server) handleStreamFrame(cc codec.Codec, req *request, streams map[uint64]*serverStream, sending *sync.Mutex, wg *sync.WaitGroup) {
+	s := streams[req.h.Seq]
+	if s == nil {
+		s = &serverStream{
+			cc: cc,
+			h: *req.h,
+			sending: sending,
+			in: make(chan []byte, 16),
+			done: make(chan struct{}),
+			ctx: req.ctx,
+		}
+		streams[req.h.Seq] = s
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release := server.acquireService(req.scv.name)
+			start := time.Now()
+			req.mtype.vars.inflight.Add(1)
+			err := req.scv.callStream(req.mtype, s)
+			req.mtype.vars.inflight.Add(-1)
+			req.mtype.vars.record(time.Since(start), err)
+			release()
+			close(s.done)
+
+			h := &codec.Header{ServiceMethod: req.h.ServiceMethod, Seq: req.h.Seq, Stream: codec.StreamEnd}
+			if err != nil {
+				server.setHeaderError(h, err)
+			}
+			req.mtype.recordResponseBytes(server.sendResponse(cc, h, invalidRequest, sending))
+		}()
+	}
+
+	switch req.h.Stream {
+	case codec.StreamData:
+		select {
+		case s.in <- req.chunk:
+		case <-s.done:
+			// 服务方法已经返回了，后面的数据直接丢掉
+		}
+	case codec.StreamEnd:
+		var err error
+		if req.h.ErrorMessage != "" {
+			err = errors.New(req.h.ErrorMessage)
+		}
+		s.end(err)
+		delete(streams, req.h.Seq)
+	}
+}
+
+// 连接断开的时候，结束所有没有发送完的流式调用
+func endStreams(streams map[uint64]*serverStream) {
+	for _, s := range streams {
+		s.end(io.ErrUnexpectedEOF)
+	}
+}
+
+func (s *service) callStream(m *methodType, stream PipeStream) error {
+	atomic.AddUint64(&m.numCalls, 1)
+	returnValues := m.method.Func.Call([]reflect.Value{s.rcvr, reflect.ValueOf(&stream).Elem()})
+	if errInter := returnValues[0].Interface(); errInter != nil {
+		return errInter.(error)
+	}
+	return nil
+}
+
+// 发送流式调用的一帧数据
+func (client *Client) writeFrame(seq uint64, serviceMethod string, flag codec.StreamFlag, chunk []byte, errMsg string) error {
+	client.sending.Lock()
+	defer client.sending.Unlock()
+	h := codec.Header{ServiceMethod: serviceMethod, Seq: seq, Stream: flag, ErrorMessage: errMsg}
+	return client.cc.Write(&h, chunk)
+}
+
+// 流式调用serviceMethod，src的数据分块发送给服务端，服务端返回的数据块写到dst
+// 服务方法返回之后才返回，src读取失败的话服务端的ReadChunk会返回错误
+func (client *Client) Pipe(ctx context.Context, serviceMethod string, src io.Reader, dst io.Writer) error {
+	var dstMu sync.Mutex
+	var writeErr error
+	finished := false
+	call := &Call{
+		ServiceMethod: serviceMethod,
+		Done: make(chan *Call, 1),
+		ctx: ctx,
+	}
+	// 在接收响应的协程里调用，Pipe返回之后不再写dst
+	call.onChunk = func(chunk []byte) {
+		dstMu.Lock()
+		defer dstMu.Unlock()
+		if !finished && writeErr == nil {
+			_, writeErr = dst.Write(chunk)
+		}
+	}
+	defer func() {
+		dstMu.Lock()
+		finished = true
+		dstMu.Unlock()
+	}()
+
+	client.sending.Lock()
+	seq, err := client.registerCall(call)
+	client.sending.Unlock()
+	if err != nil {
+		return err
+	}
+
+	sendErr := make(chan error, 1)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		buf := make([]byte, pipeChunkSize)
+		for {
+			select {
+			case <-stop:
+				// 调用已经结束了，通知服务端不再发送
+				_ = client.writeFrame(seq, serviceMethod, codec.StreamEnd, []byte{}, "rpc client: pipe finished")
+				return
+			default:
+			}
+			n, err := src.Read(buf)
+			if n > 0 {
+				if e := client.writeFrame(seq, serviceMethod, codec.StreamData, buf[:n], ""); e != nil {
+					sendErr <- e
+					return
+				}
+			}
+			if err == io.EOF {
+				sendErr <- client.writeFrame(seq, serviceMethod, codec.StreamEnd, []byte{}, "")
+				return
+			}
+			if err != nil {
+				_ = client.writeFrame(seq, serviceMethod, codec.StreamEnd, []byte{}, err.Error())
+				sendErr <- err
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			client.removeCall(seq)
+			return errors.New("rpc client: pipe failed: " + ctx.Err().Error())
+		case err := <-sendErr:
+			if err != nil {
+				client.removeCall(seq)
+				return err
+			}
+			sendErr = nil
+		case call := <-call.Done:
+			if call.Error != nil {
+				return call.Error
+			}
+			dstMu.Lock()
+			defer dstMu.Unlock()
+			return writeErr
+		}
+	}
+}
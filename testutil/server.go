@@ -0,0 +1,43 @@
+package testutil
+
+import (
+	"net"
+	"simpleRPC"
+	"testing"
+)
+
+// 启动一个测试用的rpc服务，注册rcvrs，监听随机端口，测试结束后自动关闭
+func StartTestServer(t testing.TB, rcvrs ...interface{}) (addr string, cleanup func()) {
+	t.Helper()
+	server := simpleRPC.NewServer()
+	for _, rcvr := range rcvrs {
+		if err := server.Register(rcvr); err != nil {
+			t.Fatal("testutil: register error:", err)
+		}
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("testutil: listen error:", err)
+	}
+	go server.Accept(l)
+
+	cleanup = func() {
+		_ = l.Close()
+	}
+	t.Cleanup(cleanup)
+	return l.Addr().String(), cleanup
+}
+
+// 连接测试服务，测试结束后自动关闭客户端
+func DialTestClient(t testing.TB, addr string, opts ...*simpleRPC.Option) *simpleRPC.Client {
+	t.Helper()
+	client, err := simpleRPC.DialWithTimeout("tcp", addr, opts...)
+	if err != nil {
+		t.Fatal("testutil: dial error:", err)
+	}
+	t.Cleanup(func() {
+		_ = client.Close()
+	})
+	return client
+}
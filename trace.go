@@ -0,0 +1,92 @@
+package simpleRPC
+
+import (
+	"context"
+	"errors"
+	"simpleRPC/codec"
+	"strings"
+)
+
+// W3C TraceContext，参考：https://www.w3.org/TR/trace-context/
+type TraceContext struct {
+	Version string
+	TraceID string // 32位十六进制
+	SpanID string // 16位十六进制
+	Flags string // 2位十六进制
+	TraceState string
+}
+
+type traceContextKey struct{}
+
+// 把链路追踪信息放到ctx里
+func WithTraceContext(ctx context.Context, tc TraceContext) context.Context {
+	return context.WithValue(ctx, traceContextKey{}, tc)
+}
+
+// 从ctx里获取链路追踪信息
+func TraceContextFromContext(ctx context.Context) (TraceContext, bool) {
+	tc, ok := ctx.Value(traceContextKey{}).(TraceContext)
+	return tc, ok
+}
+
+// 转换成traceparent格式的字符串
+func (tc TraceContext) TraceParent() string {
+	return strings.Join([]string{tc.Version, tc.TraceID, tc.SpanID, tc.Flags}, "-")
+}
+
+// 解析traceparent，格式：00-<trace-id>-<span-id>-<flags>
+func ParseTraceParent(traceParent string) (TraceContext, error) {
+	parts := strings.Split(traceParent, "-")
+	if len(parts) != 4 || len(parts[0]) != 2 || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return TraceContext{}, errors.New("rpc trace: invalid traceparent " + traceParent)
+	}
+	for _, part := range parts {
+		if !isHex(part) {
+			return TraceContext{}, errors.New("rpc trace: invalid traceparent " + traceParent)
+		}
+	}
+	// 规范里ff是无效版本，全0的trace-id和span-id也是无效的
+	if parts[0] == "ff" || isZero(parts[1]) || isZero(parts[2]) {
+		return TraceContext{}, errors.New("rpc trace: invalid traceparent " + traceParent)
+	}
+
+	return TraceContext{Version: parts[0], TraceID: parts[1], SpanID: parts[2], Flags: parts[3]}, nil
+}
+
+func isHex(s string) bool {
+	for _, c := range s {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func isZero(s string) bool {
+	return strings.Trim(s, "0") == ""
+}
+
+// 把ctx里的链路追踪信息写到请求头
+func InjectTraceContext(ctx context.Context, header *codec.Header) {
+	tc, ok := TraceContextFromContext(ctx)
+	if !ok {
+		return
+	}
+	header.TraceParent = tc.TraceParent()
+	header.TraceState = tc.TraceState
+}
+
+// 从请求头中解析链路追踪信息，没有或者格式不对的话，返回的ctx里不包含链路追踪信息
+func ExtractTraceContext(header *codec.Header) context.Context {
+	ctx := context.Background()
+	if header.TraceParent == "" {
+		return ctx
+	}
+
+	tc, err := ParseTraceParent(header.TraceParent)
+	if err != nil {
+		return ctx
+	}
+	tc.TraceState = header.TraceState
+	return WithTraceContext(ctx, tc)
+}
@@ -0,0 +1,83 @@
+package simpleRPC
+
+import (
+	"context"
+	"simpleRPC/codec"
+	"testing"
+)
+
+const (
+	testTraceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	testSpanID = "00f067aa0ba902b7"
+)
+
+func TestParseTraceParent(t *testing.T) {
+	tests := []struct {
+		name string
+		traceParent string
+		ok bool
+	}{
+		{"valid", "00-" + testTraceID + "-" + testSpanID + "-01", true},
+		{"future version", "01-" + testTraceID + "-" + testSpanID + "-00", true},
+		{"invalid version ff", "ff-" + testTraceID + "-" + testSpanID + "-01", false},
+		{"zero trace id", "00-00000000000000000000000000000000-" + testSpanID + "-01", false},
+		{"zero span id", "00-" + testTraceID + "-0000000000000000-01", false},
+		{"upper case hex", "00-4BF92F3577B34DA6A3CE929D0E0E4736-" + testSpanID + "-01", false},
+		{"short trace id", "00-4bf92f35-" + testSpanID + "-01", false},
+		{"missing flags", "00-" + testTraceID + "-" + testSpanID, false},
+		{"empty", "", false},
+	}
+	for _, tt := range tests {
+		tc, err := ParseTraceParent(tt.traceParent)
+		if tt.ok {
+			if err != nil {
+				t.Fatalf("%s: expect ok, but got %v", tt.name, err)
+			}
+			if tc.TraceParent() != tt.traceParent {
+				t.Fatalf("%s: expect %s after round trip, but got %s", tt.name, tt.traceParent, tc.TraceParent())
+			}
+		} else if err == nil {
+			t.Fatalf("%s: expect error, but got %+v", tt.name, tc)
+		}
+	}
+}
+
+func TestTraceContext_InjectExtract(t *testing.T) {
+	tests := []struct {
+		name string
+		header codec.Header
+		ok bool
+	}{
+		{"valid", codec.Header{TraceParent: "00-" + testTraceID + "-" + testSpanID + "-01", TraceState: "k=v"}, true},
+		{"no trace", codec.Header{}, false},
+		{"invalid version ff", codec.Header{TraceParent: "ff-" + testTraceID + "-" + testSpanID + "-01"}, false},
+		{"zero span id", codec.Header{TraceParent: "00-" + testTraceID + "-0000000000000000-01"}, false},
+	}
+	for _, tt := range tests {
+		ctx := ExtractTraceContext(&tt.header)
+		tc, ok := TraceContextFromContext(ctx)
+		if ok != tt.ok {
+			t.Fatalf("%s: expect extracted %v, but got %v", tt.name, tt.ok, ok)
+		}
+
+		// 提取出来的再写回请求头，应该和原来一样
+		var h codec.Header
+		InjectTraceContext(ctx, &h)
+		if !ok {
+			if h.TraceParent != "" {
+				t.Fatalf("%s: expect nothing injected, but got %s", tt.name, h.TraceParent)
+			}
+			continue
+		}
+		if h.TraceParent != tt.header.TraceParent || h.TraceState != tt.header.TraceState || tc.TraceState != tt.header.TraceState {
+			t.Fatalf("%s: expect %+v after round trip, but got %+v", tt.name, tt.header, h)
+		}
+	}
+
+	// ctx里没有链路追踪信息时不写请求头
+	var h codec.Header
+	InjectTraceContext(context.Background(), &h)
+	if h.TraceParent != "" || h.TraceState != "" {
+		t.Fatalf("expect empty trace header, but got %+v", h)
+	}
+}
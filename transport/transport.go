@@ -0,0 +1,63 @@
+package transport
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// 传输层，XDial根据地址里的协议（protocol@addr）找到对应的Transport建立连接
+type Transport interface {
+	Dial(addr string) (net.Conn, error)
+	Listen(addr string) (net.Listener, error)
+}
+
+// 支持连接超时的Transport可以实现这个接口，Option.ConnectTimeout会传进来，0为不限
+type TimeoutDialer interface {
+	DialTimeout(addr string, timeout time.Duration) (net.Conn, error)
+}
+
+var (
+	mu sync.RWMutex
+	transports = make(map[string]Transport)
+)
+
+// 注册Transport，第三方包可以在init()里注册自己的Transport（如WebSocket），相同的scheme会被覆盖
+func Register(scheme string, t Transport) {
+	mu.Lock()
+	defer mu.Unlock()
+	transports[scheme] = t
+}
+
+// 根据scheme查找Transport
+func Lookup(scheme string) (Transport, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	t, ok := transports[scheme]
+	return t, ok
+}
+
+// 基于标准库net包的Transport，如tcp、unix
+type netTransport struct {
+	network string
+}
+
+func (t netTransport) Dial(addr string) (net.Conn, error) {
+	return net.Dial(t.network, addr)
+}
+
+func (t netTransport) DialTimeout(addr string, timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout(t.network, addr, timeout)
+}
+
+func (t netTransport) Listen(addr string) (net.Listener, error) {
+	return net.Listen(t.network, addr)
+}
+
+var _ TimeoutDialer = netTransport{}
+
+func init() {
+	for _, network := range []string{"tcp", "tcp4", "tcp6", "unix"} {
+		Register(network, netTransport{network: network})
+	}
+}
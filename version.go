@@ -0,0 +1,63 @@
+package simpleRPC
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+const version = "0.1.0"
+
+// 编译时通过ldflags注入，例如
+// go build -ldflags "-X simpleRPC.BuildTime=$(date +%FT%T) -X simpleRPC.GitCommit=$(git rev-parse HEAD)"
+var (
+	BuildTime = ""
+	GitCommit = ""
+)
+
+// simpleRPC的版本号
+func Version() string {
+	return version
+}
+
+// GET /debug/simplerpc/version 返回的版本信息
+type versionInfo struct {
+	Version string `json:"version"`
+	BuildTime string `json:"build_time"`
+	GitCommit string `json:"git_commit"`
+}
+
+func serveVersion(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(versionInfo{Version: version, BuildTime: BuildTime, GitCommit: GitCommit}); err != nil {
+		log.Println("rpc server: encode version err:", err)
+	}
+}
+
+// 内置的元信息服务，使用Server.RegisterMeta注册
+type Meta struct{}
+
+// 返回服务端的simpleRPC版本号，参数没有使用
+func (m *Meta) Version(_ int, reply *string) error {
+	*reply = version
+	return nil
+}
+
+// 注册内置的Meta服务，客户端可以通过Client.ServerVersion获取服务端的版本号
+func (server *Server) RegisterMeta() error {
+	return server.Register(&Meta{})
+}
+
+// 获取服务端的simpleRPC版本号，服务端需要调用RegisterMeta
+func (client *Client) ServerVersion(ctx context.Context) (string, error) {
+	var reply string
+	if err := client.CallWithTimeout(ctx, "Meta.Version", 0, &reply); err != nil {
+		return "", err
+	}
+	return reply, nil
+}
@@ -0,0 +1,156 @@
+package simpleRPC
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"simpleRPC/errs"
+	"sync"
+)
+
+// SetWorkerPool默认的队列长度
+const defaultWorkerQueueSize = 1024
+
+// 协程池已经关闭（被替换），请求不能再放进队列
+var errWorkerPoolClosed = errors.New("rpc server: worker pool is closed")
+
+// 队列满了的时候返回给客户端的错误
+var errWorkerQueueFull = &RPCError{Code: errs.RateLimit, Message: "rpc server: worker pool queue is full"}
+
+type priorityKey struct{}
+
+// 设置请求的优先级（codec.PriorityNormal、PriorityHigh、PriorityCritical），客户端调用时会带到请求头
+func WithPriority(ctx context.Context, priority int) context.Context {
+	return context.WithValue(ctx, priorityKey{}, priority)
+}
+
+// 返回ctx里的优先级，没有的话返回codec.PriorityNormal
+func PriorityFromContext(ctx context.Context) int {
+	if ctx == nil {
+		return 0
+	}
+	priority, _ := ctx.Value(priorityKey{}).(int)
+	return priority
+}
+
+// 等待工作协程处理的请求
+type poolTask struct {
+	priority int
+	seq uint64 // 提交的顺序，同一优先级先提交的先处理
+	run func()
+}
+
+// 按优先级从高到低、同一优先级按提交顺序排列的堆，实现heap.Interface
+type taskHeap []*poolTask
+
+func (h taskHeap) Len() int { return len(h) }
+
+func (h taskHeap) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority > h[j].priority
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h taskHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *taskHeap) Push(x interface{}) { *h = append(*h, x.(*poolTask)) }
+
+func (h *taskHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	t := old[n - 1]
+	old[n - 1] = nil
+	*h = old[:n - 1]
+	return t
+}
+
+// 固定数量的工作协程，从优先级队列里取请求处理
+type workerPool struct {
+	mu sync.Mutex
+	cond *sync.Cond
+	tasks taskHeap
+	seq uint64
+	maxQueue int // 队列里最多等待的请求数，0为不限制
+	closed bool // 关闭之后工作协程处理完队列里的请求就退出
+}
+
+func newWorkerPool(size, maxQueue int) *workerPool {
+	p := &workerPool{maxQueue: maxQueue}
+	p.cond = sync.NewCond(&p.mu)
+	for i := 0; i < size; i ++ {
+		go p.work()
+	}
+	return p
+}
+
+// 把请求放进队列，协程池已经关闭的话返回errWorkerPoolClosed，队列满了的话返回errWorkerQueueFull
+func (p *workerPool) submit(priority int, run func()) error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return errWorkerPoolClosed
+	}
+	if p.maxQueue > 0 && len(p.tasks) >= p.maxQueue {
+		p.mu.Unlock()
+		return errWorkerQueueFull
+	}
+	p.seq ++
+	heap.Push(&p.tasks, &poolTask{priority: priority, seq: p.seq, run: run})
+	p.mu.Unlock()
+	p.cond.Signal()
+	return nil
+}
+
+func (p *workerPool) work() {
+	for {
+		p.mu.Lock()
+		for len(p.tasks) == 0 && !p.closed {
+			p.cond.Wait()
+		}
+		if len(p.tasks) == 0 {
+			p.mu.Unlock()
+			return
+		}
+		t := heap.Pop(&p.tasks).(*poolTask)
+		p.mu.Unlock()
+		t.run()
+	}
+}
+
+func (p *workerPool) close() {
+	p.mu.Lock()
+	p.closed = true
+	p.mu.Unlock()
+	p.cond.Broadcast()
+}
+
+// 使用size个工作协程处理请求，请求先放进优先级队列，高优先级的请求（例如健康检查）先处理
+// size <= 0 时恢复为每个请求一个协程。替换协程池时，原来的协程池处理完已经排队的请求后退出
+// 注意工作协程会一直等到服务方法返回（或者HandleTimeout超时），size需要比慢调用的并发数大
+// 队列最多排defaultWorkerQueueSize个请求，满了之后的请求返回RateLimit错误
+func (server *Server) SetWorkerPool(size int) {
+	server.SetWorkerPoolWithQueue(size, defaultWorkerQueueSize)
+}
+
+// 和SetWorkerPool一样，queueSize是队列里最多等待的请求数，<= 0 为不限制
+func (server *Server) SetWorkerPoolWithQueue(size, queueSize int) {
+	if queueSize < 0 {
+		queueSize = 0
+	}
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if server.workers != nil {
+		server.workers.close()
+		server.workers = nil
+	}
+	if size > 0 {
+		server.workers = newWorkerPool(size, queueSize)
+	}
+}
+
+func (server *Server) pool() *workerPool {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return server.workers
+}
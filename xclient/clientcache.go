@@ -0,0 +1,177 @@
+package xclient
+
+import (
+	"fmt"
+	"reflect"
+	. "simpleRPC"
+	"strings"
+	"sync"
+)
+
+// 多个XClient共用的连接缓存，同一个服务地址、相同配置的XClient共用一个连接，减少进程里的连接数
+// 每个使用方持有一个引用，所有引用都释放之后才关闭连接
+type ClientCache struct {
+	mu sync.Mutex
+	entries map[string]*cacheEntry // key为 服务地址|配置
+	held map[*Client]*cacheEntry // 还有引用的连接，包括已经从entries里移除的
+	dialing map[string]*pendingDial // 正在建立的连接，key和entries一样，同一个key只建立一个连接
+}
+
+// 正在建立的连接，建立完之后关闭done，失败的话err不为nil
+type pendingDial struct {
+	done chan struct{}
+	err error
+}
+
+type cacheEntry struct {
+	key string
+	rpcAddr string
+	client *Client
+	refs int
+}
+
+// 默认的连接缓存，WithClientCache(DefaultClientCache) 使用
+var DefaultClientCache = NewClientCache()
+
+func NewClientCache() *ClientCache {
+	return &ClientCache{
+		entries: make(map[string]*cacheEntry),
+		held: make(map[*Client]*cacheEntry),
+		dialing: make(map[string]*pendingDial),
+	}
+}
+
+// XClient使用连接缓存，不再自己建立连接，Close的时候只释放引用
+func WithClientCache(cache *ClientCache) XClientOption {
+	return func(xc *XClient) {
+		xc.cache = cache
+	}
+}
+
+// 返回缓存的连接，没有或者已经不可用的话新建一个，引用数加1
+// 建立连接的时候不持有锁，一个服务地址连接很慢不会阻塞其他地址，同一个key同时只建立一个连接，其他调用方等它的结果
+func (c *ClientCache) get(rpcAddr string, opt *Option) (*Client, error) {
+	key := rpcAddr + "|" + optionKey(opt)
+	c.mu.Lock()
+	for {
+		if e, ok := c.entries[key]; ok && e.client.IsAvailable() {
+			e.refs ++
+			c.mu.Unlock()
+			return e.client, nil
+		}
+		d, ok := c.dialing[key]
+		if !ok {
+			break
+		}
+		c.mu.Unlock()
+		<-d.done
+		if d.err != nil {
+			return nil, d.err
+		}
+		c.mu.Lock()
+	}
+	d := &pendingDial{done: make(chan struct{})}
+	c.dialing[key] = d
+	c.mu.Unlock()
+
+	// 不可用的连接由还持有引用的使用方释放的时候关闭
+	client, err := XDial(rpcAddr, opt)
+
+	c.mu.Lock()
+	delete(c.dialing, key)
+	d.err = err
+	close(d.done)
+	if err != nil {
+		c.mu.Unlock()
+		return nil, err
+	}
+	// 建立连接期间缓存里已经有了可用的连接的话，使用已有的，关闭新建的
+	if e, ok := c.entries[key]; ok && e.client.IsAvailable() {
+		e.refs ++
+		c.mu.Unlock()
+		_ = client.Close()
+		return e.client, nil
+	}
+	e := &cacheEntry{key: key, rpcAddr: rpcAddr, client: client, refs: 1}
+	c.entries[key] = e
+	c.held[client] = e
+	c.mu.Unlock()
+	return client, nil
+}
+
+// 释放一个引用，没有引用之后关闭连接，连接已经被替换或者移除也一样
+// 不是从缓存里拿到的连接直接关闭
+func (c *ClientCache) release(rpcAddr string, opt *Option, client *Client) error {
+	c.mu.Lock()
+	e, ok := c.held[client]
+	if !ok {
+		c.mu.Unlock()
+		return client.Close()
+	}
+	e.refs --
+	if e.refs > 0 {
+		c.mu.Unlock()
+		return nil
+	}
+	delete(c.held, client)
+	if c.entries[e.key] == e {
+		delete(c.entries, e.key)
+	}
+	c.mu.Unlock()
+	return client.Close()
+}
+
+// 连接已经不可用，从缓存里移除，其他使用方下次使用时会重新建立连接
+// 只释放调用方的引用，其他使用方还持有的话等它们释放之后再关闭
+func (c *ClientCache) discard(rpcAddr string, opt *Option, client *Client) {
+	key := rpcAddr + "|" + optionKey(opt)
+	c.mu.Lock()
+	if e, ok := c.entries[key]; ok && e.client == client {
+		delete(c.entries, key)
+	}
+	c.mu.Unlock()
+	_ = c.release(rpcAddr, opt, client)
+}
+
+// 移除服务地址的所有连接（例如服务已经下线），连接会在使用方释放引用的时候关闭
+func (c *ClientCache) Evict(rpcAddr string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, e := range c.entries {
+		if e.rpcAddr == rpcAddr {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// 返回缓存的连接数
+func (c *ClientCache) Size() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+// 配置的唯一标识，值相同的配置得到相同的key，指针、函数等字段按地址区分
+func optionKey(opt *Option) string {
+	if opt == nil {
+		return "default"
+	}
+	var b strings.Builder
+	v := reflect.ValueOf(opt).Elem()
+	for i := 0; i < v.NumField(); i ++ {
+		f := v.Field(i)
+		switch f.Kind() {
+		case reflect.Ptr, reflect.Func, reflect.Map, reflect.Slice, reflect.Chan:
+			fmt.Fprintf(&b, "%x,", f.Pointer())
+		case reflect.Interface:
+			if !f.IsNil() && f.Elem().Kind() == reflect.Ptr {
+				fmt.Fprintf(&b, "%T:%x,", f.Interface(), f.Elem().Pointer())
+			} else {
+				fmt.Fprintf(&b, "%#v,", f.Interface())
+			}
+		default:
+			fmt.Fprintf(&b, "%v,", f.Interface())
+		}
+	}
+	return b.String()
+}
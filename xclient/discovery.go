@@ -1,6 +1,7 @@
 package xclient
 
 import (
+	"context"
 	"errors"
 	"math"
 	"math/rand"
@@ -14,23 +15,71 @@ type SelectMode int
 const (
 	RandomSelect SelectMode = iota // 随机
 	RoundRobinSelect // 轮询
+	StickyRoundRobinSelect // 轮询，同一个会话（WithSessionKey）总是选择同一个服务，服务不可用时重新分配
+	HealthAwareSelect // 选择服务端报告的负载最低的服务，负载相同时轮询，由XClient选择，服务发现不知道负载，按轮询处理
 )
 
 type Discovery interface {
 	Refresh() error // 从注册中心更新服务列表
 	Update(servers []string) error // 手动更新服务列表
 	Get (mode SelectMode) (string, error) // 根据负载均衡策略，选择一个服务实例
+	GetWithContext(ctx context.Context, mode SelectMode) (string, error) // 和Get一样，ctx可以带上路由信息，例如WithZone
 	GetAll() ([]string, error) // 返回所有的服务实例
 }
 
+// 可以提供服务元数据的服务发现，例如 {"health": "degraded"}
+type MetadataDiscovery interface {
+	Discovery
+	GetMetadata(addr string) map[string]string
+}
+
+type zoneKey struct{}
+
+// 在ctx里设置调用方所在的可用区，支持的服务发现会优先选择同一个可用区的服务（服务元数据里的zone）
+func WithZone(ctx context.Context, zone string) context.Context {
+	return context.WithValue(ctx, zoneKey{}, zone)
+}
+
+// 返回ctx里的可用区，没有的话返回空字符串
+func ZoneFromContext(ctx context.Context) string {
+	zone, _ := ctx.Value(zoneKey{}).(string)
+	return zone
+}
+
+type sessionKey struct{}
+
+// 在ctx里设置会话标识，StickyRoundRobinSelect会把同一个会话的调用发到同一个服务
+func WithSessionKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, sessionKey{}, key)
+}
+
+// 返回ctx里的会话标识，没有的话返回空字符串
+func SessionKeyFromContext(ctx context.Context) string {
+	key, _ := ctx.Value(sessionKey{}).(string)
+	return key
+}
+
 // 一个简单的注册中心（手动维护一个服务地址来代替注册中心）
 type MultiServersDiscovery struct {
 	r *rand.Rand // 生成随机数
 	mu sync.RWMutex
 	servers []string // 服务地址
 	index int // 记录算法轮询到的位置
+	metadata map[string]map[string]string // 服务的元数据，key为服务地址
+	sessions map[string]*sessionEntry // 会话分配到的服务地址，StickyRoundRobinSelect使用
 }
 
+// 会话分配到的服务地址
+type sessionEntry struct {
+	server string
+	used time.Time // 最后一次使用的时间
+}
+
+const (
+	maxSessions = 10000 // 最多保留的会话数，超过之后淘汰最久没有使用的
+	sessionIdleTimeout = time.Minute * 30 // 会话超过这个时间没有使用的话重新分配
+)
+
 // 因为是需要手动配置的，所以刷新功能暂时不需要
 func (d *MultiServersDiscovery) Refresh() error {
 	return nil
@@ -41,30 +90,118 @@ func (d *MultiServersDiscovery) Update(servers []string) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 	d.servers = servers
+	// 服务已经下线的会话，下次调用时重新分配
+	for key, e := range d.sessions {
+		if !containsServer(servers, e.server) {
+			delete(d.sessions, key)
+		}
+	}
 	return nil
 }
 
+// 设置服务的元数据
+func (d *MultiServersDiscovery) SetMetadata(addr string, meta map[string]string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.metadata == nil {
+		d.metadata = make(map[string]map[string]string)
+	}
+	d.metadata[addr] = meta
+}
+
+// 返回服务的元数据，没有的话返回nil
+func (d *MultiServersDiscovery) GetMetadata(addr string) map[string]string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.metadata[addr]
+}
+
 // 通过负载均衡策略获取服务地址
 func (d *MultiServersDiscovery) Get(mode SelectMode) (string, error){
 	d.mu.Lock()
 	defer d.mu.Unlock()
-	n := len(d.servers)
+	return d.selectServer(d.servers, mode, "")
+}
+
+// 和Get一样，StickyRoundRobinSelect使用ctx里的会话标识
+func (d *MultiServersDiscovery) GetWithContext(ctx context.Context, mode SelectMode) (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.selectServer(d.servers, mode, SessionKeyFromContext(ctx))
+}
+
+// 在servers里选择，servers是过滤之后的服务列表，StickyRoundRobinSelect的会话仍然有效
+func (d *MultiServersDiscovery) selectFrom(ctx context.Context, servers []string, mode SelectMode) (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.selectServer(servers, mode, SessionKeyFromContext(ctx))
+}
+
+// 从servers里选择一个服务地址，调用时需要持有d.mu
+// session是会话标识，只有StickyRoundRobinSelect使用，为空时和RoundRobinSelect一样
+func (d *MultiServersDiscovery) selectServer(servers []string, mode SelectMode, session string) (string, error) {
+	n := len(servers)
 	if n == 0 {
 		return "", errors.New("rpc discovery: no available servers")
 	}
 
 	switch mode {
 	case RandomSelect:
-		return d.servers[d.r.Intn(n)], nil
-	case RoundRobinSelect:
-		s := d.servers[d.index%n]
+		return servers[d.r.Intn(n)], nil
+	case RoundRobinSelect, HealthAwareSelect:
+		s := servers[d.index%n]
+		d.index = (d.index + 1) % n
+		return s, nil
+	case StickyRoundRobinSelect:
+		now := time.Now()
+		if e, ok := d.sessions[session]; ok && containsServer(servers, e.server) && now.Sub(e.used) < sessionIdleTimeout {
+			e.used = now
+			return e.server, nil
+		}
+		// 新的会话或者原来的服务不可用，按轮询分配一个
+		s := servers[d.index%n]
 		d.index = (d.index + 1) % n
+		if session != "" {
+			if d.sessions == nil {
+				d.sessions = make(map[string]*sessionEntry)
+			}
+			if _, ok := d.sessions[session]; !ok && len(d.sessions) >= maxSessions {
+				d.evictSessions(now)
+			}
+			d.sessions[session] = &sessionEntry{server: s, used: now}
+		}
 		return s, nil
 	default:
 		return "", errors.New("rpc discovery: not supported select mode")
 	}
 }
 
+// 删除超时的会话，都没有超时的话删除最久没有使用的一个，调用时需要持有d.mu
+func (d *MultiServersDiscovery) evictSessions(now time.Time) {
+	var oldest string
+	for key, e := range d.sessions {
+		if now.Sub(e.used) >= sessionIdleTimeout {
+			delete(d.sessions, key)
+			continue
+		}
+		if oldest == "" || e.used.Before(d.sessions[oldest].used) {
+			oldest = key
+		}
+	}
+	if len(d.sessions) >= maxSessions {
+		delete(d.sessions, oldest)
+	}
+}
+
+func containsServer(servers []string, server string) bool {
+	for _, s := range servers {
+		if s == server {
+			return true
+		}
+	}
+	return false
+}
+
 // 返回所有的服务地址
 func (d *MultiServersDiscovery) GetAll() ([]string, error) {
 	d.mu.RLock()
@@ -86,5 +223,5 @@ func NewMultiServerDiscovery(servers []string) *MultiServersDiscovery {
 	return d
 }
 
-// 定义 MultiServersDiscovery 必须要实现 Discovery 接口
-var _ Discovery = (*MultiServersDiscovery)(nil)
+// 定义 MultiServersDiscovery 必须要实现 MetadataDiscovery 接口
+var _ MetadataDiscovery = (*MultiServersDiscovery)(nil)
@@ -0,0 +1,101 @@
+package xclient
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+)
+
+// 联合多个注册中心的服务发现，例如服务同时注册在主注册中心和备用注册中心
+// 服务列表是所有注册中心的服务去重之后的合集，某个注册中心出错时使用它上一次返回的服务列表
+type FederatedDiscovery struct {
+	*MultiServersDiscovery
+	children []Discovery
+
+	cacheMu sync.Mutex
+	cache [][]string // 每个注册中心上一次成功返回的服务列表
+}
+
+func NewFederatedDiscovery(children ...Discovery) *FederatedDiscovery {
+	return &FederatedDiscovery{
+		MultiServersDiscovery: NewMultiServerDiscovery(make([]string, 0)),
+		children: children,
+		cache: make([][]string, len(children)),
+	}
+}
+
+// 刷新所有的注册中心，返回第一个错误
+func (d *FederatedDiscovery) Refresh() error {
+	var e error
+	for _, child := range d.children {
+		if err := child.Refresh(); err != nil && e == nil {
+			e = err
+		}
+	}
+	return e
+}
+
+// 服务列表来自各个注册中心，不支持手动更新
+func (d *FederatedDiscovery) Update(servers []string) error {
+	return errors.New("rpc discovery: federated discovery does not support update")
+}
+
+// 合并所有注册中心的服务列表，按注册中心的顺序去重
+func (d *FederatedDiscovery) merge() ([]string, error) {
+	d.cacheMu.Lock()
+	defer d.cacheMu.Unlock()
+
+	var e error
+	seen := make(map[string]bool)
+	merged := make([]string, 0)
+	for i, child := range d.children {
+		servers, err := child.GetAll()
+		if err != nil {
+			log.Println("rpc discovery: federated child err, use cached servers:", err)
+			if e == nil {
+				e = err
+			}
+			servers = d.cache[i]
+		} else {
+			d.cache[i] = servers
+		}
+
+		for _, server := range servers {
+			if !seen[server] {
+				seen[server] = true
+				merged = append(merged, server)
+			}
+		}
+	}
+
+	if len(merged) == 0 && e != nil {
+		return nil, e
+	}
+	return merged, nil
+}
+
+func (d *FederatedDiscovery) Get(mode SelectMode) (string, error) {
+	servers, err := d.merge()
+	if err != nil {
+		return "", err
+	}
+	_ = d.MultiServersDiscovery.Update(servers)
+	return d.MultiServersDiscovery.Get(mode)
+}
+
+// 不支持可用区，StickyRoundRobinSelect使用ctx里的会话标识，其他和Get一样
+func (d *FederatedDiscovery) GetWithContext(ctx context.Context, mode SelectMode) (string, error) {
+	servers, err := d.merge()
+	if err != nil {
+		return "", err
+	}
+	_ = d.MultiServersDiscovery.Update(servers)
+	return d.MultiServersDiscovery.GetWithContext(ctx, mode)
+}
+
+func (d *FederatedDiscovery) GetAll() ([]string, error) {
+	return d.merge()
+}
+
+var _ Discovery = (*FederatedDiscovery)(nil)
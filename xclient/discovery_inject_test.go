@@ -0,0 +1,31 @@
+// +build simplerpc_test_inject
+
+package xclient
+
+import (
+	"net/http/httptest"
+	"simpleRPC/registry"
+	"testing"
+	"time"
+)
+
+// 注册中心响应很慢的时候，Refresh要在refreshRequestTimeout之后返回错误，不能一直持有锁
+func TestSimpleRegistryDiscovery_RefreshTimeout(t *testing.T) {
+	refreshRequestTimeout = time.Millisecond * 100
+	defer func() { refreshRequestTimeout = time.Second * 5 }()
+
+	r := registry.New(time.Minute)
+	r.InjectLatency(time.Second)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	d := NewSimpleRegistryDiscovery(ts.URL, 0)
+	start := time.Now()
+	err := d.Refresh()
+	_assert(err != nil, "expect refresh timeout error")
+	_assert(time.Since(start) < time.Millisecond * 500, "expect refresh return after timeout, but took %s", time.Since(start))
+
+	// 去掉延迟之后可以正常拉取
+	r.InjectLatency(0)
+	_assert(d.Refresh() == nil, "expect refresh ok without latency")
+}
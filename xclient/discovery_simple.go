@@ -1,6 +1,9 @@
 package xclient
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
 	"strings"
@@ -12,10 +15,16 @@ type SimpleRegistryDiscovery struct {
 	registry string // 注册中心url
 	timeout time.Duration // 服务列表过期时间
 	lastUpdate time.Time // 最后从注册中心拉取服务配置时间，超过了该时间，需要去注册中心从新拉取服务配置
+	usingInitial bool // 是否还在使用初始的服务列表（还没有从注册中心拉取成功过）
+	apiVersion int // 注册中心接口版本，默认为1
+	authToken string // 注册中心的鉴权token，为空时不带Authorization请求头
 }
 
 const defaultUpdateTimeout = time.Second * 10
 
+// 从注册中心拉取服务列表的http超时时间，拉取时持有d.mu，注册中心卡住不能让所有调用一起卡住
+var refreshRequestTimeout = time.Second * 5
+
 func NewSimpleRegistryDiscovery(registerAddr string, timeout time.Duration) *SimpleRegistryDiscovery {
 	if timeout == 0 {
 		timeout = defaultUpdateTimeout
@@ -25,11 +34,39 @@ func NewSimpleRegistryDiscovery(registerAddr string, timeout time.Duration) *Sim
 		MultiServersDiscovery:NewMultiServerDiscovery(make([]string, 0)),
 		registry:registerAddr,
 		timeout:timeout,
+		apiVersion: 1,
 	}
 
 	return d
 }
 
+// 设置注册中心的接口版本（1或2），registerAddr需要是对应版本的地址，例如 /v2/_simplerpc_/registry
+func (d *SimpleRegistryDiscovery) WithAPIVersion(version int) *SimpleRegistryDiscovery {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.apiVersion = version
+	return d
+}
+
+// 注册中心设置了SetAuthToken时，拉取服务列表带上 Authorization: Bearer <token>
+func (d *SimpleRegistryDiscovery) WithAuthToken(token string) *SimpleRegistryDiscovery {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.authToken = token
+	return d
+}
+
+// 预先设置服务列表，在第一次从注册中心拉取成功之前使用这个列表，
+// 这样客户端启动的时候注册中心刚好不可用，调用也不会失败（代价是最多会使用timeout时长的旧列表）
+func (d *SimpleRegistryDiscovery) WithInitialServers(servers []string) *SimpleRegistryDiscovery {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.servers = append([]string(nil), servers...)
+	d.lastUpdate = time.Now()
+	d.usingInitial = true
+	return d
+}
+
 func (d *SimpleRegistryDiscovery) Update(servers []string) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
@@ -46,13 +83,43 @@ func (d *SimpleRegistryDiscovery) Refresh() error {
 	}
 
 	log.Println("rpc registry: refresh servers from registry", d.registry)
-	resp, err := http.Get(d.registry)
+	req, _ := http.NewRequest("GET", d.registry, nil)
+	if d.authToken != "" {
+		req.Header.Set("Authorization", "Bearer " + d.authToken)
+	}
+	httpClient := &http.Client{Timeout: refreshRequestTimeout}
+	resp, err := httpClient.Do(req)
+	if err == nil && resp.StatusCode != http.StatusOK {
+		// 例如没有鉴权，不能当成服务列表为空
+		_ = resp.Body.Close()
+		err = fmt.Errorf("rpc registry: refresh status %s", resp.Status)
+	}
 	if err != nil {
 		log.Println("rpc registry refresh err:", err)
+		if d.usingInitial {
+			// 还没有拉取成功过，继续使用初始的服务列表，timeout之后再重试，
+			// 否则注册中心卡住的时候，每次调用都要持有锁等待一次http超时
+			d.lastUpdate = time.Now()
+			return nil
+		}
 		return err
 	}
 
-	servers := strings.Split(resp.Header.Get("X-Simplerpc-Servers"), ",")
+	defer func() { _ = resp.Body.Close() }()
+
+	var servers []string
+	if d.apiVersion >= 2 {
+		var body struct {
+			Servers []string `json:"servers"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			log.Println("rpc registry refresh err:", err)
+			return err
+		}
+		servers = body.Servers
+	} else {
+		servers = strings.Split(resp.Header.Get("X-Simplerpc-Servers"), ",")
+	}
 	d.servers = make([]string, 0, len(servers))
 	for _, server := range servers {
 		if strings.TrimSpace(server) != "" {
@@ -60,6 +127,7 @@ func (d *SimpleRegistryDiscovery) Refresh() error {
 		}
 	}
 	d.lastUpdate = time.Now()
+	d.usingInitial = false
 	return nil
 }
 
@@ -71,6 +139,30 @@ func (d *SimpleRegistryDiscovery) Get(mode SelectMode) (string, error) {
 	return d.MultiServersDiscovery.Get(mode)
 }
 
+// ctx里有可用区（WithZone）的话，优先选择元数据里zone相同的服务，没有的话在所有服务里选择
+func (d *SimpleRegistryDiscovery) GetWithContext(ctx context.Context, mode SelectMode) (string, error) {
+	if err := d.Refresh(); err != nil {
+		return "", err
+	}
+
+	zone := ZoneFromContext(ctx)
+	if zone == "" {
+		return d.MultiServersDiscovery.GetWithContext(ctx, mode)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	local := make([]string, 0, len(d.servers))
+	for _, server := range d.servers {
+		if d.metadata[server]["zone"] == zone {
+			local = append(local, server)
+		}
+	}
+	if len(local) == 0 {
+		return d.selectServer(d.servers, mode, SessionKeyFromContext(ctx))
+	}
+	return d.selectServer(local, mode, SessionKeyFromContext(ctx))
+}
+
 func (d *SimpleRegistryDiscovery) GetAll() ([]string, error) {
 	if err := d.Refresh(); err != nil {
 		return nil, err
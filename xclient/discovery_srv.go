@@ -0,0 +1,129 @@
+package xclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 方便测试替换
+var lookupSRV = net.LookupSRV
+
+// 通过DNS的SRV记录发现服务，例如 _rpc._tcp.example.com
+// 随机选择时按SRV记录的Weight加权
+type SRVDiscovery struct {
+	*MultiServersDiscovery
+	service string
+	proto string
+	domain string
+	refreshInterval time.Duration // 重新查询DNS的间隔
+	lastUpdate time.Time
+
+	weightMu sync.Mutex
+	weights []uint16 // 和servers一一对应
+}
+
+func NewSRVDiscovery(service, proto, domain string, refreshInterval time.Duration) *SRVDiscovery {
+	if refreshInterval == 0 {
+		refreshInterval = defaultUpdateTimeout
+	}
+	return &SRVDiscovery{
+		MultiServersDiscovery: NewMultiServerDiscovery(make([]string, 0)),
+		service: service,
+		proto: proto,
+		domain: domain,
+		refreshInterval: refreshInterval,
+	}
+}
+
+// 服务列表来自DNS，不支持手动更新
+func (d *SRVDiscovery) Update(servers []string) error {
+	return errors.New("rpc discovery: srv discovery does not support update")
+}
+
+// 距离上次查询超过refreshInterval时，重新查询DNS
+func (d *SRVDiscovery) Refresh() error {
+	d.weightMu.Lock()
+	defer d.weightMu.Unlock()
+	if d.lastUpdate.Add(d.refreshInterval).After(time.Now()) {
+		return nil
+	}
+
+	_, records, err := lookupSRV(d.service, d.proto, d.domain)
+	if err != nil {
+		log.Println("rpc discovery: lookup srv err:", err)
+		return err
+	}
+
+	servers := make([]string, 0, len(records))
+	weights := make([]uint16, 0, len(records))
+	for _, srv := range records {
+		host := strings.TrimSuffix(srv.Target, ".")
+		servers = append(servers, fmt.Sprintf("%s@%s", d.proto, net.JoinHostPort(host, fmt.Sprint(srv.Port))))
+		weights = append(weights, srv.Weight)
+	}
+
+	_ = d.MultiServersDiscovery.Update(servers)
+	d.weights = weights
+	d.lastUpdate = time.Now()
+	return nil
+}
+
+func (d *SRVDiscovery) Get(mode SelectMode) (string, error) {
+	if err := d.Refresh(); err != nil {
+		return "", err
+	}
+	if mode != RandomSelect {
+		return d.MultiServersDiscovery.Get(mode)
+	}
+
+	d.weightMu.Lock()
+	defer d.weightMu.Unlock()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.servers) == 0 {
+		return "", errors.New("rpc discovery: no available servers")
+	}
+
+	total := 0
+	for _, w := range d.weights {
+		total += int(w)
+	}
+	if total == 0 {
+		// 权重都是0的话，等概率选择
+		return d.servers[d.r.Intn(len(d.servers))], nil
+	}
+	n := d.r.Intn(total)
+	for i, w := range d.weights {
+		if n < int(w) {
+			return d.servers[i], nil
+		}
+		n -= int(w)
+	}
+	return d.servers[len(d.servers) - 1], nil
+}
+
+// 不支持可用区，StickyRoundRobinSelect使用ctx里的会话标识，其他和Get一样
+func (d *SRVDiscovery) GetWithContext(ctx context.Context, mode SelectMode) (string, error) {
+	if mode != StickyRoundRobinSelect {
+		return d.Get(mode)
+	}
+	if err := d.Refresh(); err != nil {
+		return "", err
+	}
+	return d.MultiServersDiscovery.GetWithContext(ctx, mode)
+}
+
+func (d *SRVDiscovery) GetAll() ([]string, error) {
+	if err := d.Refresh(); err != nil {
+		return nil, err
+	}
+	return d.MultiServersDiscovery.GetAll()
+}
+
+var _ Discovery = (*SRVDiscovery)(nil)
@@ -0,0 +1,92 @@
+package xclient
+
+import (
+	"math"
+	"time"
+)
+
+// 服务端负载的平滑系数，新的负载占的比例
+var loadScoreAlpha = 0.3
+
+// 负载的半衰期，一段时间没有调用的服务负载逐渐降到0，短暂的高负载不会让服务一直选不到
+var loadScoreHalfLife = 10 * time.Second
+
+// 一个服务地址的负载（EWMA）
+type loadScore struct {
+	value float64
+	updated time.Time
+}
+
+// 按时间衰减之后的负载
+func (s *loadScore) at(now time.Time) float64 {
+	elapsed := now.Sub(s.updated)
+	if elapsed <= 0 || loadScoreHalfLife <= 0 {
+		return s.value
+	}
+	return s.value * math.Pow(0.5, float64(elapsed) / float64(loadScoreHalfLife))
+}
+
+// 记录服务端在响应头里报告的负载（见simpleRPC.Server.ReportLoadInResponses）
+func (xc *XClient) recordLoad(rpcAddr string, load float64) {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	if xc.loadScores == nil {
+		xc.loadScores = make(map[string]*loadScore)
+	}
+	now := time.Now()
+	s, ok := xc.loadScores[rpcAddr]
+	if !ok {
+		xc.loadScores[rpcAddr] = &loadScore{value: load, updated: now}
+		return
+	}
+	s.value = loadScoreAlpha * load + (1 - loadScoreAlpha) * s.at(now)
+	s.updated = now
+}
+
+// 返回每个服务地址当前的负载，只包括报告过负载的地址
+func (xc *XClient) ServerLoadScores() map[string]float64 {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	now := time.Now()
+	scores := make(map[string]float64, len(xc.loadScores))
+	for rpcAddr, s := range xc.loadScores {
+		scores[rpcAddr] = s.at(now)
+	}
+	return scores
+}
+
+// 选择负载最低的服务，负载相同时从上一次的下一个位置开始轮询
+// 没有报告过负载的服务当作其他服务的平均负载，不会因为没有负载信息一直被选中
+func (xc *XClient) selectByLoad(servers []string) string {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	n := len(servers)
+	xc.index = (xc.index + 1) % n
+	now := time.Now()
+	scores := make([]float64, n)
+	known := make([]bool, n)
+	sum, count := 0.0, 0
+	for i, server := range servers {
+		if s, ok := xc.loadScores[server]; ok {
+			scores[i], known[i] = s.at(now), true
+			sum += scores[i]
+			count ++
+		}
+	}
+	mean := 0.0
+	if count > 0 {
+		mean = sum / float64(count)
+	}
+	best, bestScore := "", 0.0
+	for i := 0; i < n; i ++ {
+		j := (xc.index + i) % n
+		server, score := servers[j], scores[j]
+		if !known[j] {
+			score = mean
+		}
+		if best == "" || score < bestScore {
+			best, bestScore = server, score
+		}
+	}
+	return best
+}
@@ -0,0 +1,43 @@
+package xclient
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// 重试策略，第attempt次重试前等待的时间：
+// d = min(MaxDelay, BaseDelay * Multiplier^attempt)
+// delay = d * (1 - Jitter) + rand.Float64() * d * Jitter
+// Jitter为1时就是full jitter，即 rand.Float64() * d
+type RetryPolicy struct {
+	MaxAttempts int // 最多调用几次（包括第一次），小于等于1不重试
+	BaseDelay time.Duration
+	MaxDelay time.Duration
+	Multiplier float64
+	Jitter float64 // 0-1
+	Retryable func(error) bool // 判断错误是否需要重试，为nil时只重试网络错误
+}
+
+func (p *RetryPolicy) retryable(err error) bool {
+	if p.Retryable != nil {
+		return p.Retryable(err)
+	}
+	return isNetworkError(err)
+}
+
+// 第attempt次重试前需要等待的时间，attempt从1开始
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	d := float64(p.BaseDelay) * math.Pow(p.Multiplier, float64(attempt))
+	if p.MaxDelay > 0 && d > float64(p.MaxDelay) {
+		d = float64(p.MaxDelay)
+	}
+	return time.Duration(d * (1 - p.Jitter) + rand.Float64() * d * p.Jitter)
+}
+
+// 设置重试策略，XClient的所有调用都会按这个策略重试
+func (xc *XClient) SetRetryPolicy(policy RetryPolicy) {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	xc.retryPolicy = &policy
+}
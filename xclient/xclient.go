@@ -2,10 +2,16 @@ package xclient
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"io"
+	"log"
+	"math/rand"
 	"reflect"
 	. "simpleRPC"
+	"strings"
 	"sync"
+	"time"
 )
 
 type XClient struct {
@@ -14,63 +20,438 @@ type XClient struct {
 	opt *Option
 	mu sync.Mutex
 	clients map[string]*Client
+	rollout *rollout // 灰度发布配置，为nil时按负载均衡策略选择服务
+	retryPolicy *RetryPolicy // 重试策略，为nil时不重试
+	healthCheckIdle time.Duration // 连接空闲超过这个时间，使用前先检查是否可用，0为不检查
+	lastUsed map[string]time.Time // 每个服务地址的连接最后使用的时间
+	healthFilter func(addr string, meta map[string]string) bool // 过滤服务地址，为nil时不过滤
+	index int // 过滤之后轮询到的位置
+	errorWindows map[string]*errorWindow // 每个服务地址最近调用的网络错误情况
+	cache *ClientCache // 和其他XClient共用的连接缓存，为nil时自己建立连接
+	loadScores map[string]*loadScore // 每个服务地址报告的负载，HealthAwareSelect使用
+}
+
+// 每个服务地址统计错误率的最近调用次数
+var errorRateWindow = 100
+
+// 最近errorRateWindow次调用里网络错误的情况，环形缓冲区
+type errorWindow struct {
+	outcomes []bool // 每次调用是否是网络错误
+	next int // 下一次调用写入的位置
+	size int // 已经记录的调用次数，最多len(outcomes)
+	errors int // outcomes里网络错误的次数
+}
+
+func (w *errorWindow) add(failed bool) {
+	if w.size == len(w.outcomes) {
+		if w.outcomes[w.next] {
+			w.errors --
+		}
+	} else {
+		w.size ++
+	}
+	w.outcomes[w.next] = failed
+	if failed {
+		w.errors ++
+	}
+	w.next = (w.next + 1) % len(w.outcomes)
+}
+
+func (w *errorWindow) rate() float64 {
+	if w.size == 0 {
+		return 0
+	}
+	return float64(w.errors) / float64(w.size)
+}
+
+// 灰度发布：按百分比把请求从旧版本服务逐步切到新版本服务
+type rollout struct {
+	oldAddr string
+	newAddr string
+	currentPercent func() float64 // 当前切到新版本的百分比（0-100），每次调用时获取
+}
+
+// 根据当前百分比随机选择新旧服务地址
+func (r *rollout) pick() string {
+	if rand.Float64() * 100 < r.currentPercent() {
+		return r.newAddr
+	}
+	return r.oldAddr
 }
 
 var _ io.Closer = (*XClient)(nil)
 
-func NewXClient(d Discovery, mode SelectMode, opt *Option) *XClient {
-	return &XClient{d: d, mode: mode, opt: opt, clients:make(map[string]*Client)}
+// NewXClient的可选配置
+type XClientOption func(xc *XClient)
+
+// 创建XClient的时候预先连接服务发现返回的所有服务，第一次调用就不需要等待建立连接
+// 连接失败只打印日志，ctx用来限制预连接的时间
+func WithPreconnect(ctx context.Context) XClientOption {
+	return func(xc *XClient) {
+		xc.Warmup(ctx)
+	}
+}
+
+func NewXClient(d Discovery, mode SelectMode, opt *Option, opts ...XClientOption) *XClient {
+	xc := &XClient{d: d, mode: mode, opt: opt, clients:make(map[string]*Client), lastUsed: make(map[string]time.Time)}
+	for _, o := range opts {
+		o(xc)
+	}
+	return xc
+}
+
+// 连接服务发现返回的所有服务，已经连接的不会重新连接，失败只打印日志
+func (xc *XClient) Warmup(ctx context.Context) {
+	servers, err := xc.d.GetAll()
+	if err != nil {
+		log.Println("rpc xclient: warmup get servers err:", err)
+		return
+	}
+	for _, rpcAddr := range servers {
+		if ctx.Err() != nil {
+			log.Println("rpc xclient: warmup stopped:", ctx.Err())
+			return
+		}
+		if _, err := xc.dial(rpcAddr); err != nil {
+			log.Printf("rpc xclient: warmup dial %s err: %v", rpcAddr, err)
+		}
+	}
+}
+
+// 在后台执行Warmup，不阻塞调用方，返回的channel在预连接完成后关闭
+func (xc *XClient) WarmupAsync(ctx context.Context) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		xc.Warmup(ctx)
+	}()
+	return done
+}
+
+// 多个错误，例如关闭多个连接时失败的错误
+type MultiError []error
+
+func (e MultiError) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
 }
 
+// 关闭所有连接，返回所有关闭失败的错误（MultiError），都成功的话返回nil
 func (xc *XClient) Close() error {
 	xc.mu.Lock()
 	defer xc.mu.Unlock()
+	var errs MultiError
 	for key, client := range xc.clients {
-		_ = client.Close()
+		if err := xc.closeClient(key, client); err != nil {
+			errs = append(errs, fmt.Errorf("rpc xclient: close %s: %w", key, err))
+		}
 		delete(xc.clients, key)
 	}
 
+	if len(errs) > 0 {
+		return errs
+	}
 	return nil
 }
 
 func (xc *XClient) dial(rpcAddr string) (*Client, error) {
 	xc.mu.Lock()
-	defer xc.mu.Unlock()
-
 	client, ok := xc.clients[rpcAddr]
-	if ok && !client.IsAvailable() {
-		_ = client.Close()
-		delete(xc.clients, rpcAddr)
-		client = nil
+	needProbe := ok && xc.healthCheckIdle > 0 && time.Since(xc.lastUsed[rpcAddr]) >= xc.healthCheckIdle
+	xc.mu.Unlock()
+
+	// 探测和建立连接都不持有锁，避免一个服务地址卡住的时候阻塞其他地址的调用
+	if ok && (!client.IsAvailable() || needProbe && !xc.healthy(client)) {
+		xc.dropClient(rpcAddr, client)
+		ok = false
+	}
+	if ok {
+		xc.mu.Lock()
+		xc.lastUsed[rpcAddr] = time.Now()
+		xc.mu.Unlock()
+		return client, nil
 	}
 
 	// 没有建立的服务地址客户端，或者已经失效的连接，新建一个
-	if client == nil {
-		var err error
+	var err error
+	if xc.cache != nil {
+		client, err = xc.cache.get(rpcAddr, xc.opt)
+	} else {
 		client, err = XDial(rpcAddr, xc.opt)
-		if err != nil {
-			return nil, err
-		}
+	}
+	if err != nil {
+		return nil, err
+	}
 
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	// 其他goroutine可能同时建立了连接，使用已有的，关闭新建的
+	if existing, ok := xc.clients[rpcAddr]; ok && existing.IsAvailable() {
+		_ = xc.closeClient(rpcAddr, client)
+		client = existing
+	} else {
+		if ok {
+			_ = xc.closeClient(rpcAddr, existing)
+		}
 		xc.clients[rpcAddr] = client
 	}
+	xc.lastUsed[rpcAddr] = time.Now()
 
 	return client, nil
 }
 
+// 移除已经不可用的连接，连接已经被其他goroutine移除或者替换的话不做处理
+func (xc *XClient) dropClient(rpcAddr string, client *Client) {
+	xc.mu.Lock()
+	if xc.clients[rpcAddr] != client {
+		xc.mu.Unlock()
+		return
+	}
+	delete(xc.clients, rpcAddr)
+	xc.mu.Unlock()
+	if xc.cache != nil {
+		xc.cache.discard(rpcAddr, xc.opt, client)
+	} else {
+		_ = client.Close()
+	}
+}
+
+// 关闭连接，使用连接缓存时只释放引用
+func (xc *XClient) closeClient(rpcAddr string, client *Client) error {
+	if xc.cache != nil {
+		return xc.cache.release(rpcAddr, xc.opt, client)
+	}
+	return client.Close()
+}
+
+const minIdleEvictionTick = time.Millisecond * 10
+
+// 定期关闭空闲超过maxIdle的连接，直到ctx取消，避免长时间运行的进程里很少访问的服务一直占着连接
+// 有未完成调用的连接不会被关闭，关闭之后再访问时会重新连接
+// maxIdle <= 0 时不做处理，检查间隔为maxIdle的一半，最短为minIdleEvictionTick
+func (xc *XClient) StartIdleEviction(ctx context.Context, maxIdle time.Duration) {
+	if maxIdle <= 0 {
+		return
+	}
+	tick := maxIdle / 2
+	if tick < minIdleEvictionTick {
+		tick = minIdleEvictionTick
+	}
+	go func() {
+		ticker := time.NewTicker(tick)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				xc.evictIdle(maxIdle)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// 关闭空闲超过maxIdle的连接
+func (xc *XClient) evictIdle(maxIdle time.Duration) {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	for rpcAddr, client := range xc.clients {
+		if time.Since(xc.lastUsed[rpcAddr]) < maxIdle || client.PendingCount() > 0 {
+			continue
+		}
+		_ = xc.closeClient(rpcAddr, client)
+		delete(xc.clients, rpcAddr)
+		delete(xc.lastUsed, rpcAddr)
+		log.Printf("rpc xclient: close idle connection %s", rpcAddr)
+	}
+}
+
+const healthCheckTimeout = time.Second
+
+// 连接空闲超过healthCheckIdle时，发送一个心跳，healthCheckTimeout内没有收到回复就认为连接不可用
+func (xc *XClient) healthy(client *Client) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancel()
+	return client.Ping(ctx) == nil
+}
+
+// 连接空闲超过d时，使用前先检查连接是否可用，不可用的话重新连接，0为不检查
+// 可以发现服务端卡死或者网络断开但是没有收到FIN的连接
+func (xc *XClient) SetHealthCheckIdle(d time.Duration) {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	xc.healthCheckIdle = d
+}
+
 func (xc *XClient) call(rpcAddr string, ctx context.Context, serviceMethod string, args, reply interface{}) error {
+	xc.mu.Lock()
+	policy := xc.retryPolicy
+	xc.mu.Unlock()
+
+	for attempt := 0; ; attempt ++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(policy.backoff(attempt)):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		err := xc.callOnce(rpcAddr, ctx, serviceMethod, args, reply)
+		if err == nil || policy == nil || attempt + 1 >= policy.MaxAttempts || !policy.retryable(err) {
+			return err
+		}
+	}
+}
+
+func (xc *XClient) callOnce(rpcAddr string, ctx context.Context, serviceMethod string, args, reply interface{}) error {
 	client, err := xc.dial(rpcAddr)
+	if err == nil {
+		// return client.Call(serviceMethod, args, reply)
+		start := time.Now()
+		err = client.CallWithTimeout(ctx, serviceMethod, args, reply)
+		// 只记录这次调用期间收到的负载，服务端没有报告的话不重复记录旧的值
+		if load, ok := client.ServerLoadSince(start); ok {
+			xc.recordLoad(rpcAddr, load)
+		}
+	}
+	if err == nil || !callerSideError(ctx, err) {
+		xc.recordOutcome(rpcAddr, err != nil && isNetworkError(err))
+	}
+	return err
+}
+
+// 调用方取消（包括Broadcast等在得到结果之后取消其他调用）、调用方的截止时间到了、客户端本地限流的错误，
+// 和服务端是否健康无关，不计入错误率
+func callerSideError(ctx context.Context, err error) bool {
+	return ctx.Err() != nil || errors.Is(err, context.Canceled) || errors.Is(err, ErrOverloaded) || errors.Is(err, ErrSendQueueFull)
+}
+
+// 记录一次调用是否是网络错误，服务方法返回的错误不算
+func (xc *XClient) recordOutcome(rpcAddr string, failed bool) {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	if xc.errorWindows == nil {
+		xc.errorWindows = make(map[string]*errorWindow)
+	}
+	w, ok := xc.errorWindows[rpcAddr]
+	if !ok {
+		w = &errorWindow{outcomes: make([]bool, errorRateWindow)}
+		xc.errorWindows[rpcAddr] = w
+	}
+	w.add(failed)
+}
+
+// 返回每个服务地址最近errorRateWindow次调用的网络错误率（0-1），只包括调用过的地址
+// 负载均衡时可以用来避开不健康的服务（例如配合SetHealthFilter），比熔断器轻量
+func (xc *XClient) ServerErrorRates() map[string]float64 {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	rates := make(map[string]float64, len(xc.errorWindows))
+	for rpcAddr, w := range xc.errorWindows {
+		rates[rpcAddr] = w.rate()
+	}
+	return rates
+}
+
+// 设置灰度发布，currentPercent返回100时，所有请求都会发到newAddr
+func (xc *XClient) GradualRollout(oldAddr, newAddr string, currentPercent func() float64) {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	xc.rollout = &rollout{oldAddr: oldAddr, newAddr: newAddr, currentPercent: currentPercent}
+}
+
+// 设置服务过滤器，选择服务之前先过滤掉fn返回false的服务，例如元数据里 "draining": "true" 的服务
+// meta是服务发现提供的元数据（见MetadataDiscovery），没有的话为nil
+func (xc *XClient) SetHealthFilter(fn func(addr string, meta map[string]string) bool) {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	xc.healthFilter = fn
+}
+
+// 返回过滤之后的所有服务地址
+func (xc *XClient) getAll() ([]string, error) {
+	servers, err := xc.d.GetAll()
 	if err != nil {
-		return err
+		return nil, err
+	}
+	xc.mu.Lock()
+	filter := xc.healthFilter
+	xc.mu.Unlock()
+	if filter == nil {
+		return servers, nil
+	}
+
+	md, _ := xc.d.(MetadataDiscovery)
+	healthy := make([]string, 0, len(servers))
+	for _, server := range servers {
+		var meta map[string]string
+		if md != nil {
+			meta = md.GetMetadata(server)
+		}
+		if filter(server, meta) {
+			healthy = append(healthy, server)
+		}
+	}
+	return healthy, nil
+}
+
+// 可以在过滤之后的服务列表里保持会话的服务发现，MultiServersDiscovery和嵌入了它的服务发现都实现了这个接口
+type sessionSelector interface {
+	selectFrom(ctx context.Context, servers []string, mode SelectMode) (string, error)
+}
+
+// 根据负载均衡策略选择一个服务地址，设置了过滤器的话只在过滤之后的服务里选择
+// ctx会传给服务发现，例如使用WithZone优先选择同一个可用区的服务
+func (xc *XClient) get(ctx context.Context) (string, error) {
+	xc.mu.Lock()
+	filter := xc.healthFilter
+	xc.mu.Unlock()
+	// 服务发现不知道服务的负载，HealthAwareSelect由XClient自己选择
+	if filter == nil && xc.mode != HealthAwareSelect {
+		return xc.d.GetWithContext(ctx, xc.mode)
 	}
 
-	// return client.Call(serviceMethod, args, reply)
-	return client.CallWithTimeout(ctx, serviceMethod, args, reply)
+	servers, err := xc.getAll()
+	if err != nil {
+		return "", err
+	}
+	n := len(servers)
+	if n == 0 {
+		return "", errors.New("rpc discovery: no available servers")
+	}
+	if ss, ok := xc.d.(sessionSelector); ok && xc.mode == StickyRoundRobinSelect {
+		return ss.selectFrom(ctx, servers, xc.mode)
+	}
+	switch xc.mode {
+	case RandomSelect:
+		return servers[rand.Intn(n)], nil
+	case HealthAwareSelect:
+		return xc.selectByLoad(servers), nil
+	case RoundRobinSelect, StickyRoundRobinSelect:
+		// 服务发现不支持在过滤之后的服务列表里保持会话的话，和RoundRobinSelect一样
+		xc.mu.Lock()
+		defer xc.mu.Unlock()
+		xc.index = (xc.index + 1) % n
+		return servers[xc.index], nil
+	default:
+		return "", errors.New("rpc discovery: not supported select mode")
+	}
 }
 
 // 远程调用serviceMethod方法，直到完成返回错误码
 func (xc *XClient) Call(ctx context.Context, serviceMethod string, args, reply interface{}) error {
-	rpcAddr, err := xc.d.Get(xc.mode)
+	xc.mu.Lock()
+	r := xc.rollout
+	xc.mu.Unlock()
+	if r != nil {
+		return xc.call(r.pick(), ctx, serviceMethod, args, reply)
+	}
+
+	rpcAddr, err := xc.get(ctx)
 	if err != nil {
 		return err
 	}
@@ -78,8 +459,49 @@ func (xc *XClient) Call(ctx context.Context, serviceMethod string, args, reply i
 	return xc.call(rpcAddr, ctx, serviceMethod, args, reply)
 }
 
+// 远程调用serviceMethod方法，如果发生网络错误，自动切换到下一个没有尝试过的服务地址，直到所有服务都失败或者ctx被取消
+func (xc *XClient) CallWithFailover(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+	rpcAddr, err := xc.get(ctx)
+	if err != nil {
+		return err
+	}
+
+	servers, err := xc.getAll()
+	if err != nil {
+		return err
+	}
+
+	// 记录已经尝试过的服务地址，同一次调用中不会再次请求失败的服务
+	tried := make(map[string]bool)
+	for {
+		tried[rpcAddr] = true
+		err = xc.call(rpcAddr, ctx, serviceMethod, args, reply)
+		if err == nil || !isNetworkError(err) || ctx.Err() != nil {
+			return err
+		}
+
+		next := ""
+		for _, server := range servers {
+			if !tried[server] {
+				next = server
+				break
+			}
+		}
+		if next == "" {
+			return err
+		}
+		rpcAddr = next
+	}
+}
+
+// 服务端返回的错误是RPCError类型（包括ErrorSerializer还原出来的错误），其他的都认为是网络错误
+func isNetworkError(err error) bool {
+	var rpcErr *RPCError
+	return !errors.As(err, &rpcErr)
+}
+
 func (xc *XClient) Broadcast(ctx context.Context, serviceMethod string, args, reply interface{}) error {
-	servers, err := xc.d.GetAll()
+	servers, err := xc.getAll()
 	if err != nil {
 		return err
 	}
@@ -119,3 +541,226 @@ func (xc *XClient) Broadcast(ctx context.Context, serviceMethod string, args, re
 	wg.Wait()
 	return e
 }
+
+// GoAll的一个调用结果
+type CallResult struct {
+	Index int // 参数在argsList里的下标
+	Reply interface{} // replyFactory创建的返回值
+	Error error
+}
+
+// 并发发起len(argsList)次调用，每次调用按负载均衡策略选择服务，适合并行的独立查询
+// 结果按完成的顺序（不是参数的顺序）发送到返回的channel，所有调用完成之后channel关闭
+// replyFactory为每次调用创建返回值，例如 func() interface{} { return new(int) }
+func (xc *XClient) GoAll(ctx context.Context, serviceMethod string, argsList []interface{}, replyFactory func() interface{}) <-chan CallResult {
+	// 缓冲区足够放下所有结果，调用方不读取也不会让调用的协程阻塞
+	results := make(chan CallResult, len(argsList))
+	var wg sync.WaitGroup
+	for i, args := range argsList {
+		wg.Add(1)
+		go func(i int, args interface{}) {
+			defer wg.Done()
+			reply := replyFactory()
+			err := xc.Call(ctx, serviceMethod, args, reply)
+			results <- CallResult{Index: i, Reply: reply, Error: err}
+		}(i, args)
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+	return results
+}
+
+// 广播调用，所有服务的reply都追加到slicePtr指向的切片里（例如*[]int），顺序和服务返回的顺序一致
+// 一个服务失败不会取消其他的调用，返回成功的个数和第一个错误
+func (xc *XClient) BroadcastCollect(ctx context.Context, serviceMethod string, args interface{}, slicePtr interface{}) (int, error) {
+	sv := reflect.ValueOf(slicePtr)
+	if sv.Kind() != reflect.Ptr || sv.Elem().Kind() != reflect.Slice {
+		return 0, fmt.Errorf("rpc xclient: slicePtr must be a pointer to a slice, got %T", slicePtr)
+	}
+	servers, err := xc.getAll()
+	if err != nil {
+		return 0, err
+	}
+
+	elemType := sv.Elem().Type().Elem()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var e error
+	n := 0
+	for _, rpcAddr := range servers {
+		wg.Add(1)
+		go func(rpcAddr string) {
+			defer wg.Done()
+			reply := reflect.New(elemType)
+			err := xc.call(rpcAddr, ctx, serviceMethod, args, reply.Interface())
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if e == nil {
+					e = err
+				}
+				return
+			}
+			sv.Elem().Set(reflect.Append(sv.Elem(), reply.Elem()))
+			n ++
+		}(rpcAddr)
+	}
+
+	wg.Wait()
+	return n, e
+}
+
+// 广播调用的单个服务结果
+type BroadcastResult struct {
+	Addr string
+	Reply interface{}
+	Error error
+}
+
+// 广播调用失败的服务超过了容忍的个数
+type BroadcastError struct {
+	Results []BroadcastResult // 所有服务的结果，包括成功的和失败的（超过容忍个数之后被取消的调用也是失败）
+	Errors []error // 所有失败的错误
+}
+
+func (e *BroadcastError) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("rpc xclient: broadcast failed on %d of %d servers: %s", len(e.Errors), len(e.Results), strings.Join(msgs, "; "))
+}
+
+// 和Broadcast一样，但是最多允许maxFailures个服务失败，超过之后才取消其他的调用
+// 失败个数没有超过maxFailures时返回nil，reply为其中一个成功的结果；超过时返回*BroadcastError
+func (xc *XClient) BroadcastWithTolerance(ctx context.Context, serviceMethod string, args, reply interface{}, maxFailures int) error {
+	servers, err := xc.getAll()
+	if err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	be := &BroadcastError{}
+
+	replyDone := reply == nil
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	for _, rpcAddr := range servers {
+		wg.Add(1)
+		go func(rpcAddr string) {
+			defer wg.Done()
+			var clonedReply interface{}
+			if reply != nil {
+				clonedReply = reflect.New(reflect.ValueOf(reply).Elem().Type()).Interface()
+			}
+
+			err := xc.call(rpcAddr, ctx, serviceMethod, args, clonedReply)
+			mu.Lock()
+			defer mu.Unlock()
+			be.Results = append(be.Results, BroadcastResult{Addr: rpcAddr, Reply: clonedReply, Error: err})
+			if err != nil {
+				be.Errors = append(be.Errors, err)
+				if len(be.Errors) > maxFailures {
+					cancel()
+				}
+				return
+			}
+			if !replyDone {
+				reflect.ValueOf(reply).Elem().Set(reflect.ValueOf(clonedReply).Elem())
+				replyDone = true
+			}
+		}(rpcAddr)
+	}
+
+	wg.Wait()
+	if len(be.Errors) > maxFailures {
+		return be
+	}
+	return nil
+}
+
+// 异步广播，立即返回一个channel，每个服务的结果返回时就写到channel里，所有服务都返回后关闭channel
+// replyFactory 用来给每个服务创建一个新的reply
+func (xc *XClient) BroadcastAsync(ctx context.Context, serviceMethod string, args interface{}, replyFactory func() interface{}) (<-chan BroadcastResult, error) {
+	servers, err := xc.getAll()
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan BroadcastResult, len(servers))
+	var wg sync.WaitGroup
+	for _, rpcAddr := range servers {
+		wg.Add(1)
+		go func(rpcAddr string) {
+			defer wg.Done()
+			reply := replyFactory()
+			err := xc.call(rpcAddr, ctx, serviceMethod, args, reply)
+			ch <- BroadcastResult{Addr: rpcAddr, Reply: reply, Error: err}
+		}(rpcAddr)
+	}
+
+	go func() {
+		wg.Wait()
+		close(ch)
+	}()
+	return ch, nil
+}
+
+// 同时调用所有服务，收到quorum个成功的结果就返回，其他的调用会被取消
+// ctx结束或者所有服务都返回之后，成功的结果还不够quorum个的话返回错误
+func (xc *XClient) QuorumCall(ctx context.Context, serviceMethod string, args interface{}, quorum int, replyFactory func() interface{}) ([]interface{}, error) {
+	servers, err := xc.getAll()
+	if err != nil {
+		return nil, err
+	}
+	if quorum <= 0 || quorum > len(servers) {
+		return nil, fmt.Errorf("rpc xclient: invalid quorum %d for %d servers", quorum, len(servers))
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	ch := make(chan BroadcastResult, len(servers))
+	for _, rpcAddr := range servers {
+		go func(rpcAddr string) {
+			reply := replyFactory()
+			err := xc.call(rpcAddr, ctx, serviceMethod, args, reply)
+			ch <- BroadcastResult{Addr: rpcAddr, Reply: reply, Error: err}
+		}(rpcAddr)
+	}
+
+	replies := make([]interface{}, 0, quorum)
+	var e error
+	for range servers {
+		select {
+		case result := <-ch:
+			if result.Error != nil {
+				e = result.Error
+				continue
+			}
+			replies = append(replies, result.Reply)
+			if len(replies) >= quorum {
+				return replies, nil
+			}
+		case <-ctx.Done():
+			return nil, fmt.Errorf("rpc xclient: quorum %d not reached, got %d replies: %v", quorum, len(replies), ctx.Err())
+		}
+	}
+	return nil, fmt.Errorf("rpc xclient: quorum %d not reached, got %d replies: %v", quorum, len(replies), e)
+}
+
+// 流式调用serviceMethod，src的数据分块发送给服务端，服务端返回的数据块写到dst，服务方法的签名见PipeStream
+func (xc *XClient) Pipe(ctx context.Context, serviceMethod string, src io.Reader, dst io.Writer) error {
+	rpcAddr, err := xc.get(ctx)
+	if err != nil {
+		return err
+	}
+	client, err := xc.dial(rpcAddr)
+	if err != nil {
+		return err
+	}
+	return client.Pipe(ctx, serviceMethod, src, dst)
+}
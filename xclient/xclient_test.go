@@ -0,0 +1,1042 @@
+package xclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	. "simpleRPC"
+	"simpleRPC/testutil"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func _assert(condition bool, msg string, v ...interface{}) {
+	if !condition {
+		panic(fmt.Sprintf("assertion failed: " + msg, v...))
+	}
+}
+
+type Sleeper struct {
+	delay time.Duration
+}
+
+func (s *Sleeper) Echo(n int, reply *int) error {
+	time.Sleep(s.delay)
+	*reply = n
+	return nil
+}
+
+func TestXClient_GradualRollout(t *testing.T) {
+	var percent float64
+	xc := NewXClient(NewMultiServerDiscovery(nil), RandomSelect, nil)
+	xc.GradualRollout("tcp@old", "tcp@new", func() float64 { return percent })
+
+	const n = 10000
+	for percent = 0; percent <= 100; percent += 25 {
+		hit := 0
+		for i := 0; i < n; i ++ {
+			if xc.rollout.pick() == "tcp@new" {
+				hit++
+			}
+		}
+		got := float64(hit) / n * 100
+		_assert(math.Abs(got - percent) < 3, "expect %.0f%% calls to new server, but got %.2f%%", percent, got)
+	}
+}
+
+func TestXClient_BroadcastAsync(t *testing.T) {
+	fast, _ := testutil.StartTestServer(t, &Sleeper{})
+	slow, _ := testutil.StartTestServer(t, &Sleeper{delay: time.Second})
+
+	d := NewMultiServerDiscovery([]string{"tcp@" + fast, "tcp@" + slow})
+	xc := NewXClient(d, RandomSelect, nil)
+	defer func() { _ = xc.Close() }()
+
+	start := time.Now()
+	ch, err := xc.BroadcastAsync(context.Background(), "Sleeper.Echo", 1, func() interface{} { return new(int) })
+	_assert(err == nil, "failed to broadcast: %v", err)
+
+	first := <-ch
+	_assert(time.Since(start) < time.Second, "expect the first result before the slow server completes")
+	_assert(first.Error == nil && first.Addr == "tcp@" + fast && *first.Reply.(*int) == 1, "expect the first result from the fast server")
+
+	n := 1
+	for result := range ch {
+		_assert(result.Error == nil && result.Addr == "tcp@" + slow, "expect the second result from the slow server")
+		n++
+	}
+	_assert(n == 2, "expect 2 results, but got %d", n)
+}
+
+func TestRetryPolicy_backoff(t *testing.T) {
+	p := &RetryPolicy{
+		MaxAttempts: 5,
+		BaseDelay: time.Millisecond * 100,
+		MaxDelay: time.Second,
+		Multiplier: 2,
+		Jitter: 1,
+	}
+
+	const n = 10000
+	for attempt := 1; attempt < p.MaxAttempts; attempt ++ {
+		max := time.Duration(math.Min(float64(p.MaxDelay), float64(p.BaseDelay) * math.Pow(2, float64(attempt))))
+		// 把[0, max)分成10个桶，full jitter下应该大致均匀分布
+		var buckets [10]int
+		for i := 0; i < n; i ++ {
+			d := p.backoff(attempt)
+			_assert(d >= 0 && d < max, "attempt %d: delay %s out of range [0, %s)", attempt, d, max)
+			buckets[int(d * 10 / max)]++
+		}
+		t.Logf("attempt %d, max %s: %v", attempt, max, buckets)
+		for _, c := range buckets {
+			_assert(c > n / 10 / 2, "attempt %d: delay is not evenly distributed %v", attempt, buckets)
+		}
+	}
+}
+
+// GetAll在err不为nil时返回错误
+type flakyDiscovery struct {
+	*MultiServersDiscovery
+	err error
+}
+
+func (d *flakyDiscovery) GetAll() ([]string, error) {
+	if d.err != nil {
+		return nil, d.err
+	}
+	return d.MultiServersDiscovery.GetAll()
+}
+
+func TestFederatedDiscovery(t *testing.T) {
+	primary := &flakyDiscovery{MultiServersDiscovery: NewMultiServerDiscovery([]string{"tcp@a", "tcp@b"})}
+	backup := NewMultiServerDiscovery([]string{"tcp@b", "tcp@c"})
+	d := NewFederatedDiscovery(primary, backup)
+
+	servers, err := d.GetAll()
+	_assert(err == nil && fmt.Sprint(servers) == "[tcp@a tcp@b tcp@c]", "expect merged servers, but got %v %v", servers, err)
+
+	// 主注册中心出错时使用缓存的服务列表
+	primary.err = fmt.Errorf("registry down")
+	seen := make(map[string]bool)
+	for i := 0; i < 3; i ++ {
+		server, err := d.Get(RoundRobinSelect)
+		_assert(err == nil, "failed to get server: %v", err)
+		seen[server] = true
+	}
+	_assert(len(seen) == 3, "expect round robin over cached servers, but got %v", seen)
+}
+
+func TestSRVDiscovery(t *testing.T) {
+	lookupSRV = func(service, proto, name string) (string, []*net.SRV, error) {
+		_assert(service == "rpc" && proto == "tcp" && name == "example.com", "unexpected srv query")
+		return "", []*net.SRV{
+			{Target: "a.example.com.", Port: 9001, Weight: 90},
+			{Target: "b.example.com.", Port: 9002, Weight: 10},
+		}, nil
+	}
+	defer func() { lookupSRV = net.LookupSRV }()
+
+	d := NewSRVDiscovery("rpc", "tcp", "example.com", time.Minute)
+	servers, err := d.GetAll()
+	_assert(err == nil && fmt.Sprint(servers) == "[tcp@a.example.com:9001 tcp@b.example.com:9002]", "unexpected servers %v %v", servers, err)
+
+	const n = 10000
+	hit := 0
+	for i := 0; i < n; i ++ {
+		server, _ := d.Get(RandomSelect)
+		if server == "tcp@a.example.com:9001" {
+			hit ++
+		}
+	}
+	_assert(math.Abs(float64(hit) / n - 0.9) < 0.03, "expect about 90%% requests to the heavier server, but got %d/%d", hit, n)
+}
+
+// 转发到target的tcp代理，freeze之后已经建立的连接不再转发数据，模拟服务端卡死或者网络断开但是没有收到FIN
+type freezingProxy struct {
+	l net.Listener
+	target string
+	mu sync.Mutex
+	frozen []chan struct{} // 已经建立的连接，关闭之后停止转发
+}
+
+func newFreezingProxy(t *testing.T, target string) *freezingProxy {
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	p := &freezingProxy{l: l, target: target}
+	t.Cleanup(func() { _ = l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			upstream, err := net.Dial("tcp", target)
+			if err != nil {
+				_ = conn.Close()
+				continue
+			}
+			stop := make(chan struct{})
+			p.mu.Lock()
+			p.frozen = append(p.frozen, stop)
+			p.mu.Unlock()
+			go p.pipe(conn, upstream, stop)
+			go p.pipe(upstream, conn, stop)
+		}
+	}()
+	return p
+}
+
+func (p *freezingProxy) pipe(dst, src net.Conn, stop chan struct{}) {
+	buf := make([]byte, 4096)
+	for {
+		n, err := src.Read(buf)
+		if err != nil {
+			return
+		}
+		select {
+		case <-stop:
+			continue
+		default:
+		}
+		if _, err := dst.Write(buf[:n]); err != nil {
+			return
+		}
+	}
+}
+
+func (p *freezingProxy) freeze() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, stop := range p.frozen {
+		close(stop)
+	}
+	p.frozen = nil
+}
+
+// 服务端开启严格检查时，空闲连接的健康检查不能被当成不存在的服务而断开连接
+func TestXClient_HealthCheckStrictServiceCheck(t *testing.T) {
+	server := NewServer()
+	server.SetStrictServiceCheck(true)
+	_ = server.Register(&Sleeper{})
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = l.Close() }()
+	go server.Accept(l)
+	rpcAddr := "tcp@" + l.Addr().String()
+
+	xc := NewXClient(NewMultiServerDiscovery([]string{rpcAddr}), RandomSelect, nil)
+	defer func() { _ = xc.Close() }()
+	xc.SetHealthCheckIdle(time.Millisecond * 20)
+
+	var reply int
+	err := xc.Call(context.Background(), "Sleeper.Echo", 1, &reply)
+	_assert(err == nil && reply == 1, "failed to call Sleeper.Echo: %v", err)
+	old := xc.clients[rpcAddr]
+	for i := 2; i < 5; i ++ {
+		time.Sleep(time.Millisecond * 50)
+		err = xc.Call(context.Background(), "Sleeper.Echo", i, &reply)
+		_assert(err == nil && reply == i, "failed to call Sleeper.Echo after idle: %v", err)
+	}
+	_assert(xc.clients[rpcAddr] == old && old.IsAvailable(), "expect the healthy connection kept after health checks")
+}
+
+func TestXClient_SetHealthCheckIdle(t *testing.T) {
+	addr, _ := testutil.StartTestServer(t, &Sleeper{})
+	proxy := newFreezingProxy(t, addr)
+	rpcAddr := "tcp@" + proxy.l.Addr().String()
+
+	xc := NewXClient(NewMultiServerDiscovery([]string{rpcAddr}), RandomSelect, nil)
+	defer func() { _ = xc.Close() }()
+	xc.SetHealthCheckIdle(time.Millisecond * 50)
+
+	var reply int
+	err := xc.Call(context.Background(), "Sleeper.Echo", 1, &reply)
+	_assert(err == nil && reply == 1, "failed to call Sleeper.Echo: %v", err)
+	old := xc.clients[rpcAddr]
+
+	// 连接卡死之后，客户端还认为连接是可用的
+	proxy.freeze()
+	time.Sleep(time.Millisecond * 100)
+	_assert(old.IsAvailable(), "expect the frozen client still available")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 3)
+	defer cancel()
+	err = xc.Call(ctx, "Sleeper.Echo", 2, &reply)
+	_assert(err == nil && reply == 2, "failed to call Sleeper.Echo after health check: %v", err)
+	_assert(xc.clients[rpcAddr] != old, "expect the frozen client evicted and re-dialed")
+
+	// 探测卡死的连接时不持有锁，其他服务地址的调用不受影响
+	other, _ := testutil.StartTestServer(t, &Sleeper{})
+	_ = xc.call("tcp@" + other, context.Background(), "Sleeper.Echo", 3, &reply)
+	proxy.freeze()
+	time.Sleep(time.Millisecond * 100)
+	probing := make(chan struct{})
+	go func() {
+		defer close(probing)
+		_ = xc.call(rpcAddr, context.Background(), "Sleeper.Echo", 4, &reply)
+	}()
+	time.Sleep(time.Millisecond * 50)
+	start := time.Now()
+	var otherReply int
+	err = xc.call("tcp@" + other, context.Background(), "Sleeper.Echo", 5, &otherReply)
+	_assert(err == nil && otherReply == 5, "failed to call the other server: %v", err)
+	_assert(time.Since(start) < healthCheckTimeout / 2, "expect the other server not blocked by the probe, took %s", time.Since(start))
+	<-probing
+}
+
+func TestXClient_SetHealthFilter(t *testing.T) {
+	addr1, _ := testutil.StartTestServer(t, &Sleeper{})
+	addr2, _ := testutil.StartTestServer(t, &Sleeper{})
+	d := NewMultiServerDiscovery([]string{"tcp@" + addr1, "tcp@" + addr2})
+	d.SetMetadata("tcp@" + addr2, map[string]string{"draining": "true"})
+
+	xc := NewXClient(d, RoundRobinSelect, nil)
+	defer func() { _ = xc.Close() }()
+	xc.SetHealthFilter(func(addr string, meta map[string]string) bool {
+		return meta["draining"] != "true"
+	})
+
+	for i := 0; i < 10; i ++ {
+		var reply int
+		err := xc.Call(context.Background(), "Sleeper.Echo", i, &reply)
+		_assert(err == nil && reply == i, "failed to call Sleeper.Echo: %v", err)
+	}
+	_, ok := xc.clients["tcp@" + addr2]
+	_assert(!ok, "expect no calls to the draining server")
+}
+
+func TestXClient_QuorumCall(t *testing.T) {
+	var servers []string
+	for i := 0; i < 4; i ++ {
+		addr, _ := testutil.StartTestServer(t, &Sleeper{})
+		servers = append(servers, "tcp@" + addr)
+	}
+	slow, _ := testutil.StartTestServer(t, &Sleeper{delay: time.Second * 2})
+	servers = append(servers, "tcp@" + slow)
+
+	xc := NewXClient(NewMultiServerDiscovery(servers), RandomSelect, nil)
+	defer func() { _ = xc.Close() }()
+
+	start := time.Now()
+	replies, err := xc.QuorumCall(context.Background(), "Sleeper.Echo", 7, 3, func() interface{} { return new(int) })
+	_assert(err == nil && len(replies) == 3, "failed to reach quorum: %v", err)
+	for _, reply := range replies {
+		_assert(*reply.(*int) == 7, "unexpected reply %d", *reply.(*int))
+	}
+	_assert(time.Since(start) < time.Second, "expect quorum reached without waiting for the slow server")
+
+	// 只有一个服务能在截止时间之前返回时，达不到quorum
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond * 200)
+	defer cancel()
+	slowOnly := NewXClient(NewMultiServerDiscovery([]string{servers[0], "tcp@" + slow}), RandomSelect, nil)
+	defer func() { _ = slowOnly.Close() }()
+	_, err = slowOnly.QuorumCall(ctx, "Sleeper.Echo", 7, 2, func() interface{} { return new(int) })
+	_assert(err != nil, "expect an error when quorum not reached")
+}
+
+type Upper int
+
+// 把客户端发送的数据转成大写返回
+func (u *Upper) Convert(stream PipeStream) error {
+	for {
+		chunk, err := stream.ReadChunk()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := stream.WriteChunk(bytes.ToUpper(chunk)); err != nil {
+			return err
+		}
+	}
+}
+
+func (u *Upper) Fail(stream PipeStream) error {
+	_, _ = stream.ReadChunk()
+	return errors.New("upper failed")
+}
+
+func TestXClient_Pipe(t *testing.T) {
+	addr, _ := testutil.StartTestServer(t, new(Upper))
+	xc := NewXClient(NewMultiServerDiscovery([]string{"tcp@" + addr}), RandomSelect, nil)
+	defer func() { _ = xc.Close() }()
+
+	data := strings.Repeat("hello simple rpc ", 20000)
+	var dst bytes.Buffer
+	err := xc.Pipe(context.Background(), "Upper.Convert", strings.NewReader(data), &dst)
+	_assert(err == nil && dst.String() == strings.ToUpper(data), "failed to pipe %d bytes: %v, got %d bytes", len(data), err, dst.Len())
+
+	err = xc.Pipe(context.Background(), "Upper.Fail", strings.NewReader(data), &dst)
+	_assert(err != nil && strings.Contains(err.Error(), "upper failed"), "expect error from stream method, but got %v", err)
+
+	// 失败之后连接还可以继续使用
+	dst.Reset()
+	err = xc.Pipe(context.Background(), "Upper.Convert", strings.NewReader("abc"), &dst)
+	_assert(err == nil && dst.String() == "ABC", "failed to pipe after error: %v", err)
+
+	// 普通调用流式方法直接返回错误，不会一直等待
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	var reply []byte
+	err = xc.Call(ctx, "Upper.Convert", []byte("abc"), &reply)
+	_assert(err != nil && strings.Contains(err.Error(), "stream method"), "expect plain call to a stream method rejected, but got %v", err)
+}
+
+func TestSimpleRegistryDiscovery_InitialServersRegistryTimeout(t *testing.T) {
+	refreshRequestTimeout = time.Millisecond * 50
+	defer func() { refreshRequestTimeout = time.Second * 5 }()
+	var requests int32
+	block := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		<-block
+	}))
+	defer ts.Close()
+	defer close(block)
+
+	servers := []string{"tcp@a", "tcp@b"}
+	d := NewSimpleRegistryDiscovery(ts.URL, time.Hour).WithInitialServers(servers)
+	// 修改调用方的slice不影响初始的服务列表
+	servers[0] = "tcp@changed"
+	// 模拟初始列表已经到了需要从注册中心拉取的时间
+	d.lastUpdate = time.Time{}
+
+	// 第一次拉取超时之后使用初始的服务列表，之后timeout内不再等待注册中心
+	start := time.Now()
+	for i := 0; i < 5; i ++ {
+		all, err := d.GetAll()
+		_assert(err == nil && len(all) == 2 && all[0] == "tcp@a", "expect the initial servers, but got %v, %v", all, err)
+	}
+	_assert(time.Since(start) < refreshRequestTimeout * 3, "expect only one refresh to wait for the registry, took %s", time.Since(start))
+	_assert(atomic.LoadInt32(&requests) == 1, "expect one request to the registry, but got %d", atomic.LoadInt32(&requests))
+}
+
+func TestSimpleRegistryDiscovery_GetWithContext(t *testing.T) {
+	d := NewSimpleRegistryDiscovery("http://127.0.0.1:0/registry", time.Hour).WithInitialServers([]string{"tcp@a", "tcp@b", "tcp@c"})
+	d.SetMetadata("tcp@b", map[string]string{"zone": "us-east-1a"})
+	d.SetMetadata("tcp@c", map[string]string{"zone": "us-east-1b"})
+
+	ctx := WithZone(context.Background(), "us-east-1a")
+	for i := 0; i < 5; i ++ {
+		server, err := d.GetWithContext(ctx, RoundRobinSelect)
+		if err != nil || server != "tcp@b" {
+			t.Fatalf("expect server in the same zone, but got %s, %v", server, err)
+		}
+	}
+
+	// 没有同一个可用区的服务时，在所有服务里选择
+	seen := make(map[string]bool)
+	ctx = WithZone(context.Background(), "eu-west-1a")
+	for i := 0; i < 3; i ++ {
+		server, _ := d.GetWithContext(ctx, RoundRobinSelect)
+		seen[server] = true
+	}
+	if len(seen) != 3 {
+		t.Fatalf("expect fallback to all servers, but got %v", seen)
+	}
+}
+
+func TestMultiServersDiscovery_StickyRoundRobin(t *testing.T) {
+	d := NewMultiServerDiscovery([]string{"tcp@a", "tcp@b", "tcp@c"})
+	ctx1 := WithSessionKey(context.Background(), "user-1")
+	ctx2 := WithSessionKey(context.Background(), "user-2")
+	first, _ := d.GetWithContext(ctx1, StickyRoundRobinSelect)
+	other, _ := d.GetWithContext(ctx2, StickyRoundRobinSelect)
+	_assert(first != other, "expect sessions assigned round robin, but both got %s", first)
+	for i := 0; i < 5; i ++ {
+		server, err := d.GetWithContext(ctx1, StickyRoundRobinSelect)
+		_assert(err == nil && server == first, "expect sticky server %s, but got %s, %v", first, server, err)
+	}
+
+	// 原来的服务下线之后，重新分配一个服务，之后保持不变
+	var rest []string
+	for _, s := range []string{"tcp@a", "tcp@b", "tcp@c"} {
+		if s != first {
+			rest = append(rest, s)
+		}
+	}
+	_ = d.Update(rest)
+	next, _ := d.GetWithContext(ctx1, StickyRoundRobinSelect)
+	_assert(next != first, "expect session reassigned, but got %s", next)
+	again, _ := d.GetWithContext(ctx1, StickyRoundRobinSelect)
+	_assert(again == next, "expect reassigned server %s to stick, but got %s", next, again)
+
+	// 超时的会话重新分配，会话数不超过上限
+	d.sessions["user-1"].used = time.Now().Add(-sessionIdleTimeout)
+	_, _ = d.GetWithContext(ctx1, StickyRoundRobinSelect)
+	_assert(time.Since(d.sessions["user-1"].used) < time.Minute, "expect idle session reassigned")
+	for i := 0; i < maxSessions + 10; i ++ {
+		_, _ = d.GetWithContext(WithSessionKey(context.Background(), fmt.Sprintf("s-%d", i)), StickyRoundRobinSelect)
+	}
+	_assert(len(d.sessions) == maxSessions, "expect sessions capped at %d, but got %d", maxSessions, len(d.sessions))
+}
+
+func TestXClient_StickyRoundRobinWithHealthFilter(t *testing.T) {
+	d := NewMultiServerDiscovery([]string{"tcp@a", "tcp@b", "tcp@c"})
+	d.SetMetadata("tcp@c", map[string]string{"draining": "true"})
+	xc := NewXClient(d, StickyRoundRobinSelect, nil)
+	defer func() { _ = xc.Close() }()
+	xc.SetHealthFilter(func(addr string, meta map[string]string) bool {
+		return meta["draining"] != "true"
+	})
+
+	// 设置了过滤器时同一个会话仍然选择同一个服务
+	ctx := WithSessionKey(context.Background(), "user-1")
+	first, _ := xc.get(ctx)
+	for i := 0; i < 5; i ++ {
+		server, err := xc.get(ctx)
+		_assert(err == nil && server == first && server != "tcp@c", "expect sticky server %s, but got %s, %v", first, server, err)
+	}
+}
+
+func TestXClient_BroadcastWithTolerance(t *testing.T) {
+	var servers []string
+	for i := 0; i < 2; i ++ {
+		addr, _ := testutil.StartTestServer(t, &Sleeper{})
+		servers = append(servers, "tcp@" + addr)
+	}
+	// 没有监听的地址，调用会失败
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	servers = append(servers, "tcp@" + l.Addr().String())
+	_ = l.Close()
+
+	xc := NewXClient(NewMultiServerDiscovery(servers), RandomSelect, nil)
+	defer func() { _ = xc.Close() }()
+
+	var reply int
+	err := xc.BroadcastWithTolerance(context.Background(), "Sleeper.Echo", 7, &reply, 1)
+	_assert(err == nil && reply == 7, "expect one failure tolerated, but got %v, reply %d", err, reply)
+
+	err = xc.BroadcastWithTolerance(context.Background(), "Sleeper.Echo", 7, &reply, 0)
+	var be *BroadcastError
+	_assert(errors.As(err, &be), "expect a BroadcastError, but got %v", err)
+	_assert(len(be.Errors) >= 1 && len(be.Results) == 3, "expect all results and errors, but got %+v", be)
+}
+
+func TestXClient_WithPreconnect(t *testing.T) {
+	addr, _ := testutil.StartTestServer(t, &Sleeper{})
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	dead := l.Addr().String()
+	_ = l.Close()
+	servers := []string{"tcp@" + addr, "tcp@" + dead}
+
+	// 连接失败的服务不影响创建XClient
+	xc := NewXClient(NewMultiServerDiscovery(servers), RandomSelect, nil, WithPreconnect(context.Background()))
+	defer func() { _ = xc.Close() }()
+	xc.mu.Lock()
+	_, ok := xc.clients["tcp@" + addr]
+	n := len(xc.clients)
+	xc.mu.Unlock()
+	_assert(ok && n == 1, "expect connection to %s established, but got %d clients", addr, n)
+
+	xc2 := NewXClient(NewMultiServerDiscovery(servers[:1]), RandomSelect, nil)
+	defer func() { _ = xc2.Close() }()
+	<-xc2.WarmupAsync(context.Background())
+	xc2.mu.Lock()
+	n = len(xc2.clients)
+	xc2.mu.Unlock()
+	_assert(n == 1, "expect connection established after async warmup, but got %d clients", n)
+}
+
+func TestXClient_Close(t *testing.T) {
+	var servers []string
+	for i := 0; i < 3; i ++ {
+		addr, _ := testutil.StartTestServer(t, &Sleeper{})
+		servers = append(servers, "tcp@" + addr)
+	}
+	xc := NewXClient(NewMultiServerDiscovery(servers), RandomSelect, nil, WithPreconnect(context.Background()))
+
+	// 提前关闭两个连接，XClient再关闭的时候会失败
+	xc.mu.Lock()
+	_ = xc.clients[servers[0]].Close()
+	_ = xc.clients[servers[2]].Close()
+	xc.mu.Unlock()
+
+	err := xc.Close()
+	var me MultiError
+	_assert(errors.As(err, &me) && len(me) == 2, "expect 2 close errors, but got %v", err)
+	for _, e := range me {
+		_assert(errors.Is(e, ErrShutdown), "expect ErrShutdown, but got %v", e)
+	}
+	_assert(xc.Close() == nil, "expect no error when closing again")
+}
+
+func TestXClient_BroadcastCollect(t *testing.T) {
+	var servers []string
+	for i := 0; i < 3; i ++ {
+		addr, _ := testutil.StartTestServer(t, &Sleeper{})
+		servers = append(servers, "tcp@" + addr)
+	}
+	xc := NewXClient(NewMultiServerDiscovery(servers), RandomSelect, nil)
+	defer func() { _ = xc.Close() }()
+
+	var replies []int
+	n, err := xc.BroadcastCollect(context.Background(), "Sleeper.Echo", 7, &replies)
+	_assert(err == nil && n == 3 && len(replies) == 3, "expect 3 replies, but got %d %v, %v", n, replies, err)
+	for _, reply := range replies {
+		_assert(reply == 7, "unexpected reply %d", reply)
+	}
+
+	_, err = xc.BroadcastCollect(context.Background(), "Sleeper.Echo", 7, replies)
+	_assert(err != nil, "expect error when slicePtr is not a pointer")
+}
+
+func TestXClient_StartIdleEviction(t *testing.T) {
+	var servers []string
+	for i := 0; i < 5; i ++ {
+		addr, _ := testutil.StartTestServer(t, &Sleeper{})
+		servers = append(servers, "tcp@" + addr)
+	}
+	xc := NewXClient(NewMultiServerDiscovery(servers), RandomSelect, nil, WithPreconnect(context.Background()))
+	defer func() { _ = xc.Close() }()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// 0和很小的maxIdle不会panic
+	xc.StartIdleEviction(ctx, 0)
+	xc.StartIdleEviction(ctx, time.Nanosecond)
+	cancel()
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	xc.StartIdleEviction(ctx, time.Millisecond * 100)
+
+	// 只使用前两个服务
+	deadline := time.Now().Add(time.Millisecond * 400)
+	for time.Now().Before(deadline) {
+		for _, addr := range servers[:2] {
+			var reply int
+			err := xc.call(addr, context.Background(), "Sleeper.Echo", 1, &reply)
+			_assert(err == nil, "failed to call %s: %v", addr, err)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	_assert(len(xc.clients) == 2, "expect 3 idle connections evicted, but got %d clients", len(xc.clients))
+	for _, addr := range servers[:2] {
+		_, ok := xc.clients[addr]
+		_assert(ok, "expect connection to %s kept", addr)
+	}
+}
+
+func TestXClient_ServerErrorRates(t *testing.T) {
+	addr, _ := testutil.StartTestServer(t, &Sleeper{})
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	dead := "tcp@" + l.Addr().String()
+	_ = l.Close()
+	live := "tcp@" + addr
+	xc := NewXClient(NewMultiServerDiscovery([]string{live, dead}), RandomSelect, nil)
+	defer func() { _ = xc.Close() }()
+
+	var reply int
+	for i := 0; i < 3; i ++ {
+		_ = xc.call(live, context.Background(), "Sleeper.Echo", i, &reply)
+		_ = xc.call(dead, context.Background(), "Sleeper.Echo", i, &reply)
+	}
+	// 服务方法不存在是服务端返回的错误，不算网络错误
+	_ = xc.call(live, context.Background(), "Sleeper.Unknown", 0, &reply)
+	rates := xc.ServerErrorRates()
+	_assert(rates[live] == 0 && rates[dead] == 1, "expect error rate 0 for live and 1 for dead, but got %v", rates)
+
+	// 只统计最近的调用
+	w := &errorWindow{outcomes: make([]bool, 4)}
+	for _, failed := range []bool{true, true, true, true, false, false} {
+		w.add(failed)
+	}
+	_assert(w.rate() == 0.5, "expect rolling error rate 0.5, but got %v", w.rate())
+}
+
+func TestXClient_ServerErrorRatesIgnoreCallerErrors(t *testing.T) {
+	addr, _ := testutil.StartTestServer(t, &Sleeper{delay: time.Millisecond * 200})
+	slow := "tcp@" + addr
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	dead := "tcp@" + l.Addr().String()
+	_ = l.Close()
+	xc := NewXClient(NewMultiServerDiscovery([]string{slow, dead}), RandomSelect, nil)
+	defer func() { _ = xc.Close() }()
+
+	// 调用方自己的截止时间到了，不算服务端的错误
+	var reply int
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond * 50)
+	defer cancel()
+	err := xc.call(slow, ctx, "Sleeper.Echo", 1, &reply)
+	_assert(err != nil && errors.Is(err, context.DeadlineExceeded), "expect caller deadline exceeded, but got %v", err)
+
+	// dead失败之后Broadcast取消了slow上的调用，slow不算失败
+	err = xc.Broadcast(context.Background(), "Sleeper.Echo", 1, nil)
+	_assert(err != nil, "expect broadcast to fail on the dead server")
+	rates := xc.ServerErrorRates()
+	_assert(rates[slow] == 0 && rates[dead] == 1, "expect error rate 0 for the cancelled server and 1 for dead, but got %v", rates)
+}
+
+func TestXClient_GoAll(t *testing.T) {
+	var servers []string
+	for _, delay := range []time.Duration{0, time.Millisecond * 50} {
+		addr, _ := testutil.StartTestServer(t, &Sleeper{delay: delay})
+		servers = append(servers, "tcp@" + addr)
+	}
+	xc := NewXClient(NewMultiServerDiscovery(servers), RoundRobinSelect, nil)
+	defer func() { _ = xc.Close() }()
+
+	argsList := []interface{}{0, 1, 2, 3, "bad"}
+	seen := make(map[int]bool)
+	failed := 0
+	for r := range xc.GoAll(context.Background(), "Sleeper.Echo", argsList, func() interface{} { return new(int) }) {
+		if r.Error != nil {
+			_assert(r.Index == 4, "expect only the bad args to fail, but %d failed: %v", r.Index, r.Error)
+			failed ++
+			continue
+		}
+		_assert(*r.Reply.(*int) == r.Index, "expect reply %d, but got %d", r.Index, *r.Reply.(*int))
+		seen[r.Index] = true
+	}
+	_assert(len(seen) == 4 && failed == 1, "expect 4 results and 1 error, but got %v, %d", seen, failed)
+}
+
+func TestClientCache(t *testing.T) {
+	addr, _ := testutil.StartTestServer(t, &Sleeper{})
+	servers := []string{"tcp@" + addr}
+	cache := NewClientCache()
+	xc1 := NewXClient(NewMultiServerDiscovery(servers), RandomSelect, nil, WithClientCache(cache))
+	xc2 := NewXClient(NewMultiServerDiscovery(servers), RandomSelect, nil, WithClientCache(cache))
+	var reply int
+	_assert(xc1.Call(context.Background(), "Sleeper.Echo", 1, &reply) == nil, "failed to call with xc1")
+	_assert(xc2.Call(context.Background(), "Sleeper.Echo", 2, &reply) == nil, "failed to call with xc2")
+	_assert(cache.Size() == 1, "expect one shared connection, but got %d", cache.Size())
+	_assert(xc1.clients[servers[0]] == xc2.clients[servers[0]], "expect both XClients to use the same client")
+
+	// 配置不同的XClient不共用连接
+	xc3 := NewXClient(NewMultiServerDiscovery(servers), RandomSelect, &Option{MagicNumber: MagicNumber, CodecType: "application/json"}, WithClientCache(cache))
+	_assert(xc3.Call(context.Background(), "Sleeper.Echo", 3, &reply) == nil, "failed to call with xc3")
+	_assert(cache.Size() == 2, "expect a separate connection for different option, but got %d", cache.Size())
+	_ = xc3.Close()
+
+	// 关闭一个XClient不影响共用连接的其他XClient
+	_ = xc1.Close()
+	_assert(xc2.Call(context.Background(), "Sleeper.Echo", 4, &reply) == nil && reply == 4, "expect xc2 still usable after xc1 closed")
+	_assert(cache.Size() == 1, "expect shared connection kept, but got %d", cache.Size())
+	_ = xc2.Close()
+	_assert(cache.Size() == 0, "expect connection closed after all XClients closed, but got %d", cache.Size())
+
+	xc4 := NewXClient(NewMultiServerDiscovery(servers), RandomSelect, nil, WithClientCache(cache))
+	defer func() { _ = xc4.Close() }()
+	_ = xc4.Call(context.Background(), "Sleeper.Echo", 5, &reply)
+	cache.Evict(servers[0])
+	_assert(cache.Size() == 0, "expect evicted, but got %d", cache.Size())
+
+	// 一个XClient丢弃共用的连接，只移除缓存，另一个XClient还可以继续使用
+	xc5 := NewXClient(NewMultiServerDiscovery(servers), RandomSelect, nil, WithClientCache(cache))
+	xc6 := NewXClient(NewMultiServerDiscovery(servers), RandomSelect, nil, WithClientCache(cache))
+	defer func() { _ = xc6.Close() }()
+	_ = xc5.Call(context.Background(), "Sleeper.Echo", 6, &reply)
+	_ = xc6.Call(context.Background(), "Sleeper.Echo", 6, &reply)
+	shared := xc5.clients[servers[0]]
+	cache.discard(servers[0], nil, shared)
+	delete(xc5.clients, servers[0])
+	_assert(cache.Size() == 0 && shared.IsAvailable(), "expect shared client kept open for other holders")
+	_assert(xc6.Call(context.Background(), "Sleeper.Echo", 7, &reply) == nil && reply == 7, "expect xc6 still usable after discard")
+	_ = xc6.closeClient(servers[0], shared)
+	delete(xc6.clients, servers[0])
+	_assert(!shared.IsAvailable(), "expect shared client closed after the last reference released")
+}
+
+func TestXClient_HealthAwareSelect(t *testing.T) {
+	server := NewServer()
+	_ = server.Register(&Sleeper{})
+	server.ReportLoadInResponses(true)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer func() { _ = l.Close() }()
+	go server.Accept(l)
+	reporting := "tcp@" + l.Addr().String()
+	addr, _ := testutil.StartTestServer(t, &Sleeper{})
+	silent := "tcp@" + addr
+
+	xc := NewXClient(NewMultiServerDiscovery([]string{reporting, silent}), HealthAwareSelect, nil)
+	defer func() { _ = xc.Close() }()
+	var reply int
+	_ = xc.call(reporting, context.Background(), "Sleeper.Echo", 1, &reply)
+	_ = xc.call(silent, context.Background(), "Sleeper.Echo", 1, &reply)
+	scores := xc.ServerLoadScores()
+	_, ok := scores[reporting]
+	_, silentOk := scores[silent]
+	_assert(ok && !silentOk, "expect only the reporting server to have a load score, got %v", scores)
+
+	// 服务端没有在响应里报告负载的话，不重复记录连接上旧的负载
+	xc.mu.Lock()
+	xc.loadScores = nil
+	xc.mu.Unlock()
+	server.ReportLoadInResponses(false)
+	_ = xc.call(reporting, context.Background(), "Sleeper.Echo", 1, &reply)
+	_assert(len(xc.ServerLoadScores()) == 0, "expect no load recorded without a load header, got %v", xc.ServerLoadScores())
+
+	// 负载低的服务优先
+	xc.recordLoad(reporting, 10)
+	xc.recordLoad(silent, 2)
+	for i := 0; i < 3; i ++ {
+		got, err := xc.get(context.Background())
+		_assert(err == nil && got == silent, "expect the least loaded server, but got %s %v", got, err)
+	}
+	// 没有负载信息的服务当作平均负载，不会总是被选中
+	for i := 0; i < 3; i ++ {
+		got := xc.selectByLoad([]string{reporting, silent, "tcp@unknown"})
+		_assert(got == silent, "expect unknown server treated as the mean, but got %s", got)
+	}
+	// 负载相同时轮询
+	now := time.Now()
+	xc.mu.Lock()
+	xc.loadScores[reporting] = &loadScore{value: 5, updated: now}
+	xc.loadScores[silent] = &loadScore{value: 5, updated: now}
+	xc.mu.Unlock()
+	first, _ := xc.get(context.Background())
+	second, _ := xc.get(context.Background())
+	_assert(first != second, "expect round robin on ties, but got %s twice", first)
+
+	// 负载随时间衰减
+	s := &loadScore{value: 8, updated: time.Now().Add(-loadScoreHalfLife * 2)}
+	_assert(math.Abs(s.at(time.Now()) - 2) < 0.01, "expect load to halve every half-life, but got %v", s.at(time.Now()))
+}
+
+// 记录调用次数，Fail返回一个业务错误
+type Failer struct {
+	calls int32
+}
+
+func (f *Failer) Fail(n int, reply *int) error {
+	atomic.AddInt32(&f.calls, 1)
+	return &codeError{Code: n}
+}
+
+type codeError struct {
+	Code int `json:"code"`
+}
+
+func (e *codeError) Error() string {
+	return fmt.Sprintf("code %d", e.Code)
+}
+
+// 把codeError序列化成json
+type codeErrorSerializer struct{}
+
+func (codeErrorSerializer) Marshal(err error) ([]byte, error) {
+	return json.Marshal(err)
+}
+
+func (codeErrorSerializer) Unmarshal(data []byte) error {
+	var e codeError
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil
+	}
+	return &e
+}
+
+func TestXClient_ErrorSerializerIsNotNetworkError(t *testing.T) {
+	var servers []string
+	var failers []*Failer
+	for i := 0; i < 2; i ++ {
+		f := &Failer{}
+		server := NewServer()
+		server.SetErrorSerializer(codeErrorSerializer{})
+		_ = server.Register(f)
+		l, _ := net.Listen("tcp", "127.0.0.1:0")
+		defer func() { _ = l.Close() }()
+		go server.Accept(l)
+		servers = append(servers, "tcp@" + l.Addr().String())
+		failers = append(failers, f)
+	}
+	xc := NewXClient(NewMultiServerDiscovery(servers), RoundRobinSelect, &Option{
+		MagicNumber: MagicNumber,
+		CodecType: DefaultOption.CodecType,
+		ErrorSerializer: codeErrorSerializer{},
+	})
+	defer func() { _ = xc.Close() }()
+
+	var reply int
+	err := xc.CallWithFailover(context.Background(), "Failer.Fail", 7, &reply)
+	var ce *codeError
+	_assert(errors.As(err, &ce) && ce.Code == 7, "expect the deserialized codeError, but got %T %v", err, err)
+	_assert(!isNetworkError(err), "expect a deserialized handler error not to be a network error")
+	calls := atomic.LoadInt32(&failers[0].calls) + atomic.LoadInt32(&failers[1].calls)
+	_assert(calls == 1, "expect the handler error not to fail over, but called %d times", calls)
+
+	rates := xc.ServerErrorRates()
+	for _, addr := range servers {
+		_assert(rates[addr] == 0, "expect handler errors not to count as network errors, but got %v", rates)
+	}
+}
+
+// 记录调用次数，Echo执行delay之后返回参数
+type Counter struct {
+	calls int32
+	delay time.Duration
+}
+
+func (c *Counter) Echo(n int, reply *int) error {
+	atomic.AddInt32(&c.calls, 1)
+	time.Sleep(c.delay)
+	*reply = n
+	return nil
+}
+
+// 接受连接之后立即关闭，模拟已经挂掉的服务，返回地址和接受连接的次数
+func startBrokenServer(t *testing.T) (string, *int32) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("failed to listen:", err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	accepts := new(int32)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(accepts, 1)
+			_ = conn.Close()
+		}
+	}()
+	return "tcp@" + l.Addr().String(), accepts
+}
+
+func TestXClient_CallWithFailover(t *testing.T) {
+	first, second := &Counter{}, &Counter{}
+	addr1, _ := testutil.StartTestServer(t, first)
+	addr2, _ := testutil.StartTestServer(t, second)
+	broken, _ := startBrokenServer(t)
+
+	// 中间的服务挂掉了，每次调用都应该切换到其他服务成功
+	xc := NewXClient(NewMultiServerDiscovery([]string{"tcp@" + addr1, broken, "tcp@" + addr2}), RoundRobinSelect, nil)
+	defer func() { _ = xc.Close() }()
+	const n = 6
+	for i := 0; i < n; i ++ {
+		var reply int
+		err := xc.CallWithFailover(context.Background(), "Counter.Echo", i, &reply)
+		_assert(err == nil && reply == i, "expect call %d to fail over to a live server, but got %v", i, err)
+	}
+	calls := atomic.LoadInt32(&first.calls) + atomic.LoadInt32(&second.calls)
+	_assert(calls == n, "expect %d calls on the live servers, but got %d", n, calls)
+}
+
+func TestXClient_CallWithFailoverTriesEachServerOnce(t *testing.T) {
+	var servers []string
+	var accepts []*int32
+	for i := 0; i < 3; i ++ {
+		addr, n := startBrokenServer(t)
+		servers = append(servers, addr)
+		accepts = append(accepts, n)
+	}
+	xc := NewXClient(NewMultiServerDiscovery(servers), RandomSelect, nil)
+	defer func() { _ = xc.Close() }()
+
+	var reply int
+	err := xc.CallWithFailover(context.Background(), "Counter.Echo", 1, &reply)
+	_assert(err != nil && isNetworkError(err), "expect a network error when all servers are down, but got %v", err)
+	for i, n := range accepts {
+		_assert(atomic.LoadInt32(n) == 1, "expect server %d to be tried once, but got %d", i, atomic.LoadInt32(n))
+	}
+}
+
+func TestXClient_CallWithFailoverHandlerError(t *testing.T) {
+	first, second := &Failer{}, &Failer{}
+	addr1, _ := testutil.StartTestServer(t, first)
+	addr2, _ := testutil.StartTestServer(t, second)
+	xc := NewXClient(NewMultiServerDiscovery([]string{"tcp@" + addr1, "tcp@" + addr2}), RandomSelect, nil)
+	defer func() { _ = xc.Close() }()
+
+	// 服务方法返回的错误不是网络错误，不切换服务
+	var reply int
+	err := xc.CallWithFailover(context.Background(), "Failer.Fail", 3, &reply)
+	_assert(err != nil && err.Error() == "code 3", "expect the handler error, but got %v", err)
+	calls := atomic.LoadInt32(&first.calls) + atomic.LoadInt32(&second.calls)
+	_assert(calls == 1, "expect the handler error not to fail over, but called %d times", calls)
+}
+
+func TestXClient_CallWithFailoverContextCanceled(t *testing.T) {
+	first, second := &Counter{delay: time.Second}, &Counter{delay: time.Second}
+	addr1, _ := testutil.StartTestServer(t, first)
+	addr2, _ := testutil.StartTestServer(t, second)
+	xc := NewXClient(NewMultiServerDiscovery([]string{"tcp@" + addr1, "tcp@" + addr2}), RandomSelect, nil)
+	defer func() { _ = xc.Close() }()
+
+	// 第一个服务超时之后ctx已经结束，不再尝试第二个服务
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond * 100)
+	defer cancel()
+	start := time.Now()
+	var reply int
+	err := xc.CallWithFailover(ctx, "Counter.Echo", 1, &reply)
+	_assert(err != nil && ctx.Err() != nil, "expect the call to fail with the context, but got %v", err)
+	_assert(time.Since(start) < time.Millisecond * 500, "expect the failover loop to stop when ctx is done, but took %s", time.Since(start))
+	time.Sleep(time.Millisecond * 100)
+	calls := atomic.LoadInt32(&first.calls) + atomic.LoadInt32(&second.calls)
+	_assert(calls == 1, "expect only one server to be called, but called %d times", calls)
+}
+
+// 接受连接delay之后才开始交换协议，模拟建立连接很慢的服务，返回地址和接受连接的次数
+func startSlowHandshakeServer(t *testing.T, delay time.Duration) (string, *int32) {
+	server := NewServer()
+	_ = server.Register(&Sleeper{})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("failed to listen:", err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	accepts := new(int32)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(accepts, 1)
+			go func() {
+				time.Sleep(delay)
+				server.ServeConn(conn)
+			}()
+		}
+	}()
+	return "tcp@" + l.Addr().String(), accepts
+}
+
+func TestClientCache_DialOutsideLock(t *testing.T) {
+	slow, accepts := startSlowHandshakeServer(t, time.Millisecond * 500)
+	fast, _ := testutil.StartTestServer(t, &Sleeper{})
+	cache := NewClientCache()
+
+	// 同一个服务地址同时只建立一个连接
+	var wg sync.WaitGroup
+	clients := make([]*Client, 2)
+	for i := range clients {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			client, err := cache.get(slow, nil)
+			_assert(err == nil, "failed to get slow client: %v", err)
+			clients[i] = client
+		}(i)
+	}
+
+	// 慢的服务地址建立连接的时候，其他地址不用等它
+	time.Sleep(time.Millisecond * 50)
+	start := time.Now()
+	client, err := cache.get("tcp@" + fast, nil)
+	_assert(err == nil, "failed to get fast client: %v", err)
+	_assert(time.Since(start) < time.Millisecond * 300, "expect the fast dial not blocked by the slow one, took %s", time.Since(start))
+	_ = cache.release("tcp@" + fast, nil, client)
+
+	wg.Wait()
+	_assert(atomic.LoadInt32(accepts) == 1, "expect one dial for concurrent gets, but got %d", atomic.LoadInt32(accepts))
+	_assert(clients[0] == clients[1], "expect concurrent gets to share the client")
+	_ = cache.release(slow, nil, clients[0])
+	_assert(clients[0].IsAvailable(), "expect the client kept while still referenced")
+	_ = cache.release(slow, nil, clients[1])
+	_assert(!clients[0].IsAvailable(), "expect the client closed after the last reference released")
+}